@@ -0,0 +1,384 @@
+// acme obtains certificates for portal's routes from an ACME (RFC 8555)
+// certificate authority, such as Let's Encrypt, answering HTTP-01 challenges
+// with temporary routes served by the proxy.
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Client talks to an ACME directory on behalf of an account
+	Client struct {
+		Directory  string            // directory url - "https://acme-v02.api.letsencrypt.org/directory"
+		Key        *ecdsa.PrivateKey // account key (P-256)
+		Email      string            // account contact (optional)
+		HTTPClient *http.Client
+
+		dir    directory
+		kid    string // account url
+		nonces []string
+		lock   sync.Mutex
+	}
+
+	// Presenter makes the key authorization available at
+	// http://<domain>/.well-known/acme-challenge/<token>, returning a func
+	// to clean up once the challenge is done
+	Presenter func(domain, token, keyAuth string) (cleanup func(), err error)
+
+	directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+
+	order struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+		Finalize       string   `json:"finalize"`
+		Certificate    string   `json:"certificate"`
+		Error          *problem `json:"error"`
+	}
+
+	authorization struct {
+		Status     string `json:"status"`
+		Identifier struct {
+			Value string `json:"value"`
+		} `json:"identifier"`
+		Challenges []challenge `json:"challenges"`
+	}
+
+	challenge struct {
+		Type   string   `json:"type"`
+		Url    string   `json:"url"`
+		Token  string   `json:"token"`
+		Status string   `json:"status"`
+		Error  *problem `json:"error"`
+	}
+
+	problem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+	}
+)
+
+// PollInterval is the time between checks of pending authorizations and orders
+var PollInterval = 2 * time.Second
+
+func (p problem) Error() string {
+	return fmt.Sprintf("%s - %s", p.Type, p.Detail)
+}
+
+// NewKey generates a P-256 key, for accounts and certificates
+func NewKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Obtain orders a certificate for the domains, answering their challenges with
+// present. It returns the pem encoded certificate chain and key.
+func (c *Client) Obtain(domains []string, present Presenter) (string, string, error) {
+	if err := c.register(); err != nil {
+		return "", "", err
+	}
+
+	identifiers := []map[string]string{}
+	for i := range domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domains[i]})
+	}
+	var o order
+	res, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &o)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to create order - %s", err)
+	}
+	orderUrl := res.Header.Get("Location")
+
+	for i := range o.Authorizations {
+		if err = c.authorize(o.Authorizations[i], present); err != nil {
+			return "", "", err
+		}
+	}
+
+	// finalize with a csr for a new key
+	key, err := NewKey()
+	if err != nil {
+		return "", "", err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to create csr - %s", err)
+	}
+	if _, err = c.post(o.Finalize, map[string]string{"csr": b64(csr)}, &o); err != nil {
+		return "", "", fmt.Errorf("Failed to finalize order - %s", err)
+	}
+
+	for o.Status != "valid" {
+		switch o.Status {
+		case "invalid":
+			return "", "", fmt.Errorf("Order invalid - %v", o.Error)
+		case "pending", "ready", "processing":
+		default:
+			return "", "", fmt.Errorf("Unexpected order status '%s'", o.Status)
+		}
+		time.Sleep(PollInterval)
+		if _, err = c.post(orderUrl, nil, &o); err != nil {
+			return "", "", fmt.Errorf("Failed to check order - %s", err)
+		}
+	}
+
+	res, err = c.post(o.Certificate, nil, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to download certificate - %s", err)
+	}
+	chain, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return string(chain), string(keyPem), nil
+}
+
+// KeyAuth returns the key authorization for a challenge token
+func (c *Client) KeyAuth(token string) string {
+	thumb := sha256.Sum256(c.jwk())
+	return token + "." + b64(thumb[:])
+}
+
+// authorize completes the http-01 challenge of a pending authorization
+func (c *Client) authorize(url string, present Presenter) error {
+	var authz authorization
+	if _, err := c.post(url, nil, &authz); err != nil {
+		return fmt.Errorf("Failed to get authorization - %s", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("No http-01 challenge offered for '%s'", authz.Identifier.Value)
+	}
+
+	cleanup, err := present(authz.Identifier.Value, chal.Token, c.KeyAuth(chal.Token))
+	if err != nil {
+		return fmt.Errorf("Failed to present challenge for '%s' - %s", authz.Identifier.Value, err)
+	}
+	defer cleanup()
+
+	// tell the ca we're ready
+	if _, err = c.post(chal.Url, struct{}{}, nil); err != nil {
+		return fmt.Errorf("Failed to accept challenge - %s", err)
+	}
+
+	for {
+		time.Sleep(PollInterval)
+		if _, err = c.post(url, nil, &authz); err != nil {
+			return fmt.Errorf("Failed to check authorization - %s", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending":
+			continue
+		}
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Error != nil {
+				return fmt.Errorf("Challenge for '%s' failed - %s", authz.Identifier.Value, authz.Challenges[i].Error)
+			}
+		}
+		return fmt.Errorf("Authorization for '%s' is %s", authz.Identifier.Value, authz.Status)
+	}
+}
+
+// register fetches the directory and creates (or finds) the account
+func (c *Client) register() error {
+	if c.kid != "" {
+		return nil
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+
+	res, err := c.HTTPClient.Get(c.Directory)
+	if err != nil {
+		return fmt.Errorf("Failed to get directory - %s", err)
+	}
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(&c.dir); err != nil {
+		return fmt.Errorf("Bad directory - %s", err)
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.Email != "" {
+		account["contact"] = []string{"mailto:" + c.Email}
+	}
+	res, err = c.post(c.dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to register account - %s", err)
+	}
+	c.kid = res.Header.Get("Location")
+	return nil
+}
+
+// post sends a jws signed request (POST-as-GET if payload is nil), decoding
+// the json response into v if set. A bad nonce is retried once.
+func (c *Client) post(url string, payload, v interface{}) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		res, err = c.send(url, payload)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode < 400 {
+			break
+		}
+
+		var p problem
+		json.NewDecoder(res.Body).Decode(&p)
+		res.Body.Close()
+		if p.Type != "urn:ietf:params:acme:error:badNonce" || attempt == 1 {
+			return nil, p
+		}
+	}
+
+	if v != nil {
+		defer res.Body.Close()
+		if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("Bad response from '%s' - %s", url, err)
+		}
+	}
+	return res, nil
+}
+
+func (c *Client) send(url string, payload interface{}) (*http.Response, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid == "" {
+		protected["jwk"] = json.RawMessage(c.jwk())
+	} else {
+		protected["kid"] = c.kid
+	}
+	body, err := c.sign(protected, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.HTTPClient.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.saveNonce(res)
+	return res, nil
+}
+
+// sign creates a flattened jws
+func (c *Client) sign(protected map[string]interface{}, payload interface{}) ([]byte, error) {
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	body := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(b)
+	}
+
+	signingInput := b64(header) + "." + body
+	hash := crypto.SHA256.New()
+	hash.Write([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	sig := append(pad(r, 32), pad(s, 32)...)
+
+	return json.Marshal(map[string]string{"protected": b64(header), "payload": body, "signature": b64(sig)})
+}
+
+// jwk returns the account key's jwk, with its members ordered for thumbprints
+func (c *Client) jwk() []byte {
+	return []byte(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(pad(c.Key.X, 32)), b64(pad(c.Key.Y, 32))))
+}
+
+func (c *Client) nonce() (string, error) {
+	c.lock.Lock()
+	if len(c.nonces) != 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		c.lock.Unlock()
+		return nonce, nil
+	}
+	c.lock.Unlock()
+
+	res, err := c.HTTPClient.Head(c.dir.NewNonce)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get nonce - %s", err)
+	}
+	res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("No nonce returned")
+	}
+	return nonce, nil
+}
+
+func (c *Client) saveNonce(res *http.Response) {
+	if nonce := res.Header.Get("Replay-Nonce"); nonce != "" {
+		c.lock.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.lock.Unlock()
+	}
+}
+
+func b64(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+// pad left pads the big endian bytes of n to size
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
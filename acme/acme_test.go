@@ -0,0 +1,344 @@
+package acme_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanopack/portal/acme"
+	"github.com/nanopack/portal/core"
+)
+
+func init() {
+	acme.PollInterval = 10 * time.Millisecond
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ACME
+////////////////////////////////////////////////////////////////////////////////
+func TestObtain(t *testing.T) {
+	ca := newFakeCa(t)
+	defer ca.Close()
+
+	client := newClient(t, ca.URL+"/dir")
+	presented := map[string]string{}
+	cleaned := 0
+	present := func(domain, token, keyAuth string) (func(), error) {
+		presented[domain] = keyAuth
+		if keyAuth != client.KeyAuth(token) {
+			t.Errorf("Unexpected key authorization - '%s'", keyAuth)
+		}
+		return func() { cleaned++ }, nil
+	}
+
+	chain, key, err := client.Obtain([]string{"admin.myapp.com"}, present)
+	if err != nil {
+		t.Fatalf("Failed to obtain certificate - %s", err)
+	}
+	if _, ok := presented["admin.myapp.com"]; !ok || cleaned != 1 {
+		t.Errorf("Challenge not presented and cleaned up - %v, %d", presented, cleaned)
+	}
+	if _, err = tls.X509KeyPair([]byte(chain), []byte(key)); err != nil {
+		t.Errorf("Bad certificate/key - %s", err)
+	}
+	block, _ := pem.Decode([]byte(chain))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Bad certificate - %s", err)
+	}
+	if err = leaf.VerifyHostname("admin.myapp.com"); err != nil {
+		t.Errorf("Certificate not for domain - %s", err)
+	}
+
+	// account is reused
+	if _, _, err = client.Obtain([]string{"myapp.com"}, present); err != nil {
+		t.Fatalf("Failed to obtain second certificate - %s", err)
+	}
+	if ca.accounts != 1 {
+		t.Errorf("Expected 1 account, got %d", ca.accounts)
+	}
+}
+
+func TestObtainFailedChallenge(t *testing.T) {
+	ca := newFakeCa(t)
+	defer ca.Close()
+	ca.fail = true
+
+	client := newClient(t, ca.URL+"/dir")
+	_, _, err := client.Obtain([]string{"myapp.com"}, func(domain, token, keyAuth string) (func(), error) {
+		return func() {}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("Expected challenge failure, got - %v", err)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	routes := []core.Route{
+		{SubDomain: "admin", Domain: "myapp.com", Path: "/admin"},
+		{SubDomain: "admin", Domain: "MyApp.com", Path: "/"},
+		{Domain: "myapp.com"},
+		{SubDomain: "*", Domain: "myapp.com"},
+		{Domain: "127.0.0.1"},
+		{Path: "/health"},
+	}
+	domains := acme.Domains(routes)
+	if len(domains) != 2 || domains[0] != "admin.myapp.com" || domains[1] != "myapp.com" {
+		t.Errorf("Unexpected domains - %v", domains)
+	}
+}
+
+// TestPebble runs against a local pebble, started with PEBBLE_VA_ALWAYS_VALID=1
+// ACME_TEST_DIRECTORY=https://127.0.0.1:14000/dir ACME_TEST_CA=pebble.minica.pem go test ./acme/
+func TestPebble(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		t.Skip("ACME_TEST_DIRECTORY not set")
+	}
+	client := newClient(t, directory)
+	if file := os.Getenv("ACME_TEST_CA"); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	chain, _, err := client.Obtain([]string{"portal.example.com"}, func(domain, token, keyAuth string) (func(), error) {
+		return func() {}, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to obtain certificate - %s", err)
+	}
+	if !strings.Contains(chain, "BEGIN CERTIFICATE") {
+		t.Errorf("Bad certificate - %s", chain)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+func newClient(t *testing.T, directory string) *acme.Client {
+	key, err := acme.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &acme.Client{Directory: directory, Key: key, Email: "admin@myapp.com"}
+}
+
+// fakeCa is a minimal acme server that verifies request signatures
+type fakeCa struct {
+	*httptest.Server
+	t        *testing.T
+	fail     bool
+	accounts int
+	key      *ecdsa.PublicKey
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	nonce    int
+	status   map[string]string // authz url -> status
+	certs    map[string][]byte // order id -> der
+	lock     sync.Mutex
+}
+
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func newFakeCa(t *testing.T) *fakeCa {
+	ca := &fakeCa{t: t, status: map[string]string{}, certs: map[string][]byte{}}
+	var err error
+	ca.caKey, err = acme.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caCert, _ = x509.ParseCertificate(der)
+
+	ca.Server = httptest.NewServer(http.HandlerFunc(ca.handle))
+	return ca
+}
+
+func (ca *fakeCa) handle(rw http.ResponseWriter, req *http.Request) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	ca.nonce++
+	rw.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+	url := ca.URL + req.URL.Path
+
+	if req.URL.Path == "/dir" {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/order",
+		})
+		return
+	}
+	if req.URL.Path == "/nonce" {
+		return
+	}
+
+	payload, err := ca.verify(req, url)
+	if err != nil {
+		ca.t.Errorf("Bad request to %s - %s", req.URL.Path, err)
+		rw.WriteHeader(400)
+		json.NewEncoder(rw).Encode(map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": err.Error()})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "account":
+		ca.accounts++
+		rw.Header().Set("Location", ca.URL+"/accounts/1")
+		rw.WriteHeader(201)
+		rw.Write([]byte("{}"))
+	case "order":
+		var o struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &o)
+		id := fmt.Sprintf("%d", ca.nonce)
+		authzs := []string{}
+		for _, ident := range o.Identifiers {
+			authz := ca.URL + "/authz/" + id + "/" + ident.Value
+			ca.status[authz] = "pending"
+			authzs = append(authzs, authz)
+		}
+		rw.Header().Set("Location", ca.URL+"/orders/"+id)
+		rw.WriteHeader(201)
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"status":         "pending",
+			"authorizations": authzs,
+			"finalize":       ca.URL + "/finalize/" + id,
+		})
+	case "authz":
+		chal := map[string]interface{}{"type": "http-01", "url": ca.URL + "/chal/" + parts[1] + "/" + parts[2], "token": "token-" + parts[1]}
+		if ca.status[url] == "invalid" {
+			chal["error"] = map[string]string{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "wrong key authorization"}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"status":     ca.status[url],
+			"identifier": map[string]string{"type": "dns", "value": parts[2]},
+			"challenges": []interface{}{map[string]string{"type": "dns-01"}, chal},
+		})
+	case "chal":
+		status := "valid"
+		if ca.fail {
+			status = "invalid"
+		}
+		ca.status[ca.URL+"/authz/"+parts[1]+"/"+parts[2]] = status
+		rw.Write([]byte("{}"))
+	case "finalize":
+		var f struct {
+			Csr string `json:"csr"`
+		}
+		json.Unmarshal(payload, &f)
+		der, _ := base64.RawURLEncoding.DecodeString(f.Csr)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			ca.t.Errorf("Bad csr - %s", err)
+			rw.WriteHeader(400)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.nonce)),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		ca.certs[parts[1]], _ = x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+		json.NewEncoder(rw).Encode(map[string]string{"status": "processing"})
+	case "orders":
+		json.NewEncoder(rw).Encode(map[string]string{"status": "valid", "certificate": ca.URL + "/cert/" + parts[1]})
+	case "cert":
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: ca.certs[parts[1]]})
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+	default:
+		rw.WriteHeader(404)
+	}
+}
+
+// verify checks the jws signature and header, returning the payload
+func (ca *fakeCa) verify(req *http.Request, url string) ([]byte, error) {
+	var body jws
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(body.Protected)
+	var protected struct {
+		Alg   string `json:"alg"`
+		Nonce string `json:"nonce"`
+		Url   string `json:"url"`
+		Kid   string `json:"kid"`
+		Jwk   *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, err
+	}
+	if protected.Alg != "ES256" || protected.Url != url || !strings.HasPrefix(protected.Nonce, "nonce-") {
+		return nil, fmt.Errorf("Bad protected header - %s", header)
+	}
+
+	key := ca.key
+	if protected.Jwk != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.Jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.Jwk.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		ca.key = key
+	} else if protected.Kid != ca.URL+"/accounts/1" {
+		return nil, fmt.Errorf("Bad kid '%s'", protected.Kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("No account")
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(body.Signature)
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("Bad signature length %d", len(sig))
+	}
+	hash := sha256.Sum256([]byte(body.Protected + "." + body.Payload))
+	if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, fmt.Errorf("Bad signature")
+	}
+
+	return base64.RawURLEncoding.DecodeString(body.Payload)
+}
@@ -0,0 +1,252 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+var (
+	// RenewBefore is how long before expiring a certificate is renewed
+	RenewBefore = 30 * 24 * time.Hour
+	// CheckInterval is the time between checks for domains needing certificates
+	CheckInterval = 12 * time.Hour
+
+	client *Client
+)
+
+// Start checks for (and obtains) missing or expiring certificates now and
+// every CheckInterval, if an acme directory is configured
+func Start() error {
+	if config.AcmeDirectory == "" {
+		return nil
+	}
+
+	key, err := loadKey(filepath.Join(config.WorkDir, "acme-account.key"))
+	if err != nil {
+		return err
+	}
+
+	httpClient := http.DefaultClient
+	if config.AcmeCa != "" {
+		// trust a test ca's directory (pebble)
+		ca, err := ioutil.ReadFile(config.AcmeCa)
+		if err != nil {
+			return fmt.Errorf("Failed to read acme ca - %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("No certificates found in '%s'", config.AcmeCa)
+		}
+		httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	client = &Client{Directory: config.AcmeDirectory, Key: key, Email: config.AcmeEmail, HTTPClient: httpClient}
+
+	go func() {
+		for {
+			if err := Renew(); err != nil {
+				config.Log.Error("[acme] - %s", err)
+			}
+			time.Sleep(CheckInterval)
+		}
+	}()
+
+	return nil
+}
+
+// Renew obtains a certificate for each route's domain lacking one that is valid
+// beyond RenewBefore, replacing the old one (across the cluster)
+func Renew() error {
+	if client == nil {
+		return fmt.Errorf("Acme not started")
+	}
+
+	routes, err := cluster.GetRoutes()
+	if err != nil {
+		return err
+	}
+	certs, err := cluster.GetCerts()
+	if err != nil {
+		return err
+	}
+
+	failed := []string{}
+	for _, domain := range Domains(routes) {
+		old, expires := covering(certs, domain)
+		if old != nil && time.Until(expires) > RenewBefore {
+			continue
+		}
+
+		config.Log.Info("[acme] - Obtaining certificate for '%s'", domain)
+		chain, key, err := client.Obtain([]string{domain}, presenter(routes))
+		if err != nil {
+			config.Log.Error("[acme] - Failed to obtain certificate for '%s' - %s", domain, err)
+			failed = append(failed, domain)
+			continue
+		}
+
+		// swap the certs together so the domain is never without one
+		ops := []core.Op{{Action: "set-cert", Cert: &core.CertBundle{Cert: chain, Key: key}}}
+		if old != nil && onlyCovers(*old, domain) {
+			ops = append(ops, core.Op{Action: "delete-cert", Cert: old})
+		}
+		if err = cluster.Batch(ops); err != nil {
+			config.Log.Error("[acme] - Failed to store certificate for '%s' - %s", domain, err)
+			failed = append(failed, domain)
+			continue
+		}
+		config.Log.Info("[acme] - Stored certificate for '%s'", domain)
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("Failed to obtain certificates for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Domains returns the unique hosts the routes match on, skipping wildcards and
+// ips (which can't get certificates over http-01)
+func Domains(routes []core.Route) []string {
+	seen := map[string]bool{}
+	domains := []string{}
+	for i := range routes {
+		domain := routes[i].Domain
+		if domain == "" || strings.Contains(domain, "*") || net.ParseIP(domain) != nil {
+			continue
+		}
+		if routes[i].SubDomain != "" {
+			if strings.Contains(routes[i].SubDomain, "*") {
+				continue
+			}
+			domain = routes[i].SubDomain + "." + domain
+		}
+		domain = strings.ToLower(domain)
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// presenter serves key authorizations from temporary routes matching the same
+// host as the domain's routes
+func presenter(routes []core.Route) Presenter {
+	return func(domain, token, keyAuth string) (func(), error) {
+		route := challengeRoute(routes, domain, token, keyAuth)
+		if err := cluster.SetRoute(route); err != nil {
+			return nil, err
+		}
+		return func() {
+			if err := cluster.DeleteRoute(route); err != nil {
+				config.Log.Error("[acme] - Failed to remove challenge route for '%s' - %s", domain, err)
+			}
+		}, nil
+	}
+}
+
+func challengeRoute(routes []core.Route, domain, token, keyAuth string) core.Route {
+	challenge := core.Route{Domain: domain, Path: core.AcmeChallengePath + token, Page: keyAuth}
+	for i := range routes {
+		host := routes[i].Domain
+		if routes[i].SubDomain != "" {
+			host = routes[i].SubDomain + "." + host
+		}
+		if strings.EqualFold(host, domain) {
+			challenge.SubDomain, challenge.Domain = routes[i].SubDomain, routes[i].Domain
+			break
+		}
+	}
+	return challenge
+}
+
+// covering returns the cert valid for domain that expires last
+func covering(certs []core.CertBundle, domain string) (*core.CertBundle, time.Time) {
+	var found *core.CertBundle
+	var expires time.Time
+	for i := range certs {
+		leaf, err := parseLeaf(certs[i].Cert)
+		if err != nil || leaf.VerifyHostname(domain) != nil {
+			continue
+		}
+		if found == nil || leaf.NotAfter.After(expires) {
+			found = &certs[i]
+			expires = leaf.NotAfter
+		}
+	}
+	return found, expires
+}
+
+// onlyCovers reports whether the cert is for domain alone, so replacing it
+// won't drop another domain's certificate
+func onlyCovers(cert core.CertBundle, domain string) bool {
+	leaf, err := parseLeaf(cert.Cert)
+	if err != nil {
+		return false
+	}
+	for _, name := range leaf.DNSNames {
+		if !strings.EqualFold(name, domain) {
+			return false
+		}
+	}
+	return len(leaf.DNSNames) != 0 || strings.EqualFold(leaf.Subject.CommonName, domain)
+}
+
+func parseLeaf(chain string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(chain))
+	if block == nil {
+		return nil, fmt.Errorf("No pem data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadKey reads the account key, creating it if missing
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No pem data found in '%s'", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save acme account key - %s", err)
+	}
+	return key, nil
+}
@@ -1,30 +1,59 @@
 // api handles the api routes and pertaining funtionality.
 //
-//  | Action | Route                             | Description                                 | Payload                                     | Output                        |
-//  |--------|-----------------------------------|---------------------------------------------|---------------------------------------------|-------------------------------|
-//  | GET    | /services                         | List all services                           | nil                                         | json array of service objects |
-//  | POST   | /services                         | Add a service                               | json service object                         | json service object           |
-//  | PUT    | /services                         | Reset the list of services                  | json array of service objects               | json array of service objects |
-//  | PUT    | /services/:svc_id                 | Reset the specified service                 | nil                                         | json service object           |
-//  | GET    | /services/:svc_id                 | Get information about a service             | nil                                         | json service object           |
-//  | DELETE | /services/:svc_id                 | Delete a service                            | nil                                         | success message or an error   |
-//  | GET    | /services/:svc_id/servers         | List all servers on a service               | nil                                         | json array of server objects  |
-//  | POST   | /services/:svc_id/servers         | Add new server to a service                 | json server object                          | json server object            |
-//  | PUT    | /services/:svc_id/servers         | Reset the list of servers on a service      | json array of server objects                | json array of server objects  |
-//  | GET    | /services/:svc_id/servers/:srv_id | Get information about a server on a service | nil                                         | json server object            |
-//  | DELETE | /services/:svc_id/servers/:srv_id | Delete a server from a service              | nil                                         | success message or an error   |
-//  | DELETE | /routes                           | Delete a route                              | subdomain, domain, and path (json or query) | success message or an error   |
-//  | GET    | /routes                           | List all routes                             | nil                                         | json array of route objects   |
-//  | POST   | /routes                           | Add new route                               | json route object                           | json route object             |
-//  | PUT    | /routes                           | Reset the list of routes                    | json array of route objects                 | json array of route objects   |
-//  | DELETE | /certs                            | Delete a cert                               | json cert object                            | success message or an error   |
-//  | GET    | /certs                            | List all certs                              | nil                                         | json array of cert objects    |
-//  | POST   | /certs                            | Add new cert                                | json cert object                            | json cert object              |
-//  | PUT    | /certs                            | Reset the list of certs                     | json array of cert objects                  | json array of cert objects    |
-//  | DELETE | /vips                             | Delete a vip                                | json vip object                             | success message or an error   |
-//  | GET    | /vips                             | List all vips                               | nil                                         | json array of vip objects     |
-//  | POST   | /vips                             | Add new vip                                 | json vip object                             | json vip object               |
-//  | PUT    | /vips                             | Reset the list of vips                      | json array of vip objects                   | json array of vip objects     |
+//	| Action | Route                             | Description                                 | Payload                                     | Output                        |
+//	|--------|-----------------------------------|---------------------------------------------|---------------------------------------------|-------------------------------|
+//	| GET    | /services                         | List all services                           | nil                                         | json array of service objects |
+//	| POST   | /services                         | Add a service                               | json service object                         | json service object           |
+//	| PUT    | /services                         | Reset the list of services                  | json array of service objects               | json array of service objects |
+//	| PUT    | /services/:svc_id                 | Reset the specified service                 | nil                                         | json service object           |
+//	| GET    | /services/:svc_id                 | Get information about a service             | nil                                         | json service object           |
+//	| DELETE | /services/:svc_id                 | Delete a service                            | nil                                         | success message or an error   |
+//	| GET    | /services/:svc_id/servers         | List all servers on a service               | nil                                         | json array of server objects  |
+//	| POST   | /services/:svc_id/servers         | Add new server to a service                 | json server object                          | json server object            |
+//	| PUT    | /services/:svc_id/servers         | Reset the list of servers on a service      | json array of server objects                | json array of server objects  |
+//	| GET    | /services/:svc_id/servers/:srv_id | Get information about a server on a service | nil                                         | json server object            |
+//	| DELETE | /services/:svc_id/servers/:srv_id | Delete a server from a service              | nil                                         | success message or an error   |
+//	| DELETE | /services/:svc_id/servers/:srv_id | Drain, then delete a server (?drain=true)   | timeout (query, optional)                   | json server object            |
+//	| DELETE | /routes                           | Delete a route                              | subdomain, domain, and path (json or query) | success message or an error   |
+//	| GET    | /routes                           | List all routes                             | nil                                         | json array of route objects   |
+//	| POST   | /routes                           | Add new route                               | json route object                           | json route object             |
+//	| PUT    | /routes                           | Reset the list of routes                    | json array of route objects                 | json array of route objects   |
+//	| DELETE | /certs                            | Delete a cert                               | json cert object                            | success message or an error   |
+//	| GET    | /certs                            | List all certs (?expiring=30d)              | nil                                         | json array of cert objects    |
+//	| POST   | /certs                            | Add new cert                                | json cert object                            | json cert object              |
+//	| PUT    | /certs                            | Reset the list of certs                     | json array of cert objects                  | json array of cert objects    |
+//	| DELETE | /vips                             | Delete a vip                                | json vip object                             | success message or an error   |
+//	| GET    | /vips                             | List all vips                               | nil                                         | json array of vip objects     |
+//	| POST   | /vips                             | Add new vip                                 | json vip object                             | json vip object               |
+//	| PUT    | /vips                             | Reset the list of vips                      | json array of vip objects                   | json array of vip objects     |
+//	| PUT    | /manifest                         | Apply a manifest (diff only with ?dry-run)  | json manifest object                        | json object of changes        |
+//	| GET    | /snapshot                         | Get a snapshot of all config                | nil                                         | json snapshot object          |
+//	| PUT    | /snapshot                         | Restore a snapshot (diff with ?dry-run)     | json snapshot object                        | json object of changes        |
+//	| GET    | /revisions                        | List the config revisions                   | nil                                         | json array of revisions       |
+//	| GET    | /revisions/:number                | Get a config revision                       | nil                                         | json revision object          |
+//	| GET    | /revisions/:from/diff/:to         | Diff two revisions (from -> to)             | nil                                         | json array of changes         |
+//	| POST   | /revisions/:number/restore        | Roll back to revision (diff with ?dry-run)  | nil                                         | json object of changes        |
+//	| POST   | /batch                            | Apply ops as one transaction                | json array of op objects                    | json array of op objects      |
+//	| GET    | /metrics                          | Get metrics in the prometheus text format   | nil                                         | prometheus metrics            |
+//	| GET    | /events                           | Stream changes as server-sent events        | nil                                         | stream of json event objects  |
+//	| GET    | /webhooks                         | List all webhooks                           | nil                                         | json array of webhook objects |
+//	| POST   | /webhooks                         | Add (or update) a webhook                   | json webhook object                         | json webhook object           |
+//	| DELETE | /webhooks/:hook_id                | Delete a webhook                            | nil                                         | success message or an error   |
+//	| GET    | /audit                            | List changes (?since=24h&resource=route)    | nil                                         | json array of audit records   |
+//	| GET    | /tokens                           | List all named tokens                       | nil                                         | json array of token objects   |
+//	| POST   | /tokens                           | Add (or replace) a named token              | json token object                           | json token object             |
+//	| DELETE | /tokens/:name                     | Delete a named token                        | nil                                         | success message or an error   |
+//	| GET    | /cluster/members                  | List the members and their config's hashes  | nil                                         | json array of member statuses |
+//	| POST   | /cluster/resync                   | Re-pull this member's config (from others)  | nil                                         | success message or an error   |
+//	| GET    | /raft/members                     | List the raft members                       | nil                                         | json array of member objects  |
+//	| POST   | /raft/members                     | Add a raft member                           | json member object                          | json member object            |
+//	| DELETE | /raft/members/:member             | Remove a raft member                        | nil                                         | success message or an error   |
+//	| POST   | /raft/vote                        | Vote in a raft election (members only)      | json vote object                            | json vote reply object        |
+//	| POST   | /raft/append                      | Append to the raft log (members only)       | json append object                          | json append reply object      |
+//	| POST   | /raft/propose                     | Commit a raft entry (members only)          | json entry object                           | json entry object (its index) |
+//	| POST   | /raft/notify                      | Send events to subscribers (members only)   | json array of event objects                 | success message or an error   |
+//	| POST   | /raft/status                      | Report the member's status (members only)   | nil                                         | json member status object     |
+//	| POST   | /raft/vip                         | Elect a vip's owner (members only)          | json vip request object                     | json vip reply object         |
 package api
 
 // Things this api needs to support
@@ -40,6 +69,7 @@ package api
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -49,13 +79,28 @@ import (
 	"github.com/gorilla/pat"
 	"github.com/nanobox-io/golang-nanoauth"
 
+	"github.com/nanopack/portal/cluster"
 	"github.com/nanopack/portal/config"
 )
 
 var (
-	auth           nanoauth.Auth
 	BadJson        = errors.New("Bad JSON syntax received in body")
 	BodyReadFail   = errors.New("Body Read Failed")
+	BadCheck       = errors.New("Invalid health check (tcp|udp|http)")
+	BadTimeout     = errors.New("Invalid timeout, expected seconds")
+	BadAction      = errors.New("Invalid batch action")
+	BadList        = errors.New("Missing list, send [] to remove everything")
+	BadExpiring    = errors.New("Invalid expiring, expected days (30d) or a duration (12h)")
+	BadWebhook     = errors.New("Invalid webhook url, expected http(s)://host/path")
+	BadHookEvent   = errors.New("Invalid webhook event")
+	BadScope       = errors.New("Invalid token scopes, expected read-only, routes-only, certs-admin, or full")
+	BadTokenName   = errors.New("Invalid token name")
+	BadToken       = errors.New("Invalid token")
+	NoApiToken     = errors.New("Named tokens need an api-token set")
+	Forbidden      = errors.New("Token not allowed")
+	BadSince       = errors.New("Invalid since, expected a time (2016-03-23T00:00:00Z) or a duration (12h, 30d)")
+	BadMember      = errors.New("Invalid member, expected host:port")
+	NotRaft        = errors.New("Not clustered with raft")
 	NoServerError  = errors.New("No Server Found")
 	NoServiceError = errors.New("No Service Found")
 )
@@ -70,11 +115,15 @@ type (
 )
 
 func StartApi() error {
-	auth.Header = "X-AUTH-TOKEN"
+	addr := fmt.Sprintf("%s:%s", config.ApiHost, config.ApiPort)
+	handler := authenticate(instrument(routes()))
 
 	if config.Insecure {
-		config.Log.Info("Api listening at http://%s:%s...", config.ApiHost, config.ApiPort)
-		return auth.ListenAndServe(fmt.Sprintf("%s:%s", config.ApiHost, config.ApiPort), config.ApiToken, routes())
+		if config.ApiClientCa != "" {
+			return fmt.Errorf("Client certs require tls, can't listen on http")
+		}
+		config.Log.Info("Api listening at http://%s...", addr)
+		return http.ListenAndServe(addr, handler)
 	}
 
 	var cert *tls.Certificate
@@ -87,49 +136,118 @@ func StartApi() error {
 	if err != nil {
 		return err
 	}
-	auth.Certificate = cert
 
-	config.Log.Info("Api listening at https://%s:%s...", config.ApiHost, config.ApiPort)
-	return auth.ListenAndServeTLS(fmt.Sprintf("%s:%s", config.ApiHost, config.ApiPort), config.ApiToken, routes())
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+
+	// require client certs signed by the ca
+	if config.ApiClientCa != "" {
+		pem, err := ioutil.ReadFile(config.ApiClientCa)
+		if err != nil {
+			return fmt.Errorf("Failed to read client ca - %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Failed to parse client ca - no certs found")
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	config.Log.Info("Api listening at https://%s...", addr)
+	return server.ListenAndServeTLS("", "")
 }
 
 func routes() *pat.Router {
 	router := pat.New()
 	// balancing
-	router.Delete("/services/{svcId}/servers/{srvId}", deleteServer)
-	router.Get("/services/{svcId}/servers/{srvId}", getServer)
-	router.Put("/services/{svcId}/servers", putServers)
-	router.Post("/services/{svcId}/servers", postServer)
-	router.Get("/services/{svcId}/servers", getServers)
-	router.Delete("/services/{svcId}", deleteService)
-	router.Put("/services/{svcId}", putService)
-	router.Get("/services/{svcId}", getService)
-	router.Post("/services", postService)
-	router.Put("/services", putServices)
-	router.Get("/services", getServices)
+	router.Delete("/services/{svcId}/servers/{srvId}", allow("services", deleteServer))
+	router.Get("/services/{svcId}/servers/{srvId}", allow("services", getServer))
+	router.Put("/services/{svcId}/servers", allow("services", putServers))
+	router.Post("/services/{svcId}/servers", allow("services", postServer))
+	router.Get("/services/{svcId}/servers", allow("services", getServers))
+	router.Delete("/services/{svcId}", allow("services", deleteService))
+	router.Put("/services/{svcId}", allow("services", putService))
+	router.Get("/services/{svcId}", allow("services", getService))
+	router.Post("/services", allow("services", postService))
+	router.Put("/services", allow("services", putServices))
+	router.Get("/services", allow("services", getServices))
 
 	// errors
-	router.Post("/errors", postErrors)
-	router.Put("/errors", postErrors)
-	router.Get("/errors", getErrors)
+	router.Post("/errors", allow("errors", postErrors))
+	router.Put("/errors", allow("errors", postErrors))
+	router.Get("/errors", allow("errors", getErrors))
 
 	// routing
-	router.Delete("/routes", deleteRoute)
-	router.Put("/routes", putRoutes)
-	router.Get("/routes", getRoutes)
-	router.Post("/routes", postRoute)
+	router.Delete("/routes", allow("routes", deleteRoute))
+	router.Put("/routes", allow("routes", putRoutes))
+	router.Get("/routes", allow("routes", getRoutes))
+	router.Post("/routes", allow("routes", postRoute))
 
 	// certificates
-	router.Delete("/certs", deleteCert)
-	router.Put("/certs", putCerts)
-	router.Get("/certs", getCerts)
-	router.Post("/certs", postCert)
+	router.Delete("/certs", allow("certs", deleteCert))
+	router.Put("/certs", allow("certs", putCerts))
+	router.Get("/certs", allow("certs", getCerts))
+	router.Post("/certs", allow("certs", postCert))
 
 	// ips
-	router.Delete("/vips", deleteVip)
-	router.Put("/vips", putVips)
-	router.Get("/vips", getVips)
-	router.Post("/vips", postVip)
+	router.Delete("/vips", allow("vips", deleteVip))
+	router.Put("/vips", allow("vips", putVips))
+	router.Get("/vips", allow("vips", getVips))
+	router.Post("/vips", allow("vips", postVip))
+
+	// manifest
+	router.Put("/manifest", allow("manifest", putManifest))
+
+	// snapshot
+	router.Put("/snapshot", allow("snapshot", putSnapshot))
+	router.Get("/snapshot", allow("snapshot", getSnapshot))
+
+	// revisions
+	router.Post("/revisions/{number}/restore", allow("revisions", postRevisionRestore))
+	router.Get("/revisions/{from}/diff/{to}", allow("revisions", getRevisionDiff))
+	router.Get("/revisions/{number}", allow("revisions", getRevision))
+	router.Get("/revisions", allow("revisions", getRevisions))
+
+	// batch
+	router.Post("/batch", allow("batch", postBatch))
+
+	// metrics
+	router.Get("/metrics", allow("metrics", getMetrics))
+
+	// events
+	router.Get("/events", allow("events", getEvents))
+
+	// webhooks
+	router.Delete("/webhooks/{hookId}", allow("webhooks", deleteWebhook))
+	router.Post("/webhooks", allow("webhooks", postWebhook))
+	router.Get("/webhooks", allow("webhooks", getWebhooks))
+
+	// audit
+	router.Get("/audit", allow("audit", getAudit))
+
+	// tokens
+	router.Delete("/tokens/{name}", allow("tokens", deleteToken))
+	router.Post("/tokens", allow("tokens", postToken))
+	router.Get("/tokens", allow("tokens", getTokens))
+
+	// cluster
+	router.Get("/cluster/members", allow("cluster", getClusterMembers))
+	router.Post("/cluster/resync", allow("cluster", postClusterResync))
+
+	// raft
+	router.Delete("/raft/members/{member}", allow("raft", deleteRaftMember))
+	router.Post("/raft/members", allow("raft", postRaftMember))
+	router.Get("/raft/members", allow("raft", getRaftMembers))
+	router.Post("/raft/vote", allow("raft", postRaftVote))
+	router.Post("/raft/append", allow("raft", postRaftAppend))
+	router.Post("/raft/propose", allow("raft", postRaftPropose))
+	router.Post("/raft/notify", allow("raft", postRaftNotify))
+	router.Post("/raft/status", allow("raft", postRaftStatus))
+	router.Post("/raft/vip", allow("raft", postRaftVip))
 
 	return router
 }
@@ -149,12 +267,7 @@ func writeBody(rw http.ResponseWriter, req *http.Request, v interface{}, status
 		errMsg = msg["error"]
 	}
 
-	remoteAddr := req.RemoteAddr
-	if fwdFor := req.Header.Get("X-Forwarded-For"); len(fwdFor) > 0 {
-		remoteAddr = fwdFor
-	}
-
-	config.Log.Debug("%s %d %s %s %s", remoteAddr, status, req.Method, req.RequestURI, errMsg)
+	config.Log.Debug("%s %s %d %s %s %s", remoteAddr(req), identity(req), status, req.Method, req.RequestURI, errMsg)
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(status)
@@ -163,7 +276,19 @@ func writeBody(rw http.ResponseWriter, req *http.Request, v interface{}, status
 	return nil
 }
 
+// remoteAddr is who made the request, the forwarded for address if proxied
+func remoteAddr(req *http.Request) string {
+	if fwdFor := req.Header.Get("X-Forwarded-For"); len(fwdFor) > 0 {
+		return fwdFor
+	}
+	return req.RemoteAddr
+}
+
 func writeError(rw http.ResponseWriter, req *http.Request, err error, status int) error {
+	// changes are rejected until the cluster is reachable again
+	if err == cluster.DegradedError {
+		status = http.StatusServiceUnavailable
+	}
 	return writeBody(rw, req, apiError{ErrorString: err.Error()}, status)
 }
 
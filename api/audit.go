@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+// List the changes made through the api
+// /audit?since=24h&resource=route
+func getAudit(rw http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			ago, err := parseDays(s)
+			if err != nil {
+				writeError(rw, req, BadSince, http.StatusBadRequest)
+				return
+			}
+			since = time.Now().Add(-ago)
+		}
+	}
+
+	records, err := database.GetAudit(since, req.URL.Query().Get("resource"))
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	writeBody(rw, req, records, http.StatusOK)
+}
+
+// audit records a change made through the api, with what it changed from and
+// to. Failing to record it is logged, the change has already been made.
+func audit(req *http.Request, action, resource string, before, after interface{}) {
+	now := time.Now().UTC()
+	record := core.AuditRecord{
+		// named to sort in the order recorded
+		Id:         fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.NewV4().String()[:8]),
+		Time:       now,
+		RemoteAddr: remoteAddr(req),
+		Identity:   identity(req),
+		Request:    fmt.Sprintf("%s %s", req.Method, req.URL.RequestURI()),
+		Action:     action,
+		Resource:   resource,
+		Before:     redact(before),
+		After:      redact(after),
+	}
+
+	err := database.AddAudit(record)
+	if err != nil {
+		config.Log.Error("Failed to record '%s' in audit log - %s", action, err)
+		return
+	}
+
+	// remove the oldest beyond audit-keep
+	if config.AuditKeep > 0 {
+		if err = database.DeleteAudit(config.AuditKeep); err != nil {
+			config.Log.Error("Failed to trim audit log - %s", err)
+		}
+	}
+}
+
+// identity is who made a request - its client cert's identity, or the name of
+// the token it was made with
+func identity(req *http.Request) string {
+	if name := certIdentity(req); name != "" {
+		return name
+	}
+	if token, ok := req.Context().Value(tokenKey).(*core.Token); ok {
+		return token.Name
+	}
+	return ""
+}
+
+// redact encodes v with the private keys of its certs and the secrets of its
+// webhooks replaced
+func redact(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil
+	}
+
+	var generic interface{}
+	if err = json.Unmarshal(b, &generic); err != nil {
+		return nil
+	}
+	redactValue(generic)
+
+	b, _ = json.Marshal(generic)
+	return b
+}
+
+func redactValue(v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			s, ok := val.(string)
+			if ok && s != "" && (k == "key" || k == "secret") {
+				t[k] = "REDACTED"
+				continue
+			}
+			redactValue(val)
+		}
+	case []interface{}:
+		for i := range t {
+			redactValue(t[i])
+		}
+	}
+}
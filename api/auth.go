@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+type (
+	// grant is what a scope allows, by resource ("*" for all but tokens)
+	grant struct {
+		read  []string
+		write []string
+	}
+	ctxKey int
+)
+
+const (
+	authHeader = "X-AUTH-TOKEN"
+	// the request's token is kept in its context
+	tokenKey ctxKey = 0
+)
+
+var (
+	// scopes a token may have
+	scopes = map[string]grant{
+		"read-only":   {read: []string{"*"}},
+		"routes-only": {read: []string{"routes"}, write: []string{"routes"}},
+		"certs-admin": {read: []string{"certs"}, write: []string{"certs"}},
+		"full":        {read: []string{"*", "tokens"}, write: []string{"*", "tokens"}},
+	}
+)
+
+// authenticate rejects requests without a known token. The --api-token has
+// full access, named tokens only their scopes (checked per route with allow).
+// A verified client cert has the scopes of the named token matching its
+// identity, if there is one, otherwise it still needs a token. Without an
+// --api-token every request has full access.
+func authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var token *core.Token
+		if name := certIdentity(req); name != "" && config.ApiToken != "" {
+			token = namedToken(name)
+		}
+		if token == nil {
+			var err error
+			token, err = findToken(req.Header.Get(authHeader))
+			if err != nil {
+				writeError(rw, req, err, http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), tokenKey, token)))
+	})
+}
+
+// certIdentity identifies the request's verified client cert by its common
+// name, falling back to its first dns or email san
+func certIdentity(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) != 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) != 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// allow only lets requests through if their token's scopes allow reading (GET)
+// or writing the resource
+func allow(resource string, h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token, _ := req.Context().Value(tokenKey).(*core.Token)
+		write := req.Method != "GET" && req.Method != "HEAD"
+		if token == nil || !permitted(*token, resource, write) {
+			writeError(rw, req, Forbidden, http.StatusForbidden)
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// permitted returns whether any of the token's scopes allow reading or writing
+// the resource
+func permitted(token core.Token, resource string, write bool) bool {
+	for _, scope := range token.Scopes {
+		allowed := scopes[scope].read
+		if write {
+			allowed = scopes[scope].write
+		}
+		for i := range allowed {
+			if allowed[i] == resource || (allowed[i] == "*" && resource != "tokens") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findToken returns the named token matching the presented one, or a token
+// named "api-token" with full access for the --api-token. Without an
+// --api-token the api is open, and named tokens aren't used.
+func findToken(presented string) (*core.Token, error) {
+	if config.ApiToken == "" {
+		return &core.Token{Name: "api-token", Scopes: []string{"full"}}, nil
+	}
+	if presented == "" {
+		return nil, BadToken
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(config.ApiToken)) == 1 {
+		return &core.Token{Name: "api-token", Scopes: []string{"full"}}, nil
+	}
+
+	tokens, err := database.GetTokens()
+	if err != nil {
+		config.Log.Error("Failed to get tokens - %s", err)
+		return nil, BadToken
+	}
+	for i := range tokens {
+		if matchesHash(tokens[i].Hash, presented) {
+			return &tokens[i], nil
+		}
+	}
+	return nil, BadToken
+}
+
+// namedToken returns the named token, if there is one
+func namedToken(name string) *core.Token {
+	tokens, err := database.GetTokens()
+	if err != nil {
+		config.Log.Error("Failed to get tokens - %s", err)
+		return nil
+	}
+	for i := range tokens {
+		if tokens[i].Name == name {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+// hashToken returns the hash stored for the token, salted with a random salt
+// it's stored with
+func hashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return saltedHash(fmt.Sprintf("%x", salt), token), nil
+}
+
+// saltedHash is "<salt>$<hmac>", the hex hmac-sha256 of the token keyed with
+// the salt
+func saltedHash(salt, token string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(token))
+	return fmt.Sprintf("%s$%x", salt, mac.Sum(nil))
+}
+
+// matchesHash reports whether the token is the one hashed
+func matchesHash(hash, token string) bool {
+	i := strings.Index(hash, "$")
+	if i == -1 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(saltedHash(hash[:i], token))) == 1
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+)
+
+// Apply a batch of ops as one transaction
+// /batch
+func postBatch(rw http.ResponseWriter, req *http.Request) {
+	var ops []core.Op
+	err := parseBody(req, &ops)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	stored, _ := common.GetCerts()
+	for i := range ops {
+		if err := prepOp(&ops[i], stored); err != nil {
+			writeError(rw, req, fmt.Errorf("Op %d (%s) - %s", i, ops[i].Action, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// save to cluster
+	err = cluster.Batch(ops)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "batch", "batch", nil, ops)
+	writeBody(rw, req, ops, http.StatusOK)
+}
+
+// prepOp validates the op, generating the ids of its services and servers
+// (stored is the certs already stored)
+func prepOp(op *core.Op, stored []core.CertBundle) error {
+	var err error
+	switch op.Action {
+	case "set-services":
+		if op.Services == nil {
+			return BadList
+		}
+		op.Services, err = prepServices(op.Services)
+		return err
+	case "set-service":
+		if op.Service == nil {
+			return NoServiceError
+		}
+		services, err := prepServices([]core.Service{*op.Service})
+		if err != nil {
+			return err
+		}
+		op.Service = &services[0]
+	case "delete-service":
+		if op.SvcId == "" {
+			return NoServiceError
+		}
+	case "set-servers":
+		if op.SvcId == "" {
+			return NoServiceError
+		}
+		if op.Servers == nil {
+			return BadList
+		}
+		for i := range op.Servers {
+			if err := prepServer(op.SvcId, &op.Servers[i]); err != nil {
+				return err
+			}
+		}
+	case "set-server":
+		if op.SvcId == "" {
+			return NoServiceError
+		}
+		if op.Server == nil {
+			return NoServerError
+		}
+		return prepServer(op.SvcId, op.Server)
+	case "delete-server":
+		if op.SvcId == "" {
+			return NoServiceError
+		}
+		if op.SrvId == "" {
+			return NoServerError
+		}
+	case "set-routes":
+		if op.Routes == nil {
+			return BadList
+		}
+	case "set-vips":
+		if op.Vips == nil {
+			return BadList
+		}
+	case "set-certs":
+		if op.Certs == nil {
+			return BadList
+		}
+		for i := range op.Certs {
+			if err := prepCert(&op.Certs[i], stored); err != nil {
+				return err
+			}
+		}
+	case "set-route", "delete-route":
+		if op.Route == nil {
+			return BadJson
+		}
+	case "set-cert":
+		if op.Cert == nil {
+			return BadJson
+		}
+		return prepCert(op.Cert, stored)
+	case "delete-cert":
+		if op.Cert == nil {
+			return BadJson
+		}
+	case "set-vip", "delete-vip":
+		if op.Vip == nil {
+			return BadJson
+		}
+	default:
+		return BadAction
+	}
+	return nil
+}
+
+// prepServer validates the server, generating its id
+func prepServer(svcId string, srv *core.Server) error {
+	srv.GenId()
+	if srv.Id == "-0" {
+		return NoServerError
+	}
+
+	if err := checkCheck(srv); err != nil {
+		return err
+	}
+
+	// localhost doesn't work properly, use service.Host
+	srv.GenHost(svcId)
+	return nil
+}
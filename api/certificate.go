@@ -1,14 +1,26 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/core/common"
 )
 
+type (
+	// certEntry is a cert with its parsed info
+	certEntry struct {
+		core.CertBundle
+		Info *core.CertInfo `json:"info,omitempty"`
+	}
+)
+
 func postCert(rw http.ResponseWriter, req *http.Request) {
 	var cert core.CertBundle
 	err := parseBody(req, &cert)
@@ -17,6 +29,22 @@ func postCert(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	stored, _ := common.GetCerts()
+	err = prepCert(&cert, stored)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	// the cert it replaces, if any
+	var before *core.CertBundle
+	for i := range stored {
+		if stored[i].Same(cert) {
+			before = &stored[i]
+			break
+		}
+	}
+
 	// save to cluster
 	err = cluster.SetCert(cert)
 	if err != nil {
@@ -32,6 +60,7 @@ func postCert(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-cert", "cert", before, cert)
 	writeBody(rw, req, cert, http.StatusOK)
 }
 
@@ -50,6 +79,7 @@ func deleteCert(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "delete-cert", "cert", cert, nil)
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
@@ -61,6 +91,14 @@ func putCerts(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before, _ := common.GetCerts()
+	for i := range certs {
+		if err = prepCert(&certs[i], before); err != nil {
+			writeError(rw, req, fmt.Errorf("Cert %d - %s", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// save to cluster
 	err = cluster.SetCerts(certs)
 	if err != nil {
@@ -68,15 +106,66 @@ func putCerts(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-certs", "cert", before, certs)
 	writeBody(rw, req, certs, http.StatusOK)
 }
 
-// List the certs registered in my system
+// List the certs registered in my system, with their parsed info
+// /certs?expiring=30d
 func getCerts(rw http.ResponseWriter, req *http.Request) {
+	var within time.Duration
+	if expiring := req.URL.Query().Get("expiring"); expiring != "" {
+		var err error
+		within, err = parseDays(expiring)
+		if err != nil {
+			writeError(rw, req, BadExpiring, http.StatusBadRequest)
+			return
+		}
+	}
+
 	certs, err := common.GetCerts()
 	if err != nil {
 		writeError(rw, req, err, http.StatusInternalServerError)
 		return
 	}
-	writeBody(rw, req, certs, http.StatusOK)
+
+	listed := []certEntry{}
+	for i := range certs {
+		entry := certEntry{CertBundle: certs[i]}
+		entry.Info, err = certs[i].Parse()
+		if err != nil {
+			config.Log.Warn("Failed to parse cert - %s", err)
+		}
+		if within != 0 && (entry.Info == nil || time.Until(entry.Info.NotAfter) > within) {
+			continue
+		}
+		listed = append(listed, entry)
+	}
+	writeBody(rw, req, listed, http.StatusOK)
+}
+
+// prepCert validates the cert, rejecting it if it's expired (or not yet valid)
+// unless it's already stored, so an expired cert doesn't block other changes
+func prepCert(cert *core.CertBundle, stored []core.CertBundle) error {
+	if err := cert.Validate(); err != nil {
+		return err
+	}
+	for i := range stored {
+		if stored[i].Same(*cert) {
+			return nil
+		}
+	}
+	return cert.CheckExpiry()
+}
+
+// parseDays parses a duration, allowing days - "30d", "12h"
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, BadExpiring
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
 }
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core/common"
+)
+
+// List the cluster's members, with the status they last reported
+// /cluster/members
+func getClusterMembers(rw http.ResponseWriter, req *http.Request) {
+	members, err := cluster.Members()
+	if err != nil {
+		if err == cluster.NotMembered {
+			writeError(rw, req, err, http.StatusBadRequest)
+			return
+		}
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	writeBody(rw, req, members, http.StatusOK)
+}
+
+// Replace this member's config with the cluster's
+// /cluster/resync
+func postClusterResync(rw http.ResponseWriter, req *http.Request) {
+	before, _ := common.GetManifest()
+
+	err := cluster.Resync()
+	if err != nil {
+		if err == cluster.NotMembered {
+			writeError(rw, req, err, http.StatusBadRequest)
+			return
+		}
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	after, _ := common.GetManifest()
+	audit(req, "resync", "member", before, after)
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
@@ -27,6 +27,8 @@ func postErrors(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before := map[string]string{"no-routes": string(router.ErrNoRoutes), "no-healthy": string(router.ErrNoHealthy)}
+
 	for key, val := range errors {
 		switch key {
 		case "no-routes":
@@ -36,6 +38,7 @@ func postErrors(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	audit(req, "set-errors", "errors", before, errors)
 	writeBody(rw, req, errors, http.StatusOK)
 }
 
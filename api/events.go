@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+)
+
+// keepAlive is how often a comment is sent to idle event streams, keeping
+// proxies from closing them
+var keepAlive = 30 * time.Second
+
+// Stream the changes made through any member as server-sent events
+// /events
+func getEvents(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, req, fmt.Errorf("Streaming not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := cluster.Subscribe()
+	defer unsubscribe()
+
+	config.Log.Debug("%s streaming events", req.RemoteAddr)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tick := time.NewTicker(keepAlive)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-tick.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				config.Log.Error("Failed to marshal event - %s", err)
+				continue
+			}
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event.Action, b)
+		}
+		flusher.Flush()
+	}
+}
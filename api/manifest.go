@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+)
+
+type (
+	applyResult struct {
+		DryRun  bool          `json:"dry_run"`
+		Changes []core.Change `json:"changes"`
+	}
+)
+
+// Apply a manifest, setting the services, routes, certs, and vips to match it
+// /manifest?dry-run=true
+func putManifest(rw http.ResponseWriter, req *http.Request) {
+	var manifest core.Manifest
+	err := parseBody(req, &manifest)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if manifest.Services != nil {
+		manifest.Services, err = prepServices(manifest.Services)
+		if err != nil {
+			writeError(rw, req, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	stored, _ := common.GetCerts()
+	for i := range manifest.Certs {
+		if err = prepCert(&manifest.Certs[i], stored); err != nil {
+			writeError(rw, req, fmt.Errorf("Cert %d - %s", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, err := common.GetManifest()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := common.Diff(&manifest)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry-run"))
+	if !dryRun && len(changes) != 0 {
+		// save to cluster
+		err = cluster.Apply(manifest, changes)
+		if err != nil {
+			writeError(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+		audit(req, "apply-manifest", "manifest", before, manifest)
+	}
+
+	writeBody(rw, req, applyResult{DryRun: dryRun, Changes: changes}, http.StatusOK)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/metrics"
+)
+
+var (
+	apiRequests = metrics.NewCounter("portal_api_requests_total",
+		"Requests handled by the api.", "method", "resource", "code")
+	apiDuration = metrics.NewHistogram("portal_api_request_duration_seconds",
+		"Time taken to handle api requests.", metrics.DefBuckets, "method", "resource")
+
+	resources = map[string]bool{"services": true, "errors": true, "routes": true, "certs": true, "vips": true, "events": true, "webhooks": true, "audit": true, "tokens": true, "raft": true, "metrics": true}
+)
+
+type (
+	// statusRecorder captures the status code written by a handler
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets handlers stream (events) through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument records the count and duration of requests handled by h
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(rec, req)
+
+		// "/services/tcp-192_168_0_15-80/servers" -> "services"
+		resource := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+		if !resources[resource] {
+			// keep unknown paths from growing the metrics
+			resource = "other"
+		}
+		apiDuration.Observe(time.Since(start).Seconds(), req.Method, resource)
+		apiRequests.Inc(req.Method, resource, strconv.Itoa(rec.status))
+	})
+}
+
+// Get metrics in the prometheus text format
+func getMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.Write(rw); err != nil {
+		config.Log.Error("Failed to write metrics - %s", err)
+	}
+}
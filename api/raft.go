@@ -0,0 +1,207 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+)
+
+// List the raft members, as this member knows them
+// /raft/members
+func getRaftMembers(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+	writeBody(rw, req, r.RaftMembers(), http.StatusOK)
+}
+
+// Add a member to the raft cluster. It needs to be started (joining) to commit.
+// /raft/members
+func postRaftMember(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var member cluster.RaftMember
+	err := parseBody(req, &member)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	if member.Member == "" {
+		writeError(rw, req, BadMember, http.StatusBadRequest)
+		return
+	}
+	before := r.RaftMembers()
+
+	err = r.AddMember(member.Member)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "add-member", "member", before, r.RaftMembers())
+	writeBody(rw, req, member, http.StatusOK)
+}
+
+// Remove a member from the raft cluster
+// /raft/members/:member
+func deleteRaftMember(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+	before := r.RaftMembers()
+
+	err := r.RemoveMember(req.URL.Query().Get(":member"))
+	if err != nil {
+		if err == cluster.NoMemberError {
+			writeError(rw, req, err, http.StatusNotFound)
+			return
+		}
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "remove-member", "member", before, r.RaftMembers())
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
+
+// Vote in a raft election (from other members)
+// /raft/vote
+func postRaftVote(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var vote cluster.RaftVote
+	err := parseBody(req, &vote)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	writeBody(rw, req, r.HandleVote(vote), http.StatusOK)
+}
+
+// Append the leader's entries to the raft log (from the leader)
+// /raft/append
+func postRaftAppend(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var app cluster.RaftAppend
+	err := parseBody(req, &app)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	writeBody(rw, req, r.HandleAppend(app), http.StatusOK)
+}
+
+// Commit an entry, returning its index (from other members, to the leader)
+// /raft/propose
+func postRaftPropose(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var entry cluster.RaftEntry
+	err := parseBody(req, &entry)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	index, err := r.HandlePropose(entry)
+	if err != nil {
+		if err == cluster.NotLeaderError {
+			writeError(rw, req, err, http.StatusConflict)
+			return
+		}
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	writeBody(rw, req, cluster.RaftEntry{Index: index}, http.StatusOK)
+}
+
+// Send events to this member's subscribers (from other members)
+// /raft/notify
+func postRaftNotify(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var events []core.Event
+	err := parseBody(req, &events)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	r.HandleNotify(events)
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
+
+// Report this member's status (from other members)
+// /raft/status
+func postRaftStatus(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	status, err := r.HandleStatus()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	writeBody(rw, req, status, http.StatusOK)
+}
+
+// Run a vip election request (from other members, to the leader)
+// /raft/vip
+func postRaftVip(rw http.ResponseWriter, req *http.Request) {
+	r := raftMember(rw, req)
+	if r == nil {
+		return
+	}
+
+	var vipReq cluster.RaftVipRequest
+	err := parseBody(req, &vipReq)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	reply, err := r.HandleVip(vipReq)
+	if err != nil {
+		switch err {
+		case cluster.NotLeaderError:
+			writeError(rw, req, err, http.StatusConflict)
+		case cluster.BadVipAction:
+			writeError(rw, req, err, http.StatusBadRequest)
+		default:
+			writeError(rw, req, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	writeBody(rw, req, reply, http.StatusOK)
+}
+
+// raftMember returns this member's raft clusterer, writing an error if it's
+// not clustered with raft
+func raftMember(rw http.ResponseWriter, req *http.Request) *cluster.Raft {
+	r, ok := cluster.Clusterer.(*cluster.Raft)
+	if !ok {
+		writeError(rw, req, NotRaft, http.StatusBadRequest)
+		return nil
+	}
+	return r
+}
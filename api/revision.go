@@ -0,0 +1,128 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+	"github.com/nanopack/portal/database"
+)
+
+// List the config revisions, oldest first (without their config)
+// /revisions
+func getRevisions(rw http.ResponseWriter, req *http.Request) {
+	revs, err := database.GetRevisions()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range revs {
+		revs[i].Manifest = nil
+	}
+	writeBody(rw, req, revs, http.StatusOK)
+}
+
+// Get a config revision
+// /revisions/:number
+func getRevision(rw http.ResponseWriter, req *http.Request) {
+	rev, status, err := findRevision(req.URL.Query().Get(":number"))
+	if err != nil {
+		writeError(rw, req, err, status)
+		return
+	}
+	writeBody(rw, req, rev, http.StatusOK)
+}
+
+// Get the changes from one config revision to another
+// /revisions/:from/diff/:to
+func getRevisionDiff(rw http.ResponseWriter, req *http.Request) {
+	from, status, err := findRevision(req.URL.Query().Get(":from"))
+	if err != nil {
+		writeError(rw, req, err, status)
+		return
+	}
+	to, status, err := findRevision(req.URL.Query().Get(":to"))
+	if err != nil {
+		writeError(rw, req, err, status)
+		return
+	}
+	writeBody(rw, req, common.DiffManifests(revisionManifest(*from), revisionManifest(*to)), http.StatusOK)
+}
+
+// Roll back to a config revision, replacing the services, routes, certs, and
+// vips in a single batch
+// /revisions/:number/restore?dry-run=true
+func postRevisionRestore(rw http.ResponseWriter, req *http.Request) {
+	rev, status, err := findRevision(req.URL.Query().Get(":number"))
+	if err != nil {
+		writeError(rw, req, err, status)
+		return
+	}
+	manifest := revisionManifest(*rev)
+
+	before, err := common.GetManifest()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := common.Diff(&manifest)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry-run"))
+	if !dryRun && len(changes) != 0 {
+		// save to cluster
+		err = cluster.Apply(manifest, changes)
+		if err != nil {
+			writeError(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+		audit(req, "restore-revision", "revision", before, manifest)
+	}
+
+	writeBody(rw, req, applyResult{DryRun: dryRun, Changes: changes}, http.StatusOK)
+}
+
+// findRevision gets the numbered revision, returning the status to fail with
+func findRevision(number string) (*core.Revision, int, error) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Bad revision number '%s'", number)
+	}
+	rev, err := database.GetRevision(n)
+	if err != nil {
+		if err == database.NoRevisionError {
+			return nil, http.StatusNotFound, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	return rev, http.StatusOK, nil
+}
+
+// revisionManifest returns the revision's config, every section set (a
+// revision holds everything, none is none)
+func revisionManifest(rev core.Revision) core.Manifest {
+	manifest := core.Manifest{}
+	if rev.Manifest != nil {
+		manifest = *rev.Manifest
+	}
+	if manifest.Services == nil {
+		manifest.Services = []core.Service{}
+	}
+	if manifest.Routes == nil {
+		manifest.Routes = []core.Route{}
+	}
+	if manifest.Certs == nil {
+		manifest.Certs = []core.CertBundle{}
+	}
+	if manifest.Vips == nil {
+		manifest.Vips = []core.Vip{}
+	}
+	return manifest
+}
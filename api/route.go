@@ -16,6 +16,8 @@ func postRoute(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before := currentRoute(route)
+
 	// save to cluster
 	err = cluster.SetRoute(route)
 	if err != nil {
@@ -23,6 +25,7 @@ func postRoute(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-route", "route", before, route)
 	writeBody(rw, req, route, http.StatusOK)
 }
 
@@ -39,6 +42,8 @@ func deleteRoute(rw http.ResponseWriter, req *http.Request) {
 		route = core.Route{SubDomain: query.Get("subdomain"), Domain: query.Get("domain"), Path: query.Get("path")}
 	}
 
+	before := currentRoute(route)
+
 	// save to cluster
 	err = cluster.DeleteRoute(route)
 	if err != nil {
@@ -46,6 +51,7 @@ func deleteRoute(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "delete-route", "route", before, nil)
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
@@ -57,6 +63,8 @@ func putRoutes(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before, _ := common.GetRoutes()
+
 	// save to cluster
 	err = cluster.SetRoutes(routes)
 	if err != nil {
@@ -64,6 +72,7 @@ func putRoutes(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-routes", "route", before, routes)
 	writeBody(rw, req, routes, http.StatusOK)
 }
 
@@ -76,3 +85,15 @@ func getRoutes(rw http.ResponseWriter, req *http.Request) {
 	}
 	writeBody(rw, req, routes, http.StatusOK)
 }
+
+// currentRoute returns the route at the same subdomain, domain, and path, if
+// there is one
+func currentRoute(route core.Route) *core.Route {
+	routes, _ := common.GetRoutes()
+	for i := range routes {
+		if routes[i].SubDomain == route.SubDomain && routes[i].Domain == route.Domain && routes[i].Path == route.Path {
+			return &routes[i]
+		}
+	}
+	return nil
+}
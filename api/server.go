@@ -4,13 +4,23 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/nanopack/portal/balance"
 	"github.com/nanopack/portal/cluster"
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/core/common"
 )
 
+var (
+	// servers being drained by this member
+	drains    = make(map[string]bool)
+	drainLock = &sync.Mutex{}
+)
+
 func parseReqServer(req *http.Request) (*core.Server, error) {
 	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -29,10 +39,34 @@ func parseReqServer(req *http.Request) (*core.Server, error) {
 		return nil, NoServerError
 	}
 
+	if err := checkCheck(&srv); err != nil {
+		return nil, err
+	}
+
 	config.Log.Trace("SERVER: %+v", srv)
 	return &srv, nil
 }
 
+// checkCheck validates the server's health check and clears its read only
+// fields
+func checkCheck(srv *core.Server) error {
+	srv.Health = ""
+	srv.Draining = false
+	switch srv.Check {
+	case "", "tcp", "udp", "http":
+		return nil
+	}
+	return BadCheck
+}
+
+// sameDrained returns whether the stored server is still the one drained
+// (apart from draining and health, which aren't set)
+func sameDrained(stored, drained core.Server) bool {
+	stored.Draining, drained.Draining = true, true
+	stored.Health, drained.Health = "", ""
+	return stored == drained
+}
+
 // Get information about a backend server
 func getServer(rw http.ResponseWriter, req *http.Request) {
 	// /services/{svcId}/servers/{srvId}
@@ -44,6 +78,7 @@ func getServer(rw http.ResponseWriter, req *http.Request) {
 		writeError(rw, req, err, http.StatusNotFound)
 		return
 	}
+	server.Health = balance.ServerHealth(svcId, server.Id)
 	writeBody(rw, req, server, http.StatusOK)
 }
 
@@ -59,15 +94,14 @@ func postServer(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// idempotent additions (don't update server on post)
-	if srv, _ := common.GetServer(svcId, server.Id); srv != nil {
+	before, _ := common.GetServer(svcId, server.Id)
+	if before != nil {
 		writeBody(rw, req, server, http.StatusOK)
 		return
 	}
 
 	// localhost doesn't work properly, use service.Host
-	if server.Host == "127.0.0.1" {
-		server.GenHost(svcId)
-	}
+	server.GenHost(svcId)
 
 	// save to cluster
 	err = cluster.SetServer(svcId, server)
@@ -76,6 +110,7 @@ func postServer(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-server", "server", before, server)
 	// todo: or service (which would include server)
 	writeBody(rw, req, server, http.StatusOK)
 }
@@ -86,6 +121,14 @@ func deleteServer(rw http.ResponseWriter, req *http.Request) {
 	svcId := req.URL.Query().Get(":svcId")
 	srvId := req.URL.Query().Get(":srvId")
 
+	// let connections finish before removing
+	if drain, _ := strconv.ParseBool(req.URL.Query().Get("drain")); drain {
+		drainServer(rw, req, svcId, srvId)
+		return
+	}
+
+	before, _ := common.GetServer(svcId, srvId)
+
 	// remove from cluster
 	err := cluster.DeleteServer(svcId, srvId)
 	if err != nil {
@@ -93,9 +136,101 @@ func deleteServer(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "delete-server", "server", before, nil)
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
+// Drain a backend server (set weight to 0 and remove it once its connections
+// finish or the timeout passes)
+func drainServer(rw http.ResponseWriter, req *http.Request, svcId, srvId string) {
+	// /services/{svcId}/servers/{srvId}?drain=true&timeout=60
+	timeout := config.DrainTimeout
+	if t := req.URL.Query().Get("timeout"); t != "" {
+		var err error
+		timeout, err = strconv.Atoi(t)
+		if err != nil || timeout < 0 {
+			writeError(rw, req, BadTimeout, http.StatusBadRequest)
+			return
+		}
+	}
+
+	server, err := common.GetServer(svcId, srvId)
+	if err != nil {
+		writeError(rw, req, err, http.StatusNotFound)
+		return
+	}
+
+	if !server.Draining {
+		before := *server
+		server.Draining = true
+		server.Weight = 0
+
+		// stop new connections across the cluster
+		err = cluster.SetServer(svcId, server)
+		if err != nil {
+			writeError(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+		audit(req, "drain-server", "server", before, server)
+	}
+
+	go waitDrained(svcId, *server, time.Duration(timeout)*time.Second)
+
+	writeBody(rw, req, server, http.StatusAccepted)
+}
+
+// waitDrained removes the drained server from the cluster once the balancer
+// reports no active connections to it, or the timeout passes. Only this
+// member's connections are counted; other members' are cut off when it's
+// removed.
+func waitDrained(svcId string, drained core.Server, timeout time.Duration) {
+	srvId := drained.Id
+	key := svcId + "/" + srvId
+	drainLock.Lock()
+	if drains[key] {
+		// already waiting
+		drainLock.Unlock()
+		return
+	}
+	drains[key] = true
+	drainLock.Unlock()
+
+	defer func() {
+		drainLock.Lock()
+		delete(drains, key)
+		drainLock.Unlock()
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		conns, err := balance.ActiveConns(svcId, srvId)
+		if err != nil || conns == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			config.Log.Warn("Timed out draining '%s' from '%s' with %d active connections", srvId, svcId, conns)
+			break
+		}
+		config.Log.Trace("Draining '%s' from '%s' - %d active connections", srvId, svcId, conns)
+		time.Sleep(time.Second)
+	}
+
+	// don't remove if the server was reset while draining. It's compared to the
+	// drained server rather than trusting draining, so a store that didn't keep
+	// draining doesn't leave it drained forever.
+	srv, err := common.GetServer(svcId, srvId)
+	if err != nil || !sameDrained(*srv, drained) {
+		return
+	}
+
+	err = cluster.DeleteServer(svcId, srvId)
+	if err != nil {
+		config.Log.Error("Failed to remove drained server '%s' from '%s' - %s", srvId, svcId, err)
+		return
+	}
+	config.Log.Info("Drained and removed '%s' from '%s'", srvId, svcId)
+}
+
 // Get information about a backend server
 func getServers(rw http.ResponseWriter, req *http.Request) {
 	// /services/{svcId}/servers
@@ -108,6 +243,9 @@ func getServers(rw http.ResponseWriter, req *http.Request) {
 	if service.Servers == nil {
 		service.Servers = make([]core.Server, 0, 0)
 	}
+	for i := range service.Servers {
+		service.Servers[i].Health = balance.ServerHealth(svcId, service.Servers[i].Id)
+	}
 	// writeBody(rw, req, service, http.StatusOK)
 	writeBody(rw, req, service.Servers, http.StatusOK)
 }
@@ -127,10 +265,18 @@ func putServers(rw http.ResponseWriter, req *http.Request) {
 	for i := range servers {
 		servers[i].GenId()
 
-		// localhost doesn't work properly, use service.Host
-		if servers[i].Host == "127.0.0.1" {
-			servers[i].GenHost(svcId)
+		if err := checkCheck(&servers[i]); err != nil {
+			writeError(rw, req, err, http.StatusBadRequest)
+			return
 		}
+
+		// localhost doesn't work properly, use service.Host
+		servers[i].GenHost(svcId)
+	}
+
+	var before []core.Server
+	if service, err := common.GetService(svcId); err == nil {
+		before = service.Servers
 	}
 
 	// add to cluster
@@ -140,5 +286,6 @@ func putServers(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-servers", "server", before, servers)
 	writeBody(rw, req, servers, http.StatusOK)
 }
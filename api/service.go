@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -47,10 +48,12 @@ func parseReqService(req *http.Request) (*core.Service, error) {
 	for i := range svc.Servers {
 		svc.Servers[i].GenId()
 
-		// localhost doesn't work properly, use service.Host
-		if svc.Servers[i].Host == "127.0.0.1" {
-			svc.Servers[i].GenHost(svc.Id)
+		if err := checkCheck(&svc.Servers[i]); err != nil {
+			return nil, err
 		}
+
+		// localhost doesn't work properly, use service.Host
+		svc.Servers[i].GenHost(svc.Id)
 	}
 
 	config.Log.Trace("SERVICE: %+v", svc)
@@ -59,20 +62,20 @@ func parseReqService(req *http.Request) (*core.Service, error) {
 
 // ensure port is not in use by portal
 func checkPort(svc core.Service) error {
-	// split address/port
-	listenHttp := strings.Split(config.RouteHttp, ":")
-	listenTls := strings.Split(config.RouteTls, ":")
+	// split address/port (handles "[::]:80")
+	httpHost, httpPort, _ := net.SplitHostPort(config.RouteHttp)
+	tlsHost, tlsPort, _ := net.SplitHostPort(config.RouteTls)
 
-	hPort, _ := strconv.Atoi(listenHttp[1])
-	tPort, _ := strconv.Atoi(listenTls[1])
+	hPort, _ := strconv.Atoi(httpPort)
+	tPort, _ := strconv.Atoi(tlsPort)
 	aPort, _ := strconv.Atoi(config.ApiPort)
 
 	// assume tls/http listening same ip. if listen on all interfaces, break on ports
 	if svc.Port == hPort || svc.Port == tPort || svc.Port == aPort {
-		if listenHttp[0] == "" || listenHttp[0] == "0.0.0.0" {
-			return fmt.Errorf("Socket in use: '%s:%d'", listenHttp[0], svc.Port)
+		if httpHost == "" || httpHost == "0.0.0.0" || httpHost == "::" {
+			return fmt.Errorf("Socket in use: '%s:%d'", httpHost, svc.Port)
 		}
-		if svc.Host == listenHttp[0] || svc.Host == listenTls[0] || svc.Host == config.ApiHost {
+		if svc.Host == httpHost || svc.Host == tlsHost || svc.Host == config.ApiHost {
 			return fmt.Errorf("Socket in use: '%s:%d'", svc.Host, svc.Port)
 		}
 	}
@@ -84,59 +87,37 @@ func checkPort(svc core.Service) error {
 	return nil
 }
 
-// Get information about a service
-func getService(rw http.ResponseWriter, req *http.Request) {
-	// /services/{svcId}
-	svcId := req.URL.Query().Get(":svcId")
-
-	service, err := common.GetService(svcId)
-	if err != nil {
-		writeError(rw, req, err, http.StatusNotFound)
-		return
-	}
-	writeBody(rw, req, service, http.StatusOK)
-}
-
-// Reset all services
-// /services
-func putServices(rw http.ResponseWriter, req *http.Request) {
-	services := []core.Service{}
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&services); err != nil {
-		writeError(rw, req, BadJson, http.StatusBadRequest)
-		return
-	}
-
+// prepServices validates services and their servers, generating their ids and
+// dropping duplicates
+func prepServices(services []core.Service) ([]core.Service, error) {
 	for i := range services {
 		if services[i].Interface != "" {
 			err := services[i].GenHost()
 			if err != nil {
-				writeError(rw, req, err, http.StatusBadRequest)
-				return
+				return nil, err
 			}
 		}
 		services[i].GenId()
 		if services[i].Id == "--0" {
-			writeError(rw, req, NoServiceError, http.StatusBadRequest)
-			return
+			return nil, NoServiceError
 		}
 
 		if err := checkPort(services[i]); err != nil {
-			writeError(rw, req, err, http.StatusBadRequest)
-			return
+			return nil, err
 		}
 
 		for j := range services[i].Servers {
 			services[i].Servers[j].GenId()
 			if services[i].Servers[j].Id == "-0" {
-				writeError(rw, req, NoServerError, http.StatusBadRequest)
-				return
+				return nil, NoServerError
 			}
 
-			// localhost doesn't work properly, use service.Host
-			if services[i].Servers[j].Host == "127.0.0.1" {
-				services[i].Servers[j].GenHost(services[i].Id)
+			if err := checkCheck(&services[i].Servers[j]); err != nil {
+				return nil, err
 			}
+
+			// localhost doesn't work properly, use service.Host
+			services[i].Servers[j].GenHost(services[i].Id)
 		}
 	}
 
@@ -152,13 +133,48 @@ func putServices(rw http.ResponseWriter, req *http.Request) {
 		services = append(services, v)
 	}
 
+	return services, nil
+}
+
+// Get information about a service
+func getService(rw http.ResponseWriter, req *http.Request) {
+	// /services/{svcId}
+	svcId := req.URL.Query().Get(":svcId")
+
+	service, err := common.GetService(svcId)
+	if err != nil {
+		writeError(rw, req, err, http.StatusNotFound)
+		return
+	}
+	writeBody(rw, req, service, http.StatusOK)
+}
+
+// Reset all services
+// /services
+func putServices(rw http.ResponseWriter, req *http.Request) {
+	services := []core.Service{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&services); err != nil {
+		writeError(rw, req, BadJson, http.StatusBadRequest)
+		return
+	}
+
+	services, err := prepServices(services)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	before, _ := common.GetServices()
+
 	// save to cluster
-	err := cluster.SetServices(services)
+	err = cluster.SetServices(services)
 	if err != nil {
 		writeError(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
+	audit(req, "set-services", "service", before, services)
 	writeBody(rw, req, services, http.StatusOK)
 }
 
@@ -172,7 +188,8 @@ func postService(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// idempotent additions (don't update service on post)
-	if svc, _ := common.GetService(service.Id); svc != nil {
+	before, _ := common.GetService(service.Id)
+	if before != nil {
 		writeBody(rw, req, service, http.StatusOK)
 		return
 	}
@@ -184,6 +201,7 @@ func postService(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-service", "service", before, service)
 	writeBody(rw, req, service, http.StatusOK)
 }
 
@@ -210,8 +228,11 @@ func putService(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// update service by id
+	var before *core.Service
 	for i := range services {
 		if services[i].Id == svcId {
+			old := services[i]
+			before = &old
 			services[i] = *service
 			break
 		}
@@ -223,6 +244,7 @@ func putService(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-service", "service", before, service)
 	writeBody(rw, req, service, http.StatusOK)
 }
 
@@ -231,6 +253,8 @@ func deleteService(rw http.ResponseWriter, req *http.Request) {
 	// /services/{svcId}
 	svcId := req.URL.Query().Get(":svcId")
 
+	before, _ := common.GetService(svcId)
+
 	// remove from cluster
 	err := cluster.DeleteService(svcId)
 	if err != nil {
@@ -238,6 +262,7 @@ func deleteService(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "delete-service", "service", before, nil)
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
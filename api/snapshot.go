@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+	"github.com/nanopack/portal/snapshot"
+)
+
+// Get a snapshot of the services (and their servers), routes, certs, vips, and
+// error pages
+func getSnapshot(rw http.ResponseWriter, req *http.Request) {
+	snap, err := snapshot.Get()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	writeBody(rw, req, snap, http.StatusOK)
+}
+
+// Restore a snapshot, replacing the services, routes, certs, and vips in a
+// single batch, then this member's error pages
+// /snapshot?dry-run=true
+func putSnapshot(rw http.ResponseWriter, req *http.Request) {
+	var snap core.Snapshot
+	err := parseBody(req, &snap)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	if snap.Version != core.SnapshotVersion {
+		writeError(rw, req, fmt.Errorf("Unsupported snapshot version %d, expected %d", snap.Version, core.SnapshotVersion), http.StatusBadRequest)
+		return
+	}
+
+	// a snapshot holds everything, none is none
+	if snap.Services == nil {
+		snap.Services = []core.Service{}
+	}
+	if snap.Routes == nil {
+		snap.Routes = []core.Route{}
+	}
+	if snap.Certs == nil {
+		snap.Certs = []core.CertBundle{}
+	}
+	if snap.Vips == nil {
+		snap.Vips = []core.Vip{}
+	}
+
+	snap.Services, err = prepServices(snap.Services)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+	for i := range snap.Certs {
+		if err = snap.Certs[i].Validate(); err != nil {
+			writeError(rw, req, fmt.Errorf("Cert %d - %s", i, err), http.StatusBadRequest)
+			return
+		}
+		// a backup restores what it held, even a cert that expired since
+		if err = snap.Certs[i].CheckExpiry(); err != nil {
+			config.Log.Warn("Restoring cert %d anyway - %s", i, err)
+		}
+	}
+
+	before, err := snapshot.Get()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := common.Diff(&snap.Manifest)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry-run"))
+	if !dryRun {
+		if len(changes) != 0 {
+			// save to cluster
+			err = cluster.Apply(snap.Manifest, changes)
+			if err != nil {
+				writeError(rw, req, err, http.StatusInternalServerError)
+				return
+			}
+		}
+		// error pages aren't clustered (as with /errors), they're only set on this
+		// member, and only once the batch is applied
+		if page, ok := snap.Errors["no-routes"]; ok {
+			setNoRoutes(page)
+		}
+		if page, ok := snap.Errors["no-healthy"]; ok {
+			setNoHealthy(page)
+		}
+		audit(req, "restore-snapshot", "snapshot", before, snap)
+	}
+
+	writeBody(rw, req, applyResult{DryRun: dryRun, Changes: changes}, http.StatusOK)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+// Add (or replace) a named token, generating the token if it's not given. The
+// token is only returned here, only its hash is stored.
+// /tokens
+func postToken(rw http.ResponseWriter, req *http.Request) {
+	var token core.Token
+	err := parseBody(req, &token)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	// without an api-token the api is open, so named tokens would limit nothing
+	if config.ApiToken == "" {
+		writeError(rw, req, NoApiToken, http.StatusBadRequest)
+		return
+	}
+	if token.Name == "" || token.Name == "api-token" {
+		writeError(rw, req, BadTokenName, http.StatusBadRequest)
+		return
+	}
+	if len(token.Scopes) == 0 {
+		writeError(rw, req, BadScope, http.StatusBadRequest)
+		return
+	}
+	for i := range token.Scopes {
+		if _, ok := scopes[token.Scopes[i]]; !ok {
+			writeError(rw, req, BadScope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if token.Token == "" {
+		b := make([]byte, 16)
+		if _, err = rand.Read(b); err != nil {
+			writeError(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+		token.Token = fmt.Sprintf("%x", b)
+	}
+	secret := token.Token
+	token.Token = ""
+	token.Hash, err = hashToken(secret)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	before := currentToken(token.Name)
+
+	// save to every member
+	err = cluster.SetToken(token)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	token.Hash = ""
+	audit(req, "set-token", "token", before, token)
+	token.Token = secret
+	writeBody(rw, req, token, http.StatusOK)
+}
+
+// Delete a named token
+// /tokens/:name
+func deleteToken(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+	before := currentToken(name)
+	if before == nil {
+		writeError(rw, req, database.NoTokenError, http.StatusNotFound)
+		return
+	}
+
+	// remove from every member
+	err := cluster.DeleteToken(name)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "delete-token", "token", before, nil)
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
+
+// List the named tokens (without their hashes)
+// /tokens
+func getTokens(rw http.ResponseWriter, req *http.Request) {
+	tokens, err := database.GetTokens()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	writeBody(rw, req, tokens, http.StatusOK)
+}
+
+// currentToken returns the named token (without its hash), if there is one
+func currentToken(name string) *core.Token {
+	token := namedToken(name)
+	if token != nil {
+		token.Hash = ""
+	}
+	return token
+}
@@ -16,6 +16,8 @@ func postVip(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before := currentVip(vip)
+
 	// save to cluster
 	err = cluster.SetVip(vip)
 	if err != nil {
@@ -23,6 +25,7 @@ func postVip(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-vip", "vip", before, vip)
 	writeBody(rw, req, vip, http.StatusOK)
 }
 
@@ -34,6 +37,8 @@ func deleteVip(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before := currentVip(vip)
+
 	// save to cluster
 	err = cluster.DeleteVip(vip)
 	if err != nil {
@@ -41,6 +46,7 @@ func deleteVip(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "delete-vip", "vip", before, nil)
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
@@ -52,6 +58,8 @@ func putVips(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	before, _ := common.GetVips()
+
 	// save to cluster
 	err = cluster.SetVips(vips)
 	if err != nil {
@@ -59,6 +67,7 @@ func putVips(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	audit(req, "set-vips", "vip", before, vips)
 	writeBody(rw, req, vips, http.StatusOK)
 }
 
@@ -71,3 +80,14 @@ func getVips(rw http.ResponseWriter, req *http.Request) {
 	}
 	writeBody(rw, req, vips, http.StatusOK)
 }
+
+// currentVip returns the vip with the same ip, if there is one
+func currentVip(vip core.Vip) *core.Vip {
+	vips, _ := common.GetVips()
+	for i := range vips {
+		if vips[i].Ip == vip.Ip {
+			return &vips[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+// events that can be posted to webhooks
+var webhookEvents = map[string]bool{
+	"set-services": true, "set-service": true, "delete-service": true,
+	"set-servers": true, "set-server": true, "delete-server": true,
+	"set-routes": true, "set-route": true, "delete-route": true,
+	"set-certs": true, "set-cert": true, "delete-cert": true,
+	"set-vips": true, "set-vip": true, "delete-vip": true,
+	"server-health": true, "target-health": true,
+}
+
+// Add (or update) a webhook
+// /webhooks
+func postWebhook(rw http.ResponseWriter, req *http.Request) {
+	var hook core.Webhook
+	err := parseBody(req, &hook)
+	if err != nil {
+		writeError(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(hook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(rw, req, BadWebhook, http.StatusBadRequest)
+		return
+	}
+	for i := range hook.Events {
+		if !webhookEvents[hook.Events[i]] {
+			writeError(rw, req, BadHookEvent, http.StatusBadRequest)
+			return
+		}
+	}
+	hook.GenId()
+	before := currentWebhook(hook.Id)
+
+	// save to every member
+	err = cluster.SetWebhook(hook)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "set-webhook", "webhook", before, hook)
+	hook.Secret = ""
+	writeBody(rw, req, hook, http.StatusOK)
+}
+
+// Delete a webhook
+// /webhooks/:hook_id
+func deleteWebhook(rw http.ResponseWriter, req *http.Request) {
+	hookId := req.URL.Query().Get(":hookId")
+	before := currentWebhook(hookId)
+	if before == nil {
+		writeError(rw, req, database.NoWebhookError, http.StatusNotFound)
+		return
+	}
+
+	// remove from every member
+	err := cluster.DeleteWebhook(hookId)
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	audit(req, "delete-webhook", "webhook", before, nil)
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
+
+// List the webhooks (without their secrets)
+// /webhooks
+func getWebhooks(rw http.ResponseWriter, req *http.Request) {
+	hooks, err := database.GetWebhooks()
+	if err != nil {
+		writeError(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeBody(rw, req, hooks, http.StatusOK)
+}
+
+// currentWebhook returns the webhook with the id, if there is one
+func currentWebhook(id string) *core.Webhook {
+	hooks, _ := database.GetWebhooks()
+	for i := range hooks {
+		if hooks[i].Id == id {
+			return &hooks[i]
+		}
+	}
+	return nil
+}
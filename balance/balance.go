@@ -20,7 +20,29 @@ var (
 	NoServiceError = errors.New("No Service Found")
 	NoServerError  = errors.New("No Server Found")
 
-	tab *iptables.IPTables
+	tab  firewall // iptables
+	tab6 firewall // ip6tables
+)
+
+type (
+	// connCounter is implemented by balancers able to count a server's active
+	// connections (used when draining)
+	connCounter interface {
+		ActiveConns(svcId, srvId string) (int, error)
+	}
+
+	// firewall is the part of iptables portal uses, satisfied by both
+	// iptables.IPTables and ip6tables
+	firewall interface {
+		List(table, chain string) ([]string, error)
+		Insert(table, chain string, pos int, rulespec ...string) error
+		AppendUnique(table, chain string, rulespec ...string) error
+		Delete(table, chain string, rulespec ...string) error
+		NewChain(table, chain string) error
+		ClearChain(table, chain string) error
+		RenameChain(table, oldChain, newChain string) error
+		DeleteChain(table, chain string) error
+	}
 )
 
 func Init() error {
@@ -39,45 +61,94 @@ func Init() error {
 		Balancer = &Lvs{} // faster
 	}
 
-	var err error
-	tab, err = iptables.New()
-	if err != nil {
-		tab = nil
+	tab, tab6 = nil, nil
+	if t, err := iptables.New(); err == nil {
+		tab = t
 	}
-	// don't break if we can't use iptables
-	if _, err = tab.List("filter", "INPUT"); err != nil {
-		config.Log.Error("Could not use iptables, continuing without - %s", err)
-		tab = nil
+	if t, err := newIp6tables(); err == nil {
+		tab6 = t
 	}
+
+	// don't break if we can't use iptables
 	if tab != nil {
-		tab.Delete("filter", "INPUT", "-j", "portal")
-		tab.ClearChain("filter", "portal")
-		tab.DeleteChain("filter", "portal")
-		err = tab.NewChain("filter", "portal")
-		if err != nil {
-			return fmt.Errorf("Failed to create new chain - %s", err)
+		if _, err := tab.List("filter", "INPUT"); err != nil {
+			config.Log.Error("Could not use iptables, continuing without - %s", err)
+			tab = nil
 		}
-		err = tab.AppendUnique("filter", "portal", "-j", "RETURN")
-		if err != nil {
-			return fmt.Errorf("Failed to append to portal chain - %s", err)
-		}
-		err = tab.AppendUnique("filter", "INPUT", "-j", "portal")
-		if err != nil {
-			return fmt.Errorf("Failed to append to INPUT chain - %s", err)
+	}
+	if tab6 != nil {
+		if _, err := tab6.List("filter", "INPUT"); err != nil {
+			config.Log.Error("Could not use ip6tables, continuing without - %s", err)
+			tab6 = nil
 		}
+	}
 
-		// Allow router through by default (ports 80/443)
-		err = tab.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "80", "-j", "ACCEPT")
-		if err != nil {
-			return err
-		}
-		err = tab.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "443", "-j", "ACCEPT")
+	for _, t := range tables() {
+		err := initChain(t)
 		if err != nil {
 			return err
 		}
 	}
 
-	return Balancer.Init()
+	err := Balancer.Init()
+	if err != nil {
+		return err
+	}
+
+	StartHealth(config.HealthInterval)
+	return nil
+}
+
+// initChain creates a fresh "portal" chain, jumped to from INPUT
+func initChain(t firewall) error {
+	t.Delete("filter", "INPUT", "-j", "portal")
+	t.ClearChain("filter", "portal")
+	t.DeleteChain("filter", "portal")
+	err := t.NewChain("filter", "portal")
+	if err != nil {
+		return fmt.Errorf("Failed to create new chain - %s", err)
+	}
+	err = t.AppendUnique("filter", "portal", "-j", "RETURN")
+	if err != nil {
+		return fmt.Errorf("Failed to append to portal chain - %s", err)
+	}
+	err = t.AppendUnique("filter", "INPUT", "-j", "portal")
+	if err != nil {
+		return fmt.Errorf("Failed to append to INPUT chain - %s", err)
+	}
+
+	// Allow router through by default (ports 80/443)
+	err = t.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "80", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+	err = t.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "443", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// tables returns the usable iptables/ip6tables
+func tables() []firewall {
+	tabs := []firewall{}
+	if tab != nil {
+		tabs = append(tabs, tab)
+	}
+	if tab6 != nil {
+		tabs = append(tabs, tab6)
+	}
+	return tabs
+}
+
+// tableFor returns the iptables/ip6tables for the host's address family (may
+// be nil)
+func tableFor(host string) firewall {
+	if strings.Contains(host, ":") {
+		return tab6
+	}
+	return tab
 }
 
 func GetServices() ([]core.Service, error) {
@@ -98,50 +169,69 @@ func SetServices(services []core.Service) error {
 	if Balancer == nil {
 		return nil
 	}
-	if tab != nil {
-		tab.RenameChain("filter", "portal", "portal-old")
-	}
-	err := Balancer.SetServices(services)
-	if err != nil && tab != nil {
-		tab.RenameChain("filter", "portal-old", "portal")
-	}
-	if err == nil && tab != nil {
-		cleanup := func(err2 error) error {
-			tab.ClearChain("filter", "portal")
-			tab.DeleteChain("filter", "portal")
-			tab.RenameChain("filter", "portal-old", "portal")
-			return fmt.Errorf("Failed to tab.Insert() - %s", err2)
+	for _, t := range tables() {
+		t.RenameChain("filter", "portal", "portal-old")
+	}
+	trackServices(services)
+	err := Balancer.SetServices(healthyServices(services))
+	if err != nil {
+		for _, t := range tables() {
+			t.RenameChain("filter", "portal-old", "portal")
 		}
+		return err
+	}
 
-		tab.NewChain("filter", "portal")
-		tab.ClearChain("filter", "portal")
-		tab.AppendUnique("filter", "portal", "-j", "RETURN")
-
-		// rules for all services
-		for i := range services {
-			err := tab.Insert("filter", "portal", 1, "-p", services[i].Type, "-d", services[i].Host, "--dport", fmt.Sprintf("%d", services[i].Port), "-j", "ACCEPT")
-			if err != nil {
-				return cleanup(err)
-			}
+	for _, t := range tables() {
+		err = resetChain(t, services)
+		if err != nil {
+			return err
 		}
+	}
 
-		// Allow router through by default (ports 80/443)
-		err = tab.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "80", "-j", "ACCEPT")
-		if err != nil {
-			return cleanup(err)
+	return nil
+}
+
+// resetChain populates a new "portal" chain with rules for the services of
+// its address family and removes the old one
+func resetChain(t firewall, services []core.Service) error {
+	cleanup := func(err2 error) error {
+		t.ClearChain("filter", "portal")
+		t.DeleteChain("filter", "portal")
+		t.RenameChain("filter", "portal-old", "portal")
+		return fmt.Errorf("Failed to tab.Insert() - %s", err2)
+	}
+
+	t.NewChain("filter", "portal")
+	t.ClearChain("filter", "portal")
+	t.AppendUnique("filter", "portal", "-j", "RETURN")
+
+	// rules for all services
+	for i := range services {
+		if tableFor(services[i].Host) != t {
+			continue
 		}
-		err = tab.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "443", "-j", "ACCEPT")
+		err := t.Insert("filter", "portal", 1, "-p", services[i].Type, "-d", services[i].Host, "--dport", fmt.Sprintf("%d", services[i].Port), "-j", "ACCEPT")
 		if err != nil {
 			return cleanup(err)
 		}
+	}
 
-		tab.AppendUnique("filter", "INPUT", "-j", "portal")
-		tab.Delete("filter", "INPUT", "-j", "portal-old")
-		tab.ClearChain("filter", "portal-old")
-		tab.DeleteChain("filter", "portal-old")
+	// Allow router through by default (ports 80/443)
+	err := t.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "80", "-j", "ACCEPT")
+	if err != nil {
+		return cleanup(err)
+	}
+	err = t.Insert("filter", "portal", 1, "-p", "tcp", "--dport", "443", "-j", "ACCEPT")
+	if err != nil {
+		return cleanup(err)
 	}
 
-	return err
+	t.AppendUnique("filter", "INPUT", "-j", "portal")
+	t.Delete("filter", "INPUT", "-j", "portal-old")
+	t.ClearChain("filter", "portal-old")
+	t.DeleteChain("filter", "portal-old")
+
+	return nil
 }
 
 func SetService(service *core.Service) error {
@@ -149,10 +239,12 @@ func SetService(service *core.Service) error {
 		return nil
 	}
 
-	err := Balancer.SetService(service)
+	trackServers(service.Id, service.Servers)
+	healthy := healthyService(*service)
+	err := Balancer.SetService(&healthy)
 	// update iptables rules
-	if err == nil && tab != nil {
-		errTab := tab.Insert("filter", "portal", 1, "-p", service.Type, "-d", service.Host, "--dport", fmt.Sprintf("%d", service.Port), "-j", "ACCEPT")
+	if t := tableFor(service.Host); err == nil && t != nil {
+		errTab := t.Insert("filter", "portal", 1, "-p", service.Type, "-d", service.Host, "--dport", fmt.Sprintf("%d", service.Port), "-j", "ACCEPT")
 		if errTab != nil {
 			return err
 		}
@@ -169,10 +261,11 @@ func DeleteService(id string) error {
 		return err
 	}
 
+	untrackService(id)
 	err = Balancer.DeleteService(id)
-	if err == nil && tab != nil {
+	if t := tableFor(service.Host); err == nil && t != nil {
 		// update iptables rules
-		errTab := tab.Delete("filter", "portal", "-p", service.Type, "-d", service.Host, "--dport", fmt.Sprintf("%d", service.Port), "-j", "ACCEPT")
+		errTab := t.Delete("filter", "portal", "-p", service.Type, "-d", service.Host, "--dport", fmt.Sprintf("%d", service.Port), "-j", "ACCEPT")
 		if errTab != nil {
 			return err
 		}
@@ -185,13 +278,19 @@ func SetServers(svcId string, servers []core.Server) error {
 	if Balancer == nil {
 		return nil
 	}
-	return Balancer.SetServers(svcId, servers)
+	trackServers(svcId, servers)
+	return Balancer.SetServers(svcId, healthyServers(svcId, servers))
 }
 
 func SetServer(svcId string, server *core.Server) error {
 	if Balancer == nil {
 		return nil
 	}
+	trackServer(svcId, *server)
+	if isUnhealthy(svcId, server.Id) {
+		// restored to the balancer once it passes its health checks
+		return nil
+	}
 	return Balancer.SetServer(svcId, server)
 }
 
@@ -199,6 +298,7 @@ func DeleteServer(svcId, srvId string) error {
 	if Balancer == nil {
 		return nil
 	}
+	untrackServer(svcId, srvId)
 	return Balancer.DeleteServer(svcId, srvId)
 }
 
@@ -209,28 +309,39 @@ func GetServer(svcId, srvId string) (*core.Server, error) {
 	return Balancer.GetServer(svcId, srvId)
 }
 
+// ActiveConns returns the number of active connections to the server. Balancers
+// unable to count them (nginx finishes established connections on reload)
+// report 0.
+func ActiveConns(svcId, srvId string) (int, error) {
+	if Balancer == nil {
+		return 0, nil
+	}
+	if counter, ok := Balancer.(connCounter); ok {
+		return counter.ActiveConns(svcId, srvId)
+	}
+	return 0, nil
+}
+
 func parseSvc(serviceId string) (*core.Service, error) {
 	if Balancer == nil {
 		return nil, nil
 	}
-	s := strings.Replace(serviceId, "_", ".", -1)
-	svc := strings.Split(s, "-")
+	svc := strings.Split(serviceId, "-")
 	if len(svc) != 3 {
 		return nil, NoServiceError
 	}
 	p, _ := strconv.Atoi(svc[2])
-	return &core.Service{Type: svc[0], Host: svc[1], Port: p}, nil
+	return &core.Service{Type: svc[0], Host: core.DecodeHost(svc[1]), Port: p}, nil
 }
 
 func parseSrv(serverId string) (*core.Server, error) {
 	if Balancer == nil {
 		return nil, nil
 	}
-	s := strings.Replace(serverId, "_", ".", -1)
-	srv := strings.Split(s, "-")
+	srv := strings.Split(serverId, "-")
 	if len(srv) != 2 {
 		return nil, NoServerError
 	}
 	p, _ := strconv.Atoi(srv[1])
-	return &core.Server{Host: srv[0], Port: p}, nil
+	return &core.Server{Host: core.DecodeHost(srv[0]), Port: p}, nil
 }
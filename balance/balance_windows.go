@@ -18,6 +18,14 @@ var (
 	NoServerError  = errors.New("No Server Found")
 )
 
+type (
+	// connCounter is implemented by balancers able to count a server's active
+	// connections (used when draining)
+	connCounter interface {
+		ActiveConns(svcId, srvId string) (int, error)
+	}
+)
+
 func Init() error {
 	if config.JustProxy {
 		Balancer = nil
@@ -32,7 +40,13 @@ func Init() error {
 		Balancer = &Nginx{}
 	}
 
-	return Balancer.Init()
+	err := Balancer.Init()
+	if err != nil {
+		return err
+	}
+
+	StartHealth(config.HealthInterval)
+	return nil
 }
 
 func GetServices() ([]core.Service, error) {
@@ -53,20 +67,24 @@ func SetServices(services []core.Service) error {
 	if Balancer == nil {
 		return nil
 	}
-	return Balancer.SetServices(services)
+	trackServices(services)
+	return Balancer.SetServices(healthyServices(services))
 }
 
 func SetService(service *core.Service) error {
 	if Balancer == nil {
 		return nil
 	}
-	return Balancer.SetService(service)
+	trackServers(service.Id, service.Servers)
+	healthy := healthyService(*service)
+	return Balancer.SetService(&healthy)
 }
 
 func DeleteService(id string) error {
 	if Balancer == nil {
 		return nil
 	}
+	untrackService(id)
 	return Balancer.DeleteService(id)
 }
 
@@ -74,13 +92,19 @@ func SetServers(svcId string, servers []core.Server) error {
 	if Balancer == nil {
 		return nil
 	}
-	return Balancer.SetServers(svcId, servers)
+	trackServers(svcId, servers)
+	return Balancer.SetServers(svcId, healthyServers(svcId, servers))
 }
 
 func SetServer(svcId string, server *core.Server) error {
 	if Balancer == nil {
 		return nil
 	}
+	trackServer(svcId, *server)
+	if isUnhealthy(svcId, server.Id) {
+		// restored to the balancer once it passes its health checks
+		return nil
+	}
 	return Balancer.SetServer(svcId, server)
 }
 
@@ -88,6 +112,7 @@ func DeleteServer(svcId, srvId string) error {
 	if Balancer == nil {
 		return nil
 	}
+	untrackServer(svcId, srvId)
 	return Balancer.DeleteServer(svcId, srvId)
 }
 
@@ -98,28 +123,39 @@ func GetServer(svcId, srvId string) (*core.Server, error) {
 	return Balancer.GetServer(svcId, srvId)
 }
 
+// ActiveConns returns the number of active connections to the server. Balancers
+// unable to count them (nginx finishes established connections on reload)
+// report 0.
+func ActiveConns(svcId, srvId string) (int, error) {
+	if Balancer == nil {
+		return 0, nil
+	}
+	if counter, ok := Balancer.(connCounter); ok {
+		return counter.ActiveConns(svcId, srvId)
+	}
+	return 0, nil
+}
+
 func parseSvc(serviceId string) (*core.Service, error) {
 	if Balancer == nil {
 		return nil, nil
 	}
-	s := strings.Replace(serviceId, "_", ".", -1)
-	svc := strings.Split(s, "-")
+	svc := strings.Split(serviceId, "-")
 	if len(svc) != 3 {
 		return nil, NoServiceError
 	}
 	p, _ := strconv.Atoi(svc[2])
-	return &core.Service{Type: svc[0], Host: svc[1], Port: p}, nil
+	return &core.Service{Type: svc[0], Host: core.DecodeHost(svc[1]), Port: p}, nil
 }
 
 func parseSrv(serverId string) (*core.Server, error) {
 	if Balancer == nil {
 		return nil, nil
 	}
-	s := strings.Replace(serverId, "_", ".", -1)
-	srv := strings.Split(s, "-")
+	srv := strings.Split(serverId, "-")
 	if len(srv) != 2 {
 		return nil, NoServerError
 	}
 	p, _ := strconv.Atoi(srv[1])
-	return &core.Server{Host: srv[0], Port: p}, nil
+	return &core.Server{Host: core.DecodeHost(srv[0]), Port: p}, nil
 }
@@ -0,0 +1,16 @@
+package balance
+
+// internals exercised by the (external) tests
+var (
+	RecordCheck  = recordCheck
+	TrackServer  = trackServer
+	UntrackCheck = untrackService
+)
+
+// SetTables swaps the iptables and ip6tables used, returning a func restoring
+// the old ones
+func SetTables(t, t6 firewall) func() {
+	oldTab, oldTab6 := tab, tab6
+	tab, tab6 = t, t6
+	return func() { tab, tab6 = oldTab, oldTab6 }
+}
@@ -0,0 +1,149 @@
+package balance_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/core"
+)
+
+var (
+	testService4 = core.Service{Id: "tcp-192_168_0_17-1234", Host: "192.168.0.17", Port: 1234, Type: "tcp"}
+	testService6 = core.Service{Id: "udp-fd00..3-1234", Host: "fd00::3", Port: 1234, Type: "udp"}
+
+	rule4 = "-p tcp -d 192.168.0.17 --dport 1234 -j ACCEPT"
+	rule6 = "-p udp -d fd00::3 --dport 1234 -j ACCEPT"
+)
+
+// services' rules go to the table of their address family only
+func TestFirewallFamilies(t *testing.T) {
+	tab, tab6 := newFakeFirewall(), newFakeFirewall()
+	defer balance.SetTables(tab, tab6)()
+	old := balance.Balancer
+	balance.Balancer = &fakeBalancer{}
+	defer func() { balance.Balancer = old }()
+	defer balance.UntrackCheck(testService4.Id)
+	defer balance.UntrackCheck(testService6.Id)
+
+	for _, svc := range []core.Service{testService4, testService6} {
+		svc := svc
+		if err := balance.SetService(&svc); err != nil {
+			t.Fatalf("Failed to SET service - %s", err)
+		}
+	}
+	tab.expect(t, "iptables", rule4)
+	tab6.expect(t, "ip6tables", rule6)
+
+	if err := balance.DeleteService(testService6.Id); err != nil {
+		t.Fatalf("Failed to DELETE service - %s", err)
+	}
+	tab.expect(t, "iptables", rule4)
+	tab6.expect(t, "ip6tables")
+
+	// reset chains
+	if err := balance.SetServices([]core.Service{testService4, testService6}); err != nil {
+		t.Fatalf("Failed to SET services - %s", err)
+	}
+	tab.expect(t, "iptables", rule4)
+	tab6.expect(t, "ip6tables", rule6)
+	if _, ok := tab6.chains["portal-old"]; ok {
+		t.Errorf("Old ip6tables chain not removed")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+
+// fakeFirewall keeps its chains' rules in memory
+type fakeFirewall struct {
+	chains map[string][]string
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{chains: map[string][]string{"INPUT": {}, "portal": {"-j RETURN"}}}
+}
+
+// expect checks the portal chain has the service rules (and nothing but the
+// router and RETURN rules besides)
+func (f *fakeFirewall) expect(t *testing.T, name string, rules ...string) {
+	t.Helper()
+	want := map[string]bool{"-j RETURN": true}
+	for _, rule := range rules {
+		want[rule] = true
+		if !f.has("portal", rule) {
+			t.Errorf("%s missing rule '%s' - %q", name, rule, f.chains["portal"])
+		}
+	}
+	for _, rule := range f.chains["portal"] {
+		if !want[rule] && !strings.Contains(rule, "--dport 80 ") && !strings.Contains(rule, "--dport 443 ") {
+			t.Errorf("%s has unexpected rule '%s'", name, rule)
+		}
+	}
+}
+
+func (f *fakeFirewall) has(chain, rule string) bool {
+	for _, r := range f.chains[chain] {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeFirewall) List(table, chain string) ([]string, error) {
+	return f.chains[chain], nil
+}
+
+func (f *fakeFirewall) Insert(table, chain string, pos int, rulespec ...string) error {
+	rule := strings.Join(rulespec, " ")
+	f.chains[chain] = append([]string{rule}, f.chains[chain]...)
+	return nil
+}
+
+func (f *fakeFirewall) AppendUnique(table, chain string, rulespec ...string) error {
+	rule := strings.Join(rulespec, " ")
+	if !f.has(chain, rule) {
+		f.chains[chain] = append(f.chains[chain], rule)
+	}
+	return nil
+}
+
+func (f *fakeFirewall) Delete(table, chain string, rulespec ...string) error {
+	rule := strings.Join(rulespec, " ")
+	for i, r := range f.chains[chain] {
+		if r == rule {
+			f.chains[chain] = append(f.chains[chain][:i], f.chains[chain][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirewall) NewChain(table, chain string) error {
+	if _, ok := f.chains[chain]; !ok {
+		f.chains[chain] = []string{}
+	}
+	return nil
+}
+
+func (f *fakeFirewall) ClearChain(table, chain string) error {
+	if _, ok := f.chains[chain]; ok {
+		f.chains[chain] = []string{}
+	}
+	return nil
+}
+
+func (f *fakeFirewall) RenameChain(table, oldChain, newChain string) error {
+	if rules, ok := f.chains[oldChain]; ok {
+		f.chains[newChain] = rules
+		delete(f.chains, oldChain)
+	}
+	return nil
+}
+
+func (f *fakeFirewall) DeleteChain(table, chain string) error {
+	delete(f.chains, chain)
+	return nil
+}
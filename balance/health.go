@@ -0,0 +1,328 @@
+package balance
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+var (
+	// health checks for servers, keyed by service id then server id
+	checks    = make(map[string]map[string]*serverCheck)
+	checkLock = &sync.Mutex{}
+	checking  = false
+
+	// HealthChanged, if set, is called when a server becomes unhealthy or
+	// recovers (with its new health)
+	HealthChanged func(svcId string, server core.Server, health string)
+)
+
+type (
+	serverCheck struct {
+		server core.Server
+		state  string
+		passes int
+		fails  int
+	}
+)
+
+// StartHealth begins checking the health of servers that define a check every
+// `interval` seconds. Servers failing their checks are removed from the
+// balancer until they recover.
+func StartHealth(interval int) {
+	checkLock.Lock()
+	if checking {
+		checkLock.Unlock()
+		return
+	}
+	checking = true
+	checkLock.Unlock()
+
+	if interval < 1 {
+		interval = 1
+	}
+
+	go func() {
+		for range time.Tick(time.Duration(interval) * time.Second) {
+			checkServers()
+		}
+	}()
+}
+
+// ServerHealth returns the health state of the server, or "" if the server
+// doesn't define a health check.
+func ServerHealth(svcId, srvId string) string {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	if c, ok := checks[svcId][srvId]; ok {
+		return c.state
+	}
+	return ""
+}
+
+// CheckServer performs the server's health check once, returning an error if
+// the server is not healthy.
+func CheckServer(server core.Server) error {
+	timeout := time.Duration(server.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	addr := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+
+	switch server.Check {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case "udp":
+		conn, err := net.DialTimeout("udp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write([]byte("\n")); err != nil {
+			return err
+		}
+		// udp is connectionless, a closed port is only detected if the host
+		// replies with an icmp 'port unreachable' (seen here as a read error)
+		_, err = conn.Read(make([]byte, 512))
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil
+		}
+		return err
+	case "http":
+		endpoint := server.Endpoint
+		if endpoint == "" {
+			endpoint = "/"
+		}
+		return core.HttpCheck{Url: fmt.Sprintf("http://%s%s", addr, endpoint), ExpectedCode: server.ExpectedCode, Timeout: timeout}.Check()
+	default:
+		return fmt.Errorf("Unknown health check - '%s'", server.Check)
+	}
+
+	return nil
+}
+
+// checkServers runs all health checks concurrently and records the results.
+func checkServers() {
+	type result struct {
+		svcId  string
+		server core.Server
+		err    error
+	}
+
+	checkLock.Lock()
+	pending := []result{}
+	for svcId := range checks {
+		for _, c := range checks[svcId] {
+			pending = append(pending, result{svcId: svcId, server: c.server})
+		}
+	}
+	checkLock.Unlock()
+
+	var wg sync.WaitGroup
+	for i := range pending {
+		wg.Add(1)
+		go func(r *result) {
+			defer wg.Done()
+			r.err = CheckServer(r.server)
+		}(&pending[i])
+	}
+	wg.Wait()
+
+	for i := range pending {
+		recordCheck(pending[i].svcId, pending[i].server.Id, pending[i].err)
+	}
+}
+
+// recordCheck updates the server's health, removing it from (or restoring it
+// to) the balancer when its state changes.
+func recordCheck(svcId, srvId string, err error) {
+	checkLock.Lock()
+	c, ok := checks[svcId][srvId]
+	if !ok {
+		// removed while being checked
+		checkLock.Unlock()
+		return
+	}
+
+	attempts := c.server.Attempts
+	if attempts == 0 {
+		attempts = 3
+	}
+	recoveries := c.server.Recover
+	if recoveries == 0 {
+		recoveries = 2
+	}
+
+	prev := c.state
+	if err != nil {
+		config.Log.Trace("Health check failed for '%s' on '%s' - %s", srvId, svcId, err)
+		c.passes = 0
+		c.fails++
+		if c.state != HealthUnhealthy && c.fails >= attempts {
+			c.state = HealthUnhealthy
+		}
+	} else {
+		c.fails = 0
+		c.passes++
+		if c.state == HealthUnknown || (c.state == HealthUnhealthy && c.passes >= recoveries) {
+			c.state = HealthHealthy
+		}
+	}
+	state := c.state
+	server := c.server
+	checkLock.Unlock()
+
+	if Balancer == nil || state == prev {
+		return
+	}
+
+	switch {
+	case state == HealthUnhealthy:
+		config.Log.Warn("Server '%s' on '%s' is unhealthy, removing from balancer", srvId, svcId)
+		err = Balancer.DeleteServer(svcId, srvId)
+	case prev == HealthUnhealthy:
+		config.Log.Info("Server '%s' on '%s' recovered, restoring to balancer", srvId, svcId)
+		err = Balancer.SetServer(svcId, &server)
+	}
+	if err != nil {
+		config.Log.Error("Failed to update balancer for '%s' on '%s' - %s", srvId, svcId, err)
+		// retry on the next check
+		checkLock.Lock()
+		if c, ok := checks[svcId][srvId]; ok && c.state == state {
+			c.state = prev
+		}
+		checkLock.Unlock()
+		return
+	}
+	if HealthChanged != nil && (state == HealthUnhealthy || prev == HealthUnhealthy) {
+		HealthChanged(svcId, server, state)
+	}
+}
+
+// trackServers resets the health checks for a service, keeping the state of
+// servers already being checked.
+func trackServers(svcId string, servers []core.Server) {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	old := checks[svcId]
+	delete(checks, svcId)
+	for i := range servers {
+		trackServerLocked(svcId, servers[i], old[servers[i].Id])
+	}
+}
+
+// trackServer adds or updates the health check for a server.
+func trackServer(svcId string, server core.Server) {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	trackServerLocked(svcId, server, checks[svcId][server.Id])
+}
+
+func trackServerLocked(svcId string, server core.Server, old *serverCheck) {
+	if server.Check == "" {
+		if checks[svcId] != nil {
+			delete(checks[svcId], server.Id)
+		}
+		return
+	}
+	server.Health = ""
+
+	c := &serverCheck{server: server, state: HealthUnknown}
+	if old != nil {
+		c.state, c.passes, c.fails = old.state, old.passes, old.fails
+	}
+	if checks[svcId] == nil {
+		checks[svcId] = make(map[string]*serverCheck)
+	}
+	checks[svcId][server.Id] = c
+}
+
+// trackServices resets all health checks.
+func trackServices(services []core.Service) {
+	checkLock.Lock()
+	old := checks
+	checks = make(map[string]map[string]*serverCheck)
+	for i := range services {
+		for j := range services[i].Servers {
+			trackServerLocked(services[i].Id, services[i].Servers[j], old[services[i].Id][services[i].Servers[j].Id])
+		}
+	}
+	checkLock.Unlock()
+}
+
+// untrackServer stops checking a server.
+func untrackServer(svcId, srvId string) {
+	checkLock.Lock()
+	if checks[svcId] != nil {
+		delete(checks[svcId], srvId)
+	}
+	checkLock.Unlock()
+}
+
+// untrackService stops checking a service's servers.
+func untrackService(svcId string) {
+	checkLock.Lock()
+	delete(checks, svcId)
+	checkLock.Unlock()
+}
+
+// isUnhealthy reports whether the server is currently removed from the
+// balancer due to failed health checks.
+func isUnhealthy(svcId, srvId string) bool {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	c, ok := checks[svcId][srvId]
+	return ok && c.state == HealthUnhealthy
+}
+
+// healthyServers returns a copy of servers without the unhealthy ones.
+func healthyServers(svcId string, servers []core.Server) []core.Server {
+	if servers == nil {
+		return nil
+	}
+	healthy := make([]core.Server, 0, len(servers))
+	for i := range servers {
+		if !isUnhealthy(svcId, servers[i].Id) {
+			healthy = append(healthy, servers[i])
+		}
+	}
+	return healthy
+}
+
+// healthyService returns a copy of the service without unhealthy servers.
+func healthyService(service core.Service) core.Service {
+	service.Servers = healthyServers(service.Id, service.Servers)
+	return service
+}
+
+// healthyServices returns a copy of services without unhealthy servers.
+func healthyServices(services []core.Service) []core.Service {
+	if services == nil {
+		return nil
+	}
+	healthy := make([]core.Service, 0, len(services))
+	for i := range services {
+		healthy = append(healthy, healthyService(services[i]))
+	}
+	return healthy
+}
@@ -0,0 +1,176 @@
+package balance_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// HEALTH CHECKS
+////////////////////////////////////////////////////////////////////////////////
+func TestCheckServerTcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen - %s", err)
+	}
+	host, port := splitAddr(ln.Addr().String())
+
+	server := core.Server{Host: host, Port: port, Check: "tcp", Timeout: 500}
+	if err := balance.CheckServer(server); err != nil {
+		t.Errorf("Failed to check healthy server - %s", err)
+	}
+
+	ln.Close()
+	if err := balance.CheckServer(server); err == nil {
+		t.Errorf("Closed server reported healthy")
+	}
+}
+
+func TestCheckServerHttp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	host, port := splitAddr(ts.Listener.Addr().String())
+
+	server := core.Server{Host: host, Port: port, Check: "http", Endpoint: "/health", Timeout: 500}
+	if err := balance.CheckServer(server); err != nil {
+		t.Errorf("Failed to check healthy server - %s", err)
+	}
+
+	server.Endpoint = "/"
+	if err := balance.CheckServer(server); err == nil {
+		t.Errorf("Unexpected response code reported healthy")
+	}
+
+	server.ExpectedCode = http.StatusNotFound
+	if err := balance.CheckServer(server); err != nil {
+		t.Errorf("Failed to check server with expected code - %s", err)
+	}
+}
+
+func TestCheckServerUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen - %s", err)
+	}
+	host, port := splitAddr(conn.LocalAddr().String())
+
+	server := core.Server{Host: host, Port: port, Check: "udp", Timeout: 200}
+	if err := balance.CheckServer(server); err != nil {
+		t.Errorf("Failed to check healthy server - %s", err)
+	}
+
+	// closed udp ports are detected by icmp 'port unreachable' on loopback
+	conn.Close()
+	if err := balance.CheckServer(server); err == nil {
+		t.Errorf("Closed server reported healthy")
+	}
+}
+
+func TestCheckServerUnknown(t *testing.T) {
+	if err := balance.CheckServer(core.Server{Host: "127.0.0.1", Port: 80, Check: "icmp"}); err == nil {
+		t.Errorf("Unknown check type reported healthy")
+	}
+}
+
+func TestRecordCheck(t *testing.T) {
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+	fake := &fakeBalancer{}
+	old := balance.Balancer
+	balance.Balancer = fake
+	defer func() { balance.Balancer = old }()
+
+	failed := errors.New("connection refused")
+	tests := []struct {
+		name     string
+		attempts int
+		recover  int
+		results  []error  // check results, in order
+		states   []string // health after each
+		calls    string   // balancer changes made
+	}{
+		{"default attempts and recover", 0, 0,
+			[]error{nil, failed, failed, failed, nil, nil},
+			[]string{"healthy", "healthy", "healthy", "unhealthy", "unhealthy", "healthy"},
+			"delete set"},
+		{"removed from unknown", 0, 0,
+			[]error{failed, failed, failed},
+			[]string{"unknown", "unknown", "unhealthy"},
+			"delete"},
+		{"pass resets fails", 0, 0,
+			[]error{nil, failed, failed, nil, failed, failed},
+			[]string{"healthy", "healthy", "healthy", "healthy", "healthy", "healthy"},
+			""},
+		{"fail resets passes", 0, 0,
+			[]error{failed, failed, failed, nil, failed, nil, nil},
+			[]string{"unknown", "unknown", "unhealthy", "unhealthy", "unhealthy", "unhealthy", "healthy"},
+			"delete set"},
+		{"custom attempts and recover", 1, 3,
+			[]error{nil, failed, nil, nil, nil},
+			[]string{"healthy", "unhealthy", "unhealthy", "unhealthy", "healthy"},
+			"delete set"},
+	}
+
+	for _, tt := range tests {
+		fake.calls = nil
+		server := core.Server{Id: "127_0_0_11-8080", Host: "127.0.0.11", Port: 8080, Check: "tcp", Attempts: tt.attempts, Recover: tt.recover}
+		balance.TrackServer("tcp-192_168_0_15-80", server)
+		for i, err := range tt.results {
+			balance.RecordCheck("tcp-192_168_0_15-80", server.Id, err)
+			if health := balance.ServerHealth("tcp-192_168_0_15-80", server.Id); health != tt.states[i] {
+				t.Errorf("%s: expected '%s' after check %d, got '%s'", tt.name, tt.states[i], i+1, health)
+			}
+		}
+		if calls := strings.Join(fake.calls, " "); calls != tt.calls {
+			t.Errorf("%s: expected balancer changes '%s', got '%s'", tt.name, tt.calls, calls)
+		}
+		balance.UntrackCheck("tcp-192_168_0_15-80")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+// fakeBalancer records the servers removed from and restored to it
+type fakeBalancer struct {
+	calls []string
+}
+
+func (f *fakeBalancer) Init() error                                          { return nil }
+func (f *fakeBalancer) GetServices() ([]core.Service, error)                 { return nil, nil }
+func (f *fakeBalancer) GetService(id string) (*core.Service, error)          { return nil, nil }
+func (f *fakeBalancer) SetServices(services []core.Service) error            { return nil }
+func (f *fakeBalancer) SetService(service *core.Service) error               { return nil }
+func (f *fakeBalancer) DeleteService(id string) error                        { return nil }
+func (f *fakeBalancer) SetServers(svcId string, servers []core.Server) error { return nil }
+func (f *fakeBalancer) GetServer(svcId, srvId string) (*core.Server, error)  { return nil, nil }
+func (f *fakeBalancer) SetServer(svcId string, server *core.Server) error {
+	f.calls = append(f.calls, "set")
+	return nil
+}
+func (f *fakeBalancer) DeleteServer(svcId, srvId string) error {
+	f.calls = append(f.calls, "delete")
+	return nil
+}
+
+func splitAddr(addr string) (string, int) {
+	host, p, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(p)
+	return host, port
+}
@@ -0,0 +1,91 @@
+// +build linux darwin
+
+package balance
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ip6tables manages ipv6 rules with the `ip6tables` command (the vendored
+	// go-iptables only speaks ipv4)
+	ip6tables struct {
+		path string
+	}
+)
+
+func newIp6tables() (*ip6tables, error) {
+	path, err := exec.LookPath("ip6tables")
+	if err != nil {
+		return nil, err
+	}
+	return &ip6tables{path: path}, nil
+}
+
+// List returns the rules in the chain
+func (t *ip6tables) List(table, chain string) ([]string, error) {
+	out, err := t.run("-t", table, "-S", chain)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(out), "\n"), nil
+}
+
+// Insert inserts the rule at pos
+func (t *ip6tables) Insert(table, chain string, pos int, rulespec ...string) error {
+	_, err := t.run(append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, rulespec...)...)
+	return err
+}
+
+// AppendUnique appends the rule if it doesn't already exist
+func (t *ip6tables) AppendUnique(table, chain string, rulespec ...string) error {
+	if _, err := t.run(append([]string{"-t", table, "-C", chain}, rulespec...)...); err == nil {
+		return nil
+	}
+	_, err := t.run(append([]string{"-t", table, "-A", chain}, rulespec...)...)
+	return err
+}
+
+// Delete removes the rule
+func (t *ip6tables) Delete(table, chain string, rulespec ...string) error {
+	_, err := t.run(append([]string{"-t", table, "-D", chain}, rulespec...)...)
+	return err
+}
+
+// NewChain creates the chain
+func (t *ip6tables) NewChain(table, chain string) error {
+	_, err := t.run("-t", table, "-N", chain)
+	return err
+}
+
+// ClearChain flushes the chain, creating it if it doesn't exist
+func (t *ip6tables) ClearChain(table, chain string) error {
+	if err := t.NewChain(table, chain); err == nil {
+		return nil
+	}
+	_, err := t.run("-t", table, "-F", chain)
+	return err
+}
+
+// RenameChain renames the chain
+func (t *ip6tables) RenameChain(table, oldChain, newChain string) error {
+	_, err := t.run("-t", table, "-E", oldChain, newChain)
+	return err
+}
+
+// DeleteChain deletes the (empty) chain
+func (t *ip6tables) DeleteChain(table, chain string) error {
+	_, err := t.run("-t", table, "-X", chain)
+	return err
+}
+
+func (t *ip6tables) run(args ...string) (string, error) {
+	out, err := exec.Command(t.path, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run ip6tables %s - %s", strings.Join(args, " "), out)
+	}
+	return string(out), nil
+}
@@ -4,6 +4,10 @@ package balance
 
 import (
 	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/nanobox-io/golang-lvs"
@@ -40,12 +44,12 @@ func (l *Lvs) GetServer(svcId, srvId string) (*core.Server, error) {
 
 	ipvsLock.RLock()
 	defer ipvsLock.RUnlock()
-	s := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	s := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if s == nil {
 		return nil, NoServiceError
 	}
 
-	srv := s.FindServer(server.Host, server.Port)
+	srv := s.FindServer(lvsHost(server.Host), server.Port)
 	if srv == nil {
 		return nil, NoServerError
 	}
@@ -64,11 +68,16 @@ func (l *Lvs) SetServer(svcId string, server *core.Server) error {
 	defer ipvsLock.Unlock()
 
 	// add to lvs
-	s := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	s := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if s == nil {
 		return NoServiceError
 	}
 
+	// update in place if it exists, re-adding would drop established connections
+	if srv := s.FindServer(lvsServer.Host, lvsServer.Port); srv != nil {
+		return editServer(s, srv, lvsServer)
+	}
+
 	err = s.AddServer(lvsServer)
 	if err != nil {
 		return err
@@ -93,13 +102,13 @@ func (l *Lvs) DeleteServer(svcId, srvId string) error {
 	ipvsLock.Lock()
 	defer ipvsLock.Unlock()
 	// remove from lvs
-	s := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	s := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if s == nil {
 		return nil
 	}
 
 	// if ipvsadm remove fails, should return error
-	err = s.RemoveServer(server.Host, server.Port)
+	err = s.RemoveServer(lvsHost(server.Host), server.Port)
 	if err != nil {
 		return err
 	}
@@ -122,7 +131,7 @@ func (l *Lvs) SetServers(svcId string, servers []core.Server) error {
 	ipvsLock.Lock()
 	defer ipvsLock.Unlock()
 	// add to lvs
-	s := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	s := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if s == nil {
 		return NoServiceError
 	}
@@ -140,6 +149,92 @@ func (l *Lvs) SetServers(svcId string, servers []core.Server) error {
 	return nil
 }
 
+// ActiveConns returns the number of active connections ipvs has to the server
+func (l *Lvs) ActiveConns(svcId, srvId string) (int, error) {
+	service, err := parseSvc(svcId)
+	if err != nil {
+		return 0, err
+	}
+
+	server, err := parseSrv(srvId)
+	if err != nil {
+		return 0, err
+	}
+
+	svcArgs, err := ipvsService(service.Type, service.Host, service.Port)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := exec.Command("ipvsadm", append([]string{"-Ln"}, svcArgs...)...).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("[ipvsadm] Failed to list service - %s", out)
+	}
+
+	// "  -> 192.168.0.3:8080             Masq    0      4          12"
+	addr := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 6 && fields[0] == "->" && fields[1] == addr {
+			return strconv.Atoi(fields[4])
+		}
+	}
+
+	return 0, NoServerError
+}
+
+// Stats returns the kernel's connection, packet, and byte counters for each
+// service and server
+func (l *Lvs) Stats() ([]Stat, error) {
+	out, err := exec.Command("ipvsadm", "-Ln", "--stats", "--exact").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("[ipvsadm] Failed to list stats - %s", out)
+	}
+
+	// "TCP  192.168.0.1:80                     3       20        0     1200        0"
+	// "  -> 192.168.0.3:8080                   3       20        0     1200        0"
+	stats := []Stat{}
+	svcId := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 7 {
+			continue
+		}
+		// skips the headers ("Prot LocalAddress:Port ...")
+		host, p, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			continue
+		}
+
+		stat := Stat{}
+		if fields[0] == "->" {
+			if svcId == "" {
+				continue
+			}
+			srv := core.Server{Host: host, Port: port}
+			srv.GenId()
+			stat.Service, stat.Server = svcId, srv.Id
+		} else {
+			svc := core.Service{Type: strings.ToLower(fields[0]), Host: host, Port: port}
+			svc.GenId()
+			svcId = svc.Id
+			stat.Service = svcId
+		}
+
+		counters := []*float64{&stat.Conns, &stat.InPkts, &stat.OutPkts, &stat.InBytes, &stat.OutBytes}
+		for i := range counters {
+			*counters[i], _ = strconv.ParseFloat(fields[i+2], 64)
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
 // GetService
 func (l *Lvs) GetService(id string) (*core.Service, error) {
 	service, err := parseSvc(id)
@@ -150,7 +245,7 @@ func (l *Lvs) GetService(id string) (*core.Service, error) {
 	ipvsLock.RLock()
 	defer ipvsLock.RUnlock()
 
-	svc := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	svc := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if svc == nil {
 		return nil, NoServiceError
 	}
@@ -172,7 +267,7 @@ func (l *Lvs) SetService(service *core.Service) error {
 
 	// add servers, if any
 	if len(lvsService.Servers) != 0 {
-		s := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+		s := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 		if s == nil {
 			return fmt.Errorf("Balancer failed to set service")
 		}
@@ -196,14 +291,14 @@ func (l *Lvs) DeleteService(id string) error {
 
 	ipvsLock.Lock()
 	defer ipvsLock.Unlock()
-	svc := lvs.DefaultIpvs.FindService(service.Type, service.Host, service.Port)
+	svc := lvs.DefaultIpvs.FindService(service.Type, lvsHost(service.Host), service.Port)
 	if svc == nil {
 		// if not exist, 'delete' successful
 		return nil
 	}
 
 	// remove from lvs
-	err = lvs.DefaultIpvs.RemoveService(service.Type, service.Host, service.Port)
+	err = lvs.DefaultIpvs.RemoveService(service.Type, lvsHost(service.Host), service.Port)
 	if err != nil {
 		return err
 	}
@@ -286,16 +381,66 @@ func Sync() error {
 	return nil
 }
 
+// editServer updates an existing server with `ipvsadm -e` and saves the
+// changes to the cached service
+func editServer(s *lvs.Service, srv *lvs.Server, server lvs.Server) error {
+	svcArgs, err := ipvsService(s.Type, coreHost(s.Host), s.Port)
+	if err != nil {
+		return err
+	}
+
+	forwarder := server.Forwarder
+	if forwarder == "" {
+		forwarder = "g"
+	}
+
+	args := append([]string{"-e"}, svcArgs...)
+	args = append(args, "-r", net.JoinHostPort(coreHost(server.Host), strconv.Itoa(server.Port)), "-"+forwarder,
+		"-w", strconv.Itoa(server.Weight), "-x", strconv.Itoa(server.UpperThreshold), "-y", strconv.Itoa(server.LowerThreshold))
+
+	out, err := exec.Command("ipvsadm", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[ipvsadm] Failed to edit server - %s:%d; %s", server.Host, server.Port, out)
+	}
+
+	*srv = server
+	return nil
+}
+
+// ipvsService returns the ipvsadm arguments identifying a service
+func ipvsService(netType, host string, port int) ([]string, error) {
+	switch netType {
+	case "tcp":
+		return []string{"-t", net.JoinHostPort(host, strconv.Itoa(port))}, nil
+	case "udp":
+		return []string{"-u", net.JoinHostPort(host, strconv.Itoa(port))}, nil
+	}
+	return nil, fmt.Errorf("Unsupported Protocol - '%s'", netType)
+}
+
+// lvsHost brackets ipv6 hosts, as ipvsadm expects them ("[fd00::1]:80")
+func lvsHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// coreHost strips the brackets from ipv6 hosts
+func coreHost(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
 // conversion functions
 // takes a lvs.Server and converts it to a core.Server
 func lToSrv(server lvs.Server) core.Server {
-	srv := core.Server{Host: server.Host, Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
+	srv := core.Server{Host: coreHost(server.Host), Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
 	srv.GenId()
 	return srv
 }
 
 func lToSrvp(server *lvs.Server) *core.Server {
-	srv := &core.Server{Host: server.Host, Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
+	srv := &core.Server{Host: coreHost(server.Host), Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
 	srv.GenId()
 	return srv
 }
@@ -307,7 +452,7 @@ func lToSvc(service lvs.Service) core.Service {
 		srvs = append(srvs, lToSrv(srv))
 		srvs[i].GenId()
 	}
-	svc := core.Service{Host: service.Host, Port: service.Port, Type: service.Type, Scheduler: service.Scheduler, Persistence: service.Persistence, Netmask: service.Netmask, Servers: srvs}
+	svc := core.Service{Host: coreHost(service.Host), Port: service.Port, Type: service.Type, Scheduler: service.Scheduler, Persistence: service.Persistence, Netmask: service.Netmask, Servers: srvs}
 	svc.GenId()
 	return svc
 }
@@ -318,14 +463,14 @@ func lToSvcp(service *lvs.Service) *core.Service {
 		srvs = append(srvs, lToSrv(srv))
 		srvs[i].GenId()
 	}
-	svc := &core.Service{Host: service.Host, Port: service.Port, Type: service.Type, Scheduler: service.Scheduler, Persistence: service.Persistence, Netmask: service.Netmask, Servers: srvs}
+	svc := &core.Service{Host: coreHost(service.Host), Port: service.Port, Type: service.Type, Scheduler: service.Scheduler, Persistence: service.Persistence, Netmask: service.Netmask, Servers: srvs}
 	svc.GenId()
 	return svc
 }
 
 // takes a core.Server and converts it to an lvs.Server
 func srvToL(server core.Server) lvs.Server {
-	return lvs.Server{Host: server.Host, Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
+	return lvs.Server{Host: lvsHost(server.Host), Port: server.Port, Forwarder: server.Forwarder, Weight: server.Weight, UpperThreshold: server.UpperThreshold, LowerThreshold: server.LowerThreshold}
 }
 
 // takes a core.Service and converts it to an lvs.Service
@@ -334,5 +479,5 @@ func svcToL(server core.Service) lvs.Service {
 	for _, srv := range server.Servers {
 		srvs = append(srvs, srvToL(srv))
 	}
-	return lvs.Service{Host: server.Host, Port: server.Port, Type: server.Type, Scheduler: server.Scheduler, Persistence: server.Persistence, Netmask: server.Netmask, Servers: srvs}
+	return lvs.Service{Host: lvsHost(server.Host), Port: server.Port, Type: server.Type, Scheduler: server.Scheduler, Persistence: server.Persistence, Netmask: server.Netmask, Servers: srvs}
 }
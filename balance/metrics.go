@@ -0,0 +1,96 @@
+package balance
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/metrics"
+)
+
+var (
+	// kernel stats are cached briefly, as each metric is collected separately
+	stats     []Stat
+	statsTime time.Time
+	statsLock = &sync.Mutex{}
+)
+
+type (
+	// Stat holds the counters for a service (Server is blank) or one of its
+	// servers
+	Stat struct {
+		Service  string
+		Server   string
+		Conns    float64
+		InPkts   float64
+		OutPkts  float64
+		InBytes  float64
+		OutBytes float64
+	}
+
+	// statser is implemented by balancers able to report traffic counters
+	statser interface {
+		Stats() ([]Stat, error)
+	}
+)
+
+func init() {
+	counters := []struct {
+		name  string
+		help  string
+		value func(Stat) float64
+	}{
+		{"connections", "Connections scheduled", func(s Stat) float64 { return s.Conns }},
+		{"packets_in", "Incoming packets", func(s Stat) float64 { return s.InPkts }},
+		{"packets_out", "Outgoing packets", func(s Stat) float64 { return s.OutPkts }},
+		{"bytes_in", "Incoming bytes", func(s Stat) float64 { return s.InBytes }},
+		{"bytes_out", "Outgoing bytes", func(s Stat) float64 { return s.OutBytes }},
+	}
+
+	for i := range counters {
+		value := counters[i].value
+		metrics.NewCounterFunc("portal_ipvs_service_"+counters[i].name+"_total", counters[i].help+" by the service.",
+			[]string{"service"}, func() []metrics.Sample {
+				samples := []metrics.Sample{}
+				for _, stat := range Stats() {
+					if stat.Server == "" {
+						samples = append(samples, metrics.Sample{Labels: []string{stat.Service}, Value: value(stat)})
+					}
+				}
+				return samples
+			})
+		metrics.NewCounterFunc("portal_ipvs_server_"+counters[i].name+"_total", counters[i].help+" by the server.",
+			[]string{"service", "server"}, func() []metrics.Sample {
+				samples := []metrics.Sample{}
+				for _, stat := range Stats() {
+					if stat.Server != "" {
+						samples = append(samples, metrics.Sample{Labels: []string{stat.Service, stat.Server}, Value: value(stat)})
+					}
+				}
+				return samples
+			})
+	}
+}
+
+// Stats returns the traffic counters for the balanced services and servers.
+// Balancers unable to report them (nginx) return none.
+func Stats() []Stat {
+	statser, ok := Balancer.(statser)
+	if !ok {
+		return nil
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if time.Since(statsTime) < time.Second {
+		return stats
+	}
+
+	s, err := statser.Stats()
+	if err != nil {
+		config.Log.Error("Failed to get balancer stats - %s", err)
+		return nil
+	}
+	stats, statsTime = s, time.Now()
+	return stats
+}
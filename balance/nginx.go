@@ -3,9 +3,11 @@ package balance
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"sync"
 	"text/template"
 
@@ -249,7 +251,7 @@ func (n *Nginx) regenerloadConfig() error {
 stream {
 {{- range . }}
 	upstream {{.Id }} {
-	{{- if (eq .Scheduler "lc") or (eq .Scheduler "wlc") or (eq .Scheduler "lblc") or (eq .Scheduler "lblcr") -}}
+	{{- if or (eq .Scheduler "lc") (eq .Scheduler "wlc") (eq .Scheduler "lblc") (eq .Scheduler "lblcr") -}}
 	least_con
 	{{- end -}}
 	{{if eq .Scheduler "sh" -}}
@@ -266,13 +268,13 @@ stream {
 	{{- end -}}
 	{{- with .Servers -}}
 		{{range .}}
-		server {{.Host}}:{{.Port}} {{if .Weight}}weight={{.Weight}}{{end}} {{- if .UpperThreshold}} max_conns={{.UpperThreshold}}{{end}};
+		server {{hostPort .Host .Port}} {{if .Weight}}weight={{.Weight}}{{end}} {{- if .UpperThreshold}} max_conns={{.UpperThreshold}}{{end}}{{if .Draining}} down{{end}};
 		{{- end -}}
 	{{end}}
 	}
 
 	server {
-		listen        {{.Host}}:{{.Port}}{{if ne .Type "tcp"}} udp{{end}};
+		listen        {{hostPort .Host .Port}}{{if ne .Type "tcp"}} udp{{end}};
 		proxy_pass    {{.Id}};
 		{{if ne .Persistence 0 -}}
 		proxy_timeout {{.Persistence}}s;
@@ -284,7 +286,7 @@ stream {
 `, n.originalConfig)
 
 	// create a new template and parse the config into it.
-	t := template.Must(template.New("nginxConfig").Parse(nginxConfig))
+	t := template.Must(template.New("nginxConfig").Funcs(template.FuncMap{"hostPort": hostPort}).Parse(nginxConfig))
 
 	cfgFile, err := os.Create(n.configFile)
 	defer cfgFile.Close()
@@ -308,3 +310,8 @@ stream {
 
 	return nil
 }
+
+// hostPort joins the host and port, bracketing ipv6 hosts ("[fd00::1]:80")
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -2,7 +2,10 @@ package balance_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os/exec"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/jcelliott/lumber"
@@ -295,6 +298,37 @@ func TestDeleteServerNginx(t *testing.T) {
 	}
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// IPV6
+////////////////////////////////////////////////////////////////////////////////
+func TestIpv6ConfigNginx(t *testing.T) {
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+	oldDir := config.WorkDir
+	config.WorkDir = t.TempDir()
+	defer func() { config.WorkDir = oldDir }()
+
+	cfgFile := path.Join(config.WorkDir, "portal-nginx.conf")
+	if err := ioutil.WriteFile(cfgFile, []byte("# primer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// reloading fails without nginx, the config is written first
+	n := &balance.Nginx{}
+	n.Init()
+	n.SetService(&core.Service{Id: "tcp-fd00..3-1234", Host: "fd00::3", Port: 1234, Type: "tcp",
+		Servers: []core.Server{{Id: "fd00..1-8080", Host: "fd00::1", Port: 8080, Weight: 1}}})
+
+	cfg, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"listen        [fd00::3]:1234;", "server [fd00::1]:8080 weight=1;"} {
+		if !strings.Contains(string(cfg), want) {
+			t.Errorf("Config missing '%s' - %s", want, cfg)
+		}
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
@@ -9,6 +9,7 @@ import (
 
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
 )
 
 var (
@@ -17,12 +18,25 @@ var (
 	NoServiceError = errors.New("No Service Found")
 	NoServerError  = errors.New("No Server Found")
 	BadJson        = errors.New("Bad JSON syntax received in body")
+	DegradedError  = errors.New("Cluster unreachable, not accepting changes")
 )
 
+// clusterConfig is the config ops are staged on, to check them before they're
+// applied (and what etcd stores)
+type clusterConfig struct {
+	core.Manifest
+	Webhooks []core.Webhook
+	Tokens   []core.Token
+}
+
 type Clusterable interface {
 	core.Backender
 	core.Proxyable
 	core.Vipable
+	// Batch applies the ops as one transaction, undoing them all on failure
+	Batch(ops []core.Op) error
+	// Notify sends the events to the subscribers of every member
+	Notify(events []core.Event) error
 }
 
 func Init() error {
@@ -34,6 +48,10 @@ func Init() error {
 	switch url.Scheme {
 	case "redis":
 		Clusterer = &Redis{}
+	case "raft":
+		Clusterer = &Raft{}
+	case "etcd":
+		Clusterer = &Etcd{}
 	case "none":
 		Clusterer = &None{}
 	default:
@@ -53,27 +71,57 @@ func GetService(id string) (*core.Service, error) {
 }
 
 func SetServices(services []core.Service) error {
-	return Clusterer.SetServices(services)
+	err := Clusterer.SetServices(services)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-services", Services: services})
+	return nil
 }
 
 func SetService(service *core.Service) error {
-	return Clusterer.SetService(service)
+	err := Clusterer.SetService(service)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-service", Service: service})
+	return nil
 }
 
 func DeleteService(id string) error {
-	return Clusterer.DeleteService(id)
+	err := Clusterer.DeleteService(id)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "delete-service", SvcId: id})
+	return nil
 }
 
 func SetServers(svcId string, servers []core.Server) error {
-	return Clusterer.SetServers(svcId, servers)
+	err := Clusterer.SetServers(svcId, servers)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-servers", SvcId: svcId, Servers: servers})
+	return nil
 }
 
 func SetServer(svcId string, server *core.Server) error {
-	return Clusterer.SetServer(svcId, server)
+	err := Clusterer.SetServer(svcId, server)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-server", SvcId: svcId, Server: server})
+	return nil
 }
 
 func DeleteServer(svcId, srvId string) error {
-	return Clusterer.DeleteServer(svcId, srvId)
+	err := Clusterer.DeleteServer(svcId, srvId)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "delete-server", SvcId: svcId, SrvId: srvId})
+	return nil
 }
 
 func GetServer(svcId, srvId string) (*core.Server, error) {
@@ -81,15 +129,30 @@ func GetServer(svcId, srvId string) (*core.Server, error) {
 }
 
 func SetRoutes(routes []core.Route) error {
-	return Clusterer.SetRoutes(routes)
+	err := Clusterer.SetRoutes(routes)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-routes", Routes: routes})
+	return nil
 }
 
 func SetRoute(route core.Route) error {
-	return Clusterer.SetRoute(route)
+	err := Clusterer.SetRoute(route)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-route", Route: &route})
+	return nil
 }
 
 func DeleteRoute(route core.Route) error {
-	return Clusterer.DeleteRoute(route)
+	err := Clusterer.DeleteRoute(route)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "delete-route", Route: &route})
+	return nil
 }
 
 func GetRoutes() ([]core.Route, error) {
@@ -97,15 +160,30 @@ func GetRoutes() ([]core.Route, error) {
 }
 
 func SetCerts(certs []core.CertBundle) error {
-	return Clusterer.SetCerts(certs)
+	err := Clusterer.SetCerts(certs)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-certs", Certs: certs})
+	return nil
 }
 
 func SetCert(cert core.CertBundle) error {
-	return Clusterer.SetCert(cert)
+	err := Clusterer.SetCert(cert)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-cert", Cert: &cert})
+	return nil
 }
 
 func DeleteCert(cert core.CertBundle) error {
-	return Clusterer.DeleteCert(cert)
+	err := Clusterer.DeleteCert(cert)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "delete-cert", Cert: &cert})
+	return nil
 }
 
 func GetCerts() ([]core.CertBundle, error) {
@@ -113,21 +191,77 @@ func GetCerts() ([]core.CertBundle, error) {
 }
 
 func SetVips(vips []core.Vip) error {
-	return Clusterer.SetVips(vips)
+	err := Clusterer.SetVips(vips)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-vips", Vips: vips})
+	return nil
 }
 
 func SetVip(vip core.Vip) error {
-	return Clusterer.SetVip(vip)
+	err := Clusterer.SetVip(vip)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "set-vip", Vip: &vip})
+	return nil
 }
 
 func DeleteVip(vip core.Vip) error {
-	return Clusterer.DeleteVip(vip)
+	err := Clusterer.DeleteVip(vip)
+	if err != nil {
+		return err
+	}
+	notify(core.Op{Action: "delete-vip", Vip: &vip})
+	return nil
 }
 
 func GetVips() ([]core.Vip, error) {
 	return Clusterer.GetVips()
 }
 
+func Batch(ops []core.Op) error {
+	err := Clusterer.Batch(ops)
+	if err != nil {
+		return err
+	}
+	notify(ops...)
+	return nil
+}
+
+// SetWebhook saves the webhook on every member, so any of them can post the
+// changes made through it. It isn't sent as an event (it has the secret).
+func SetWebhook(hook core.Webhook) error {
+	return Clusterer.Batch([]core.Op{{Action: "set-webhook", Webhook: &hook}})
+}
+
+// DeleteWebhook removes the webhook from every member
+func DeleteWebhook(id string) error {
+	return Clusterer.Batch([]core.Op{{Action: "delete-webhook", HookId: id}})
+}
+
+// SetToken saves the named token on every member, so it's accepted by any of
+// them. It isn't sent as an event.
+func SetToken(token core.Token) error {
+	return Clusterer.Batch([]core.Op{{Action: "set-token", Token: &token}})
+}
+
+// DeleteToken removes the named token from every member
+func DeleteToken(name string) error {
+	return Clusterer.Batch([]core.Op{{Action: "delete-token", TokenName: name}})
+}
+
+// Apply makes the changes to the services, servers, routes, certs, and vips
+// that differ from the manifest, in a single batch
+func Apply(manifest core.Manifest, changes []core.Change) error {
+	current, err := common.GetManifest()
+	if err != nil {
+		return err
+	}
+	return Batch(common.ChangeOps(*current, manifest, changes))
+}
+
 func marshalSvc(service []byte) (*core.Service, error) {
 	var svc core.Service
 
@@ -210,3 +344,187 @@ func parseBody(body []byte, v interface{}) error {
 	}
 	return nil
 }
+
+// stageOps stages the ops on the manifest, failing if any can't be applied to
+// it
+func stageOps(manifest core.Manifest, ops []core.Op) error {
+	staged := clusterConfig{Manifest: manifest}
+	for i := range ops {
+		if err := stageOp(&staged, ops[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageOp applies the op to the config, the way each member's subsystems
+// apply it
+func stageOp(manifest *clusterConfig, op core.Op) error {
+	switch op.Action {
+	case "set-services":
+		manifest.Services = op.Services
+	case "set-service":
+		if op.Service == nil {
+			return fmt.Errorf("%s - missing service", op.Action)
+		}
+		if i := serviceIndex(manifest.Services, op.Service.Id); i != -1 {
+			manifest.Services[i] = *op.Service
+		} else {
+			manifest.Services = append(manifest.Services, *op.Service)
+		}
+	case "delete-service":
+		if i := serviceIndex(manifest.Services, op.SvcId); i != -1 {
+			manifest.Services = append(manifest.Services[:i], manifest.Services[i+1:]...)
+		}
+	case "set-servers", "set-server", "delete-server":
+		if op.Action == "set-server" && op.Server == nil {
+			return fmt.Errorf("%s - missing server", op.Action)
+		}
+		i := serviceIndex(manifest.Services, op.SvcId)
+		if i == -1 {
+			if op.Action == "delete-server" {
+				return nil
+			}
+			return NoServiceError
+		}
+		service := &manifest.Services[i]
+		if op.Action == "set-servers" {
+			service.Servers = op.Servers
+			return nil
+		}
+		servers := []core.Server{}
+		set := op.Action == "set-server"
+		for _, srv := range service.Servers {
+			switch {
+			case set && srv.Id == op.Server.Id:
+				// if server already exists, update it rather than duplicate it
+				srv, set = *op.Server, false
+			case op.Action == "delete-server" && srv.Id == op.SrvId:
+				continue
+			}
+			servers = append(servers, srv)
+		}
+		if set {
+			servers = append(servers, *op.Server)
+		}
+		service.Servers = servers
+	case "set-routes":
+		manifest.Routes = op.Routes
+	case "set-route", "delete-route":
+		if op.Route == nil {
+			return fmt.Errorf("%s - missing route", op.Action)
+		}
+		routes := []core.Route{}
+		set := op.Action == "set-route"
+		for _, route := range manifest.Routes {
+			if route.SubDomain == op.Route.SubDomain && route.Domain == op.Route.Domain && route.Path == op.Route.Path {
+				if !set {
+					continue
+				}
+				route, set = *op.Route, false
+			}
+			routes = append(routes, route)
+		}
+		if set {
+			routes = append(routes, *op.Route)
+		}
+		manifest.Routes = routes
+	case "set-certs":
+		manifest.Certs = op.Certs
+	case "set-cert", "delete-cert":
+		if op.Cert == nil {
+			return fmt.Errorf("%s - missing cert", op.Action)
+		}
+		certs := []core.CertBundle{}
+		set := op.Action == "set-cert"
+		for _, cert := range manifest.Certs {
+			switch {
+			case set && cert.Same(*op.Cert):
+				cert, set = *op.Cert, false
+			case op.Action == "delete-cert" && cert.Cert == op.Cert.Cert && cert.Key == op.Cert.Key:
+				continue
+			}
+			certs = append(certs, cert)
+		}
+		if set {
+			certs = append(certs, *op.Cert)
+		}
+		manifest.Certs = certs
+	case "set-vips":
+		manifest.Vips = op.Vips
+	case "set-vip", "delete-vip":
+		if op.Vip == nil {
+			return fmt.Errorf("%s - missing vip", op.Action)
+		}
+		vips := []core.Vip{}
+		set := op.Action == "set-vip"
+		for _, vip := range manifest.Vips {
+			if vip.Ip == op.Vip.Ip && vip.Interface == op.Vip.Interface {
+				if !set {
+					continue
+				}
+				vip, set = *op.Vip, false
+			}
+			vips = append(vips, vip)
+		}
+		if set {
+			vips = append(vips, *op.Vip)
+		}
+		manifest.Vips = vips
+	case "set-webhooks":
+		manifest.Webhooks = op.Webhooks
+	case "set-webhook", "delete-webhook":
+		if op.Action == "set-webhook" && op.Webhook == nil {
+			return fmt.Errorf("%s - missing webhook", op.Action)
+		}
+		hooks := []core.Webhook{}
+		set := op.Action == "set-webhook"
+		for _, hook := range manifest.Webhooks {
+			switch {
+			case set && hook.Id == op.Webhook.Id:
+				hook, set = *op.Webhook, false
+			case op.Action == "delete-webhook" && hook.Id == op.HookId:
+				continue
+			}
+			hooks = append(hooks, hook)
+		}
+		if set {
+			hooks = append(hooks, *op.Webhook)
+		}
+		manifest.Webhooks = hooks
+	case "set-tokens":
+		manifest.Tokens = op.Tokens
+	case "set-token", "delete-token":
+		if op.Action == "set-token" && op.Token == nil {
+			return fmt.Errorf("%s - missing token", op.Action)
+		}
+		tokens := []core.Token{}
+		set := op.Action == "set-token"
+		for _, token := range manifest.Tokens {
+			switch {
+			case set && token.Name == op.Token.Name:
+				token, set = *op.Token, false
+			case op.Action == "delete-token" && token.Name == op.TokenName:
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+		if set {
+			tokens = append(tokens, *op.Token)
+		}
+		manifest.Tokens = tokens
+	default:
+		return fmt.Errorf("%s - '%s'", common.BadAction, op.Action)
+	}
+	return nil
+}
+
+// serviceIndex returns the index of the service, or -1
+func serviceIndex(services []core.Service, id string) int {
+	for i := range services {
+		if services[i].Id == id {
+			return i
+		}
+	}
+	return -1
+}
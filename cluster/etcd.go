@@ -0,0 +1,861 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/vipmgr"
+)
+
+var (
+	// EtcdAckTimeout is how long members have to apply a change before it's
+	// rolled back
+	EtcdAckTimeout = 30 * time.Second
+)
+
+type (
+	// Etcd stores the services, routes, certs, and vips under a key prefix in
+	// etcd, which every member watches, applying changes as they're made.
+	// Members keep their keys alive with a lease, so they're gone once they stop.
+	// Without a central database to share them, webhooks and tokens are kept
+	// there too.
+	//   /portal/config/{services,routes,certs,vips} - json of each
+	//   /portal/config/{webhooks,tokens}            - json, without a central database
+	//   /portal/members/<member>                    - its status, under its lease
+	//   /portal/applied/<member>                    - last revision it applied
+	//   /portal/events                              - last events notified
+	//   /portal/vips/<ip>/owner                     - member owning it, under its lease
+	//   /portal/vips/<ip>/candidates/<member>       - its priority, under its lease
+	Etcd struct {
+		client *clientv3.Client
+		prefix string
+		lease  clientv3.LeaseID
+		rev    int64      // last revision applied
+		mu     sync.Mutex // held applying, one revision at a time
+		ctx    context.Context
+		stop   context.CancelFunc
+	}
+)
+
+func (e *Etcd) Init() error {
+	client, prefix, err := database.NewEtcdClient(config.ClusterConnection)
+	if err != nil {
+		return err
+	}
+	return e.Start(client, prefix)
+}
+
+// Start joins the cluster stored under prefix, seeding it with this member's
+// services, routes, and certs if it's the first
+func (e *Etcd) Start(client *clientv3.Client, prefix string) error {
+	setSelf()
+	// vips are added to the host once elected to own them
+	vipmgr.Owns = ownsVip
+	e.client = client
+	e.prefix = prefix
+
+	err := e.seed()
+	if err != nil {
+		return err
+	}
+	err = e.sync()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.ctx, e.stop = ctx, cancel
+
+	// membership
+	resp, err := e.client.Grant(ctx, int64(ttl))
+	if err != nil {
+		cancel()
+		return fmt.Errorf("Failed to get etcd lease - %s", err)
+	}
+	e.lease = resp.ID
+	err = e.ack()
+	if err != nil {
+		cancel()
+		return err
+	}
+	alive, err := e.client.KeepAlive(ctx, e.lease)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("Failed to keep etcd lease alive - %s", err)
+	}
+
+	config.Log.Info("[cluster] - Etcd watching %s...", e.prefix)
+	go e.keepAlive(ctx, alive)
+	go e.watch(ctx)
+	go electVips(ctx, e)
+
+	return nil
+}
+
+// Stop leaves the cluster, revoking the member's lease (and with it, the vips
+// it owns)
+func (e *Etcd) Stop() {
+	e.stop()
+	releaseVips()
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	e.client.Revoke(ctx, e.lease)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SERVICES
+////////////////////////////////////////////////////////////////////////////////
+
+func (e *Etcd) SetServices(services []core.Service) error {
+	return e.commit(core.Op{Action: "set-services", Services: services})
+}
+
+func (e *Etcd) SetService(service *core.Service) error {
+	return e.commit(core.Op{Action: "set-service", Service: service})
+}
+
+func (e *Etcd) DeleteService(id string) error {
+	return e.commit(core.Op{Action: "delete-service", SvcId: id})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SERVERS
+////////////////////////////////////////////////////////////////////////////////
+
+func (e *Etcd) SetServers(svcId string, servers []core.Server) error {
+	return e.commit(core.Op{Action: "set-servers", SvcId: svcId, Servers: servers})
+}
+
+func (e *Etcd) SetServer(svcId string, server *core.Server) error {
+	return e.commit(core.Op{Action: "set-server", SvcId: svcId, Server: server})
+}
+
+func (e *Etcd) DeleteServer(svcId, srvId string) error {
+	return e.commit(core.Op{Action: "delete-server", SvcId: svcId, SrvId: srvId})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ROUTES
+////////////////////////////////////////////////////////////////////////////////
+
+func (e *Etcd) SetRoutes(routes []core.Route) error {
+	return e.commit(core.Op{Action: "set-routes", Routes: routes})
+}
+
+func (e *Etcd) SetRoute(route core.Route) error {
+	return e.commit(core.Op{Action: "set-route", Route: &route})
+}
+
+func (e *Etcd) DeleteRoute(route core.Route) error {
+	return e.commit(core.Op{Action: "delete-route", Route: &route})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CERTS
+////////////////////////////////////////////////////////////////////////////////
+
+func (e *Etcd) SetCerts(certs []core.CertBundle) error {
+	return e.commit(core.Op{Action: "set-certs", Certs: certs})
+}
+
+func (e *Etcd) SetCert(cert core.CertBundle) error {
+	return e.commit(core.Op{Action: "set-cert", Cert: &cert})
+}
+
+func (e *Etcd) DeleteCert(cert core.CertBundle) error {
+	return e.commit(core.Op{Action: "delete-cert", Cert: &cert})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VIPS
+////////////////////////////////////////////////////////////////////////////////
+
+func (e *Etcd) SetVips(vips []core.Vip) error {
+	return e.commit(core.Op{Action: "set-vips", Vips: vips})
+}
+
+func (e *Etcd) SetVip(vip core.Vip) error {
+	return e.commit(core.Op{Action: "set-vip", Vip: &vip})
+}
+
+func (e *Etcd) DeleteVip(vip core.Vip) error {
+	return e.commit(core.Op{Action: "delete-vip", Vip: &vip})
+}
+
+func (e *Etcd) GetVips() ([]core.Vip, error) {
+	return common.GetVips()
+}
+
+func (e *Etcd) candidate(vip core.Vip) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	key, priority := e.vipKey(vip, "candidates/"+self), strconv.Itoa(config.VipPriority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	// only put when changed, every put is watched
+	_, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", priority)).
+		Else(clientv3.OpPut(key, priority, clientv3.WithLease(e.lease))).
+		Commit()
+	return err
+}
+
+func (e *Etcd) vipState(vip core.Vip) (string, map[string]int, error) {
+	if isDegraded() {
+		return "", nil, DegradedError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	// only there while their member's lease is
+	resp, err := e.client.Txn(ctx).Then(
+		clientv3.OpGet(e.vipKey(vip, "owner")),
+		clientv3.OpGet(e.vipKey(vip, "candidates/"), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return "", nil, err
+	}
+
+	owner := ""
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) != 0 {
+		owner = string(kvs[0].Value)
+	}
+	candidates := map[string]int{}
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		candidates[strings.TrimPrefix(string(kv.Key), e.vipKey(vip, "candidates/"))], _ = strconv.Atoi(string(kv.Value))
+	}
+	return owner, candidates, nil
+}
+
+func (e *Etcd) claimVip(vip core.Vip, from string) (bool, error) {
+	key := e.vipKey(vip, "owner")
+	cmp := clientv3.Compare(clientv3.Value(key), "=", from)
+	if from == "" {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	resp, err := e.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, self, clientv3.WithLease(e.lease))).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (e *Etcd) resignVip(vip core.Vip) error {
+	key := e.vipKey(vip, "owner")
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	_, err := e.client.Txn(ctx).If(clientv3.Compare(clientv3.Value(key), "=", self)).
+		Then(clientv3.OpDelete(key)).Commit()
+	if err != nil {
+		return err
+	}
+	_, err = e.client.Delete(ctx, e.vipKey(vip, "candidates/"+self))
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// BATCH
+////////////////////////////////////////////////////////////////////////////////
+
+// Batch commits the ops to etcd in one transaction
+func (e *Etcd) Batch(ops []core.Op) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	storedOps, clusterOps := []core.Op{}, []core.Op{}
+	for i := range ops {
+		if database.CentralStore && (strings.Contains(ops[i].Action, "webhook") || strings.Contains(ops[i].Action, "token")) {
+			storedOps = append(storedOps, ops[i])
+		} else {
+			clusterOps = append(clusterOps, ops[i])
+		}
+	}
+
+	// webhooks and tokens are only shared through the central database, when
+	// there's one
+	if len(storedOps) != 0 {
+		err := common.StoreBatch(storedOps)
+		if err != nil {
+			return err
+		}
+	}
+	if len(clusterOps) == 0 {
+		return nil
+	}
+	return e.commit(clusterOps...)
+}
+
+// Notify puts the events in etcd for every member (myself included) to send to
+// its subscribers
+func (e *Etcd) Notify(events []core.Event) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return BadJson
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	_, err = e.client.Put(ctx, e.prefix+"/events", string(b), clientv3.WithLease(e.lease))
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// MEMBERS
+////////////////////////////////////////////////////////////////////////////////
+
+// Members returns the status of the members in etcd, as of the last revision
+// they applied
+func (e *Etcd) Members() ([]MemberStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	resp, err := e.client.Get(ctx, e.prefix+"/members/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get members from etcd - %s", err)
+	}
+
+	members := make([]MemberStatus, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		member := MemberStatus{}
+		json.Unmarshal(kv.Value, &member)
+		// only there while its lease is
+		member.Id, member.Alive = strings.TrimPrefix(string(kv.Key), e.prefix+"/members/"), true
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// Resync reapplies what's in etcd
+func (e *Etcd) Resync() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.sync()
+	if err != nil {
+		return err
+	}
+	return e.ack()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// GETS
+////////////////////////////////////////////////////////////////////////////////
+
+// GetService - this member has applied everything in etcd (as of the last
+// change watched)
+func (e *Etcd) GetService(id string) (*core.Service, error) {
+	return common.GetService(id)
+}
+
+func (e *Etcd) GetServices() ([]core.Service, error) {
+	return common.GetServices()
+}
+
+func (e *Etcd) GetServer(svcId, srvId string) (*core.Server, error) {
+	return common.GetServer(svcId, srvId)
+}
+
+func (e *Etcd) GetRoutes() ([]core.Route, error) {
+	return common.GetRoutes()
+}
+
+func (e *Etcd) GetCerts() ([]core.CertBundle, error) {
+	return common.GetCerts()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE
+////////////////////////////////////////////////////////////////////////////////
+
+// commit stages the ops on what's in etcd and puts the result, retrying if
+// another member changed it meanwhile. Once every member has applied it, it's
+// saved to the central database, otherwise it's rolled back.
+func (e *Etcd) commit(ops ...core.Op) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+		resp, err := e.client.Get(ctx, e.prefix+"/config/", clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Failed to get config from etcd - %s", err)
+		}
+
+		// what's there now, and when it was last changed
+		old := map[string]string{}
+		modRevs := map[string]int64{}
+		for _, kv := range resp.Kvs {
+			section := strings.TrimPrefix(string(kv.Key), e.prefix+"/config/")
+			old[section] = string(kv.Value)
+			modRevs[section] = kv.ModRevision
+		}
+		manifest, err := parseEtcdConfig(old)
+		if err != nil {
+			return err
+		}
+
+		for i := range ops {
+			err = stageOp(manifest, ops[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		// only put what changed
+		changed := map[string]string{}
+		for section, v := range manifest.sections() {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return BadJson
+			}
+			if old[section] != string(b) {
+				changed[section] = string(b)
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+
+		cmps, puts := []clientv3.Cmp{}, []clientv3.Op{}
+		for section, v := range changed {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(e.key("config", section)), "=", modRevs[section]))
+			puts = append(puts, clientv3.OpPut(e.key("config", section), v))
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), database.EtcdTimeout)
+		tresp, err := e.client.Txn(ctx).If(cmps...).Then(puts...).Commit()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Failed to put config to etcd - %s", err)
+		}
+		if !tresp.Succeeded {
+			config.Log.Debug("[cluster] - Config changed meanwhile, retrying...")
+			continue
+		}
+
+		// ensure all members applied it
+		err = e.waitForMembers(tresp.Header.Revision)
+		if err != nil {
+			// attempt rollback - no need to waitForMembers here. Only while it's
+			// still this commit's, so a later change isn't undone.
+			cmps, undos := []clientv3.Cmp{}, []clientv3.Op{}
+			for section := range changed {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(e.key("config", section)), "=", tresp.Header.Revision))
+				if v, ok := old[section]; ok {
+					undos = append(undos, clientv3.OpPut(e.key("config", section), v))
+				} else {
+					undos = append(undos, clientv3.OpDelete(e.key("config", section)))
+				}
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), database.EtcdTimeout)
+			uresp, uerr := e.client.Txn(ctx).If(cmps...).Then(undos...).Commit()
+			cancel()
+			switch {
+			case uerr != nil:
+				err = fmt.Errorf("%s - %s", err, uerr)
+			case !uresp.Succeeded:
+				err = fmt.Errorf("%s - not rolled back, it's been changed since", err)
+			}
+			return err
+		}
+
+		if database.CentralStore {
+			return common.StoreBatch(ops)
+		}
+		return nil
+	}
+}
+
+// seed puts this member's services, routes, certs, and vips (and webhooks and
+// tokens, without a central database) in etcd, unless another member already
+// has
+func (e *Etcd) seed() error {
+	services, err := common.GetServices()
+	if err != nil {
+		return fmt.Errorf("Failed to get services - %s", err)
+	}
+	routes, err := common.GetRoutes()
+	if err != nil {
+		return fmt.Errorf("Failed to get routes - %s", err)
+	}
+	certs, err := common.GetCerts()
+	if err != nil {
+		return fmt.Errorf("Failed to get certs - %s", err)
+	}
+	vips, err := common.GetVips()
+	if err != nil {
+		return fmt.Errorf("Failed to get vips - %s", err)
+	}
+	seed := clusterConfig{Manifest: core.Manifest{Services: services, Routes: routes, Certs: certs, Vips: vips}}
+	if !database.CentralStore {
+		seed.Webhooks, err = database.GetWebhooks()
+		if err != nil {
+			return fmt.Errorf("Failed to get webhooks - %s", err)
+		}
+		seed.Tokens, err = database.GetTokens()
+		if err != nil {
+			return fmt.Errorf("Failed to get tokens - %s", err)
+		}
+	}
+
+	cmps, puts := []clientv3.Cmp{}, []clientv3.Op{}
+	for section, v := range seed.sections() {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return BadJson
+		}
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(e.key("config", section)), "=", 0))
+		puts = append(puts, clientv3.OpPut(e.key("config", section), string(b)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	resp, err := e.client.Txn(ctx).If(cmps...).Then(puts...).Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to seed etcd - %s", err)
+	}
+	if resp.Succeeded {
+		config.Log.Info("[cluster] - Seeded etcd with my config")
+	}
+	return nil
+}
+
+// sync applies everything in etcd
+func (e *Etcd) sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	resp, err := e.client.Get(ctx, e.prefix+"/config/", clientv3.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("Failed to get config from etcd - %s", err)
+	}
+
+	ops := []core.Op{}
+	for _, kv := range resp.Kvs {
+		op, err := e.configOp(kv)
+		if err != nil {
+			return err
+		}
+		if op != nil {
+			ops = append(ops, *op)
+		}
+	}
+	if len(ops) != 0 {
+		config.Log.Trace("[cluster] - Setting config from etcd...")
+		err = common.Batch(ops)
+		if err != nil {
+			return fmt.Errorf("Failed to set config - %s", err)
+		}
+	}
+
+	e.rev = resp.Header.Revision
+	return nil
+}
+
+// watch applies changes to the config, and sends events to this member's
+// subscribers, until stopped
+func (e *Etcd) watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		e.mu.Lock()
+		rev := e.rev
+		e.mu.Unlock()
+
+		wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		changes := e.client.Watch(wctx, e.prefix+"/", clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range changes {
+			if resp.CompactRevision != 0 {
+				// missed changes, start over from what's there now
+				config.Log.Warn("[cluster] - Etcd compacted past revision %d, resyncing...", rev)
+				if err := e.Resync(); err != nil {
+					config.Log.Error("[cluster] - Failed to resync - %s", err)
+				}
+				break
+			}
+			if err := resp.Err(); err != nil {
+				config.Log.Error("[cluster] - Etcd watch failed - %s", err)
+				break
+			}
+			e.apply(resp)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// apply applies the watched changes to the config (in one transaction), and
+// sends events to this member's subscribers
+func (e *Etcd) apply(resp clientv3.WatchResponse) {
+	sections := map[string]core.Op{}
+	for _, ev := range resp.Events {
+		if ev.Type != clientv3.EventTypePut {
+			continue
+		}
+		switch {
+		case string(ev.Kv.Key) == e.prefix+"/events":
+			var events []core.Event
+			err := json.Unmarshal(ev.Kv.Value, &events)
+			if err != nil {
+				config.Log.Error("[cluster] - Failed to unmarshal events - %s", err)
+				continue
+			}
+			broadcast(events)
+		case strings.HasPrefix(string(ev.Kv.Key), e.prefix+"/config/"):
+			op, err := e.configOp(ev.Kv)
+			if err != nil {
+				config.Log.Error("[cluster] - %s", err)
+				continue
+			}
+			// the last change to a section is all that matters
+			if op != nil {
+				sections[op.Action] = *op
+			}
+		}
+	}
+	if len(sections) == 0 {
+		// only acks or events, don't ack
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// in the order members apply a batch
+	ops := []core.Op{}
+	for _, action := range []string{"set-services", "set-routes", "set-certs", "set-vips", "set-webhooks", "set-tokens"} {
+		if op, ok := sections[action]; ok {
+			ops = append(ops, op)
+		}
+	}
+	config.Log.Trace("[cluster] - Applying revision %d...", resp.Header.Revision)
+	err := common.Batch(ops)
+	if err != nil {
+		// not acking fails the change, it's rolled back
+		config.Log.Error("[cluster] - Failed to apply revision %d - %s", resp.Header.Revision, err)
+		return
+	}
+
+	e.rev = resp.Header.Revision
+	if err = e.ack(); err != nil {
+		config.Log.Error("[cluster] - %s", err)
+	}
+}
+
+// ack records the last revision this member applied, and its status
+func (e *Etcd) ack() error {
+	status, err := status()
+	if err != nil {
+		return fmt.Errorf("Failed to get my status - %s", err)
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+	_, err = e.client.Txn(ctx).Then(
+		clientv3.OpPut(e.key("members", self), string(b), clientv3.WithLease(e.lease)),
+		clientv3.OpPut(e.key("applied", self), strconv.FormatInt(e.rev, 10), clientv3.WithLease(e.lease)),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to ack revision %d - %s", e.rev, err)
+	}
+	return nil
+}
+
+// keepAlive keeps the member's lease alive. Once it's lost, the others no
+// longer wait for me to apply changes, so i fail like a redis member does.
+func (e *Etcd) keepAlive(ctx context.Context, alive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range alive {
+		config.Log.Trace("[cluster] - Heartbeat...")
+	}
+	if ctx.Err() != nil {
+		// stopped
+		return
+	}
+	lost("Lost etcd lease", e.rejoin)
+}
+
+// rejoin gets me a new lease, reapplying what's in etcd before acking under it
+func (e *Etcd) rejoin() error {
+	ctx, cancel := context.WithTimeout(e.ctx, database.EtcdTimeout)
+	resp, err := e.client.Grant(ctx, int64(ttl))
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Failed to get etcd lease - %s", err)
+	}
+
+	e.mu.Lock()
+	e.lease = resp.ID
+	err = e.sync()
+	if err == nil {
+		err = e.ack()
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	alive, err := e.client.KeepAlive(e.ctx, resp.ID)
+	if err != nil {
+		return fmt.Errorf("Failed to keep etcd lease alive - %s", err)
+	}
+	go e.keepAlive(e.ctx, alive)
+	return nil
+}
+
+// waitForMembers waits for all members to apply the revision
+func (e *Etcd) waitForMembers(rev int64) error {
+	config.Log.Trace("[cluster] - Waiting for members to apply revision %d", rev)
+
+	start := time.Now()
+	observe := func(result string) {
+		ackDuration.Observe(time.Since(start).Seconds(), result)
+	}
+
+	// members are polled every 500ms, for up to EtcdAckTimeout
+	timeout := time.After(EtcdAckTimeout)
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	var list []string
+	for {
+		members, err := e.members(rev)
+		if err != nil {
+			observe("error")
+			return err
+		}
+		list = members
+		if len(list) == 0 {
+			// if all members applied it, all is well
+			observe("ok")
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		// if members don't apply it in time, return error
+		case <-timeout:
+			observe("timeout")
+			return fmt.Errorf("Member(s) '%s' failed to apply revision %d", list, rev)
+		}
+	}
+}
+
+// members returns the members that haven't applied the revision yet
+func (e *Etcd) members(rev int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.EtcdTimeout)
+	defer cancel()
+
+	resp, err := e.client.Txn(ctx).Then(
+		clientv3.OpGet(e.prefix+"/members/", clientv3.WithPrefix(), clientv3.WithKeysOnly()),
+		clientv3.OpGet(e.prefix+"/applied/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get members from etcd - %s", err)
+	}
+
+	applied := map[string]int64{}
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		applied[strings.TrimPrefix(string(kv.Key), e.prefix+"/applied/")], _ = strconv.ParseInt(string(kv.Value), 10, 64)
+	}
+	behind := []string{}
+	for _, kv := range resp.Responses[0].GetResponseRange().Kvs {
+		member := strings.TrimPrefix(string(kv.Key), e.prefix+"/members/")
+		if applied[member] < rev {
+			behind = append(behind, member)
+		}
+	}
+	return behind, nil
+}
+
+// configOp returns the op setting the config section stored in kv
+func (e *Etcd) configOp(kv *mvccpb.KeyValue) (*core.Op, error) {
+	section := strings.TrimPrefix(string(kv.Key), e.prefix+"/config/")
+	manifest, err := parseEtcdConfig(map[string]string{section: string(kv.Value)})
+	if err != nil {
+		return nil, err
+	}
+	switch section {
+	case "services":
+		return &core.Op{Action: "set-services", Services: manifest.Services}, nil
+	case "routes":
+		return &core.Op{Action: "set-routes", Routes: manifest.Routes}, nil
+	case "certs":
+		return &core.Op{Action: "set-certs", Certs: manifest.Certs}, nil
+	case "vips":
+		return &core.Op{Action: "set-vips", Vips: manifest.Vips}, nil
+	case "webhooks":
+		return &core.Op{Action: "set-webhooks", Webhooks: manifest.Webhooks}, nil
+	case "tokens":
+		return &core.Op{Action: "set-tokens", Tokens: manifest.Tokens}, nil
+	}
+	return nil, nil
+}
+
+func (e *Etcd) key(kind, id string) string {
+	return fmt.Sprintf("%s/%s/%s", e.prefix, kind, id)
+}
+
+// vipKey is the key of the vip's owner, or its candidates
+func (e *Etcd) vipKey(vip core.Vip, rest string) string {
+	return fmt.Sprintf("%s/vips/%s/%s", e.prefix, url.PathEscape(vip.Ip), rest)
+}
+
+// parseEtcdConfig decodes the config sections stored in etcd. Missing sections
+// are empty.
+func parseEtcdConfig(sections map[string]string) (*clusterConfig, error) {
+	manifest := &clusterConfig{Manifest: core.Manifest{Services: []core.Service{}, Routes: []core.Route{}, Certs: []core.CertBundle{}, Vips: []core.Vip{}}, Webhooks: []core.Webhook{}, Tokens: []core.Token{}}
+	for section, v := range sections {
+		var err error
+		switch section {
+		case "services":
+			err = json.Unmarshal([]byte(v), &manifest.Services)
+		case "routes":
+			err = json.Unmarshal([]byte(v), &manifest.Routes)
+		case "certs":
+			err = json.Unmarshal([]byte(v), &manifest.Certs)
+		case "vips":
+			err = json.Unmarshal([]byte(v), &manifest.Vips)
+		case "webhooks":
+			err = json.Unmarshal([]byte(v), &manifest.Webhooks)
+		case "tokens":
+			err = json.Unmarshal([]byte(v), &manifest.Tokens)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in etcd - %s", err)
+		}
+	}
+	return manifest, nil
+}
+
+// sections returns the config sections to store in etcd. Webhooks and tokens
+// are only stored there without a central database.
+func (c clusterConfig) sections() map[string]interface{} {
+	sections := map[string]interface{}{"services": c.Services, "routes": c.Routes, "certs": c.Certs, "vips": c.Vips}
+	if !database.CentralStore {
+		sections["webhooks"], sections["tokens"] = c.Webhooks, c.Tokens
+	}
+	return sections
+}
@@ -0,0 +1,482 @@
+//go:build etcd
+// +build etcd
+
+// the etcd tests start an embedded etcd - go test -tags etcd ./cluster/
+
+package cluster_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/proxymgr"
+	"github.com/nanopack/portal/vipmgr"
+)
+
+var etcdOnce sync.Once
+
+////////////////////////////////////////////////////////////////////////////////
+// ETCD
+////////////////////////////////////////////////////////////////////////////////
+func TestEtcdReplicate(t *testing.T) {
+	client := newEtcdClient(t)
+	etcdSubsystems(t)
+
+	// the first member seeds etcd with what it has
+	if err := common.SetRoutes([]core.Route{testRoute}); err != nil {
+		t.Fatal(err)
+	}
+	member := startEtcdMember(t, client)
+	if routes := etcdRoutes(t, client); len(routes) != 1 || routes[0].Domain != testRoute.Domain {
+		t.Fatalf("Expected etcd to be seeded with my routes, got %v", routes)
+	}
+
+	// applied here when it returns
+	route := core.Route{SubDomain: "admin", Domain: "portal.test", Page: "admin\n"}
+	if err := member.SetRoute(route); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	if routes, _ := common.GetRoutes(); len(routes) != 2 {
+		t.Errorf("Expected route to be applied before returning, got %v", routes)
+	}
+	if routes := etcdRoutes(t, client); len(routes) != 2 {
+		t.Errorf("Expected route to be put in etcd, got %v", routes)
+	}
+
+	// as if made through another member
+	_, err := client.Put(context.Background(), "/portalTest/config/routes", `[{"domain":"other.test","page":"other\n"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the change to be applied", func() bool {
+		routes, _ := common.GetRoutes()
+		return len(routes) == 1 && routes[0].Domain == "other.test"
+	})
+
+	// a batch is one change
+	err = member.Batch([]core.Op{
+		{Action: "set-service", Service: &testService1},
+		{Action: "set-server", SvcId: testService1.Id, Server: &testServer1},
+		{Action: "delete-route", Route: &core.Route{Domain: "other.test"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to batch - %s", err)
+	}
+	if svc, err := common.GetService(testService1.Id); err != nil || len(svc.Servers) != 1 {
+		t.Errorf("Failed to apply batch - %v %s", svc, err)
+	}
+	if routes, _ := common.GetRoutes(); len(routes) != 0 {
+		t.Errorf("Failed to apply batch - %v", routes)
+	}
+
+	// a failed op fails the batch
+	err = member.Batch([]core.Op{
+		{Action: "delete-service", SvcId: testService1.Id},
+		{Action: "set-server", SvcId: "not-a-service", Server: &testServer1},
+	})
+	if err != cluster.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+	if _, err = common.GetService(testService1.Id); err != nil {
+		t.Errorf("Expected failed batch not to be applied - %s", err)
+	}
+}
+
+func TestEtcdMembers(t *testing.T) {
+	client := newEtcdClient(t)
+	member := startEtcdMember(t, client)
+
+	members, err := member.Members()
+	if err != nil || len(members) != 1 || !members[0].Alive || len(members[0].Hashes) != 4 {
+		t.Errorf("Expected myself as the only member - %v %v", members, err)
+	}
+
+	// another member, that never applies anything
+	lease, err := client.Grant(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Put(context.Background(), "/portalTest/members/other:8443", "alive", clientv3.WithLease(lease.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.EtcdAckTimeout = time.Second
+	defer func() { cluster.EtcdAckTimeout = 30 * time.Second }()
+	err = member.SetRoute(testRoute)
+	if err == nil || !strings.Contains(err.Error(), "other:8443") {
+		t.Fatalf("Expected the other member to fail to apply it, got %v", err)
+	}
+	// rolled back
+	if routes := etcdRoutes(t, client); len(routes) != 0 {
+		t.Errorf("Expected change to be rolled back, got %v", routes)
+	}
+	eventually(t, "the rollback to be applied", func() bool {
+		routes, _ := common.GetRoutes()
+		return len(routes) == 0
+	})
+
+	// unless it's been changed since
+	done := make(chan error)
+	go func() { done <- member.SetRoute(testRoute) }()
+	eventually(t, "the change to be put", func() bool {
+		routes := etcdRoutes(t, client)
+		return len(routes) == 1 && routes[0].Domain == testRoute.Domain
+	})
+	_, err = client.Put(context.Background(), "/portalTest/config/routes", `[{"domain":"other.test","page":"other\n"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err == nil || !strings.Contains(err.Error(), "not rolled back") {
+		t.Errorf("Expected the change not to be rolled back, got %v", err)
+	}
+	if routes := etcdRoutes(t, client); len(routes) != 1 || routes[0].Domain != "other.test" {
+		t.Errorf("Expected the later change to be kept, got %v", routes)
+	}
+
+	// once it's gone, it's not waited for
+	_, err = client.Revoke(context.Background(), lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = member.SetRoute(testRoute); err != nil {
+		t.Errorf("Failed to set route - %s", err)
+	}
+
+	// nor are we, once stopped
+	member.Stop()
+	resp, err := client.Get(context.Background(), "/portalTest/members/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || resp.Count != 0 {
+		t.Errorf("Expected member to be gone once stopped - %v %s", resp, err)
+	}
+}
+
+func TestEtcdVips(t *testing.T) {
+	client := newEtcdClient(t)
+	member := startEtcdMember(t, client)
+
+	vip := core.Vip{Ip: "192.168.0.101", Interface: "eth0", Alias: "eth0:2"}
+	if err := member.SetVip(vip); err != nil {
+		t.Fatalf("Failed to set vip - %s", err)
+	}
+	if vips, _ := common.GetVips(); len(vips) != 1 || vips[0].Ip != vip.Ip {
+		t.Errorf("Expected vip to be applied before returning, got %v", vips)
+	}
+
+	// as if made through another member
+	_, err := client.Put(context.Background(), "/portalTest/config/vips", `[]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the vip to be deleted", func() bool {
+		vips, _ := common.GetVips()
+		return len(vips) == 0
+	})
+}
+
+func TestEtcdWebhooks(t *testing.T) {
+	client := newEtcdClient(t)
+	member := startEtcdMember(t, client)
+	defer common.Batch([]core.Op{{Action: "set-webhooks", Webhooks: []core.Webhook{}}})
+
+	// kept in etcd, without a central database
+	hook := core.Webhook{Id: "abc123", Url: "http://127.0.0.1:8080/hook"}
+	if err := member.Batch([]core.Op{{Action: "set-webhook", Webhook: &hook}}); err != nil {
+		t.Fatalf("Failed to set webhook - %s", err)
+	}
+	if hooks, _ := database.GetWebhooks(); len(hooks) != 1 || hooks[0].Url != hook.Url {
+		t.Errorf("Expected webhook to be applied before returning, got %v", hooks)
+	}
+	resp, err := client.Get(context.Background(), "/portalTest/config/webhooks")
+	if err != nil || len(resp.Kvs) != 1 || !strings.Contains(string(resp.Kvs[0].Value), hook.Url) {
+		t.Errorf("Expected webhook to be put in etcd - %v %v", resp, err)
+	}
+
+	// as if made through another member
+	_, err = client.Put(context.Background(), "/portalTest/config/webhooks", `[]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the webhook to be deleted", func() bool {
+		hooks, _ := database.GetWebhooks()
+		return len(hooks) == 0
+	})
+}
+
+func TestEtcdTokens(t *testing.T) {
+	client := newEtcdClient(t)
+	member := startEtcdMember(t, client)
+	defer common.Batch([]core.Op{{Action: "set-tokens", Tokens: []core.Token{}}})
+
+	// kept in etcd, without a central database
+	token := core.Token{Name: "ci", Hash: "abc123", Scopes: []string{"read-only"}}
+	if err := member.Batch([]core.Op{{Action: "set-token", Token: &token}}); err != nil {
+		t.Fatalf("Failed to set token - %s", err)
+	}
+	if tokens, _ := database.GetTokens(); len(tokens) != 1 || tokens[0].Hash != token.Hash {
+		t.Errorf("Expected token to be applied before returning, got %v", tokens)
+	}
+	if err := member.Batch([]core.Op{{Action: "delete-token", TokenName: token.Name}}); err != nil {
+		t.Fatalf("Failed to delete token - %s", err)
+	}
+	resp, err := client.Get(context.Background(), "/portalTest/config/tokens")
+	if err != nil || len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "[]" {
+		t.Errorf("Expected token to be deleted from etcd - %v %v", resp, err)
+	}
+	if tokens, _ := database.GetTokens(); len(tokens) != 0 {
+		t.Errorf("Expected token to be deleted, got %v", tokens)
+	}
+}
+
+func TestEtcdLostLease(t *testing.T) {
+	client := newEtcdClient(t)
+	member := startEtcdMember(t, client)
+	config.ClusterDegraded = true
+	defer func() { config.ClusterDegraded = false }()
+
+	lease := func() int64 {
+		resp, err := client.Get(context.Background(), "/portalTest/members/", clientv3.WithPrefix())
+		if err != nil || len(resp.Kvs) != 1 {
+			return 0
+		}
+		return resp.Kvs[0].Lease
+	}
+	old := lease()
+	if old == 0 {
+		t.Fatalf("Expected to be a member")
+	}
+
+	// as if it expired
+	if _, err := client.Revoke(context.Background(), clientv3.LeaseID(old)); err != nil {
+		t.Fatal(err)
+	}
+	// noticed on the next keepalive (a third of its ttl)
+	for i := 0; ; i++ {
+		if now := lease(); now != 0 && now != old {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("Timed out waiting for the member to rejoin")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	eventually(t, "changes to be accepted again", func() bool {
+		return member.SetRoute(testRoute) == nil
+	})
+}
+
+func TestEtcdNotify(t *testing.T) {
+	member := startEtcdMember(t, newEtcdClient(t))
+
+	events, unsubscribe := cluster.Subscribe()
+	defer unsubscribe()
+
+	err := member.Notify([]core.Event{{Op: core.Op{Action: "set-route", Route: &testRoute}, Member: "a"}})
+	if err != nil {
+		t.Fatalf("Failed to notify - %s", err)
+	}
+	select {
+	case event := <-events:
+		if event.Action != "set-route" || event.Member != "a" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected event")
+	}
+}
+
+func TestEtcdVipFailover(t *testing.T) {
+	client := newEtcdClient(t)
+	etcdSubsystems(t)
+	host := &vipRecorder{bound: map[string]bool{}}
+	vipmgr.Vip = host
+	cluster.VipInterval, config.VipPriority = 50*time.Millisecond, 10
+	defer func() { cluster.VipInterval, config.VipPriority = time.Second, 0 }()
+
+	vip := core.Vip{Ip: "192.168.0.100", Interface: "eth0", Alias: "eth0:1"}
+	if err := database.SetVips([]core.Vip{vip}); err != nil {
+		t.Fatal(err)
+	}
+	defer database.SetVips([]core.Vip{})
+	owner := "/portalTest/vips/" + url.PathEscape(vip.Ip) + "/owner"
+
+	// another member owns it, with a higher priority
+	other := otherVipMember(t, client, vip, 50)
+	member := startEtcdMember(t, client)
+	time.Sleep(5 * cluster.VipInterval)
+	if host.has(vip.Ip) {
+		t.Fatalf("Expected vip to be left to its owner")
+	}
+
+	// its heartbeat expires
+	if _, err := client.Revoke(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the vip to fail over", func() bool { return host.has(vip.Ip) })
+	resp, err := client.Get(context.Background(), owner)
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("Expected to own the vip - %v %s", resp, err)
+	}
+
+	// it's back, with a lower priority, and took it
+	otherVipMember(t, client, vip, 5)
+	eventually(t, "the vip to be released", func() bool { return !host.has(vip.Ip) })
+
+	// not taken back without preempt
+	time.Sleep(5 * cluster.VipInterval)
+	if host.has(vip.Ip) {
+		t.Fatalf("Expected vip to be left to its owner")
+	}
+	vip.Preempt = true
+	if err = member.SetVips([]core.Vip{vip}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the vip to be preempted", func() bool { return host.has(vip.Ip) })
+
+	// changing preempt doesn't re-add it
+	adds := host.added()
+	vip.Preempt = false
+	if err = member.SetVips([]core.Vip{vip}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * cluster.VipInterval)
+	if !host.has(vip.Ip) || host.added() != adds {
+		t.Errorf("Expected vip to stay added - %d adds, was %d", host.added(), adds)
+	}
+}
+
+// otherVipMember registers another member owning the vip, returning its lease
+func otherVipMember(t *testing.T, client *clientv3.Client, vip core.Vip, priority int) clientv3.LeaseID {
+	lease, err := client.Grant(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "/portalTest/vips/" + url.PathEscape(vip.Ip)
+	_, err = client.Put(context.Background(), key+"/candidates/other:8443", strconv.Itoa(priority), clientv3.WithLease(lease.ID))
+	if err == nil {
+		_, err = client.Put(context.Background(), key+"/owner", "other:8443", clientv3.WithLease(lease.ID))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Revoke(context.Background(), lease.ID) })
+	return lease.ID
+}
+
+// etcdSubsystems inits the database and subsystems members apply changes to
+func etcdSubsystems(t *testing.T) {
+	etcdOnce.Do(func() {
+		config.DatabaseConnection = "scribble:///tmp/clusterTest/etcd"
+		if err := database.Init(); err != nil {
+			t.Fatalf("Failed to init database - %s", err)
+		}
+		balance.Balancer = &database.ScribbleDatabase{}
+		if err := balance.Balancer.Init(); err != nil {
+			t.Fatalf("Failed to init balancer - %s", err)
+		}
+		if err := proxymgr.Init(); err != nil {
+			t.Fatalf("Failed to init proxymgr - %s", err)
+		}
+		vipmgr.Vip = &vipRecorder{bound: map[string]bool{}}
+	})
+}
+
+// startEtcdMember starts a member with the subsystems (and database) emptied,
+// stopping it when the test is done
+func startEtcdMember(t *testing.T, client *clientv3.Client) *cluster.Etcd {
+	etcdSubsystems(t)
+
+	member := &cluster.Etcd{}
+	if err := member.Start(client, "/portalTest"); err != nil {
+		t.Fatalf("Failed to start member - %s", err)
+	}
+	t.Cleanup(func() {
+		member.Stop()
+		common.SetServices([]core.Service{})
+		common.SetRoutes([]core.Route{})
+		common.SetVips([]core.Vip{})
+	})
+	return member
+}
+
+// etcdRoutes returns the routes in etcd
+func etcdRoutes(t *testing.T, client *clientv3.Client) []core.Route {
+	resp, err := client.Get(context.Background(), "/portalTest/config/routes")
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("Failed to get routes from etcd - %s", err)
+	}
+	routes := []core.Route{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &routes); err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+// newEtcdClient starts an embedded etcd for the test, returning a client of it
+func newEtcdClient(t *testing.T) *clientv3.Client {
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{newEtcd(t)}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to connect to etcd - %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newEtcd starts an embedded etcd for the test, returning its client address
+func newEtcd(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "etcdTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	client, peer := freeUrl(t), freeUrl(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start etcd - %s", err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		os.RemoveAll(dir)
+	})
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Etcd took too long to start")
+	}
+	return client.Host
+}
+
+func freeUrl(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+var (
+	// EventBuffer is how many events a subscriber may fall behind before
+	// events are dropped for it
+	EventBuffer = 100
+
+	subscribers = map[chan core.Event]bool{}
+	subLock     sync.Mutex
+)
+
+// Subscribe returns a channel of the changes made through any member, and a
+// func to stop receiving them
+func Subscribe() (<-chan core.Event, func()) {
+	events := make(chan core.Event, EventBuffer)
+
+	subLock.Lock()
+	subscribers[events] = true
+	subLock.Unlock()
+
+	return events, func() {
+		subLock.Lock()
+		defer subLock.Unlock()
+		if subscribers[events] {
+			delete(subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// broadcast sends the events to this member's subscribers
+func broadcast(events []core.Event) {
+	subLock.Lock()
+	defer subLock.Unlock()
+
+	for sub := range subscribers {
+		for i := range events {
+			select {
+			case sub <- events[i]:
+			default:
+				config.Log.Warn("[cluster] - Subscriber fell behind, dropped '%s' event", events[i].Action)
+			}
+		}
+	}
+}
+
+// notify tells the subscribers of every member about the applied ops. Private
+// keys are never sent.
+func notify(ops ...core.Op) {
+	if len(ops) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	events := make([]core.Event, len(ops))
+	for i := range ops {
+		op := ops[i]
+		if op.Cert != nil {
+			op.Cert = &core.CertBundle{Cert: op.Cert.Cert}
+		}
+		if op.Certs != nil {
+			op.Certs = make([]core.CertBundle, len(ops[i].Certs))
+			for j := range ops[i].Certs {
+				op.Certs[j] = core.CertBundle{Cert: ops[i].Certs[j].Cert}
+			}
+		}
+		events[i] = core.Event{Op: op, Member: Member(), Time: now}
+	}
+
+	err := Clusterer.Notify(events)
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to notify members of changes - %s", err)
+		// let this member's subscribers know at least
+		broadcast(events)
+	}
+}
+
+// Member identifies this member - "hostname:apiport"
+func Member() string {
+	if self != "" {
+		return self
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+}
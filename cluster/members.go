@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+)
+
+var (
+	// Version is the version of portal members report (set on start)
+	Version = ""
+
+	// set while the cluster is unreachable, and until this member has rejoined
+	// (with config.ClusterDegraded) - changes are rejected in the meantime
+	degraded int32
+	// longest wait between attempts to rejoin
+	maxBackoff = 30 * time.Second
+
+	NotMembered = errors.New("Cluster doesn't report its members")
+)
+
+type (
+	// Membered clusters report their members' status, and can resync this
+	// member's config from the cluster's
+	Membered interface {
+		Members() ([]MemberStatus, error)
+		Resync() error
+	}
+
+	// MemberStatus is a member, as of its last report
+	MemberStatus struct {
+		Id        string            `json:"id"` // "portal1:8443"
+		Alive     bool              `json:"alive"`
+		Heartbeat time.Time         `json:"heartbeat"` // when it last reported
+		Version   string            `json:"version"`
+		Hashes    map[string]string `json:"hashes"` // of its services, routes, certs, and vips
+	}
+)
+
+// Members returns the status of every member
+func Members() ([]MemberStatus, error) {
+	m, ok := Clusterer.(Membered)
+	if !ok {
+		return nil, NotMembered
+	}
+	return m.Members()
+}
+
+// Resync replaces this member's config with the cluster's
+func Resync() error {
+	m, ok := Clusterer.(Membered)
+	if !ok {
+		return NotMembered
+	}
+	return m.Resync()
+}
+
+// setSelf sets who this member is to the others
+func setSelf() {
+	hostname, _ := os.Hostname()
+	self = fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+}
+
+// status is this member's status, to report
+func status() (*MemberStatus, error) {
+	manifest, err := common.GetManifest()
+	if err != nil {
+		return nil, err
+	}
+	return &MemberStatus{
+		Id:        self,
+		Alive:     true,
+		Heartbeat: time.Now().UTC(),
+		Version:   Version,
+		Hashes:    common.Hashes(*manifest),
+	}, nil
+}
+
+// lost handles this member losing touch with the cluster, which will assume
+// it's dead: it stops balancing and exits. With config.ClusterDegraded, it
+// keeps balancing what it has instead, rejecting changes until it's rejoined
+// the cluster (tried until it succeeds, the first time it's lost).
+func lost(msg string, rejoin func() error) {
+	config.Log.Error("[cluster] - %s", msg)
+	// the others take over my vips once my heartbeat (or lease) expires
+	releaseVips()
+	if !config.ClusterDegraded {
+		// clear balancer rules ("stop balancing if we are 'dead'")
+		balance.SetServices(make([]core.Service, 0, 0))
+		os.Exit(1)
+	}
+	if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+		config.Log.Info("[cluster] - Degraded, serving the last known config until the cluster is reachable...")
+		go reconnect(rejoin)
+	}
+}
+
+// reconnect rejoins the cluster, backing off between attempts
+func reconnect(rejoin func() error) {
+	wait := time.Second
+	for {
+		time.Sleep(wait)
+		err := rejoin()
+		if err == nil {
+			break
+		}
+		config.Log.Error("[cluster] - Failed to rejoin, retrying in %s - %s", wait, err)
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+	atomic.StoreInt32(&degraded, 0)
+	config.Log.Info("[cluster] - Rejoined, accepting changes again")
+}
+
+// isDegraded is whether changes should be rejected
+func isDegraded() bool {
+	return atomic.LoadInt32(&degraded) == 1
+}
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/core/common"
 	"github.com/nanopack/portal/database"
@@ -14,6 +15,25 @@ func (n None) UnInit() error {
 	return nil
 }
 func (n None) Init() error {
+	setSelf()
+
+	err := n.load()
+	if err != nil {
+		return err
+	}
+
+	// members sharing a central store apply each other's changes
+	if notifier, ok := database.Backend.(database.Notifier); ok {
+		err = notifier.Listen(n.changed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load applies what's in my database
+func (n None) load() error {
 	// load vips
 	vips, err := common.GetVips()
 	if err != nil {
@@ -72,7 +92,7 @@ func (n None) SetServices(services []core.Service) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetServices(services)
+		return common.Stored("set-services", database.SetServices(services))
 	}
 	return nil
 }
@@ -82,7 +102,7 @@ func (n None) SetService(service *core.Service) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetService(service)
+		return common.Stored("set-service", database.SetService(service))
 	}
 	return nil
 }
@@ -92,7 +112,7 @@ func (n None) DeleteService(id string) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.DeleteService(id)
+		return common.Stored("delete-service", database.DeleteService(id))
 	}
 	return nil
 }
@@ -102,7 +122,7 @@ func (n None) SetServers(svcId string, servers []core.Server) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetServers(svcId, servers)
+		return common.Stored("set-servers", database.SetServers(svcId, servers))
 	}
 	return nil
 }
@@ -112,7 +132,7 @@ func (n None) SetServer(svcId string, server *core.Server) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetServer(svcId, server)
+		return common.Stored("set-server", database.SetServer(svcId, server))
 	}
 	return nil
 }
@@ -122,7 +142,7 @@ func (n None) DeleteServer(svcId, srvId string) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.DeleteServer(svcId, srvId)
+		return common.Stored("delete-server", database.DeleteServer(svcId, srvId))
 	}
 	return nil
 }
@@ -135,7 +155,7 @@ func (n None) SetRoutes(routes []core.Route) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetRoutes(routes)
+		return common.Stored("set-routes", database.SetRoutes(routes))
 	}
 	return nil
 }
@@ -145,7 +165,7 @@ func (n None) SetRoute(route core.Route) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetRoute(route)
+		return common.Stored("set-route", database.SetRoute(route))
 	}
 	return nil
 }
@@ -155,7 +175,7 @@ func (n None) DeleteRoute(route core.Route) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.DeleteRoute(route)
+		return common.Stored("delete-route", database.DeleteRoute(route))
 	}
 	return nil
 }
@@ -168,7 +188,7 @@ func (n None) SetCerts(certs []core.CertBundle) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetCerts(certs)
+		return common.Stored("set-certs", database.SetCerts(certs))
 	}
 	return nil
 }
@@ -178,7 +198,7 @@ func (n None) SetCert(cert core.CertBundle) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetCert(cert)
+		return common.Stored("set-cert", database.SetCert(cert))
 	}
 	return nil
 }
@@ -188,7 +208,7 @@ func (n None) DeleteCert(cert core.CertBundle) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.DeleteCert(cert)
+		return common.Stored("delete-cert", database.DeleteCert(cert))
 	}
 	return nil
 }
@@ -201,7 +221,7 @@ func (n None) SetVips(vips []core.Vip) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetVips(vips)
+		return common.Stored("set-vips", database.SetVips(vips))
 	}
 	return nil
 }
@@ -211,7 +231,7 @@ func (n None) SetVip(vip core.Vip) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.SetVip(vip)
+		return common.Stored("set-vip", database.SetVip(vip))
 	}
 	return nil
 }
@@ -221,10 +241,88 @@ func (n None) DeleteVip(vip core.Vip) error {
 		return err
 	}
 	if database.CentralStore {
-		return database.DeleteVip(vip)
+		return common.Stored("delete-vip", database.DeleteVip(vip))
 	}
 	return nil
 }
 func (n None) GetVips() ([]core.Vip, error) {
 	return common.GetVips()
 }
+func (n None) Batch(ops []core.Op) error {
+	err := common.Batch(ops)
+	if err != nil {
+		return err
+	}
+	if database.CentralStore {
+		return common.StoreBatch(ops)
+	}
+	return nil
+}
+func (n None) Notify(events []core.Event) error {
+	broadcast(events)
+	return nil
+}
+
+// Members returns my status, the only member
+func (n None) Members() ([]MemberStatus, error) {
+	status, err := status()
+	if err != nil {
+		return nil, err
+	}
+	return []MemberStatus{*status}, nil
+}
+
+// Resync reapplies what's in my database
+func (n None) Resync() error {
+	return n.load()
+}
+
+// changed applies a change another member made to the central store
+func (n None) changed(change database.Change) {
+	var err error
+	switch change.Resource {
+	case "services":
+		if change.Id == "" {
+			var services []core.Service
+			services, err = database.GetServices()
+			if err == nil {
+				err = common.SetServices(services)
+			}
+			break
+		}
+		var service *core.Service
+		service, err = database.GetService(change.Id)
+		switch err {
+		case nil:
+			err = common.SetService(service)
+		case database.NoServiceError:
+			err = common.DeleteService(change.Id)
+		}
+	case "routes":
+		var routes []core.Route
+		routes, err = database.GetRoutes()
+		if err == nil {
+			err = common.SetRoutes(routes)
+		}
+	case "certs":
+		var certs []core.CertBundle
+		certs, err = database.GetCerts()
+		if err == nil {
+			err = common.SetCerts(certs)
+		}
+	case "vips":
+		var vips []core.Vip
+		vips, err = database.GetVips()
+		if err == nil {
+			err = common.SetVips(vips)
+		}
+	default:
+		// may have missed some
+		err = n.load()
+	}
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to apply %s change - %s", change.Resource, err)
+		return
+	}
+	config.Log.Debug("[cluster] - Applied %s change", change.Resource)
+}
@@ -0,0 +1,1807 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/vipmgr"
+)
+
+var (
+	// RaftHeartbeat is how often the leader sends the members new entries (or a
+	// heartbeat)
+	RaftHeartbeat = 250 * time.Millisecond
+	// RaftElection is how long a member waits to hear from the leader before
+	// trying to become it (randomly up to twice as long)
+	RaftElection = 2 * time.Second
+	// RaftTimeout is how long a change may take to be committed
+	RaftTimeout = 30 * time.Second
+	// RaftSnapshotAfter is how many applied entries are kept before the log is
+	// compacted to a snapshot of the state
+	RaftSnapshotAfter = 1000
+	// RaftRetry is how long a member waits to retry an entry it failed to apply
+	RaftRetry = 5 * time.Second
+	// RaftVipTimeout is how long a vip candidate stays alive without registering
+	// with the leader again
+	RaftVipTimeout = time.Duration(ttl) * time.Second
+
+	NoLeaderError     = errors.New("No raft leader")
+	NotLeaderError    = errors.New("Not the raft leader")
+	LostError         = errors.New("Change lost to a new raft leader, retry")
+	MemberChangeError = errors.New("Membership change in progress, retry")
+	LastMemberError   = errors.New("Can't remove the last member")
+	NoMemberError     = errors.New("No Member Found")
+	RaftTimeoutError  = errors.New("Timed out waiting for the change to commit")
+	NoClusterCa       = errors.New("Raft needs a cluster-ca, or an api-cert shared by the members, to verify them")
+	UnverifiedMember  = errors.New("Member's api cert doesn't match the api-cert")
+	BadVipAction      = errors.New("Unknown vip action")
+
+	// entries sent to a member at a time
+	raftBatch = 100
+)
+
+const (
+	stateFollower  = "follower"
+	stateCandidate = "candidate"
+	stateLeader    = "leader"
+)
+
+type (
+	// Raft replicates changes through a log kept by the members themselves
+	// (https://raft.github.io). Changes are sent to the leader, which appends
+	// them to its log and, once a majority of members have them, every member
+	// applies them in order.
+	Raft struct {
+		Id        string        // this member - "portal1:8443"
+		Dir       string        // where the state, log, and snapshot are saved
+		Transport RaftTransport // how the members talk, over their apis by default
+		// Apply applies the committed ops (common.Batch by default)
+		Apply func(ops []core.Op) error
+		// Manifest returns the applied state, to snapshot (common.GetManifest by default)
+		Manifest func() (*core.Manifest, error)
+		// Webhooks returns the applied webhooks, to snapshot (database.GetWebhooks by default)
+		Webhooks func() ([]core.Webhook, error)
+		// Tokens returns the applied tokens, to snapshot (database.GetTokens by default)
+		Tokens func() ([]core.Token, error)
+
+		mu       sync.Mutex
+		applying sync.Mutex // held while applying, so resyncing doesn't interleave
+		state    string
+		term     uint64
+		vote     string
+		leader   string
+		snapshot RaftSnapshot
+		log      []RaftEntry
+		commit   uint64
+		applied  uint64
+		heard    time.Time // when the leader was last heard from
+		deadline time.Time // when to start an election
+		next     map[string]uint64
+		match    map[string]uint64
+		sending  map[string]bool
+		waiting  map[uint64][]raftWaiter
+		applyCh  chan struct{}
+		stop     chan struct{}
+
+		// the leader's vip owners and candidates, by ip (not replicated, a new
+		// leader learns them as the members register)
+		vips     map[string]*raftVip
+		vipsMu   sync.Mutex
+		stopVips context.CancelFunc
+	}
+
+	// RaftTransport sends requests to other members
+	RaftTransport interface {
+		// Vote asks the member for its vote
+		Vote(member string, vote RaftVote) (*RaftVoteReply, error)
+		// Append sends the member entries (or a snapshot) to add to its log
+		Append(member string, app RaftAppend) (*RaftAppendReply, error)
+		// Propose asks the leader to commit the entry, returning its index
+		Propose(member string, entry RaftEntry) (uint64, error)
+		// Join asks the member to add id to the cluster
+		Join(member, id string) error
+		// Notify sends the events to the member's subscribers
+		Notify(member string, events []core.Event) error
+		// Status asks the member for its status
+		Status(member string) (*MemberStatus, error)
+		// Vip sends the leader a vip election request
+		Vip(member string, req RaftVipRequest) (*RaftVipReply, error)
+	}
+
+	// RaftEntry is a change in the log - ops to apply or a member to add or
+	// remove (an empty entry starts each leader's term)
+	RaftEntry struct {
+		Index uint64    `json:"index"`
+		Term  uint64    `json:"term"`
+		Ops   []core.Op `json:"ops,omitempty"`
+		Join  string    `json:"join,omitempty"`
+		Leave string    `json:"leave,omitempty"`
+	}
+
+	// RaftSnapshot replaces the log up to and including Index
+	RaftSnapshot struct {
+		Index    uint64         `json:"index"`
+		Term     uint64         `json:"term"`
+		Members  []string       `json:"members"`
+		Manifest core.Manifest  `json:"manifest"` // vips are nil in snapshots taken before vips were replicated
+		Webhooks []core.Webhook `json:"webhooks"` // nil in snapshots taken before webhooks were replicated
+		Tokens   []core.Token   `json:"tokens"`   // nil in snapshots taken before tokens were replicated
+	}
+
+	RaftVote struct {
+		Term      uint64 `json:"term"`
+		Candidate string `json:"candidate"`
+		LastIndex uint64 `json:"last_index"`
+		LastTerm  uint64 `json:"last_term"`
+	}
+
+	RaftVoteReply struct {
+		Term    uint64 `json:"term"`
+		Granted bool   `json:"granted"`
+	}
+
+	RaftAppend struct {
+		Term      uint64        `json:"term"`
+		Leader    string        `json:"leader"`
+		PrevIndex uint64        `json:"prev_index"`
+		PrevTerm  uint64        `json:"prev_term"`
+		Entries   []RaftEntry   `json:"entries,omitempty"`
+		Commit    uint64        `json:"commit"`
+		Snapshot  *RaftSnapshot `json:"snapshot,omitempty"` // sent when the leader no longer has the entries the member needs
+	}
+
+	RaftAppendReply struct {
+		Term      uint64 `json:"term"`
+		Success   bool   `json:"success"`
+		LastIndex uint64 `json:"last_index"` // the member's last entry, so the leader knows where to send from
+	}
+
+	RaftMember struct {
+		Member string `json:"member"` // "portal1:8443"
+		Leader bool   `json:"leader"`
+	}
+
+	// RaftVipRequest registers a member as a vip's candidate, or gets, claims,
+	// or resigns its ownership
+	RaftVipRequest struct {
+		Action   string   `json:"action"` // "candidate", "state", "claim", or "resign"
+		Member   string   `json:"member"`
+		Vip      core.Vip `json:"vip"`
+		Priority int      `json:"priority,omitempty"` // the candidate's
+		Owns     bool     `json:"owns,omitempty"`     // the candidate has it added, so a new leader keeps it the owner
+		From     string   `json:"from,omitempty"`     // the owner being claimed from
+	}
+
+	RaftVipReply struct {
+		Owner      string         `json:"owner"`
+		Candidates map[string]int `json:"candidates"`
+		Claimed    bool           `json:"claimed,omitempty"`
+	}
+
+	// raftVip is a vip's owner and alive candidates, as the leader knows them
+	raftVip struct {
+		owner      string
+		candidates map[string]raftCandidate
+	}
+
+	raftCandidate struct {
+		priority int
+		seen     time.Time // when it last registered
+	}
+
+	raftWaiter struct {
+		term uint64 // term the entry was appended in (0 for any)
+		done chan error
+	}
+
+	// raftState is what's saved besides the log and snapshot
+	raftState struct {
+		Term    uint64 `json:"term"`
+		Vote    string `json:"vote"`
+		Applied uint64 `json:"applied"`
+	}
+
+	// raftHttp sends requests to the members' apis
+	raftHttp struct {
+		client *http.Client
+	}
+)
+
+// NewRaft creates a member saving its log in dir and talking to the others
+// through transport
+func NewRaft(id, dir string, transport RaftTransport) *Raft {
+	r := &Raft{}
+	r.setup(id, dir, transport)
+	return r
+}
+
+func (r *Raft) setup(id, dir string, transport RaftTransport) {
+	r.Id = id
+	r.Dir = dir
+	r.Transport = transport
+	r.Apply = common.Batch
+	r.Manifest = common.GetManifest
+	r.Webhooks = database.GetWebhooks
+	r.Tokens = database.GetTokens
+}
+
+// Init starts this member - "raft://" bootstraps a new cluster, and
+// "raft://portal1:8443" joins the cluster portal1:8443 is a member of. Once
+// started, the member rejoins with its saved log.
+func (r *Raft) Init() error {
+	u, err := url.Parse(config.ClusterConnection)
+	if err != nil {
+		return fmt.Errorf("Failed to parse cluster connection - %s", err)
+	}
+	hostname, _ := os.Hostname()
+	self = fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+	// members' election timeouts need to differ
+	rand.Seed(time.Now().UnixNano())
+	transport, err := newRaftHttp()
+	if err != nil {
+		return err
+	}
+	r.setup(self, filepath.Join(config.WorkDir, "raft"), transport)
+	// vips are added to the host once elected to own them
+	vipmgr.Owns = ownsVip
+
+	// apply the saved state, the log resumes from the last entry applied
+	err = None{}.Init()
+	if err != nil {
+		return err
+	}
+
+	err = r.Start(u.Host)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.stopVips = cancel
+	r.mu.Unlock()
+	go electVips(ctx, r)
+
+	return nil
+}
+
+// Start loads the saved log and starts taking part in the cluster. Without a
+// saved log, the member bootstraps a cluster of itself, or if join is set,
+// asks join to add it to its cluster.
+func (r *Raft) Start(join string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := os.MkdirAll(r.Dir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create raft dir - %s", err)
+	}
+
+	joining := false
+	err = r.load()
+	switch {
+	case os.IsNotExist(err) && join == "":
+		config.Log.Info("[cluster] - Bootstrapping raft cluster...")
+		r.term = 1
+		if err = r.persist(); err != nil {
+			return fmt.Errorf("Failed to save raft state - %s", err)
+		}
+		if _, err = r.append(RaftEntry{Join: r.Id}); err != nil {
+			return fmt.Errorf("Failed to save raft log - %s", err)
+		}
+	case os.IsNotExist(err):
+		joining = true
+	case err != nil:
+		return fmt.Errorf("Failed to load raft log - %s", err)
+	}
+
+	// applied entries were committed
+	r.commit = r.applied
+	if r.snapshot.Index > r.commit {
+		r.commit = r.snapshot.Index
+	}
+	r.state = stateFollower
+	r.next = map[string]uint64{}
+	r.match = map[string]uint64{}
+	r.sending = map[string]bool{}
+	r.waiting = map[uint64][]raftWaiter{}
+	r.vips = map[string]*raftVip{}
+	r.applyCh = make(chan struct{}, 1)
+	r.stop = make(chan struct{})
+	r.resetDeadline()
+
+	go r.run()
+	go r.applier()
+	r.signal()
+	if joining {
+		go r.join(join)
+	}
+
+	config.Log.Info("[cluster] - Raft member %s started", r.Id)
+	return nil
+}
+
+// Stop stops taking part in the cluster
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopVips != nil {
+		r.stopVips()
+	}
+	r.state = stateFollower
+	r.leader = ""
+	close(r.stop)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// MEMBERS
+////////////////////////////////////////////////////////////////////////////////
+
+// RaftMembers lists the members, as this member knows them
+func (r *Raft) RaftMembers() []RaftMember {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, _ := r.config(r.lastIndex())
+	rtn := make([]RaftMember, len(members))
+	for i := range members {
+		rtn[i] = RaftMember{Member: members[i], Leader: members[i] == r.leader}
+	}
+	return rtn
+}
+
+// Members returns the status of every member, as each reports it now. Members
+// that can't be reached aren't alive.
+func (r *Raft) Members() ([]MemberStatus, error) {
+	r.mu.Lock()
+	ids, _ := r.config(r.lastIndex())
+	r.mu.Unlock()
+
+	members := make([]MemberStatus, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var status *MemberStatus
+			var err error
+			if ids[i] == r.Id {
+				status, err = r.HandleStatus()
+			} else {
+				status, err = r.Transport.Status(ids[i])
+			}
+			if err != nil {
+				config.Log.Debug("[cluster] - Failed to get %s's status - %s", ids[i], err)
+				members[i] = MemberStatus{Id: ids[i]}
+				return
+			}
+			members[i] = *status
+			members[i].Id = ids[i]
+		}(i)
+	}
+	wg.Wait()
+	return members, nil
+}
+
+// Resync replaces this member's config with the log's, reapplying the snapshot
+// and every entry applied since (config this member had before joining, or
+// bootstrapping, the cluster is dropped)
+func (r *Raft) Resync() error {
+	// no entries are applied meanwhile
+	r.applying.Lock()
+	defer r.applying.Unlock()
+
+	r.mu.Lock()
+	ops := r.snapshot.ops()
+	if r.applied > r.snapshot.Index {
+		for _, entry := range r.log[:r.applied-r.snapshot.Index] {
+			ops = append(ops, entry.Ops...)
+		}
+	}
+	r.mu.Unlock()
+
+	return r.Apply(ops)
+}
+
+// HandleStatus returns this member's status (to other members)
+func (r *Raft) HandleStatus() (*MemberStatus, error) {
+	manifest, err := r.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return &MemberStatus{
+		Id:        r.Id,
+		Alive:     true,
+		Heartbeat: time.Now().UTC(),
+		Version:   Version,
+		Hashes:    common.Hashes(*manifest),
+	}, nil
+}
+
+// AddMember adds a member to the cluster, returning once it's committed. The
+// member needs to be started (with no log) to commit it.
+func (r *Raft) AddMember(id string) error {
+	return r.Propose(RaftEntry{Join: id})
+}
+
+// RemoveMember removes a member from the cluster, returning once it's committed
+func (r *Raft) RemoveMember(id string) error {
+	return r.Propose(RaftEntry{Leave: id})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SERVICES
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) GetServices() ([]core.Service, error) {
+	return common.GetServices()
+}
+func (r *Raft) GetService(id string) (*core.Service, error) {
+	return common.GetService(id)
+}
+func (r *Raft) SetServices(services []core.Service) error {
+	return r.commitOps(core.Op{Action: "set-services", Services: services})
+}
+func (r *Raft) SetService(service *core.Service) error {
+	return r.commitOps(core.Op{Action: "set-service", Service: service})
+}
+func (r *Raft) DeleteService(id string) error {
+	return r.commitOps(core.Op{Action: "delete-service", SvcId: id})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SERVERS
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) SetServers(svcId string, servers []core.Server) error {
+	return r.commitOps(core.Op{Action: "set-servers", SvcId: svcId, Servers: servers})
+}
+func (r *Raft) SetServer(svcId string, server *core.Server) error {
+	return r.commitOps(core.Op{Action: "set-server", SvcId: svcId, Server: server})
+}
+func (r *Raft) DeleteServer(svcId, srvId string) error {
+	return r.commitOps(core.Op{Action: "delete-server", SvcId: svcId, SrvId: srvId})
+}
+func (r *Raft) GetServer(svcId, srvId string) (*core.Server, error) {
+	return common.GetServer(svcId, srvId)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ROUTES
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) SetRoutes(routes []core.Route) error {
+	return r.commitOps(core.Op{Action: "set-routes", Routes: routes})
+}
+func (r *Raft) SetRoute(route core.Route) error {
+	return r.commitOps(core.Op{Action: "set-route", Route: &route})
+}
+func (r *Raft) DeleteRoute(route core.Route) error {
+	return r.commitOps(core.Op{Action: "delete-route", Route: &route})
+}
+func (r *Raft) GetRoutes() ([]core.Route, error) {
+	return common.GetRoutes()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CERTS
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) SetCerts(certs []core.CertBundle) error {
+	return r.commitOps(core.Op{Action: "set-certs", Certs: certs})
+}
+func (r *Raft) SetCert(cert core.CertBundle) error {
+	return r.commitOps(core.Op{Action: "set-cert", Cert: &cert})
+}
+func (r *Raft) DeleteCert(cert core.CertBundle) error {
+	return r.commitOps(core.Op{Action: "delete-cert", Cert: &cert})
+}
+func (r *Raft) GetCerts() ([]core.CertBundle, error) {
+	return common.GetCerts()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VIPS
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) SetVips(vips []core.Vip) error {
+	return r.commitOps(core.Op{Action: "set-vips", Vips: vips})
+}
+func (r *Raft) SetVip(vip core.Vip) error {
+	return r.commitOps(core.Op{Action: "set-vip", Vip: &vip})
+}
+func (r *Raft) DeleteVip(vip core.Vip) error {
+	return r.commitOps(core.Op{Action: "delete-vip", Vip: &vip})
+}
+func (r *Raft) GetVips() ([]core.Vip, error) {
+	return common.GetVips()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VIP ELECTIONS
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *Raft) candidate(vip core.Vip) error {
+	_, err := r.vipRequest(RaftVipRequest{Action: "candidate", Vip: vip, Priority: config.VipPriority, Owns: ownsVip(vip)})
+	return err
+}
+
+func (r *Raft) vipState(vip core.Vip) (string, map[string]int, error) {
+	reply, err := r.vipRequest(RaftVipRequest{Action: "state", Vip: vip})
+	if err != nil {
+		return "", nil, err
+	}
+	return reply.Owner, reply.Candidates, nil
+}
+
+func (r *Raft) claimVip(vip core.Vip, from string) (bool, error) {
+	reply, err := r.vipRequest(RaftVipRequest{Action: "claim", Vip: vip, From: from})
+	if err != nil {
+		return false, err
+	}
+	return reply.Claimed, nil
+}
+
+func (r *Raft) resignVip(vip core.Vip) error {
+	_, err := r.vipRequest(RaftVipRequest{Action: "resign", Vip: vip})
+	return err
+}
+
+// vipRequest sends the request to the leader. Without one, who owns the vips
+// is unknown, so they're left as they are.
+func (r *Raft) vipRequest(req RaftVipRequest) (*RaftVipReply, error) {
+	req.Member = r.Id
+	r.mu.Lock()
+	leader := r.leader
+	r.mu.Unlock()
+
+	switch leader {
+	case "":
+		return nil, DegradedError
+	case r.Id:
+		return r.HandleVip(req)
+	}
+	return r.Transport.Vip(leader, req)
+}
+
+// HandleVip runs a member's vip election request on the leader. Candidates
+// that haven't registered within RaftVipTimeout, or are no longer members,
+// aren't alive, and neither is an owner that isn't a candidate. A candidate
+// that has the vip added becomes its owner if it has none, so electing a new
+// leader doesn't move the vips.
+func (r *Raft) HandleVip(req RaftVipRequest) (*RaftVipReply, error) {
+	r.mu.Lock()
+	leader := r.state == stateLeader
+	members, _ := r.config(r.lastIndex())
+	r.mu.Unlock()
+	if !leader {
+		return nil, NotLeaderError
+	}
+
+	r.vipsMu.Lock()
+	defer r.vipsMu.Unlock()
+	v, ok := r.vips[req.Vip.Ip]
+	if !ok {
+		v = &raftVip{candidates: map[string]raftCandidate{}}
+		r.vips[req.Vip.Ip] = v
+	}
+	for member, c := range v.candidates {
+		if time.Since(c.seen) > RaftVipTimeout || !contains(members, member) {
+			delete(v.candidates, member)
+		}
+	}
+	if _, ok := v.candidates[v.owner]; !ok {
+		v.owner = ""
+	}
+
+	reply := &RaftVipReply{}
+	switch req.Action {
+	case "candidate":
+		v.candidates[req.Member] = raftCandidate{priority: req.Priority, seen: time.Now()}
+		if req.Owns && v.owner == "" {
+			v.owner = req.Member
+		}
+	case "state":
+	case "claim":
+		if _, ok := v.candidates[req.Member]; ok && v.owner == req.From {
+			v.owner = req.Member
+			reply.Claimed = true
+		}
+	case "resign":
+		if v.owner == req.Member {
+			v.owner = ""
+		}
+		delete(v.candidates, req.Member)
+	default:
+		return nil, BadVipAction
+	}
+
+	reply.Owner = v.owner
+	reply.Candidates = map[string]int{}
+	for member, c := range v.candidates {
+		reply.Candidates[member] = c.priority
+	}
+	if len(v.candidates) == 0 {
+		delete(r.vips, req.Vip.Ip)
+	}
+	return reply, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// BATCH
+////////////////////////////////////////////////////////////////////////////////
+
+// Batch commits the ops as one entry
+func (r *Raft) Batch(ops []core.Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	return r.commitOps(ops...)
+}
+
+// Notify sends the events to this member's subscribers, and the other
+// members'. Members that can't be reached are logged and skipped.
+func (r *Raft) Notify(events []core.Event) error {
+	broadcast(events)
+
+	r.mu.Lock()
+	members, _ := r.config(r.lastIndex())
+	r.mu.Unlock()
+
+	for i := range members {
+		if members[i] == r.Id {
+			continue
+		}
+		go func(member string) {
+			err := r.Transport.Notify(member, events)
+			if err != nil {
+				config.Log.Warn("[cluster] - Failed to notify %s - %s", member, err)
+			}
+		}(members[i])
+	}
+	return nil
+}
+
+// HandleNotify sends events from another member to this member's subscribers
+func (r *Raft) HandleNotify(events []core.Event) {
+	broadcast(events)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PROPOSALS
+////////////////////////////////////////////////////////////////////////////////
+
+// commitOps commits the ops, returning once they've been applied here
+func (r *Raft) commitOps(ops ...core.Op) error {
+	err := r.Propose(RaftEntry{Ops: ops})
+	if err != nil {
+		return err
+	}
+	if database.CentralStore {
+		return common.StoreBatch(ops)
+	}
+	return nil
+}
+
+// Propose sends the entry to the leader to commit, returning once this member
+// has applied it (with the error applying it, if any)
+func (r *Raft) Propose(entry RaftEntry) error {
+	leader, err := r.waitLeader()
+	if err != nil {
+		return err
+	}
+	if leader == r.Id {
+		_, err = r.HandlePropose(entry)
+		return err
+	}
+
+	index, err := r.Transport.Propose(leader, entry)
+	if err != nil {
+		return err
+	}
+	return r.wait(index, 0)
+}
+
+// HandlePropose appends the entry to the leader's log, returning its index
+// once it's committed and applied. Ops that can't be applied to the leader's
+// state are rejected before they're appended.
+func (r *Raft) HandlePropose(entry RaftEntry) (uint64, error) {
+	if len(entry.Ops) != 0 {
+		manifest, err := r.Manifest()
+		if err != nil {
+			return 0, err
+		}
+		if err = stageOps(*manifest, entry.Ops); err != nil {
+			return 0, err
+		}
+	}
+
+	r.mu.Lock()
+	if r.state != stateLeader {
+		r.mu.Unlock()
+		return 0, NotLeaderError
+	}
+
+	if entry.Join != "" || entry.Leave != "" {
+		members, index := r.config(r.lastIndex())
+		// one change at a time, once this term's first entry is committed
+		if index > r.commit || r.termAt(r.commit) != r.term {
+			r.mu.Unlock()
+			return 0, MemberChangeError
+		}
+		switch {
+		case entry.Join != "" && contains(members, entry.Join):
+			r.mu.Unlock()
+			return 0, nil
+		case entry.Leave != "" && !contains(members, entry.Leave):
+			r.mu.Unlock()
+			return 0, NoMemberError
+		case entry.Leave != "" && len(members) == 1:
+			r.mu.Unlock()
+			return 0, LastMemberError
+		}
+	}
+
+	index, err := r.append(entry)
+	if err != nil {
+		r.mu.Unlock()
+		return 0, err
+	}
+	term := r.term
+	r.advance()
+	r.mu.Unlock()
+
+	r.replicate()
+	return index, r.wait(index, term)
+}
+
+// wait waits for the entry at index to be applied. If term is set, the entry
+// must be from that term.
+func (r *Raft) wait(index, term uint64) error {
+	if index == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	if r.applied >= index {
+		r.mu.Unlock()
+		return nil
+	}
+	done := make(chan error, 1)
+	r.waiting[index] = append(r.waiting[index], raftWaiter{term: term, done: done})
+	r.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(RaftTimeout):
+		return RaftTimeoutError
+	}
+}
+
+// waitLeader waits for a leader to be elected
+func (r *Raft) waitLeader() (string, error) {
+	for start := time.Now(); time.Since(start) < RaftTimeout; time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		leader := r.leader
+		r.mu.Unlock()
+		if leader != "" {
+			return leader, nil
+		}
+	}
+	return "", NoLeaderError
+}
+
+// join asks the member to add this member to its cluster, until it does
+func (r *Raft) join(member string) {
+	for {
+		config.Log.Info("[cluster] - Joining raft cluster through %s...", member)
+		err := r.Transport.Join(member, r.Id)
+		if err == nil {
+			config.Log.Info("[cluster] - Joined raft cluster")
+			return
+		}
+		config.Log.Error("[cluster] - Failed to join raft cluster - %s", err)
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(RaftElection):
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ELECTIONS
+////////////////////////////////////////////////////////////////////////////////
+
+// run sends heartbeats while leading, and starts an election when the leader
+// hasn't been heard from
+func (r *Raft) run() {
+	tick := time.NewTicker(RaftHeartbeat)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+		}
+
+		r.mu.Lock()
+		state := r.state
+		elect := state != stateLeader && time.Now().After(r.deadline) && r.isMember(r.Id)
+		r.mu.Unlock()
+
+		switch {
+		case state == stateLeader:
+			r.replicate()
+		case elect:
+			go r.elect()
+		}
+	}
+}
+
+// elect asks the members to make this member the leader
+func (r *Raft) elect() {
+	r.mu.Lock()
+	oldTerm, oldVote := r.term, r.vote
+	r.state = stateCandidate
+	r.term++
+	r.vote = r.Id
+	r.leader = ""
+	r.resetDeadline()
+	// only campaign once the vote for itself is saved
+	if r.persist() != nil {
+		r.state = stateFollower
+		r.term, r.vote = oldTerm, oldVote
+		r.mu.Unlock()
+		return
+	}
+
+	term := r.term
+	vote := RaftVote{Term: term, Candidate: r.Id, LastIndex: r.lastIndex(), LastTerm: r.termAt(r.lastIndex())}
+	members, _ := r.config(r.lastIndex())
+	config.Log.Debug("[cluster] - Starting raft election for term %d", term)
+
+	if len(members) == 1 {
+		r.lead()
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	granted := make(chan bool, len(members))
+	for i := range members {
+		if members[i] == r.Id {
+			continue
+		}
+		go func(member string) {
+			reply, err := r.Transport.Vote(member, vote)
+			if err != nil {
+				granted <- false
+				return
+			}
+			if reply.Term > term {
+				r.mu.Lock()
+				if reply.Term > r.term {
+					r.follow(reply.Term, "")
+				}
+				r.mu.Unlock()
+			}
+			granted <- reply.Granted
+		}(members[i])
+	}
+
+	votes := 1
+	for i := 1; i < len(members); i++ {
+		if !<-granted {
+			continue
+		}
+		votes++
+		if votes > len(members)/2 {
+			r.mu.Lock()
+			if r.state == stateCandidate && r.term == term {
+				r.lead()
+			}
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// lead makes this member the leader (locked)
+func (r *Raft) lead() {
+	config.Log.Info("[cluster] - Leading raft cluster for term %d", r.term)
+	r.state = stateLeader
+	r.leader = r.Id
+	r.next = map[string]uint64{}
+	r.match = map[string]uint64{}
+	members, _ := r.config(r.lastIndex())
+	for i := range members {
+		r.next[members[i]] = r.lastIndex() + 1
+	}
+	// learnt again as the members register, from the vips they own
+	r.vipsMu.Lock()
+	r.vips = map[string]*raftVip{}
+	r.vipsMu.Unlock()
+
+	// entries from earlier terms are committed along with one from this term
+	if _, err := r.append(RaftEntry{}); err != nil {
+		r.follow(r.term, "")
+		return
+	}
+	r.advance()
+	go r.replicate()
+}
+
+// follow makes this member a follower, in a newer term (locked)
+func (r *Raft) follow(term uint64, leader string) {
+	if r.state == stateLeader {
+		config.Log.Info("[cluster] - No longer leading raft cluster")
+	}
+	r.state = stateFollower
+	r.leader = leader
+	if term > r.term {
+		r.term = term
+		r.vote = ""
+		r.persist()
+	}
+}
+
+// HandleVote votes for the candidate, if it's the first to ask this term and
+// its log is at least as up to date
+func (r *Raft) HandleVote(vote RaftVote) RaftVoteReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// ignore (likely removed) members trying to replace a live leader
+	if r.state == stateLeader || (r.leader != "" && time.Since(r.heard) < RaftElection) {
+		return RaftVoteReply{Term: r.term}
+	}
+
+	if vote.Term > r.term {
+		r.follow(vote.Term, "")
+	}
+	reply := RaftVoteReply{Term: r.term}
+	if vote.Term < r.term || (r.vote != "" && r.vote != vote.Candidate) {
+		return reply
+	}
+	lastTerm := r.termAt(r.lastIndex())
+	if vote.LastTerm < lastTerm || (vote.LastTerm == lastTerm && vote.LastIndex < r.lastIndex()) {
+		return reply
+	}
+
+	// only grant the vote once it's saved
+	oldVote := r.vote
+	r.vote = vote.Candidate
+	if r.persist() != nil {
+		r.vote = oldVote
+		return reply
+	}
+	r.resetDeadline()
+	reply.Granted = true
+	return reply
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// REPLICATION
+////////////////////////////////////////////////////////////////////////////////
+
+// replicate sends each member the entries it's missing (or a heartbeat)
+func (r *Raft) replicate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != stateLeader {
+		return
+	}
+
+	members, _ := r.config(r.lastIndex())
+	for i := range members {
+		if members[i] == r.Id || r.sending[members[i]] {
+			continue
+		}
+		if r.next[members[i]] == 0 {
+			r.next[members[i]] = r.lastIndex() + 1
+		}
+		r.sending[members[i]] = true
+		go r.send(members[i], r.term)
+	}
+}
+
+// send sends the member the entries it's missing, or the snapshot if they've
+// been compacted
+func (r *Raft) send(member string, term uint64) {
+	r.mu.Lock()
+	if r.state != stateLeader || r.term != term {
+		r.sending[member] = false
+		r.mu.Unlock()
+		return
+	}
+	app := RaftAppend{Term: term, Leader: r.Id, Commit: r.commit}
+	next := r.next[member]
+	if next <= r.snapshot.Index {
+		snapshot := r.snapshot
+		app.Snapshot = &snapshot
+		next = snapshot.Index + 1
+	}
+	app.PrevIndex = next - 1
+	app.PrevTerm = r.termAt(next - 1)
+	app.Entries = r.entries(next, raftBatch)
+	r.mu.Unlock()
+
+	reply, err := r.Transport.Append(member, app)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sending[member] = false
+	if err != nil {
+		config.Log.Trace("[cluster] - Failed to reach %s - %s", member, err)
+		return
+	}
+	if reply.Term > r.term {
+		r.follow(reply.Term, "")
+		return
+	}
+	if r.state != stateLeader || r.term != term {
+		return
+	}
+
+	if reply.Success {
+		if match := app.PrevIndex + uint64(len(app.Entries)); match > r.match[member] {
+			r.match[member] = match
+		}
+		r.next[member] = r.match[member] + 1
+		r.advance()
+	} else {
+		// back up to what the member has
+		next = app.PrevIndex
+		if reply.LastIndex+1 < next {
+			next = reply.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.next[member] = next
+	}
+
+	// keep sending until the member is caught up
+	if r.next[member] <= r.lastIndex() {
+		r.sending[member] = true
+		go r.send(member, term)
+	}
+}
+
+// HandleAppend adds the leader's entries to the log, if it has the entry
+// before them
+func (r *Raft) HandleAppend(app RaftAppend) RaftAppendReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if app.Term < r.term {
+		return RaftAppendReply{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	if app.Term > r.term || r.state != stateFollower {
+		r.follow(app.Term, app.Leader)
+	}
+	r.leader = app.Leader
+	r.heard = time.Now()
+	r.resetDeadline()
+	reply := RaftAppendReply{Term: r.term}
+
+	if app.Snapshot != nil {
+		if r.install(*app.Snapshot) != nil {
+			reply.LastIndex = r.lastIndex()
+			return reply
+		}
+	}
+
+	if app.PrevIndex > r.lastIndex() {
+		reply.LastIndex = r.lastIndex()
+		return reply
+	}
+	if app.PrevIndex >= r.snapshot.Index && r.termAt(app.PrevIndex) != app.PrevTerm {
+		reply.LastIndex = app.PrevIndex - 1
+		return reply
+	}
+
+	// only acknowledge the entries once they're saved
+	old := r.log
+	if len(app.Entries) != 0 {
+		old = append([]RaftEntry{}, r.log...)
+	}
+	appended := []RaftEntry{}
+	dropped := false
+	for _, entry := range app.Entries {
+		if entry.Index <= r.snapshot.Index {
+			continue
+		}
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// conflicts with the leader, drop it and what follows
+			r.log = r.log[:entry.Index-r.snapshot.Index-1]
+			dropped = true
+		}
+		r.log = append(r.log, entry)
+		appended = append(appended, entry)
+	}
+	var err error
+	switch {
+	case dropped:
+		err = r.persistLog()
+	case len(appended) != 0:
+		err = r.persistEntries(appended)
+	}
+	if err != nil {
+		r.log = old
+		reply.LastIndex = r.lastIndex()
+		return reply
+	}
+
+	last := app.PrevIndex + uint64(len(app.Entries))
+	commit := app.Commit
+	if last < commit {
+		commit = last
+	}
+	if commit > r.commit {
+		r.commit = commit
+		r.signal()
+	}
+
+	reply.Success = true
+	reply.LastIndex = last
+	return reply
+}
+
+// install replaces the log up to the snapshot, keeping the old log if the
+// snapshot can't be saved (locked)
+func (r *Raft) install(snapshot RaftSnapshot) error {
+	if snapshot.Index <= r.snapshot.Index {
+		return nil
+	}
+	oldSnapshot, oldLog, oldCommit := r.snapshot, r.log, r.commit
+	if snapshot.Index <= r.lastIndex() && r.termAt(snapshot.Index) == snapshot.Term {
+		// keep the entries after it
+		r.log = append([]RaftEntry{}, r.log[snapshot.Index-r.snapshot.Index:]...)
+	} else {
+		r.log = nil
+	}
+	r.snapshot = snapshot
+	if snapshot.Index > r.commit {
+		r.commit = snapshot.Index
+	}
+	if err := r.persistSnapshot(); err != nil {
+		r.snapshot, r.log, r.commit = oldSnapshot, oldLog, oldCommit
+		return err
+	}
+	r.signal()
+	return nil
+}
+
+// advance commits the entries a majority of members have (locked)
+func (r *Raft) advance() {
+	members, index := r.config(r.lastIndex())
+	for n := r.lastIndex(); n > r.commit && n > r.snapshot.Index; n-- {
+		// earlier terms' entries are committed along with this term's
+		if r.termAt(n) != r.term {
+			break
+		}
+		count := 0
+		for i := range members {
+			if members[i] == r.Id || r.match[members[i]] >= n {
+				count++
+			}
+		}
+		if count > len(members)/2 {
+			r.commit = n
+			r.signal()
+			break
+		}
+	}
+
+	// a removed leader steps down once its removal is committed
+	if index <= r.commit && !contains(members, r.Id) {
+		r.follow(r.term, "")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// APPLYING
+////////////////////////////////////////////////////////////////////////////////
+
+// applier applies committed entries in order
+func (r *Raft) applier() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.applyCh:
+		}
+		for {
+			r.applying.Lock()
+			more := r.applyNext()
+			r.applying.Unlock()
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// applyNext applies the next committed entry (or the snapshot, if behind it),
+// returning whether there was one
+func (r *Raft) applyNext() bool {
+	r.mu.Lock()
+	if r.applied < r.snapshot.Index {
+		snapshot := r.snapshot
+		r.mu.Unlock()
+
+		config.Log.Info("[cluster] - Restoring raft snapshot at %d", snapshot.Index)
+		err := r.Apply(snapshot.ops())
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to restore raft snapshot, retrying in %s - %s", RaftRetry, err)
+			return r.halt(snapshot.Index, snapshot.Term, err)
+		}
+
+		r.mu.Lock()
+		r.applied = snapshot.Index
+		r.persist()
+		r.release(snapshot.Index, snapshot.Term, nil)
+		r.mu.Unlock()
+		return true
+	}
+	if r.applied >= r.commit {
+		r.mu.Unlock()
+		return false
+	}
+	entry := r.log[r.applied-r.snapshot.Index]
+	compact := entry.Index-r.snapshot.Index >= uint64(RaftSnapshotAfter)
+	r.mu.Unlock()
+
+	// ops that can't be applied to the state (accepted by an earlier leader,
+	// or before an earlier entry was applied) are rejected by every member
+	// alike, as they've all applied the same entries
+	var rejected error
+	if len(entry.Ops) != 0 {
+		manifest, err := r.Manifest()
+		if err == nil {
+			rejected = stageOps(*manifest, entry.Ops)
+		}
+		if err == nil && rejected == nil {
+			err = r.Apply(entry.Ops)
+		}
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to apply raft entry %d, retrying in %s - %s", entry.Index, RaftRetry, err)
+			return r.halt(entry.Index, entry.Term, err)
+		}
+		if rejected != nil {
+			config.Log.Warn("[cluster] - Rejected raft entry %d - %s", entry.Index, rejected)
+		}
+	}
+
+	// the state as of this entry
+	var manifest *core.Manifest
+	var hooks []core.Webhook
+	var tokens []core.Token
+	if compact {
+		var merr error
+		manifest, merr = r.Manifest()
+		if merr == nil {
+			hooks, merr = r.Webhooks()
+		}
+		if merr == nil {
+			tokens, merr = r.Tokens()
+		}
+		if merr != nil {
+			config.Log.Error("[cluster] - Failed to snapshot raft log - %s", merr)
+			manifest = nil
+		}
+		if hooks == nil {
+			hooks = []core.Webhook{}
+		}
+		if tokens == nil {
+			tokens = []core.Token{}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = entry.Index
+
+	if manifest != nil && entry.Index > r.snapshot.Index {
+		members, _ := r.config(entry.Index)
+		if manifest.Vips == nil {
+			manifest.Vips = []core.Vip{}
+		}
+		oldSnapshot, oldLog := r.snapshot, r.log
+		r.log = append([]RaftEntry{}, r.log[entry.Index-r.snapshot.Index:]...)
+		r.snapshot = RaftSnapshot{Index: entry.Index, Term: entry.Term, Members: members, Manifest: *manifest, Webhooks: hooks, Tokens: tokens}
+		if r.persistSnapshot() != nil {
+			// compacted next time
+			r.snapshot, r.log = oldSnapshot, oldLog
+		}
+	}
+	// saved before those waiting are told
+	r.persist()
+	r.release(entry.Index, entry.Term, rejected)
+	return true
+}
+
+// halt stops applying entries at the one that failed (at index in term), and
+// tells those waiting for it, then retries it after RaftRetry. Only entries
+// that failed here (not rejected by every member) halt, skipping them would
+// leave this member's config differing from the others'.
+func (r *Raft) halt(index, term uint64, err error) bool {
+	r.mu.Lock()
+	r.release(index, term, err)
+	r.mu.Unlock()
+
+	select {
+	case <-r.stop:
+		return false
+	case <-time.After(RaftRetry):
+		return true
+	}
+}
+
+// release tells those waiting for entries up to the one applied (at index in
+// term) that they're applied. Entries skipped by a snapshot can't be told
+// apart from the ones they replaced, so are reported lost. (locked)
+func (r *Raft) release(index, term uint64, err error) {
+	for i, waiters := range r.waiting {
+		if i > index {
+			continue
+		}
+		for _, w := range waiters {
+			switch {
+			case w.term != 0 && (i != index || w.term != term):
+				w.done <- LostError
+			case i == index:
+				w.done <- err
+			default:
+				w.done <- nil
+			}
+		}
+		delete(r.waiting, i)
+	}
+}
+
+// ops restores the snapshot's state
+func (s RaftSnapshot) ops() []core.Op {
+	ops := []core.Op{
+		{Action: "set-services", Services: s.Manifest.Services},
+		{Action: "set-routes", Routes: s.Manifest.Routes},
+		{Action: "set-certs", Certs: s.Manifest.Certs},
+	}
+	if s.Manifest.Vips != nil {
+		ops = append(ops, core.Op{Action: "set-vips", Vips: s.Manifest.Vips})
+	}
+	if s.Webhooks != nil {
+		ops = append(ops, core.Op{Action: "set-webhooks", Webhooks: s.Webhooks})
+	}
+	if s.Tokens != nil {
+		ops = append(ops, core.Op{Action: "set-tokens", Tokens: s.Tokens})
+	}
+	return ops
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LOG
+////////////////////////////////////////////////////////////////////////////////
+
+// append appends the entry to the log in this term, returning its index. The
+// entry is dropped if it can't be saved. (locked)
+func (r *Raft) append(entry RaftEntry) (uint64, error) {
+	entry.Index = r.lastIndex() + 1
+	entry.Term = r.term
+	r.log = append(r.log, entry)
+	if err := r.persistEntries([]RaftEntry{entry}); err != nil {
+		r.log = r.log[:len(r.log)-1]
+		return 0, err
+	}
+	return entry.Index, nil
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.snapshot.Index + uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at index (if it's not compacted)
+func (r *Raft) termAt(index uint64) uint64 {
+	if index == r.snapshot.Index {
+		return r.snapshot.Term
+	}
+	if index < r.snapshot.Index || index > r.lastIndex() {
+		return 0
+	}
+	return r.log[index-r.snapshot.Index-1].Term
+}
+
+// entries returns up to max entries starting at index
+func (r *Raft) entries(index uint64, max int) []RaftEntry {
+	if index > r.lastIndex() {
+		return nil
+	}
+	entries := r.log[index-r.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]RaftEntry{}, entries...)
+}
+
+// config returns the members as of the entry at index, and the index of the
+// entry that last changed them
+func (r *Raft) config(index uint64) ([]string, uint64) {
+	members := append([]string{}, r.snapshot.Members...)
+	changed := r.snapshot.Index
+	for i := range r.log {
+		entry := r.log[i]
+		if entry.Index > index {
+			break
+		}
+		switch {
+		case entry.Join != "" && !contains(members, entry.Join):
+			members = append(members, entry.Join)
+			changed = entry.Index
+		case entry.Leave != "":
+			for j := range members {
+				if members[j] == entry.Leave {
+					members = append(members[:j], members[j+1:]...)
+					break
+				}
+			}
+			changed = entry.Index
+		}
+	}
+	sort.Strings(members)
+	return members, changed
+}
+
+func (r *Raft) isMember(id string) bool {
+	members, _ := r.config(r.lastIndex())
+	return contains(members, id)
+}
+
+func (r *Raft) resetDeadline() {
+	r.deadline = time.Now().Add(RaftElection + time.Duration(rand.Int63n(int64(RaftElection))))
+}
+
+// signal wakes the applier
+func (r *Raft) signal() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// persist saves the term, vote, and last entry applied, synced to disk before
+// it replaces the last save, so a crash leaves one or the other. Votes are only
+// granted once it succeeds. (locked)
+func (r *Raft) persist() error {
+	b, err := json.Marshal(raftState{Term: r.term, Vote: r.vote, Applied: r.applied})
+	if err == nil {
+		err = saveFile(r.Dir, "state.json", b)
+	}
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to save raft state - %s", err)
+	}
+	return err
+}
+
+// persistEntries appends the entries to the saved log, synced to disk before
+// they're acknowledged. What was written of a failed append is cut off.
+// (locked)
+func (r *Raft) persistEntries(entries []RaftEntry) error {
+	err := r.appendFile(entries)
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to save raft log - %s", err)
+	}
+	return err
+}
+
+func (r *Raft) appendFile(entries []RaftEntry) error {
+	var buf bytes.Buffer
+	for i := range entries {
+		b, err := json.Marshal(entries[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	f, err := os.OpenFile(filepath.Join(r.Dir, "log.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(info.Size())
+	}
+	return err
+}
+
+// persistLog replaces the saved log with the log, once entries are dropped
+// from it (conflicting with the leader's, or compacted) (locked)
+func (r *Raft) persistLog() error {
+	var buf bytes.Buffer
+	for i := range r.log {
+		b, err := json.Marshal(r.log[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	err := saveFile(r.Dir, "log.jsonl", buf.Bytes())
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to save raft log - %s", err)
+	}
+	return err
+}
+
+// persistSnapshot saves the snapshot, then the log after it (locked)
+func (r *Raft) persistSnapshot() error {
+	b, err := json.Marshal(r.snapshot)
+	if err == nil {
+		err = saveFile(r.Dir, "snapshot.json", b)
+	}
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to save raft snapshot - %s", err)
+		return err
+	}
+	return r.persistLog()
+}
+
+// saveFile writes the file, synced to disk before it replaces the last one
+func saveFile(dir, name string, b []byte) error {
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	// the rename is durable once the dir is synced (not supported everywhere)
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// load loads the saved state, snapshot, and log. Entries after one that was
+// only partly written (or the snapshot covers) are dropped. (locked)
+func (r *Raft) load() error {
+	b, err := ioutil.ReadFile(filepath.Join(r.Dir, "state.json"))
+	if err != nil {
+		return err
+	}
+	var state raftState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return err
+	}
+	r.term = state.Term
+	r.vote = state.Vote
+	r.applied = state.Applied
+
+	b, err = ioutil.ReadFile(filepath.Join(r.Dir, "snapshot.json"))
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(b, &r.snapshot); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(r.Dir, "log.jsonl"))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	r.log = nil
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	dropped := false
+	for i := range lines {
+		if len(lines[i]) == 0 {
+			continue
+		}
+		var entry RaftEntry
+		if !bytes.HasSuffix(lines[i], []byte("\n")) || json.Unmarshal(lines[i], &entry) != nil || entry.Index > r.lastIndex()+1 {
+			config.Log.Warn("[cluster] - Dropping partly saved raft log after entry %d", r.lastIndex())
+			dropped = true
+			break
+		}
+		if entry.Index <= r.snapshot.Index {
+			dropped = true
+			continue
+		}
+		r.log = append(r.log[:entry.Index-r.snapshot.Index-1], entry)
+	}
+	if dropped {
+		return r.persistLog()
+	}
+	return nil
+}
+
+func contains(members []string, id string) bool {
+	for i := range members {
+		if members[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TRANSPORT
+////////////////////////////////////////////////////////////////////////////////
+
+// newRaftHttp creates a transport to the members' apis, authenticating with
+// the api-token (and client cert, if set). The members' certs are verified
+// with the cluster-ca, or must match this member's api-cert, so the token is
+// never sent to an unverified member. Generated api certs can't be verified.
+func newRaftHttp() (*raftHttp, error) {
+	tlsConfig := &tls.Config{}
+	switch {
+	case config.Insecure:
+	case config.ClusterCa != "":
+		ca, err := ioutil.ReadFile(config.ClusterCa)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read cluster ca - %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Failed to read cluster ca - no certs found")
+		}
+	case config.ApiCert != "":
+		b, err := ioutil.ReadFile(config.ApiCert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read api cert - %s", err)
+		}
+		pinned, _ := pem.Decode(b)
+		if pinned == nil {
+			return nil, fmt.Errorf("Failed to read api cert - no certs found")
+		}
+		// members share the api cert, so it's checked rather than its chain
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 || !bytes.Equal(raw[0], pinned.Bytes) {
+				return UnverifiedMember
+			}
+			return nil
+		}
+	default:
+		return nil, NoClusterCa
+	}
+
+	if config.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to load client cert - %s", err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	// own transport, as http.DefaultTransport is wrapped when the proxy runs
+	return &raftHttp{client: &http.Client{
+		Timeout:   RaftTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}}, nil
+}
+
+func (t *raftHttp) Vote(member string, vote RaftVote) (*RaftVoteReply, error) {
+	var reply RaftVoteReply
+	return &reply, t.do(member, "/raft/vote", vote, &reply)
+}
+
+func (t *raftHttp) Append(member string, app RaftAppend) (*RaftAppendReply, error) {
+	var reply RaftAppendReply
+	return &reply, t.do(member, "/raft/append", app, &reply)
+}
+
+func (t *raftHttp) Propose(member string, entry RaftEntry) (uint64, error) {
+	var reply RaftEntry
+	err := t.do(member, "/raft/propose", entry, &reply)
+	return reply.Index, err
+}
+
+func (t *raftHttp) Join(member, id string) error {
+	return t.do(member, "/raft/members", RaftMember{Member: id}, nil)
+}
+
+func (t *raftHttp) Notify(member string, events []core.Event) error {
+	return t.do(member, "/raft/notify", events, nil)
+}
+
+func (t *raftHttp) Status(member string) (*MemberStatus, error) {
+	var reply MemberStatus
+	return &reply, t.do(member, "/raft/status", nil, &reply)
+}
+
+func (t *raftHttp) Vip(member string, req RaftVipRequest) (*RaftVipReply, error) {
+	var reply RaftVipReply
+	return &reply, t.do(member, "/raft/vip", req, &reply)
+}
+
+// do posts v to the member's api, decoding the reply into reply
+func (t *raftHttp) do(member, path string, v, reply interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return BadJson
+	}
+
+	scheme := "https"
+	if config.Insecure {
+		scheme = "http"
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s", scheme, member, path), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-AUTH-TOKEN", config.ApiToken)
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			return fmt.Errorf("Unexpected status %d from %s", res.StatusCode, member)
+		}
+		return errors.New(apiErr.Error)
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(reply)
+}
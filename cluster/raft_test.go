@@ -0,0 +1,788 @@
+package cluster_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/core"
+)
+
+var raftOnce sync.Once
+
+type (
+	// raftNet connects raft members in-process, dropping requests to or from
+	// cut members
+	raftNet struct {
+		sync.Mutex
+		dir     string
+		members map[string]*cluster.Raft
+		fsms    map[string]*raftFsm
+		cut     map[string]bool
+	}
+
+	// raftLink is a member's transport
+	raftLink struct {
+		net  *raftNet
+		from string
+	}
+
+	// raftFsm is the routes, vips, and webhooks a member applied
+	raftFsm struct {
+		sync.Mutex
+		routes []core.Route
+		vips   []core.Vip
+		hooks  []core.Webhook
+		fail   int // how many applies to fail
+	}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// RAFT
+////////////////////////////////////////////////////////////////////////////////
+func TestRaftReplicate(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	b := net.start(t, "b", "a")
+	c := net.start(t, "c", "a")
+	net.waitMembers(t, 3, "a", "b", "c")
+
+	// through a follower
+	follower := b
+	if net.leader(t) == "b" {
+		follower = c
+	}
+	if err := follower.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	// applied by the member it was made through when it returns
+	if len(net.routes(follower.Id)) != 1 {
+		t.Errorf("Expected route to be applied before returning")
+	}
+	net.waitRoutes(t, 1, "a", "b", "c")
+
+	if err := a.DeleteRoute(testRoute); err != nil {
+		t.Fatalf("Failed to delete route - %s", err)
+	}
+	net.waitRoutes(t, 0, "a", "b", "c")
+
+	// a batch is one entry
+	if err := a.Batch([]core.Op{{Action: "set-routes", Routes: []core.Route{testRoute}}}); err != nil {
+		t.Fatalf("Failed to batch - %s", err)
+	}
+	net.waitRoutes(t, 1, "a", "b", "c")
+
+	// vips too
+	if err := follower.SetVip(core.Vip{Ip: "192.168.0.100", Interface: "eth0"}); err != nil {
+		t.Fatalf("Failed to set vip - %s", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		eventually(t, id+" to have the vip", func() bool {
+			manifest, _ := net.fsms[id].manifest()
+			return len(manifest.Vips) == 1
+		})
+	}
+}
+
+func TestRaftNotify(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.waitMembers(t, 2, "a", "b")
+
+	events, unsubscribe := cluster.Subscribe()
+	defer unsubscribe()
+
+	a.Notify([]core.Event{{Op: core.Op{Action: "set-route", Route: &testRoute}, Member: "a"}})
+
+	// both members (in-process) send it to their subscribers
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event.Action != "set-route" || event.Member != "a" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 events, got %d", i)
+		}
+	}
+}
+
+func TestRaftApplyRetry(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.waitMembers(t, 2, "a", "b")
+
+	// b fails to apply the entry, then retries it rather than skipping it
+	net.fsms["b"].Lock()
+	net.fsms["b"].fail = 2
+	net.fsms["b"].Unlock()
+
+	if err := a.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	net.waitRoutes(t, 1, "a", "b")
+
+	net.fsms["b"].Lock()
+	defer net.fsms["b"].Unlock()
+	if net.fsms["b"].fail != 0 {
+		t.Errorf("Expected b to retry the entry, %d failures left", net.fsms["b"].fail)
+	}
+}
+
+func TestRaftRejected(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	b := net.start(t, "b", "a")
+	net.waitMembers(t, 2, "a", "b")
+
+	// rejected by the leader, before it's appended
+	if err := b.SetServer("not-a-service", &testServer1); err != cluster.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+	if err := a.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route after a rejected change - %s", err)
+	}
+	net.waitRoutes(t, 1, "a", "b")
+
+	// committed, but rejected by every member as it's applied, rather than
+	// retried forever
+	c := net.start(t, "c", "z")
+	reply := c.HandleAppend(cluster.RaftAppend{Term: 1, Leader: "z", Commit: 4, Entries: []cluster.RaftEntry{
+		{Index: 1, Term: 1, Join: "z"},
+		{Index: 2, Term: 1, Join: "c"},
+		{Index: 3, Term: 1, Ops: []core.Op{{Action: "set-server", SvcId: "not-a-service", Server: &testServer1}}},
+		{Index: 4, Term: 1, Ops: []core.Op{{Action: "set-route", Route: &testRoute}}},
+	}})
+	if !reply.Success {
+		t.Fatalf("Expected entries to be appended - %+v", reply)
+	}
+	net.waitRoutes(t, 1, "c")
+}
+
+func TestRaftFailover(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.start(t, "c", "a")
+	net.waitMembers(t, 3, "a", "b", "c")
+
+	old := net.leader(t)
+	net.setCut(old, true)
+
+	var leader string
+	eventually(t, "a new leader", func() bool {
+		leader = net.leader(t, old)
+		return leader != ""
+	})
+	if err := net.member(leader).SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+
+	others := []string{}
+	for _, id := range []string{"a", "b", "c"} {
+		if id != old {
+			others = append(others, id)
+		}
+	}
+	net.waitRoutes(t, 1, others...)
+	if len(net.routes(old)) != 0 {
+		t.Errorf("Expected cut off leader not to apply route")
+	}
+
+	// catches up once it's back
+	net.setCut(old, false)
+	net.waitRoutes(t, 1, old)
+	eventually(t, "old leader to follow", func() bool {
+		for _, member := range net.member(old).RaftMembers() {
+			if member.Leader {
+				return member.Member != old
+			}
+		}
+		return false
+	})
+}
+
+func TestRaftVips(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+	timeout := cluster.RaftVipTimeout
+	cluster.RaftVipTimeout = 300 * time.Millisecond
+	defer func() { cluster.RaftVipTimeout = timeout }()
+
+	net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.start(t, "c", "a")
+	net.waitMembers(t, 3, "a", "b", "c")
+	leader := net.member(net.leader(t))
+	vip := core.Vip{Ip: "192.168.0.100", Interface: "lo", Alias: "lo:1"}
+	vipReq := func(action, member, from string, priority int, owns bool) *cluster.RaftVipReply {
+		reply, err := leader.HandleVip(cluster.RaftVipRequest{Action: action, Member: member, Vip: vip, Priority: priority, Owns: owns, From: from})
+		if err != nil {
+			t.Fatalf("Failed to %s vip - %s", action, err)
+		}
+		return reply
+	}
+
+	// only the leader decides
+	for _, id := range []string{"a", "b", "c"} {
+		if r := net.member(id); r != leader {
+			if _, err := r.HandleVip(cluster.RaftVipRequest{Action: "state", Member: id, Vip: vip}); err != cluster.NotLeaderError {
+				t.Errorf("Expected %s to refuse vip requests - %v", id, err)
+			}
+		}
+	}
+	if _, err := leader.HandleVip(cluster.RaftVipRequest{Action: "steal", Member: "a", Vip: vip}); err != cluster.BadVipAction {
+		t.Errorf("Expected unknown action to fail - %v", err)
+	}
+
+	vipReq("candidate", "a", "", 1, false)
+	reply := vipReq("candidate", "b", "", 2, false)
+	if reply.Owner != "" || reply.Candidates["a"] != 1 || reply.Candidates["b"] != 2 {
+		t.Fatalf("Unexpected vip state - %+v", reply)
+	}
+	if reply = vipReq("claim", "b", "", 0, false); !reply.Claimed || reply.Owner != "b" {
+		t.Fatalf("Expected b to claim vip - %+v", reply)
+	}
+	// only from the owner the claimant saw
+	if reply = vipReq("claim", "a", "", 0, false); reply.Claimed || reply.Owner != "b" {
+		t.Errorf("Expected a's stale claim to fail - %+v", reply)
+	}
+	// nor from a member that isn't a candidate
+	if reply = vipReq("claim", "c", "b", 0, false); reply.Claimed {
+		t.Errorf("Expected c's claim to fail - %+v", reply)
+	}
+
+	// an owner that stops registering loses it
+	eventually(t, "b's candidacy to expire", func() bool {
+		vipReq("candidate", "a", "", 1, false)
+		reply = vipReq("state", "a", "", 0, false)
+		_, ok := reply.Candidates["b"]
+		return reply.Owner == "" && !ok
+	})
+
+	// an owner registering with a leader that doesn't know it keeps it
+	if reply = vipReq("candidate", "c", "", 0, true); reply.Owner != "c" {
+		t.Errorf("Expected c to stay owner - %+v", reply)
+	}
+	if reply = vipReq("resign", "c", "", 0, false); reply.Owner != "" || len(reply.Candidates) != 1 {
+		t.Errorf("Expected c to resign vip - %+v", reply)
+	}
+
+	// members that leave aren't candidates
+	gone := "c"
+	if leader == net.member(gone) {
+		gone = "b"
+	}
+	vipReq("candidate", gone, "", 0, true)
+	if err := leader.RemoveMember(gone); err != nil {
+		t.Fatalf("Failed to remove %s - %s", gone, err)
+	}
+	if reply = vipReq("state", "a", "", 0, false); reply.Owner != "" || len(reply.Candidates) != 1 {
+		t.Errorf("Expected removed member to lose vip - %+v", reply)
+	}
+}
+
+func TestRaftMembers(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.start(t, "c", "a")
+	net.waitMembers(t, 3, "a", "b", "c")
+
+	if err := a.RemoveMember("d"); err != cluster.NoMemberError {
+		t.Errorf("Expected no member error, got %v", err)
+	}
+	if err := a.RemoveMember("c"); err != nil {
+		t.Fatalf("Failed to remove member - %s", err)
+	}
+	net.waitMembers(t, 2, "a", "b")
+
+	// the removed member can't take over
+	net.stopMember("c")
+	if err := a.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	net.waitRoutes(t, 1, "a", "b")
+
+	// removing the leader hands over to the remaining member
+	leader := net.leader(t)
+	if err := net.member(leader).RemoveMember(leader); err != nil {
+		t.Fatalf("Failed to remove leader - %s", err)
+	}
+	remaining := "a"
+	if leader == "a" {
+		remaining = "b"
+	}
+	net.waitMembers(t, 1, remaining)
+	eventually(t, "remaining member to lead", func() bool {
+		return net.leader(t, leader) == remaining
+	})
+
+	if err := net.member(remaining).RemoveMember(remaining); err != cluster.LastMemberError {
+		t.Errorf("Expected last member error, got %v", err)
+	}
+}
+
+func TestRaftStatus(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	net.start(t, "b", "a")
+	net.start(t, "c", "a")
+	net.waitMembers(t, 3, "a", "b", "c")
+	if err := a.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	net.waitRoutes(t, 1, "a", "b", "c")
+
+	var m cluster.Membered = a
+	members, err := m.Members()
+	if err != nil {
+		t.Fatalf("Failed to get members - %s", err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("Expected 3 members, got %+v", members)
+	}
+	for i := range members {
+		if !members[i].Alive || members[i].Hashes["routes"] != members[0].Hashes["routes"] {
+			t.Errorf("Unexpected status - %+v", members[i])
+		}
+	}
+
+	// members that can't be reached aren't alive
+	net.setCut("c", true)
+	members, _ = a.Members()
+	for i := range members {
+		if members[i].Alive != (members[i].Id != "c") {
+			t.Errorf("Unexpected status - %+v", members[i])
+		}
+	}
+	net.setCut("c", false)
+
+	// a member that drifted resyncs from the log
+	net.Lock()
+	fsm := net.fsms["b"]
+	net.Unlock()
+	fsm.Lock()
+	fsm.remove(testRoute)
+	fsm.Unlock()
+	if err = net.member("b").Resync(); err != nil {
+		t.Fatalf("Failed to resync - %s", err)
+	}
+	if routes := net.routes("b"); len(routes) != 1 || routes[0].Domain != testRoute.Domain {
+		t.Errorf("Expected resync to restore the route, got %+v", routes)
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	if err := a.Batch([]core.Op{{Action: "set-webhook", Webhook: &core.Webhook{Id: "hook", Url: "http://127.0.0.1/hook"}}}); err != nil {
+		t.Fatalf("Failed to set webhook - %s", err)
+	}
+	if err := a.SetVip(core.Vip{Ip: "192.168.0.100", Interface: "eth0"}); err != nil {
+		t.Fatalf("Failed to set vip - %s", err)
+	}
+	for i := 0; i < 12; i++ {
+		if err := a.SetRoute(core.Route{Domain: fmt.Sprintf("portal%d.test", i)}); err != nil {
+			t.Fatalf("Failed to set route - %s", err)
+		}
+	}
+
+	// saved apart, readable only by portal
+	var snapshot cluster.RaftSnapshot
+	b, err := ioutil.ReadFile(filepath.Join(a.Dir, "snapshot.json"))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot - %s", err)
+	}
+	json.Unmarshal(b, &snapshot)
+	log, err := ioutil.ReadFile(filepath.Join(a.Dir, "log.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to read log - %s", err)
+	}
+	entries := strings.Count(string(log), "\n")
+	if snapshot.Index == 0 || entries >= 5 || len(snapshot.Manifest.Routes) == 0 {
+		t.Errorf("Expected log to be compacted, snapshot at %d with %d entries after", snapshot.Index, entries)
+	}
+	for _, name := range []string{"state.json", "snapshot.json", "log.jsonl"} {
+		if info, err := os.Stat(filepath.Join(a.Dir, name)); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be saved 0600 - %v %v", name, info, err)
+		}
+	}
+
+	// a new member gets the snapshot
+	net.start(t, "b", "a")
+	net.waitRoutes(t, 12, "b")
+	eventually(t, "webhook from the snapshot", func() bool {
+		hooks := net.webhooks("b")
+		return len(hooks) == 1 && hooks[0].Id == "hook"
+	})
+	if manifest, _ := net.fsms["b"].manifest(); len(manifest.Vips) != 1 {
+		t.Errorf("Expected vip from the snapshot, got %v", manifest.Vips)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	net := newRaftNet(t)
+	defer net.stop()
+
+	a := net.start(t, "a", "")
+	if err := a.SetRoute(testRoute); err != nil {
+		t.Fatalf("Failed to set route - %s", err)
+	}
+	net.stopMember("a")
+
+	// an entry only partly saved (crashed while appending it) is dropped
+	f, err := os.OpenFile(filepath.Join(a.Dir, "log.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"index":99,"term":1,"ops":[{"act`)
+	f.Close()
+
+	// resumes after the last entry it applied
+	a = net.start(t, "a", "")
+	net.waitMembers(t, 1, "a")
+	if err := a.SetRoute(core.Route{Domain: "portal2.test"}); err != nil {
+		t.Fatalf("Failed to set route after restart - %s", err)
+	}
+	if routes := net.routes("a"); len(routes) != 1 || routes[0].Domain != "portal2.test" {
+		t.Errorf("Expected only the new route to be applied, got %v", routes)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+func newRaftNet(t *testing.T) *raftNet {
+	raftOnce.Do(func() {
+		cluster.RaftHeartbeat = 20 * time.Millisecond
+		cluster.RaftElection = 150 * time.Millisecond
+		cluster.RaftTimeout = 5 * time.Second
+		cluster.RaftSnapshotAfter = 5
+		cluster.RaftRetry = 50 * time.Millisecond
+	})
+
+	dir, err := ioutil.TempDir("", "portal-raft")
+	if err != nil {
+		t.Fatalf("Failed to create dir - %s", err)
+	}
+	return &raftNet{dir: dir, members: map[string]*cluster.Raft{}, fsms: map[string]*raftFsm{}, cut: map[string]bool{}}
+}
+
+// start starts a member, joining the cluster through join if set
+func (n *raftNet) start(t *testing.T, id, join string) *cluster.Raft {
+	r := cluster.NewRaft(id, filepath.Join(n.dir, id), &raftLink{net: n, from: id})
+	fsm := &raftFsm{}
+	r.Apply = fsm.apply
+	r.Manifest = fsm.manifest
+	r.Webhooks = fsm.webhooks
+	r.Tokens = func() ([]core.Token, error) { return nil, nil }
+
+	n.Lock()
+	n.members[id] = r
+	n.fsms[id] = fsm
+	n.Unlock()
+
+	if err := r.Start(join); err != nil {
+		t.Fatalf("Failed to start %s - %s", id, err)
+	}
+	return r
+}
+
+func (n *raftNet) stopMember(id string) {
+	n.Lock()
+	r := n.members[id]
+	delete(n.members, id)
+	n.Unlock()
+	r.Stop()
+}
+
+func (n *raftNet) stop() {
+	n.Lock()
+	ids := []string{}
+	for id := range n.members {
+		ids = append(ids, id)
+	}
+	n.Unlock()
+	for i := range ids {
+		n.stopMember(ids[i])
+	}
+	os.RemoveAll(n.dir)
+}
+
+func (n *raftNet) setCut(id string, cut bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.cut[id] = cut
+}
+
+func (n *raftNet) member(id string) *cluster.Raft {
+	n.Lock()
+	defer n.Unlock()
+	return n.members[id]
+}
+
+// reach returns the member, if from can reach it
+func (n *raftNet) reach(from, to string) (*cluster.Raft, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.cut[from] || n.cut[to] || n.members[to] == nil {
+		return nil, fmt.Errorf("Can't reach %s", to)
+	}
+	return n.members[to], nil
+}
+
+// leader returns the member (other than the skipped) that's leading, according
+// to a majority of the reachable members
+func (n *raftNet) leader(t *testing.T, skip ...string) string {
+	n.Lock()
+	members := map[string]*cluster.Raft{}
+	for id, r := range n.members {
+		if !n.cut[id] && !contains(skip, id) {
+			members[id] = r
+		}
+	}
+	n.Unlock()
+
+	votes := map[string]int{}
+	for _, r := range members {
+		for _, member := range r.RaftMembers() {
+			if member.Leader && !contains(skip, member.Member) {
+				votes[member.Member]++
+			}
+		}
+	}
+	for id, count := range votes {
+		if count > len(members)/2 {
+			return id
+		}
+	}
+	return ""
+}
+
+func (n *raftNet) routes(id string) []core.Route {
+	n.Lock()
+	fsm := n.fsms[id]
+	n.Unlock()
+
+	fsm.Lock()
+	defer fsm.Unlock()
+	return append([]core.Route{}, fsm.routes...)
+}
+
+func (n *raftNet) webhooks(id string) []core.Webhook {
+	n.Lock()
+	fsm := n.fsms[id]
+	n.Unlock()
+
+	hooks, _ := fsm.webhooks()
+	return hooks
+}
+
+// waitMembers waits for each member to know of count members and a leader
+func (n *raftNet) waitMembers(t *testing.T, count int, ids ...string) {
+	for _, id := range ids {
+		eventually(t, fmt.Sprintf("%s to have %d members", id, count), func() bool {
+			members := n.member(id).RaftMembers()
+			leader := false
+			for i := range members {
+				leader = leader || members[i].Leader
+			}
+			return len(members) == count && leader
+		})
+	}
+}
+
+// waitRoutes waits for each member to apply count routes
+func (n *raftNet) waitRoutes(t *testing.T, count int, ids ...string) {
+	for _, id := range ids {
+		eventually(t, fmt.Sprintf("%s to have %d routes", id, count), func() bool {
+			return len(n.routes(id)) == count
+		})
+	}
+}
+
+func (l *raftLink) Vote(member string, vote cluster.RaftVote) (*cluster.RaftVoteReply, error) {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return nil, err
+	}
+	var sent cluster.RaftVote
+	roundTrip(vote, &sent)
+	reply := r.HandleVote(sent)
+	return &reply, nil
+}
+
+func (l *raftLink) Append(member string, app cluster.RaftAppend) (*cluster.RaftAppendReply, error) {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return nil, err
+	}
+	var sent cluster.RaftAppend
+	roundTrip(app, &sent)
+	reply := r.HandleAppend(sent)
+	return &reply, nil
+}
+
+func (l *raftLink) Propose(member string, entry cluster.RaftEntry) (uint64, error) {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return 0, err
+	}
+	var sent cluster.RaftEntry
+	roundTrip(entry, &sent)
+	return r.HandlePropose(sent)
+}
+
+func (l *raftLink) Join(member, id string) error {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return err
+	}
+	return r.AddMember(id)
+}
+
+func (l *raftLink) Notify(member string, events []core.Event) error {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return err
+	}
+	var sent []core.Event
+	roundTrip(events, &sent)
+	r.HandleNotify(sent)
+	return nil
+}
+
+func (l *raftLink) Vip(member string, req cluster.RaftVipRequest) (*cluster.RaftVipReply, error) {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return nil, err
+	}
+	var sent cluster.RaftVipRequest
+	roundTrip(req, &sent)
+	reply, err := r.HandleVip(sent)
+	if err != nil {
+		return nil, err
+	}
+	var got cluster.RaftVipReply
+	roundTrip(reply, &got)
+	return &got, nil
+}
+
+func (l *raftLink) Status(member string) (*cluster.MemberStatus, error) {
+	r, err := l.net.reach(l.from, member)
+	if err != nil {
+		return nil, err
+	}
+	status, err := r.HandleStatus()
+	if err != nil {
+		return nil, err
+	}
+	var sent cluster.MemberStatus
+	roundTrip(status, &sent)
+	return &sent, nil
+}
+
+func (f *raftFsm) apply(ops []core.Op) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		return fmt.Errorf("failing apply")
+	}
+	for _, op := range ops {
+		switch op.Action {
+		case "set-routes":
+			f.routes = append([]core.Route{}, op.Routes...)
+		case "set-route":
+			f.remove(*op.Route)
+			f.routes = append(f.routes, *op.Route)
+		case "delete-route":
+			f.remove(*op.Route)
+		case "set-server":
+			// no services, like a balancer without them
+			return fmt.Errorf("No Service Found")
+		case "set-vips":
+			f.vips = append([]core.Vip{}, op.Vips...)
+		case "set-vip":
+			f.vips = append(f.vips, *op.Vip)
+		case "set-webhooks":
+			f.hooks = append([]core.Webhook{}, op.Webhooks...)
+		case "set-webhook":
+			f.hooks = append(f.hooks, *op.Webhook)
+		}
+	}
+	return nil
+}
+
+func (f *raftFsm) remove(route core.Route) {
+	for i := range f.routes {
+		if f.routes[i].Domain == route.Domain {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *raftFsm) manifest() (*core.Manifest, error) {
+	f.Lock()
+	defer f.Unlock()
+	return &core.Manifest{Routes: append([]core.Route{}, f.routes...), Vips: append([]core.Vip{}, f.vips...)}, nil
+}
+
+func (f *raftFsm) webhooks() ([]core.Webhook, error) {
+	f.Lock()
+	defer f.Unlock()
+	return append([]core.Webhook{}, f.hooks...), nil
+}
+
+// roundTrip copies v to sent through json, like the api does
+func roundTrip(v, sent interface{}) {
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, sent)
+}
+
+// eventually waits (up to 5s) for ok
+func eventually(t *testing.T, what string, ok func() bool) {
+	for i := 0; i < 500; i++ {
+		if ok() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func contains(ids []string, id string) bool {
+	for i := range ids {
+		if ids[i] == id {
+			return true
+		}
+	}
+	return false
+}
@@ -1,21 +1,25 @@
 package cluster
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/garyburd/redigo/redis"
 
-	"github.com/nanopack/portal/balance"
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/core/common"
 	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/metrics"
+	"github.com/nanopack/portal/vipmgr"
 )
 
 var (
@@ -23,18 +27,32 @@ var (
 	ttl  = 20 // time until a member is deemed "dead"
 	beat = time.Duration(ttl/2) * time.Second
 	pool *redis.Pool
+
+	// subconn is the subscription on the portal and events channels, replaced
+	// when rejoining
+	subconn   redis.PubSubConn
+	subconnMu sync.Mutex
+
+	// my config's hashes, reported with each heartbeat - recomputed once it's
+	// changed (rehash is set)
+	hashes   map[string]string
+	hashesMu sync.Mutex
+	rehash   = int32(1)
+
+	// members are polled every 500ms, for up to 30s
+	ackDuration = metrics.NewHistogram("portal_cluster_ack_duration_seconds",
+		"Time taken for all members to apply a published update.", []float64{.5, 1, 2.5, 5, 10, 20, 30}, "result")
 )
 
 type (
-	Redis struct {
-		subconn redis.PubSubConn
-	}
+	Redis struct{}
 )
 
 func (r *Redis) Init() error {
-	hostname, _ := os.Hostname()
-	self = fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+	setSelf()
 	pool = r.newPool(config.ClusterConnection, config.ClusterToken)
+	// vips are added to the host once elected to own them
+	vipmgr.Owns = ownsVip
 
 	// get vips
 	vips, err := r.GetVips()
@@ -92,6 +110,34 @@ func (r *Redis) Init() error {
 		}
 	}
 
+	// get webhooks
+	hooks, err := r.getWebhooks()
+	if err != nil {
+		return fmt.Errorf("Failed to get webhooks - %s", err)
+	}
+	// write webhooks
+	if hooks != nil {
+		config.Log.Trace("[cluster] - Setting webhooks...")
+		err = common.Batch([]core.Op{{Action: "set-webhooks", Webhooks: hooks}})
+		if err != nil {
+			return fmt.Errorf("Failed to set webhooks - %s", err)
+		}
+	}
+
+	// get tokens
+	tokens, err := r.getTokens()
+	if err != nil {
+		return fmt.Errorf("Failed to get tokens - %s", err)
+	}
+	// write tokens
+	if tokens != nil {
+		config.Log.Trace("[cluster] - Setting tokens...")
+		err = common.Batch([]core.Op{{Action: "set-tokens", Tokens: tokens}})
+		if err != nil {
+			return fmt.Errorf("Failed to set tokens - %s", err)
+		}
+	}
+
 	// note: keep subconn connection initialization out here or sleep after `go r.subscribe()`
 	// don't set read timeout on subscriber - it dies if no 'updates' within that time
 	s, err := redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(30*time.Second), redis.DialPassword(config.ClusterToken))
@@ -99,21 +145,25 @@ func (r *Redis) Init() error {
 		return fmt.Errorf("Failed to reach redis for subconn - %s", err)
 	}
 
-	r.subconn = redis.PubSubConn{s}
-	r.subconn.Subscribe("portal")
+	sub := redis.PubSubConn{s}
+	sub.Subscribe("portal", "events")
+	subconnMu.Lock()
+	subconn = sub
+	subconnMu.Unlock()
 
 	p := pool.Get()
 	defer p.Close()
 
-	p.Do("SET", self, "alive", "EX", ttl)
+	r.beat(p)
 	_, err = p.Do("SADD", "members", self)
 	if err != nil {
 		return fmt.Errorf("Failed to add myself to list of members - %s", err)
 	}
 
-	go r.subscribe()
+	go r.subscribe(sub)
 	go r.heartbeat()
 	go r.cleanup()
+	go electVips(context.Background(), r)
 
 	return nil
 }
@@ -125,6 +175,9 @@ func (r *Redis) Init() error {
 // SetServices tells all members to replace the services in their database with a new set.
 // rolls back on failure
 func (r *Redis) SetServices(services []core.Service) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -157,7 +210,7 @@ func (r *Redis) SetServices(services []core.Service) error {
 	}
 
 	if database.CentralStore {
-		return database.SetServices(services)
+		return common.Stored("set-services", database.SetServices(services))
 	}
 
 	return nil
@@ -166,6 +219,9 @@ func (r *Redis) SetServices(services []core.Service) error {
 // SetService tells all members to add the service to their database.
 // rolls back on failure
 func (r *Redis) SetService(service *core.Service) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -193,7 +249,7 @@ func (r *Redis) SetService(service *core.Service) error {
 	}
 
 	if database.CentralStore {
-		return database.SetService(service)
+		return common.Stored("set-service", database.SetService(service))
 	}
 
 	return nil
@@ -202,6 +258,9 @@ func (r *Redis) SetService(service *core.Service) error {
 // DeleteService tells all members to remove the service from their database.
 // rolls back on failure
 func (r *Redis) DeleteService(id string) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -235,7 +294,7 @@ func (r *Redis) DeleteService(id string) error {
 	}
 
 	if database.CentralStore {
-		return database.DeleteService(id)
+		return common.Stored("delete-service", database.DeleteService(id))
 	}
 
 	return nil
@@ -248,6 +307,9 @@ func (r *Redis) DeleteService(id string) error {
 // SetServers tells all members to replace a service's servers with a new set.
 // rolls back on failure
 func (r *Redis) SetServers(svcId string, servers []core.Server) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -280,7 +342,7 @@ func (r *Redis) SetServers(svcId string, servers []core.Server) error {
 	}
 
 	if database.CentralStore {
-		return database.SetServers(svcId, servers)
+		return common.Stored("set-servers", database.SetServers(svcId, servers))
 	}
 
 	return nil
@@ -289,6 +351,9 @@ func (r *Redis) SetServers(svcId string, servers []core.Server) error {
 // SetServer tells all members to add the server to their database.
 // rolls back on failure
 func (r *Redis) SetServer(svcId string, server *core.Server) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -315,7 +380,7 @@ func (r *Redis) SetServer(svcId string, server *core.Server) error {
 	}
 
 	if database.CentralStore {
-		return database.SetServer(svcId, server)
+		return common.Stored("set-server", database.SetServer(svcId, server))
 	}
 
 	return nil
@@ -324,6 +389,9 @@ func (r *Redis) SetServer(svcId string, server *core.Server) error {
 // DeleteServer tells all members to remove the server from their database.
 // rolls back on failure
 func (r *Redis) DeleteServer(svcId, srvId string) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -357,7 +425,7 @@ func (r *Redis) DeleteServer(svcId, srvId string) error {
 	}
 
 	if database.CentralStore {
-		return database.DeleteServer(svcId, srvId)
+		return common.Stored("delete-server", database.DeleteServer(svcId, srvId))
 	}
 
 	return nil
@@ -370,6 +438,9 @@ func (r *Redis) DeleteServer(svcId, srvId string) error {
 // SetRoutes tells all members to replace the routes in their database with a new set.
 // rolls back on failure
 func (r Redis) SetRoutes(routes []core.Route) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -402,7 +473,7 @@ func (r Redis) SetRoutes(routes []core.Route) error {
 	}
 
 	if database.CentralStore {
-		return database.SetRoutes(routes)
+		return common.Stored("set-routes", database.SetRoutes(routes))
 	}
 
 	return nil
@@ -411,6 +482,9 @@ func (r Redis) SetRoutes(routes []core.Route) error {
 // SetRoute tells all members to add the route to their database.
 // rolls back on failure
 func (r Redis) SetRoute(route core.Route) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -438,7 +512,7 @@ func (r Redis) SetRoute(route core.Route) error {
 	}
 
 	if database.CentralStore {
-		return database.SetRoute(route)
+		return common.Stored("set-route", database.SetRoute(route))
 	}
 
 	return nil
@@ -447,6 +521,9 @@ func (r Redis) SetRoute(route core.Route) error {
 // DeleteRoute tells all members to remove the route from their database.
 // rolls back on failure
 func (r Redis) DeleteRoute(route core.Route) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -480,7 +557,7 @@ func (r Redis) DeleteRoute(route core.Route) error {
 	}
 
 	if database.CentralStore {
-		return database.DeleteRoute(route)
+		return common.Stored("delete-route", database.DeleteRoute(route))
 	}
 
 	return nil
@@ -493,6 +570,9 @@ func (r Redis) DeleteRoute(route core.Route) error {
 // SetCerts tells all members to replace the certs in their database with a new set.
 // rolls back on failure
 func (r Redis) SetCerts(certs []core.CertBundle) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -525,7 +605,7 @@ func (r Redis) SetCerts(certs []core.CertBundle) error {
 	}
 
 	if database.CentralStore {
-		return database.SetCerts(certs)
+		return common.Stored("set-certs", database.SetCerts(certs))
 	}
 
 	return nil
@@ -534,6 +614,9 @@ func (r Redis) SetCerts(certs []core.CertBundle) error {
 // SetCert tells all members to add the cert to their database.
 // rolls back on failure
 func (r Redis) SetCert(cert core.CertBundle) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -561,7 +644,7 @@ func (r Redis) SetCert(cert core.CertBundle) error {
 	}
 
 	if database.CentralStore {
-		return database.SetCert(cert)
+		return common.Stored("set-cert", database.SetCert(cert))
 	}
 
 	return nil
@@ -570,6 +653,9 @@ func (r Redis) SetCert(cert core.CertBundle) error {
 // DeleteCert tells all members to remove the cert from their database.
 // rolls back on failure
 func (r Redis) DeleteCert(cert core.CertBundle) error {
+	if isDegraded() {
+		return DegradedError
+	}
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -603,7 +689,7 @@ func (r Redis) DeleteCert(cert core.CertBundle) error {
 	}
 
 	if database.CentralStore {
-		return database.DeleteCert(cert)
+		return common.Stored("delete-cert", database.DeleteCert(cert))
 	}
 
 	return nil
@@ -613,18 +699,356 @@ func (r Redis) DeleteCert(cert core.CertBundle) error {
 // VIPS
 ////////////////////////////////////////////////////////////////////////////////
 
-// todo: clustered
+// SetVips tells all members to replace the vips in their database with a new set.
+// rolls back on failure
 func (r Redis) SetVips(vips []core.Vip) error {
-	return common.SetVips(vips)
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	oldVips, err := common.GetVips()
+	if err != nil {
+		return err
+	}
+
+	// publishJson to others
+	err = r.publishJson(conn, "set-vips", vips)
+	if err != nil {
+		// if i failed to publishJson, request should fail
+		return err
+	}
+
+	actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vips %v", vips))))
+
+	// ensure all members applied action
+	err = r.waitForMembers(conn, actionHash)
+	if err != nil {
+		uActionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vips %v", oldVips))))
+		// cleanup rollback cruft. clear actionHash ensures no mistakes on re-submit
+		defer conn.Do("DEL", uActionHash, actionHash)
+		// attempt rollback - no need to waitForMembers here
+		uerr := r.publishJson(conn, "set-vips", oldVips)
+		if uerr != nil {
+			err = fmt.Errorf("%s - %s", err, uerr)
+		}
+		return err
+	}
+
+	if database.CentralStore {
+		return common.Stored("set-vips", database.SetVips(vips))
+	}
+
+	return nil
 }
+
+// SetVip tells all members to add the vip to their database.
+// rolls back on failure
 func (r Redis) SetVip(vip core.Vip) error {
-	return common.SetVip(vip)
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	// publishJson to others
+	err := r.publishJson(conn, "set-vip", vip)
+	if err != nil {
+		// nothing to rollback yet (nobody received)
+		return err
+	}
+
+	actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vip %v", vip))))
+
+	// ensure all members applied action
+	err = r.waitForMembers(conn, actionHash)
+	if err != nil {
+		uActionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("delete-vip %v", vip))))
+		// cleanup rollback cruft. clear actionHash ensures no mistakes on re-submit
+		defer conn.Do("DEL", uActionHash, actionHash)
+		// attempt rollback - no need to waitForMembers here
+		uerr := r.publishJson(conn, "delete-vip", vip)
+		if uerr != nil {
+			err = fmt.Errorf("%s - %s", err, uerr)
+		}
+		return err
+	}
+
+	if database.CentralStore {
+		return common.Stored("set-vip", database.SetVip(vip))
+	}
+
+	return nil
 }
+
+// DeleteVip tells all members to remove the vip from their database.
+// rolls back on failure
 func (r Redis) DeleteVip(vip core.Vip) error {
-	return common.DeleteVip(vip)
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	oldVips, err := common.GetVips()
+	if err != nil {
+		return err
+	}
+
+	// publishJson to others
+	err = r.publishJson(conn, "delete-vip", vip)
+	if err != nil {
+		// if i failed to publishJson, request should fail
+		return err
+	}
+
+	actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("delete-vip %v", vip))))
+
+	// ensure all members applied action
+	err = r.waitForMembers(conn, actionHash)
+	if err != nil {
+		uActionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vips %v", oldVips))))
+		// cleanup rollback cruft. clear actionHash ensures no mistakes on re-submit
+		defer conn.Do("DEL", uActionHash, actionHash)
+		// attempt rollback - no need to waitForMembers here
+		uerr := r.publishJson(conn, "set-vips", oldVips)
+		if uerr != nil {
+			err = fmt.Errorf("%s - %s", err, uerr)
+		}
+		return err
+	}
+
+	if database.CentralStore {
+		return common.Stored("delete-vip", database.DeleteVip(vip))
+	}
+
+	return nil
+}
+
+// each vip is owned by the member in "vip-owner:<ip>" while that member is
+// alive (its heartbeat hasn't expired), candidates register their priority in
+// the "vip-candidates:<ip>" hash
+
+var (
+	// claim the vip if its owner is still ARGV[1] ("" for none alive)
+	claimScript = redis.NewScript(1, `
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] or (ARGV[1] == "" and (not owner or redis.call("EXISTS", owner) == 0)) then
+  redis.call("SET", KEYS[1], ARGV[2])
+  return 1
+end
+return 0`)
+	// give up the vip, if owned by ARGV[1]
+	resignScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+func (r Redis) candidate(vip core.Vip) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", "vip-candidates:"+vip.Ip, self, config.VipPriority)
+	return err
+}
+
+func (r Redis) vipState(vip core.Vip) (string, map[string]int, error) {
+	if isDegraded() {
+		return "", nil, DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	owner, err := redis.String(conn.Do("GET", "vip-owner:"+vip.Ip))
+	if err != nil && err != redis.ErrNil {
+		return "", nil, err
+	}
+	all, err := redis.IntMap(conn.Do("HGETALL", "vip-candidates:"+vip.Ip))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// only alive members
+	if owner != "" {
+		if exist, _ := redis.Int(conn.Do("EXISTS", owner)); exist == 0 {
+			owner = ""
+		}
+	}
+	candidates := map[string]int{}
+	for member, priority := range all {
+		if exist, _ := redis.Int(conn.Do("EXISTS", member)); exist == 1 {
+			candidates[member] = priority
+		}
+	}
+	return owner, candidates, nil
+}
+
+func (r Redis) claimVip(vip core.Vip, from string) (bool, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(claimScript.Do(conn, "vip-owner:"+vip.Ip, from, self))
+}
+
+func (r Redis) resignVip(vip core.Vip) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := resignScript.Do(conn, "vip-owner:"+vip.Ip, self)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HDEL", "vip-candidates:"+vip.Ip, self)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// BATCH
+////////////////////////////////////////////////////////////////////////////////
+
+// Batch tells all members to apply the ops as one transaction. Rolls back on
+// failure.
+func (r *Redis) Batch(ops []core.Op) error {
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	// in case of failure
+	old, err := common.GetManifest()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return BadJson
+	}
+
+	// publish to others
+	_, err = conn.Do("PUBLISH", "portal", fmt.Sprintf("batch %s", b))
+	if err != nil {
+		return err
+	}
+
+	actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("batch %s", b))))
+
+	// ensure all members applied action
+	err = r.waitForMembers(conn, actionHash)
+	if err != nil {
+		// members that applied the batch restore the previous state of what it changed
+		undos := map[string]interface{}{}
+		for _, op := range ops {
+			switch {
+			case strings.Contains(op.Action, "service"), strings.Contains(op.Action, "server"):
+				undos["set-services"] = old.Services
+			case strings.Contains(op.Action, "route"):
+				undos["set-routes"] = old.Routes
+			case strings.Contains(op.Action, "cert"):
+				undos["set-certs"] = old.Certs
+			case strings.Contains(op.Action, "vip"):
+				undos["set-vips"] = old.Vips
+			}
+		}
+		uActionHashes := []interface{}{actionHash}
+		for action, v := range undos {
+			uActionHashes = append(uActionHashes, fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s %s", action, v)))))
+			// attempt rollback - no need to waitForMembers here
+			if uerr := r.publishJson(conn, action, v); uerr != nil {
+				err = fmt.Errorf("%s - %s", err, uerr)
+			}
+		}
+		// cleanup rollback cruft. clear actionHash ensures no mistakes on re-submit
+		defer conn.Do("DEL", uActionHashes...)
+		return err
+	}
+
+	if database.CentralStore {
+		return common.StoreBatch(ops)
+	}
+
+	return nil
+}
+
+// Notify publishes the events to the "events" channel for every member (myself
+// included) to send to its subscribers
+func (r *Redis) Notify(events []core.Event) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		return BadJson
+	}
+
+	_, err = conn.Do("PUBLISH", "events", b)
+	return err
 }
-func (r Redis) GetVips() ([]core.Vip, error) {
-	return common.GetVips()
+
+////////////////////////////////////////////////////////////////////////////////
+// MEMBERS
+////////////////////////////////////////////////////////////////////////////////
+
+// Members returns the status of the members redis knows about, as of their last
+// heartbeat. Members that haven't heartbeat within ttl aren't alive (until
+// they're cleaned up).
+func (r *Redis) Members() ([]MemberStatus, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", "members"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	members := make([]MemberStatus, 0, len(ids))
+	for _, id := range ids {
+		member := MemberStatus{}
+		b, err := redis.Bytes(conn.Do("GET", id))
+		switch err {
+		case nil:
+			// older members just say "alive"
+			json.Unmarshal(b, &member)
+			member.Alive = true
+		case redis.ErrNil:
+		default:
+			return nil, err
+		}
+		member.Id = id
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// Resync replaces my services, routes, certs, webhooks, and tokens with the
+// other members'
+func (r *Redis) Resync() error {
+	if isDegraded() {
+		return DegradedError
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	// so i'm not asked for mine
+	_, err := conn.Do("SREM", "members", self)
+	if err != nil {
+		return err
+	}
+	err = r.reconcile()
+	r.beat(conn)
+	_, aerr := conn.Do("SADD", "members", self)
+	if err != nil {
+		return err
+	}
+	return aerr
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -931,65 +1355,430 @@ func (r *Redis) GetCerts() ([]core.CertBundle, error) {
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
-// PRIVATE
-////////////////////////////////////////////////////////////////////////////////
+// GetVips gets a list of vips from the database, or another cluster member.
+func (r *Redis) GetVips() ([]core.Vip, error) {
+	if database.CentralStore {
+		return database.GetVips()
+	}
 
-// cleanup cleans up members not present after ttl seconds
-func (r Redis) cleanup() {
-	// cycle every second to check for dead members
-	tick := time.Tick(time.Second)
 	conn := pool.Get()
 	defer conn.Close()
 
-	for _ = range tick {
-		// get list of members that should be alive
-		members, err := redis.Strings(conn.Do("SMEMBERS", "members"))
-		if err != nil {
-			config.Log.Error("[cluster] - Failed to reach redis for cleanup - %s", err)
-			// clear balancer rules ("stop balancing if we are 'dead'")
-			balance.SetServices(make([]core.Service, 0, 0))
-			os.Exit(1)
-		}
-		for _, member := range members {
-			// if the member timed out, remove the member from the member set
-			exist, _ := redis.Int(conn.Do("EXISTS", member))
-			if exist == 0 {
-				conn.Do("SREM", "members", member)
-				config.Log.Info("[cluster] - Member '%s' assumed dead. Removed.", member)
-			}
-		}
+	// get known members(other than me) to 'poll' for vips
+	members, _ := redis.Strings(conn.Do("SMEMBERS", "members"))
+	if len(members) == 0 {
+		// should only happen on new cluster
+		// assume i'm ok to be master so don't reset imported vips
+		config.Log.Trace("[cluster] - Assuming OK to be master, using vips from my database...")
+		return common.GetVips()
+	}
+	for i := range members {
+		if members[i] == self {
+			// if i'm in the list of members, new requests should have failed while `waitForMembers`ing
+			config.Log.Trace("[cluster] - Assuming I was in sync, using vips from my database...")
+			return common.GetVips()
+		}
+	}
+
+	c, err := redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(15*time.Second), redis.DialPassword(config.ClusterToken))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach redis for vips subscriber - %s", err)
+	}
+	defer c.Close()
+
+	message := make(chan interface{})
+	subconn := redis.PubSubConn{Conn: c}
+
+	// subscribe to channel that vips will be published on
+	if err := subconn.Subscribe("vips"); err != nil {
+		return nil, fmt.Errorf("Failed to reach redis for vips subscriber - %s", err)
+	}
+	defer subconn.Close()
+
+	// listen always
+	go func() {
+		for {
+			message <- subconn.Receive()
+		}
+	}()
+
+	// todo: maybe use ttl?
+	// timeout is how long to wait for the listed members to come back online
+	timeout := time.After(time.Duration(20) * time.Second)
+
+	// loop attempts for timeout, allows last dead members to start back up
+	for {
+		select {
+		case <-timeout:
+			return nil, fmt.Errorf("Timed out waiting for vips from %s", strings.Join(members, ", "))
+		default:
+			// request vips from each member until successful
+			for _, member := range members {
+				// memberTimeout is how long to wait for a member to respond with list of vips
+				memberTimeout := time.After(3 * time.Second)
+
+				// ask a member for its vips
+				config.Log.Trace("[cluster] - Attempting to request vips from %s...", member)
+				_, err := conn.Do("PUBLISH", "portal", fmt.Sprintf("get-vips %s", member))
+				if err != nil {
+					return nil, err
+				}
+
+				// wait for member to respond
+				for {
+					select {
+					case <-memberTimeout:
+						config.Log.Debug("[cluster] - Timed out waiting for vips from %s", member)
+						goto nextVipMember
+					case msg := <-message:
+						switch v := msg.(type) {
+						case redis.Message:
+							config.Log.Trace("[cluster] - Received message on 'vips' channel")
+							var vips []core.Vip
+							err = parseBody(v.Data, &vips)
+							if err != nil {
+								return nil, fmt.Errorf("Failed to marshal vips - %s", err)
+							}
+							config.Log.Trace("[cluster] - Vips from cluster: %#v\n", vips)
+							return vips, nil
+						case error:
+							return nil, fmt.Errorf("Subscriber failed to receive vips - %s", v.Error())
+						}
+					}
+				}
+			nextVipMember:
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE
+////////////////////////////////////////////////////////////////////////////////
+
+// getWebhooks gets the webhooks from another cluster member. They're nil if
+// mine are already in sync, or shared through a central database.
+func (r Redis) getWebhooks() ([]core.Webhook, error) {
+	if database.CentralStore {
+		return nil, nil
+	}
+	var hooks []core.Webhook
+	asked, err := r.fromMembers("webhooks", &hooks)
+	if err != nil || !asked {
+		return nil, err
+	}
+	if hooks == nil {
+		hooks = []core.Webhook{}
+	}
+	return hooks, nil
+}
+
+// getTokens gets the named tokens from another cluster member. They're nil if
+// mine are already in sync, or shared through a central database.
+func (r Redis) getTokens() ([]core.Token, error) {
+	if database.CentralStore {
+		return nil, nil
+	}
+	var tokens []core.Token
+	asked, err := r.fromMembers("tokens", &tokens)
+	if err != nil || !asked {
+		return nil, err
+	}
+	if tokens == nil {
+		tokens = []core.Token{}
+	}
+	return tokens, nil
+}
+
+// fromMembers asks the other members, one at a time, for what they have (the
+// channel they publish it on, "webhooks" or "tokens"), unmarshaling the first answer into
+// v. Nobody is asked if there are no others, or i'm already a member.
+func (r Redis) fromMembers(what string, v interface{}) (bool, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	members, _ := redis.Strings(conn.Do("SMEMBERS", "members"))
+	if len(members) == 0 {
+		config.Log.Trace("[cluster] - Assuming OK to be master, using %s from my database...", what)
+		return false, nil
+	}
+	for i := range members {
+		if members[i] == self {
+			config.Log.Trace("[cluster] - Assuming I was in sync, using %s from my database...", what)
+			return false, nil
+		}
+	}
+
+	c, err := redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(15*time.Second), redis.DialPassword(config.ClusterToken))
+	if err != nil {
+		return false, fmt.Errorf("Failed to reach redis for %s subscriber - %s", what, err)
+	}
+	defer c.Close()
+
+	message := make(chan interface{})
+	subconn := redis.PubSubConn{Conn: c}
+	if err := subconn.Subscribe(what); err != nil {
+		return false, fmt.Errorf("Failed to reach redis for %s subscriber - %s", what, err)
+	}
+	defer subconn.Close()
+
+	go func() {
+		for {
+			msg := subconn.Receive()
+			message <- msg
+			if _, ok := msg.(error); ok {
+				return
+			}
+		}
+	}()
+
+	// timeout is how long to wait for the listed members to come back online
+	timeout := time.After(20 * time.Second)
+	for {
+		for _, member := range members {
+			select {
+			case <-timeout:
+				return false, fmt.Errorf("Timed out waiting for %s from %s", what, strings.Join(members, ", "))
+			default:
+			}
+
+			config.Log.Trace("[cluster] - Attempting to request %s from %s...", what, member)
+			_, err := conn.Do("PUBLISH", "portal", fmt.Sprintf("get-%s %s", what, member))
+			if err != nil {
+				return false, err
+			}
+
+			// memberTimeout is how long to wait for a member to respond
+			memberTimeout := time.After(3 * time.Second)
+		wait:
+			for {
+				select {
+				case <-memberTimeout:
+					config.Log.Debug("[cluster] - Timed out waiting for %s from %s", what, member)
+					break wait
+				case msg := <-message:
+					switch m := msg.(type) {
+					case redis.Message:
+						if err = parseBody(m.Data, v); err != nil {
+							return false, fmt.Errorf("Failed to marshal %s - %s", what, err)
+						}
+						return true, nil
+					case error:
+						return false, fmt.Errorf("Subscriber failed to receive %s - %s", what, m.Error())
+					}
+				}
+			}
+		}
+	}
+}
+
+// cleanup cleans up members not present after ttl seconds
+func (r Redis) cleanup() {
+	// cycle every second to check for dead members
+	tick := time.Tick(time.Second)
+
+	for _ = range tick {
+		// others are cleaned up once i've rejoined
+		if isDegraded() {
+			continue
+		}
+		conn := pool.Get()
+		// get list of members that should be alive
+		members, err := redis.Strings(conn.Do("SMEMBERS", "members"))
+		if err != nil {
+			conn.Close()
+			r.fail("Failed to reach redis for cleanup", err)
+			continue
+		}
+		for _, member := range members {
+			// if the member timed out, remove the member from the member set
+			exist, _ := redis.Int(conn.Do("EXISTS", member))
+			if exist == 0 {
+				conn.Do("SREM", "members", member)
+				config.Log.Info("[cluster] - Member '%s' assumed dead. Removed.", member)
+			}
+		}
+		conn.Close()
 	}
-	conn.Close()
 }
 
 // heartbeat records that the member is still alive
 func (r Redis) heartbeat() {
 	tick := time.Tick(beat)
-	// write timeout set in connection pool so each 'beat' ensures we can talk to redis (network partition) (rather than create new connection)
-	conn := pool.Get()
-	defer conn.Close()
 
 	for _ = range tick {
+		// rejoining re-adds me
+		if isDegraded() {
+			continue
+		}
 		config.Log.Trace("[cluster] - Heartbeat...")
-		_, err := conn.Do("SET", self, "alive", "EX", ttl)
+		// write timeout set in connection pool so each 'beat' ensures we can talk to redis (network partition)
+		conn := pool.Get()
+		err := r.beat(conn)
 		if err != nil {
 			conn.Close()
-			config.Log.Error("[cluster] - Failed to heartbeat - %s", err)
-			// clear balancer rules ("stop balancing if we are 'dead'")
-			balance.SetServices(make([]core.Service, 0, 0))
-			os.Exit(1)
+			r.fail("Failed to heartbeat", err)
+			continue
 		}
 		// re-add ourself to member list (just in case)
 		_, err = conn.Do("SADD", "members", self)
+		conn.Close()
 		if err != nil {
-			conn.Close()
-			config.Log.Error("[cluster] - Failed to add myself to list of members - %s", err)
-			// clear balancer rules ("stop balancing if we are 'dead'")
-			balance.SetServices(make([]core.Service, 0, 0))
-			os.Exit(1)
+			r.fail("Failed to add myself to list of members", err)
+		}
+	}
+}
+
+// beat records that i'm alive, with my status (or just "alive" if my config
+// can't be hashed)
+func (r Redis) beat(conn redis.Conn) error {
+	var value interface{} = "alive"
+	if h := statusHashes(); h != nil {
+		b, err := json.Marshal(MemberStatus{
+			Id:        self,
+			Alive:     true,
+			Heartbeat: time.Now().UTC(),
+			Version:   Version,
+			Hashes:    h,
+		})
+		if err == nil {
+			value = b
+		}
+	}
+	_, err := conn.Do("SET", self, value, "EX", ttl)
+	return err
+}
+
+// statusHashes returns my config's hashes, only rehashing it once it's changed
+func statusHashes() map[string]string {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+
+	// changes made while hashing set it again
+	if atomic.SwapInt32(&rehash, 0) == 1 {
+		status, err := status()
+		if err != nil {
+			atomic.StoreInt32(&rehash, 1)
+			config.Log.Error("[cluster] - Failed to hash my config, heartbeating without it - %s", err)
+			return nil
+		}
+		hashes = status.Hashes
+	}
+	return hashes
+}
+
+// configChanged marks my config as changed, to rehash it on the next heartbeat
+func configChanged() {
+	atomic.StoreInt32(&rehash, 1)
+}
+
+// fail stops balancing and exits, as the other members will assume i'm dead.
+// With config.ClusterDegraded, i keep balancing what i have instead, rejecting
+// changes until i've reconnected and caught up with the others.
+func (r Redis) fail(msg string, err error) {
+	subconnMu.Lock()
+	old := subconn
+	subconnMu.Unlock()
+
+	lost(fmt.Sprintf("%s - %s", msg, err), r.rejoin)
+	// stop its subscriber, rejoining starts another (both would apply changes)
+	old.Close()
+}
+
+// rejoin resubscribes, then replaces my config with the cluster's (changes
+// made by others in the meantime stay queued on the new subscription until it's
+// applied) before adding me back as a member
+func (r Redis) rejoin() error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	// others don't wait for, or ask, me while i catch up
+	_, err := conn.Do("SREM", "members", self)
+	if err != nil {
+		return err
+	}
+
+	s, err := redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(30*time.Second), redis.DialPassword(config.ClusterToken))
+	if err != nil {
+		return fmt.Errorf("Failed to reach redis for subconn - %s", err)
+	}
+	sub := redis.PubSubConn{Conn: s}
+	if err = sub.Subscribe("portal", "events"); err != nil {
+		s.Close()
+		return err
+	}
+
+	err = r.reconcile()
+	if err == nil {
+		r.beat(conn)
+		_, err = conn.Do("SADD", "members", self)
+	}
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	subconnMu.Lock()
+	subconn = sub
+	subconnMu.Unlock()
+	go r.subscribe(sub)
+	return nil
+}
+
+// reconcile applies the cluster's vips, services, routes, certs, webhooks, and
+// tokens
+func (r Redis) reconcile() error {
+	defer configChanged()
+
+	vips, err := r.GetVips()
+	if err != nil {
+		return fmt.Errorf("Failed to get vips - %s", err)
+	}
+	services, err := r.GetServices()
+	if err != nil {
+		return fmt.Errorf("Failed to get services - %s", err)
+	}
+	routes, err := r.GetRoutes()
+	if err != nil {
+		return fmt.Errorf("Failed to get routes - %s", err)
+	}
+	certs, err := r.GetCerts()
+	if err != nil {
+		return fmt.Errorf("Failed to get certs - %s", err)
+	}
+	hooks, err := r.getWebhooks()
+	if err != nil {
+		return fmt.Errorf("Failed to get webhooks - %s", err)
+	}
+	tokens, err := r.getTokens()
+	if err != nil {
+		return fmt.Errorf("Failed to get tokens - %s", err)
+	}
+
+	config.Log.Trace("[cluster] - Reconciling with the cluster...")
+	if err = common.SetVips(vips); err != nil {
+		return fmt.Errorf("Failed to set vips - %s", err)
+	}
+	if err = common.SetServices(services); err != nil {
+		return fmt.Errorf("Failed to set services - %s", err)
+	}
+	if err = common.SetRoutes(routes); err != nil {
+		return fmt.Errorf("Failed to set routes - %s", err)
+	}
+	if err = common.SetCerts(certs); err != nil {
+		return fmt.Errorf("Failed to set certs - %s", err)
+	}
+	if hooks != nil {
+		if err = common.Batch([]core.Op{{Action: "set-webhooks", Webhooks: hooks}}); err != nil {
+			return fmt.Errorf("Failed to set webhooks - %s", err)
+		}
+	}
+	if tokens != nil {
+		if err = common.Batch([]core.Op{{Action: "set-tokens", Tokens: tokens}}); err != nil {
+			return fmt.Errorf("Failed to set tokens - %s", err)
 		}
 	}
+	return nil
 }
 
 // creates a redis connection pool to use
@@ -1014,13 +1803,24 @@ func (r Redis) newPool(server, password string) *redis.Pool {
 }
 
 // subscribe listens on the portal channel and acts based on messages received
-func (r Redis) subscribe() {
+func (r Redis) subscribe(sub redis.PubSubConn) {
 	config.Log.Info("[cluster] - Redis subscribing on %s...", config.ClusterConnection)
 
 	// listen for published messages
 	for {
-		switch v := r.subconn.Receive().(type) {
+		switch v := sub.Receive().(type) {
 		case redis.Message:
+			// EVENTS ///////////////////////////////////////////////////////////////////////////////////////////////
+			if v.Channel == "events" {
+				var events []core.Event
+				err := json.Unmarshal(v.Data, &events)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to marshal events - %s", err)
+					break
+				}
+				broadcast(events)
+				break
+			}
 			switch pdata := strings.FieldsFunc(string(v.Data), keepSubstrings); pdata[0] {
 			// SERVICES ///////////////////////////////////////////////////////////////////////////////////////////////
 			case "get-services":
@@ -1355,16 +2155,183 @@ func (r Redis) subscribe() {
 				conn.Do("SADD", actionHash, self)
 				conn.Close()
 				config.Log.Debug("[cluster] - delete-cert successful")
+			// VIPS ///////////////////////////////////////////////////////////////////////////////////////////////
+			case "get-vips":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - member not passed in message")
+					break
+				}
+
+				member := pdata[1]
+
+				if member == self {
+					vps, err := common.GetVips()
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to get vips - %s", err)
+						break
+					}
+					vips, err := json.Marshal(vps)
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to marshal vips - %s", err)
+						break
+					}
+					config.Log.Debug("[cluster] - get-vips requested, publishing my vips")
+					conn := pool.Get()
+					conn.Do("PUBLISH", "vips", fmt.Sprintf("%s", vips))
+					conn.Close()
+				}
+			case "set-vips":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - vips not passed in message")
+					break
+				}
+				var vips []core.Vip
+				err := parseBody([]byte(pdata[1]), &vips)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to marshal vips - %s", err)
+					break
+				}
+				err = common.SetVips(vips)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to set vips - %s", err)
+					break
+				}
+				actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vips %v", vips))))
+				config.Log.Trace("[cluster] - set-vips hash - %s", actionHash)
+				conn := pool.Get()
+				conn.Do("SADD", actionHash, self)
+				conn.Close()
+				config.Log.Debug("[cluster] - set-vips successful")
+			case "set-vip":
+				if len(pdata) != 2 {
+					// shouldn't happen unless redis is not secure and someone manually `publishJson`es
+					config.Log.Error("[cluster] - vip not passed in message")
+					break
+				}
+				var vip core.Vip
+				err := parseBody([]byte(pdata[1]), &vip)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to marshal vip - %s", err)
+					break
+				}
+				err = common.SetVip(vip)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to set vip - %s", err)
+					break
+				}
+				actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("set-vip %v", vip))))
+				config.Log.Trace("[cluster] - set-vip hash - %s", actionHash)
+				conn := pool.Get()
+				conn.Do("SADD", actionHash, self)
+				conn.Close()
+				config.Log.Debug("[cluster] - set-vip successful")
+			case "delete-vip":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - vip not passed in message")
+					break
+				}
+				var vip core.Vip
+				err := parseBody([]byte(pdata[1]), &vip)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to marshal vip - %s", err)
+					break
+				}
+				err = common.DeleteVip(vip)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to delete vip - %s", err)
+					break
+				}
+				actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("delete-vip %v", vip))))
+				config.Log.Trace("[cluster] - delete-vip hash - %s", actionHash)
+				conn := pool.Get()
+				conn.Do("SADD", actionHash, self)
+				conn.Close()
+				config.Log.Debug("[cluster] - delete-vip successful")
+			// WEBHOOKS ///////////////////////////////////////////////////////////////////////////////////////////////
+			case "get-webhooks":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - member not passed in message")
+					break
+				}
+
+				if pdata[1] == self {
+					hks, err := database.GetWebhooks()
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to get webhooks - %s", err)
+						break
+					}
+					hooks, err := json.Marshal(hks)
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to marshal webhooks - %s", err)
+						break
+					}
+					config.Log.Debug("[cluster] - get-webhooks requested, publishing my webhooks")
+					conn := pool.Get()
+					conn.Do("PUBLISH", "webhooks", fmt.Sprintf("%s", hooks))
+					conn.Close()
+				}
+			// TOKENS ///////////////////////////////////////////////////////////////////////////////////////////////
+			case "get-tokens":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - member not passed in message")
+					break
+				}
+
+				if pdata[1] == self {
+					tkns, err := database.GetTokens()
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to get tokens - %s", err)
+						break
+					}
+					tokens, err := json.Marshal(tkns)
+					if err != nil {
+						config.Log.Error("[cluster] - Failed to marshal tokens - %s", err)
+						break
+					}
+					config.Log.Debug("[cluster] - get-tokens requested, publishing my tokens")
+					conn := pool.Get()
+					conn.Do("PUBLISH", "tokens", fmt.Sprintf("%s", tokens))
+					conn.Close()
+				}
+			// BATCH ///////////////////////////////////////////////////////////////////////////////////////////////
+			case "batch":
+				if len(pdata) != 2 {
+					config.Log.Error("[cluster] - ops not passed in message")
+					break
+				}
+				var ops []core.Op
+				err := json.Unmarshal([]byte(pdata[1]), &ops)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to marshal ops - %s", err)
+					break
+				}
+				err = common.Batch(ops)
+				if err != nil {
+					config.Log.Error("[cluster] - Failed to apply batch - %s", err)
+					break
+				}
+				actionHash := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("batch %s", pdata[1]))))
+				config.Log.Trace("[cluster] - batch hash - %s", actionHash)
+				conn := pool.Get()
+				conn.Do("SADD", actionHash, self)
+				conn.Close()
+				config.Log.Debug("[cluster] - batch successful")
 			default:
 				config.Log.Error("[cluster] - Recieved unknown data on %s: %s", v.Channel, string(v.Data))
 			}
+			if !strings.HasPrefix(string(v.Data), "get-") {
+				configChanged()
+			}
 		case error:
+			if isDegraded() {
+				// closed by fail, a new subscriber is started once rejoined
+				return
+			}
 			config.Log.Error("[cluster] - Subscriber failed to receive - %s", v.Error())
-			if strings.Contains(v.Error(), "closed network connection") {
-				// clear balancer rules ("stop balancing if we are 'dead'")
-				balance.SetServices(make([]core.Service, 0, 0))
-				// exit so we don't get spammed with logs
-				os.Exit(1)
+			if sub.Conn.Err() != nil {
+				// exits, unless config.ClusterDegraded
+				r.fail("Subscriber lost redis", v)
+				return
 			}
 			continue
 		}
@@ -1409,6 +2376,11 @@ func (r Redis) waitForMembers(conn redis.Conn, actionHash string) error {
 	// clear cruft
 	defer conn.Do("DEL", actionHash)
 
+	start := time.Now()
+	observe := func(result string) {
+		ackDuration.Observe(time.Since(start).Seconds(), result)
+	}
+
 	// todo: make timeout configurable
 	// timeout is the amount of time to wait for members to apply the action
 	timeout := time.After(30 * time.Second)
@@ -1421,14 +2393,17 @@ func (r Redis) waitForMembers(conn redis.Conn, actionHash string) error {
 			// compare who we know about, to who performed the update
 			list, err = redis.Strings(conn.Do("SDIFF", "members", actionHash))
 			if err != nil {
+				observe("error")
 				return err
 			}
 			if len(list) == 0 {
 				// if all members respond, all is well
+				observe("ok")
 				return nil
 			}
 		// if members don't respond in time, return error
 		case <-timeout:
+			observe("timeout")
 			return fmt.Errorf("Member(s) '%s' failed to set-service", list)
 		}
 	}
@@ -1,11 +1,13 @@
 package cluster_test
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,31 +35,37 @@ var (
 	cert      = "-----BEGIN CERTIFICATE-----\nMIIDXTCCAkWgAwIBAgIJAL/FFFuKTjwRMA0GCSqGSIb3DQEBCwUAMEUxCzAJBgNV\nBAYTAlVTMQswCQYDVQQIDAJJRDETMBEGA1UECgwKbmFub2JveC5pbzEUMBIGA1UE\nAwwLcG9ydGFsLnRlc3QwHhcNMTYwMzIzMTQ1NjMzWhcNMTcwMzIzMTQ1NjMzWjBF\nMQswCQYDVQQGEwJVUzELMAkGA1UECAwCSUQxEzARBgNVBAoMCm5hbm9ib3guaW8x\nFDASBgNVBAMMC3BvcnRhbC50ZXN0MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIB\nCgKCAQEAm2Qq+2Tiq01TnV6cGrW6xi5fL+EkXSXde8rPhpv1U6HvaBeBTExqtNmo\nLZnoj3mkB6Z2l1uXK/KBAd/auNElczxGSJE+p+b21o/kjKRh9f6aaNOx/2jRFNAQ\ncHYL0kftrFPsqXl9OEULkuqXU7l4cuJDaDWiiFsjuzqivTNB5/P8dsi8mYSrbOIJ\n/N+SBEIi1kkhNISv0NMql6cdh8ZB9eBfq3RQ8TJ+0rRGaMqE2laRkEaSDunrXo4P\nQaAzF4Uge1YIjuYby8KeN9+rW1qVWnXqpEumFvleXLPeSxN/qGCupeWMs+e9gamT\nNAmorX4f/+9dJW7YXuqefks7DW/0OQIDAQABo1AwTjAdBgNVHQ4EFgQU66LzKbHE\nyE9LCnaqkcEwOeVQ3fgwHwYDVR0jBBgwFoAU66LzKbHEyE9LCnaqkcEwOeVQ3fgw\nDAYDVR0TBAUwAwEB/zANBgkqhkiG9w0BAQsFAAOCAQEAQ2lAzHHyJfyONWfcao6C\nOz5k8Il4eJ3d55qqYvyVBBWp/sFIh9aLGDazbaX7sO55cur/uWp0SiiMw/tt+2nG\n6Yn08l1FeSBDXwvrFOJXScSMEb7Ttl3y2qfJ3z6/rPx6eIBU0c/uzAH+sHiIQNJ1\n7FXD7CvGSIzxU0UU1LEsgM0o5HrOLPubsHmKruM8hcKxHkj9pXKIgY4SJe4BOhwm\nbVh43+VrCDNJf79/KmWrwFXFMg2QvsGS673ps1uGEafGj5vzX4n9S0aCV71ser5P\nmVX2N3jj2WgiYIXI5SmH3BlfR5aGWq4Fq124gi9dxkZljFTolTc6aYyQu0i40B0X\nzQ==\n-----END CERTIFICATE-----"
 	testCert  = core.CertBundle{Key: key, Cert: cert}
 	testRoute = core.Route{Domain: "portal.test", Page: "routing works\n"}
+	testVip   = core.Vip{Ip: "192.168.0.100", Interface: "eth0", Alias: "eth0:1"}
+	testVip2  = core.Vip{Ip: "192.168.0.101", Interface: "eth0", Alias: "eth0:2", Preempt: true}
 )
 
 func TestMain(m *testing.M) {
 	// clean test dir
 	os.RemoveAll("/tmp/clusterTest")
 
-	// initialize backend if redis-server found
+	// initialize backend, the redis tests skip without a redis to connect to
 	initialize()
 
-	conn, err := redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(30*time.Second), redis.DialPassword(config.ClusterToken))
-	if err != nil {
-		return
+	var conn redis.Conn
+	if !skip {
+		var err error
+		conn, err = redis.DialURL(config.ClusterConnection, redis.DialConnectTimeout(30*time.Second), redis.DialPassword(config.ClusterToken))
+		if err != nil {
+			fmt.Printf("Failed to connect to redis - %s\n", err)
+			os.Exit(1)
+		}
 	}
-	hostname, _ := os.Hostname()
-	self := fmt.Sprintf("%s:%s", hostname, config.ApiPort)
-	defer conn.Do("SREM", "members", self)
-	defer conn.Close()
 
 	rtn := m.Run()
 
 	// clean test dir
 	os.RemoveAll("/tmp/clusterTest")
 	// just in case, ensure clean members
-	conn.Do("SREM", "members", self)
-	conn.Close()
+	if conn != nil {
+		hostname, _ := os.Hostname()
+		conn.Do("SREM", "members", fmt.Sprintf("%s:%s", hostname, config.ApiPort))
+		conn.Close()
+	}
 
 	os.Exit(rtn)
 }
@@ -334,7 +342,7 @@ func TestDeleteRoute(t *testing.T) {
 	// don't use cluster.GetRoutes()
 	routes, err := database.GetRoutes()
 	if len(routes) != 0 {
-		t.Error("Failed to DELETE route - %s", err)
+		t.Errorf("Failed to DELETE route - %s", err)
 	}
 }
 
@@ -411,7 +419,82 @@ func TestDeleteCert(t *testing.T) {
 	// don't use cluster.GetCerts()
 	certs, err := database.GetCerts()
 	if len(certs) != 0 {
-		t.Error("Failed to DELETE cert - %s", err)
+		t.Errorf("Failed to DELETE cert - %s", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VIPS
+////////////////////////////////////////////////////////////////////////////////
+func TestSetVips(t *testing.T) {
+	if skip {
+		t.SkipNow()
+	}
+	vipmgr.Vip = &vipRecorder{bound: map[string]bool{}}
+	peer := newVipPeer(t, "peer:8443")
+	if err := cluster.SetVips([]core.Vip{testVip}); err != nil {
+		t.Errorf("Failed to SET vips - %s", err)
+		t.FailNow()
+	}
+
+	// don't use cluster.GetVips()
+	vips, err := database.GetVips()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(vips) != 1 || vips[0].Ip != testVip.Ip {
+		t.Errorf("Read vip differs from written vip")
+	}
+	if vips = peer.get(); len(vips) != 1 || vips[0] != testVip {
+		t.Errorf("Expected the peer to have the vip - %+v", vips)
+	}
+}
+
+func TestGetVips(t *testing.T) {
+	if skip {
+		t.SkipNow()
+	}
+
+	// added on a peer too
+	peer := newVipPeer(t, "peer:8443", testVip)
+	if err := cluster.SetVip(testVip2); err != nil {
+		t.Fatalf("Failed to SET vip - %s", err)
+	}
+
+	vips, err := cluster.GetVips()
+	if err != nil {
+		t.Errorf("Failed to GET vips - %s", err)
+		t.FailNow()
+	}
+
+	if len(vips) != 2 || vips[0] != testVip || vips[1] != testVip2 {
+		t.Errorf("Read vip differs from written vip")
+	}
+	if peerVips := peer.get(); fmt.Sprint(peerVips) != fmt.Sprint(vips) {
+		t.Errorf("Expected the peer to have the same vips - %+v", peerVips)
+	}
+}
+
+func TestDeleteVip(t *testing.T) {
+	if skip {
+		t.SkipNow()
+	}
+	peer := newVipPeer(t, "peer:8443", testVip, testVip2)
+	for _, vip := range []core.Vip{testVip, testVip2} {
+		if err := cluster.DeleteVip(vip); err != nil {
+			t.Errorf("Failed to DELETE vip - %s", err)
+			t.FailNow()
+		}
+	}
+
+	// don't use cluster.GetVips()
+	vips, err := database.GetVips()
+	if len(vips) != 0 {
+		t.Errorf("Failed to DELETE vip - %s", err)
+	}
+	if vips = peer.get(); len(vips) != 0 {
+		t.Errorf("Expected the peer to delete the vip - %+v", vips)
 	}
 }
 
@@ -649,7 +732,7 @@ func TestNoneDeleteRoute(t *testing.T) {
 	// don't use cluster.GetRoutes()
 	routes, err := database.GetRoutes()
 	if len(routes) != 0 {
-		t.Error("Failed to DELETE route - %s", err)
+		t.Errorf("Failed to DELETE route - %s", err)
 	}
 }
 
@@ -714,7 +797,129 @@ func TestNoneDeleteCert(t *testing.T) {
 	// don't use cluster.GetCerts()
 	certs, err := database.GetCerts()
 	if len(certs) != 0 {
-		t.Error("Failed to DELETE cert - %s", err)
+		t.Errorf("Failed to DELETE cert - %s", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// MEMBERS
+////////////////////////////////////////////////////////////////////////////////
+func TestMembers(t *testing.T) {
+	if skip {
+		t.SkipNow()
+	}
+	hostname, _ := os.Hostname()
+	self := fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+
+	members, err := cluster.Members()
+	if err != nil {
+		t.Fatalf("Failed to get members - %s", err)
+	}
+	mine := func(members []cluster.MemberStatus) cluster.MemberStatus {
+		for _, member := range members {
+			if member.Id == self {
+				return member
+			}
+		}
+		t.Fatalf("Expected myself among members - %+v", members)
+		return cluster.MemberStatus{}
+	}
+	member := mine(members)
+	if !member.Alive || len(member.Hashes) != 4 {
+		t.Errorf("Unexpected status for myself - %+v", member)
+	}
+
+	// the next heartbeat (resyncing beats) reports the change
+	if err = cluster.SetRoutes([]core.Route{{Domain: "members.test", Page: "members\n"}}); err != nil {
+		t.Fatalf("Failed to set routes - %s", err)
+	}
+	if err = cluster.Resync(); err != nil {
+		t.Fatalf("Failed to resync - %s", err)
+	}
+	members, err = cluster.Members()
+	if err != nil {
+		t.Fatalf("Failed to get members - %s", err)
+	}
+	if mine(members).Hashes["routes"] == member.Hashes["routes"] {
+		t.Errorf("Expected my routes' hash to change - %+v", mine(members))
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	if skip {
+		t.SkipNow()
+	}
+	// the none tests unset it
+	connection := config.ClusterConnection
+	config.ClusterConnection, config.ClusterDegraded = "redis://127.0.0.1:6379", true
+	defer func() { config.ClusterConnection, config.ClusterDegraded = connection, false }()
+	hostname, _ := os.Hostname()
+	self := fmt.Sprintf("%s:%s", hostname, config.ApiPort)
+
+	conn, err := redis.DialURL(config.ClusterConnection)
+	if err != nil {
+		t.Fatalf("Failed to reach redis - %s", err)
+	}
+	defer conn.Close()
+
+	// mine, until replaced by the cluster's
+	if err = database.SetRoutes([]core.Route{testRoute}); err != nil {
+		t.Fatal(err)
+	}
+
+	// break my subscription
+	if _, err = conn.Do("CLIENT", "KILL", "TYPE", "pubsub"); err != nil {
+		t.Fatalf("Failed to kill subscribers - %s", err)
+	}
+
+	// another member, whose routes i take when i rejoin
+	other := "other:8443"
+	otherRoute := core.Route{Domain: "other.test", Page: "other\n"}
+	if _, err = conn.Do("SET", other, "alive", "EX", 60); err == nil {
+		_, err = conn.Do("SADD", "members", other)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConn := fakeMember(t, other, []core.Route{otherRoute})
+	defer func() {
+		otherConn.Close()
+		conn.Do("SREM", "members", other)
+		conn.Do("DEL", other)
+	}()
+
+	eventually(t, "the cluster's routes to be reconciled", func() bool {
+		routes, _ := database.GetRoutes()
+		return len(routes) == 1 && routes[0].Domain == otherRoute.Domain
+	})
+	// added back once reconciled
+	eventually(t, "to be a member again", func() bool {
+		members, _ := redis.Strings(conn.Do("SMEMBERS", "members"))
+		for i := range members {
+			if members[i] == self {
+				return true
+			}
+		}
+		return false
+	})
+
+	// only one subscriber is left to receive
+	events, unsubscribe := cluster.Subscribe()
+	defer unsubscribe()
+	if err = (&cluster.Redis{}).Notify([]core.Event{{Op: core.Op{Action: "set-route", Route: &testRoute}, Member: self}}); err != nil {
+		t.Fatalf("Failed to notify - %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+			if i == 1 {
+				t.Errorf("Expected the event once")
+			}
+		case <-time.After(time.Second):
+			if i == 0 {
+				t.Errorf("Expected the event")
+			}
+		}
 	}
 }
 
@@ -729,53 +934,242 @@ func toJson(v interface{}) ([]byte, error) {
 	return jsonified, nil
 }
 
+// fakeMember answers requests for member's vips, services, routes, and certs
+// (empty, but for the routes), until the returned conn is closed
+func fakeMember(t *testing.T, member string, routes []core.Route) redis.Conn {
+	sub, err := redis.DialURL(config.ClusterConnection)
+	if err != nil {
+		t.Fatalf("Failed to reach redis - %s", err)
+	}
+	pub, err := redis.DialURL(config.ClusterConnection)
+	if err != nil {
+		t.Fatalf("Failed to reach redis - %s", err)
+	}
+	subconn := redis.PubSubConn{Conn: sub}
+	if err = subconn.Subscribe("portal"); err != nil {
+		t.Fatalf("Failed to subscribe - %s", err)
+	}
+	b, _ := json.Marshal(routes)
+
+	go func() {
+		defer pub.Close()
+		for {
+			switch v := subconn.Receive().(type) {
+			case redis.Message:
+				fields := strings.Fields(string(v.Data))
+				if len(fields) != 2 || fields[1] != member || !strings.HasPrefix(fields[0], "get-") {
+					continue
+				}
+				data := "[]"
+				if fields[0] == "get-routes" {
+					data = string(b)
+				}
+				pub.Do("PUBLISH", strings.TrimPrefix(fields[0], "get-"), data)
+			case error:
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+// vipPeer is another member, applying and acking the vips published
+type vipPeer struct {
+	sync.Mutex
+	vips []core.Vip
+}
+
+// newVipPeer adds member to the cluster, with vips, until the test ends
+func newVipPeer(t *testing.T, member string, vips ...core.Vip) *vipPeer {
+	sub, err := redis.DialURL(config.ClusterConnection)
+	if err != nil {
+		t.Fatalf("Failed to reach redis - %s", err)
+	}
+	pub, err := redis.DialURL(config.ClusterConnection)
+	if err != nil {
+		t.Fatalf("Failed to reach redis - %s", err)
+	}
+	subconn := redis.PubSubConn{Conn: sub}
+	if err = subconn.Subscribe("portal"); err == nil {
+		// subscribed before it's a member
+		if _, ok := subconn.Receive().(redis.Subscription); !ok {
+			err = fmt.Errorf("Expected a subscription")
+		}
+	}
+	if err == nil {
+		_, err = pub.Do("SET", member, "alive", "EX", 60)
+	}
+	if err == nil {
+		_, err = pub.Do("SADD", "members", member)
+	}
+	if err != nil {
+		t.Fatalf("Failed to add peer - %s", err)
+	}
+
+	p := &vipPeer{vips: vips}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			switch v := subconn.Receive().(type) {
+			case redis.Message:
+				fields := strings.SplitN(string(v.Data), " ", 2)
+				if len(fields) != 2 {
+					continue
+				}
+				var ack string
+				p.Lock()
+				switch fields[0] {
+				case "set-vips":
+					var vips []core.Vip
+					json.Unmarshal([]byte(fields[1]), &vips)
+					p.vips = vips
+					ack = fmt.Sprintf("set-vips %v", vips)
+				case "set-vip", "delete-vip":
+					var vip core.Vip
+					json.Unmarshal([]byte(fields[1]), &vip)
+					// like the database, a vip already set is left as it is
+					vips, found := []core.Vip{}, false
+					for i := range p.vips {
+						if p.vips[i].Ip == vip.Ip && p.vips[i].Interface == vip.Interface {
+							found = true
+							if fields[0] == "delete-vip" {
+								continue
+							}
+						}
+						vips = append(vips, p.vips[i])
+					}
+					if fields[0] == "set-vip" && !found {
+						vips = append(vips, vip)
+					}
+					p.vips = vips
+					ack = fmt.Sprintf("%s %v", fields[0], vip)
+				}
+				p.Unlock()
+				if ack != "" {
+					pub.Do("SADD", fmt.Sprintf("%x", md5.Sum([]byte(ack))), member)
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		pub.Do("SREM", "members", member)
+		pub.Do("DEL", member)
+		sub.Close()
+		<-done
+		pub.Close()
+	})
+	return p
+}
+
+func (p *vipPeer) get() []core.Vip {
+	p.Lock()
+	defer p.Unlock()
+	return append([]core.Vip{}, p.vips...)
+}
+
 func initialize() {
 	rExec, err := exec.Command("redis-server", "-v").CombinedOutput()
 	if err != nil {
 		fmt.Printf("Failed to run redis-server - %s%s\n", rExec, err)
 		skip = true
 	}
+	if !skip {
+		conn, err := redis.DialURL("redis://127.0.0.1:6379", redis.DialConnectTimeout(time.Second))
+		if err != nil {
+			fmt.Printf("Failed to reach redis-server - %s\n", err)
+			skip = true
+		} else {
+			conn.Close()
+		}
+	}
 
 	config.RouteHttp = "0.0.0.0:9082"
 	config.RouteTls = "0.0.0.0:9445"
 	config.LogLevel = "FATAL"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
+	// the none tests only need the database, the redis tests need redis
+	config.ClusterConnection = "none://"
 	if !skip {
 		config.ClusterConnection = "redis://127.0.0.1:6379"
-		config.DatabaseConnection = "scribble:///tmp/clusterTest"
+	}
+	config.DatabaseConnection = "scribble:///tmp/clusterTest"
 
-		err = database.Init()
-		if err != nil {
-			fmt.Printf("database init failed - %s\n", err)
-			os.Exit(1)
-		}
+	err = database.Init()
+	if err != nil {
+		fmt.Printf("database init failed - %s\n", err)
+		os.Exit(1)
+	}
 
-		balance.Balancer = &database.ScribbleDatabase{}
-		err = balance.Balancer.Init()
-		if err != nil {
-			fmt.Printf("balance init failed - %s\n", err)
-			os.Exit(1)
-		}
+	balance.Balancer = &database.ScribbleDatabase{}
+	err = balance.Balancer.Init()
+	if err != nil {
+		fmt.Printf("balance init failed - %s\n", err)
+		os.Exit(1)
+	}
 
-		// initialize proxymgr
-		err = proxymgr.Init()
-		if err != nil {
-			fmt.Printf("Proxymgr init failed - %s\n", err)
-			os.Exit(1)
-		}
+	// initialize proxymgr
+	err = proxymgr.Init()
+	if err != nil {
+		fmt.Printf("Proxymgr init failed - %s\n", err)
+		os.Exit(1)
+	}
 
-		// initialize vipmgr
-		err = vipmgr.Init()
-		if err != nil {
-			fmt.Printf("Vipmgr init failed - %s\n", err)
-			os.Exit(1)
-		}
+	// initialize vipmgr
+	err = vipmgr.Init()
+	if err != nil {
+		fmt.Printf("Vipmgr init failed - %s\n", err)
+		os.Exit(1)
+	}
 
-		err = cluster.Init()
-		if err != nil {
-			fmt.Printf("Cluster init failed - %s\n", err)
-			os.Exit(1)
-		}
+	err = cluster.Init()
+	if err != nil {
+		fmt.Printf("Cluster init failed - %s\n", err)
+		os.Exit(1)
 	}
 }
+
+// vipRecorder records the vips added to the host
+type vipRecorder struct {
+	sync.Mutex
+	bound map[string]bool
+	adds  int
+}
+
+func (v *vipRecorder) Init() error { return nil }
+func (v *vipRecorder) SetVip(vip core.Vip) error {
+	v.Lock()
+	defer v.Unlock()
+	v.bound[vip.Ip] = true
+	v.adds++
+	return nil
+}
+func (v *vipRecorder) DeleteVip(vip core.Vip) error {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.bound, vip.Ip)
+	return nil
+}
+func (v *vipRecorder) SetVips(vips []core.Vip) error {
+	v.Lock()
+	defer v.Unlock()
+	v.bound = map[string]bool{}
+	for i := range vips {
+		v.bound[vips[i].Ip] = true
+	}
+	return nil
+}
+func (v *vipRecorder) GetVips() ([]core.Vip, error) { return nil, nil }
+func (v *vipRecorder) added() int {
+	v.Lock()
+	defer v.Unlock()
+	return v.adds
+}
+func (v *vipRecorder) has(ip string) bool {
+	v.Lock()
+	defer v.Unlock()
+	return v.bound[ip]
+}
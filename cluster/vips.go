@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/vipmgr"
+)
+
+var (
+	// VipInterval is how often vip ownership is checked (and renewed)
+	VipInterval = time.Second
+
+	// vips this member owns (and added to the host), by ip
+	owned   = map[string]core.Vip{}
+	ownedMu sync.Mutex
+)
+
+type (
+	// vipElector is a cluster that elects one alive member to own each vip
+	vipElector interface {
+		// candidate registers this member as a candidate to own the vip
+		candidate(vip core.Vip) error
+		// vipState returns the vip's owner ("" if it has none alive) and its alive
+		// candidates, with their priorities
+		vipState(vip core.Vip) (string, map[string]int, error)
+		// claimVip makes this member the vip's owner if its owner is still from
+		claimVip(vip core.Vip, from string) (bool, error)
+		// resignVip gives up the vip, if this member owns it, and its candidacy
+		resignVip(vip core.Vip) error
+	}
+)
+
+// electVips elects the owner of each of the vips this member has, adding those
+// it owns to the host and removing the rest, until stopped. vipmgr.Owns must be
+// set to ownsVip first, so vips aren't added to the host as they're set.
+func electVips(ctx context.Context, e vipElector) {
+	tick := time.NewTicker(VipInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, vip := range releaseVips() {
+				e.resignVip(vip)
+			}
+			return
+		case <-tick.C:
+			electOnce(e)
+		}
+	}
+}
+
+// electOnce runs an election for each vip this member has
+func electOnce(e vipElector) {
+	vips, err := database.GetVips()
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to get vips - %s", err)
+		return
+	}
+
+	has := map[string]bool{}
+	for _, vip := range vips {
+		has[vip.Ip] = true
+		err = e.candidate(vip)
+		if err == DegradedError {
+			// who owns them is unknown until rejoined
+			return
+		}
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to register for vip '%s' - %s", vip.Ip, err)
+			continue
+		}
+		owner, candidates, err := e.vipState(vip)
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to get owner of vip '%s' - %s", vip.Ip, err)
+			continue
+		}
+
+		if elected := electVip(vip, owner, candidates); elected == self && owner != self {
+			ok, err := e.claimVip(vip, owner)
+			if err != nil {
+				config.Log.Error("[cluster] - Failed to claim vip '%s' - %s", vip.Ip, err)
+				continue
+			}
+			if ok {
+				config.Log.Info("[cluster] - Elected owner of vip '%s' (from '%s')", vip.Ip, owner)
+				owner = self
+			}
+		}
+
+		if owner == self {
+			claimVip(vip)
+		} else {
+			releaseVip(vip)
+		}
+	}
+
+	// deleted here
+	ownedMu.Lock()
+	gone := []core.Vip{}
+	for ip, vip := range owned {
+		if !has[ip] {
+			gone = append(gone, vip)
+			delete(owned, ip)
+		}
+	}
+	ownedMu.Unlock()
+	for _, vip := range gone {
+		if err = e.resignVip(vip); err != nil {
+			config.Log.Error("[cluster] - Failed to resign vip '%s' - %s", vip.Ip, err)
+		}
+	}
+}
+
+// electVip returns who should own the vip - its owner while it's alive (unless
+// preempted by a candidate with a higher priority), otherwise the candidate
+// with the highest priority (the lowest member of those tied)
+func electVip(vip core.Vip, owner string, candidates map[string]int) string {
+	best := ""
+	for member, priority := range candidates {
+		if best == "" || priority > candidates[best] || (priority == candidates[best] && member < best) {
+			best = member
+		}
+	}
+	if owner == "" {
+		return best
+	}
+	if vip.Preempt && best != "" && candidates[best] > candidates[owner] {
+		return best
+	}
+	return owner
+}
+
+// claimVip adds the vip to the host, if it isn't already (as it's now set)
+func claimVip(vip core.Vip) {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	if old, ok := owned[vip.Ip]; ok {
+		// only changing where it's added re-adds it (not preempt)
+		if old.Interface == vip.Interface && old.Alias == vip.Alias {
+			owned[vip.Ip] = vip
+			return
+		}
+		// moved since it was added
+		if err := vipmgr.Release(old); err != nil {
+			config.Log.Error("[cluster] - Failed to remove vip '%s' - %s", old.Ip, err)
+		}
+		delete(owned, vip.Ip)
+	}
+	err := vipmgr.Claim(vip)
+	if err != nil {
+		// tried again next election
+		config.Log.Error("[cluster] - Failed to add vip '%s' - %s", vip.Ip, err)
+		return
+	}
+	owned[vip.Ip] = vip
+}
+
+// releaseVip removes the vip from the host, if it was added
+func releaseVip(vip core.Vip) {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	if _, ok := owned[vip.Ip]; !ok {
+		return
+	}
+	config.Log.Info("[cluster] - No longer owner of vip '%s', removing it", vip.Ip)
+	err := vipmgr.Release(owned[vip.Ip])
+	if err != nil {
+		config.Log.Error("[cluster] - Failed to remove vip '%s' - %s", vip.Ip, err)
+	}
+	delete(owned, vip.Ip)
+}
+
+// releaseVips removes every vip this member owns from the host, returning them
+// (it can no longer tell if it's their owner)
+func releaseVips() []core.Vip {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	vips := []core.Vip{}
+	for ip, vip := range owned {
+		err := vipmgr.Release(vip)
+		if err != nil {
+			config.Log.Error("[cluster] - Failed to remove vip '%s' - %s", vip.Ip, err)
+		}
+		delete(owned, ip)
+		vips = append(vips, vip)
+	}
+	return vips
+}
+
+// ownsVip is whether this member owns the vip
+func ownsVip(vip core.Vip) bool {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	_, ok := owned[vip.Ip]
+	return ok
+}
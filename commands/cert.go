@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 
 	"github.com/spf13/cobra"
 
@@ -46,6 +47,7 @@ var (
 		Run: certsSet,
 	}
 	certJsonString string
+	certExpiring   string
 	cert           core.CertBundle
 )
 
@@ -54,6 +56,7 @@ func init() {
 	certFlags(certsSetCmd)
 	certFlags(certRemoveCmd)
 
+	certsShowCmd.Flags().StringVarP(&certExpiring, "expiring", "e", "", "Only show certs expiring within days (30d) or a duration (12h)")
 }
 
 func certFlags(ccmd *cobra.Command) {
@@ -109,7 +112,11 @@ func certRemove(ccmd *cobra.Command, args []string) {
 }
 
 func certsShow(ccmd *cobra.Command, args []string) {
-	res, err := rest("certs", "GET", nil)
+	path := "certs"
+	if certExpiring != "" {
+		path = fmt.Sprintf("%s?expiring=%s", path, url.QueryEscape(certExpiring))
+	}
+	res, err := rest(path, "GET", nil)
 	if err != nil {
 		fail("Could not contact portal - %s", err)
 	}
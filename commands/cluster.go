@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nanopack/portal/cluster"
+)
+
+// cluster-status
+
+var (
+	clusterStatusCmd = &cobra.Command{
+		Use:   "cluster-status",
+		Short: "Show cluster members, marking those whose config has drifted",
+		Long: `Show cluster members, with a hash of each member's services, routes, certs,
+and vips. Hashes differing from most members' are marked with a '*', and the
+command fails if any alive member's have drifted.`,
+
+		Run: clusterStatus,
+	}
+
+	// sections of config members report hashes of
+	clusterSections = []string{"services", "routes", "certs", "vips"}
+)
+
+func clusterStatus(ccmd *cobra.Command, args []string) {
+	res, err := rest("cluster/members", "GET", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	var members []cluster.MemberStatus
+	if err = json.Unmarshal(b, &members); err != nil {
+		// an error
+		fail("%s", strings.TrimSpace(string(b)))
+	}
+
+	drifted := driftedMembers(members)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MEMBER\tALIVE\tHEARTBEAT\tVERSION\t%s\n", strings.ToUpper(strings.Join(clusterSections, "\t")))
+	for _, member := range members {
+		alive, heartbeat := "no", "-"
+		if member.Alive {
+			alive = "yes"
+		}
+		if !member.Heartbeat.IsZero() {
+			heartbeat = member.Heartbeat.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s", member.Id, alive, heartbeat, member.Version)
+		for _, section := range clusterSections {
+			hash := member.Hashes[section]
+			if len(hash) > 8 {
+				hash = hash[:8]
+			}
+			if hash == "" {
+				hash = "-"
+			}
+			if contains(drifted[member.Id], section) {
+				hash += "*"
+			}
+			fmt.Fprintf(w, "\t%s", hash)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	if len(drifted) != 0 {
+		summary := []string{}
+		for _, member := range members {
+			if sections, ok := drifted[member.Id]; ok {
+				summary = append(summary, fmt.Sprintf("%s (%s)", member.Id, strings.Join(sections, ", ")))
+			}
+		}
+		fail("\nDrifted from the other members: %s", strings.Join(summary, ", "))
+	}
+}
+
+// driftedMembers returns the sections of each alive member's config that differ
+// from most alive members'
+func driftedMembers(members []cluster.MemberStatus) map[string][]string {
+	drifted := map[string][]string{}
+	for _, section := range clusterSections {
+		// the most common hash is what the cluster has, first seen wins a tie
+		counts, common := map[string]int{}, ""
+		for _, member := range members {
+			hash := member.Hashes[section]
+			if !member.Alive || hash == "" {
+				continue
+			}
+			counts[hash]++
+			if counts[hash] > counts[common] {
+				common = hash
+			}
+		}
+		for _, member := range members {
+			hash := member.Hashes[section]
+			if member.Alive && hash != "" && hash != common {
+				drifted[member.Id] = append(drifted[member.Id], section)
+			}
+		}
+	}
+	return drifted
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
 
+	"github.com/nanopack/portal/acme"
 	"github.com/nanopack/portal/api"
 	"github.com/nanopack/portal/balance"
 	"github.com/nanopack/portal/cluster"
@@ -21,7 +22,9 @@ import (
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/database"
 	"github.com/nanopack/portal/proxymgr"
+	"github.com/nanopack/portal/snapshot"
 	"github.com/nanopack/portal/vipmgr"
+	"github.com/nanopack/portal/webhook"
 )
 
 var (
@@ -52,6 +55,7 @@ func init() {
 
 	Portal.AddCommand(serverAddCmd)
 	Portal.AddCommand(serverRemoveCmd)
+	Portal.AddCommand(serverDrainCmd)
 	Portal.AddCommand(serverShowCmd)
 	Portal.AddCommand(serversShowCmd)
 	Portal.AddCommand(serversSetCmd)
@@ -70,6 +74,22 @@ func init() {
 	Portal.AddCommand(vipsSetCmd)
 	Portal.AddCommand(vipsShowCmd)
 	Portal.AddCommand(vipRemoveCmd)
+
+	Portal.AddCommand(applyCmd)
+	Portal.AddCommand(backupCmd)
+	Portal.AddCommand(restoreCmd)
+
+	Portal.AddCommand(webhookAddCmd)
+	Portal.AddCommand(webhooksShowCmd)
+	Portal.AddCommand(webhookRemoveCmd)
+
+	Portal.AddCommand(tokenAddCmd)
+	Portal.AddCommand(tokensShowCmd)
+	Portal.AddCommand(tokenRemoveCmd)
+
+	Portal.AddCommand(clusterStatusCmd)
+
+	Portal.AddCommand(dbCmd)
 }
 
 func preFlight(ccmd *cobra.Command, args []string) error {
@@ -124,6 +144,12 @@ func startPortal(ccmd *cobra.Command, args []string) error {
 		config.Log.Fatal("Database init failed - %s", err)
 		return fmt.Errorf("")
 	}
+	// start posting to webhooks (before the balancer and proxy, to see health changes)
+	err = webhook.Start()
+	if err != nil {
+		config.Log.Fatal("Webhook start failed - %s", err)
+		return fmt.Errorf("")
+	}
 	// initialize balancer
 	err = balance.Init()
 	if err != nil {
@@ -143,12 +169,27 @@ func startPortal(ccmd *cobra.Command, args []string) error {
 		return fmt.Errorf("")
 	}
 	// initialize cluster
+	cluster.Version = fmt.Sprintf("%s (%s)", tag, commit)
 	err = cluster.Init()
 	if err != nil {
 		config.Log.Fatal("Cluster init failed - %s", err)
 		return fmt.Errorf("")
 	}
 
+	// start obtaining route certs
+	err = acme.Start()
+	if err != nil {
+		config.Log.Fatal("Acme start failed - %s", err)
+		return fmt.Errorf("")
+	}
+
+	// start writing config snapshots
+	err = snapshot.Start()
+	if err != nil {
+		config.Log.Fatal("Snapshot start failed - %s", err)
+		return fmt.Errorf("")
+	}
+
 	go sigHandle()
 
 	// start api
@@ -180,8 +221,21 @@ func rest(path string, method string, body io.Reader) (*http.Response, error) {
 	client = http.DefaultClient
 	uri := fmt.Sprintf("https://%s:%s/%s", config.ApiHost, config.ApiPort, path)
 
-	if config.Insecure {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if config.Insecure || config.ClientCert != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+		// present a client cert, for apis requiring them
+		if config.ClientCert != "" {
+			cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load client cert - %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		// own transport, as http.DefaultTransport is wrapped when the proxy runs
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}}
 	}
 
 	req, err := http.NewRequest(method, uri, body)
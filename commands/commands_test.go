@@ -441,6 +441,23 @@ func TestSetCerts(t *testing.T) {
 	}
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// CLUSTER
+////////////////////////////////////////////////////////////////////////////////
+func TestClusterStatus(t *testing.T) {
+	Portal.SetArgs(strings.Split("cluster-status", " "))
+
+	out, err := capture(Portal.Execute)
+	if err != nil {
+		t.Errorf("Failed to execute - %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "MEMBER") || !strings.Contains(lines[1], ":"+config.ApiPort) || strings.Contains(lines[1], "*") {
+		t.Errorf("Unexpected output: %q", string(out))
+	}
+}
+
 func TestRunServer(t *testing.T) {
 	config.JustProxy = true
 	config.RouteHttp = "0.0.0.0:9085"
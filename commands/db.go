@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nanopack/portal/database"
+)
+
+// db
+
+var (
+	dbCmd = &cobra.Command{
+		Use:   "db",
+		Short: "Manage portal's database",
+		Long: `Manage portal's database (db-connection). Only postgres databases are
+versioned; portal migrates them on start as well. A scribble directory can be
+imported into a new bolt database.`,
+	}
+
+	dbMigrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending database migrations",
+		Long:  ``,
+
+		Run: dbMigrate,
+	}
+
+	dbStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show database migrations and when they were applied",
+		Long:  ``,
+
+		Run: dbStatus,
+	}
+
+	dbImportCmd = &cobra.Command{
+		Use:   "import <scribble-dir>",
+		Short: "Import a scribble directory into a new bolt database",
+		Long: `Import everything stored in a scribble directory into the (empty) bolt
+database, in one transaction. Portal must not be running on the bolt database.`,
+
+		Run: dbImport,
+	}
+)
+
+func init() {
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbStatusCmd)
+	dbCmd.AddCommand(dbImportCmd)
+}
+
+func dbMigrate(ccmd *cobra.Command, args []string) {
+	applied, err := database.Migrate()
+	if err != nil {
+		fail("Failed to migrate database - %s", err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("Database is up to date")
+		return
+	}
+	printMigrations(applied)
+}
+
+func dbStatus(ccmd *cobra.Command, args []string) {
+	migrations, err := database.Migrations()
+	if err != nil {
+		fail("Failed to get database migrations - %s", err)
+	}
+	printMigrations(migrations)
+}
+
+func dbImport(ccmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fail("Please specify the scribble directory to import")
+	}
+	err := database.ImportScribble(args[0])
+	if err != nil {
+		fail("Failed to import '%s' - %s", args[0], err)
+	}
+	fmt.Printf("Imported '%s'\n", args[0])
+}
+
+func printMigrations(migrations []database.Migration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.Applied != nil {
+			applied = m.Applied.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	w.Flush()
+}
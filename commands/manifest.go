@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/nanopack/portal/core"
+)
+
+// apply
+
+var (
+	applyCmd = &cobra.Command{
+		Use:   "apply",
+		Short: "Apply a manifest (yaml or json) of services, routes, certs, and vips",
+		Long: `Sets the services (and their servers), routes, certs, and vips to match the
+manifest, undoing the changes if any fail. Sections left out of the manifest
+are left as they are.`,
+
+		Run: manifestApply,
+	}
+	manifestFile string
+	applyDryRun  bool
+)
+
+func init() {
+	applyCmd.Flags().StringVarP(&manifestFile, "file", "f", "", "Manifest file to apply (yaml or json)")
+	applyCmd.Flags().BoolVarP(&applyDryRun, "dry-run", "n", false, "Show the changes without applying them")
+}
+
+func manifestApply(ccmd *cobra.Command, args []string) {
+	if manifestFile == "" {
+		fail("Please specify a manifest file (-f manifest.yaml)")
+	}
+
+	b, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		fail("Could not read manifest - %s", err)
+	}
+
+	// yaml is a superset of json, so either is parsed
+	var manifest interface{}
+	if err = yaml.Unmarshal(b, &manifest); err != nil {
+		fail("Bad manifest syntax - %s", err)
+	}
+	jsonBytes, err := json.Marshal(jsonable(manifest))
+	if err != nil {
+		fail("Bad values for manifest - %s", err)
+	}
+
+	path := "manifest"
+	if applyDryRun {
+		path = "manifest?dry-run=true"
+	}
+	res, err := rest(path, "PUT", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	printChanges(b)
+}
+
+// printChanges prints the changes portal applied (or would have, on a dry run)
+// or its error
+func printChanges(b []byte) {
+	var result struct {
+		DryRun  bool          `json:"dry_run"`
+		Changes []core.Change `json:"changes"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil || result.Changes == nil {
+		// an error message
+		fmt.Print(string(b))
+		return
+	}
+
+	symbols := map[string]string{"add": "+", "update": "~", "delete": "-"}
+	for _, change := range result.Changes {
+		fmt.Printf("%s %s %s\n", symbols[change.Action], change.Resource, change.Id)
+	}
+	switch {
+	case len(result.Changes) == 0:
+		fmt.Println("No changes")
+	case result.DryRun:
+		fmt.Printf("%d change(s) not applied (dry run)\n", len(result.Changes))
+	default:
+		fmt.Printf("%d change(s) applied\n", len(result.Changes))
+	}
+}
+
+// jsonable converts the map[interface{}]interface{}s yaml decodes to into
+// map[string]interface{}s json can encode
+func jsonable(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = jsonable(val)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = jsonable(t[i])
+		}
+		return t
+	}
+	return v
+}
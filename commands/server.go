@@ -13,6 +13,7 @@ import (
 
 // server-add
 // server-remove
+// server-drain
 // server-show
 // servers-show
 // servers-set
@@ -32,6 +33,13 @@ var (
 
 		Run: serverRemove,
 	}
+	serverDrainCmd = &cobra.Command{
+		Use:   "drain-server",
+		Short: "Drain and remove server from a service",
+		Long:  ``,
+
+		Run: serverDrain,
+	}
 	serverShowCmd = &cobra.Command{
 		Use:   "show-server",
 		Short: "Show server on a service",
@@ -55,6 +63,7 @@ var (
 	}
 	server           core.Server
 	serverJsonString string
+	drainTimeout     int
 )
 
 func init() {
@@ -64,6 +73,10 @@ func init() {
 	serviceSimpleFlags(serverRemoveCmd)
 	serverSimpleFlags(serverRemoveCmd)
 
+	serviceSimpleFlags(serverDrainCmd)
+	serverSimpleFlags(serverDrainCmd)
+	serverDrainCmd.Flags().IntVarP(&drainTimeout, "timeout", "m", 0, "Seconds to wait for connections to finish (0 uses portal's drain-timeout)")
+
 	serviceSimpleFlags(serverShowCmd)
 	serverSimpleFlags(serverShowCmd)
 
@@ -133,6 +146,25 @@ func serverRemove(ccmd *cobra.Command, args []string) {
 	fmt.Print(string(b))
 }
 
+func serverDrain(ccmd *cobra.Command, args []string) {
+	svcValidate(&service)
+	srvValidate(&server)
+
+	path := fmt.Sprintf("services/%s/servers/%s?drain=true", service.Id, server.Id)
+	if drainTimeout > 0 {
+		path = fmt.Sprintf("%s&timeout=%d", path, drainTimeout)
+	}
+	res, err := rest(path, "DELETE", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
+
 func serverShow(ccmd *cobra.Command, args []string) {
 	svcValidate(&service)
 	srvValidate(&server)
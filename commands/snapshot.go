@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nanopack/portal/core"
+)
+
+// backup/restore
+
+var (
+	backupCmd = &cobra.Command{
+		Use:   "backup",
+		Short: "Save a snapshot of the services, routes, certs, vips, and error pages",
+		Long: `Saves a snapshot of portal's config (services and their servers, routes,
+certs, vips, and error pages) to a file, or prints it. It holds cert keys, so
+keep it safe.`,
+
+		Run: backup,
+	}
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a snapshot saved with backup",
+		Long: `Replaces portal's config with the snapshot's, undoing the changes if any
+fail. Anything left out of the snapshot is removed. Restoring a backup taken
+from a portal using another database (scribble, postgres, etc.) moves the
+config to this one's.`,
+
+		Run: restore,
+	}
+	snapshotFile  string
+	restoreDryRun bool
+)
+
+func init() {
+	backupCmd.Flags().StringVarP(&snapshotFile, "file", "f", "", "File to save the snapshot to (default prints it)")
+	restoreCmd.Flags().StringVarP(&snapshotFile, "file", "f", "", "Snapshot file to restore")
+	restoreCmd.Flags().BoolVarP(&restoreDryRun, "dry-run", "n", false, "Show the changes without applying them")
+}
+
+func backup(ccmd *cobra.Command, args []string) {
+	res, err := rest("snapshot", "GET", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	var snap core.Snapshot
+	if err = json.Unmarshal(b, &snap); err != nil || snap.Version == 0 {
+		// an error
+		fail("%s", strings.TrimSpace(string(b)))
+	}
+
+	if snapshotFile == "" {
+		fmt.Print(string(b))
+		return
+	}
+	// holds cert keys
+	err = ioutil.WriteFile(snapshotFile, b, 0600)
+	if err != nil {
+		fail("Could not save snapshot - %s", err)
+	}
+	fmt.Printf("Saved snapshot to '%s'\n", snapshotFile)
+}
+
+func restore(ccmd *cobra.Command, args []string) {
+	if snapshotFile == "" {
+		fail("Please specify a snapshot file (-f snapshot.json)")
+	}
+
+	b, err := ioutil.ReadFile(snapshotFile)
+	if err != nil {
+		fail("Could not read snapshot - %s", err)
+	}
+	if !json.Valid(b) {
+		fail("Bad snapshot syntax in '%s'", snapshotFile)
+	}
+
+	path := "snapshot"
+	if restoreDryRun {
+		path = "snapshot?dry-run=true"
+	}
+	res, err := rest(path, "PUT", bytes.NewBuffer(b))
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	printChanges(b)
+	if res.StatusCode != 200 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nanopack/portal/core"
+)
+
+// add-token
+// remove-token
+// show-tokens
+
+var (
+	tokenAddCmd = &cobra.Command{
+		Use:   "add-token",
+		Short: "Add (or replace) named api token",
+		Long:  ``,
+
+		Run: tokenAdd,
+	}
+	tokenRemoveCmd = &cobra.Command{
+		Use:   "remove-token",
+		Short: "Remove named api token",
+		Long:  ``,
+
+		Run: tokenRemove,
+	}
+	tokensShowCmd = &cobra.Command{
+		Use:   "show-tokens",
+		Short: "Show all named api tokens",
+		Long:  ``,
+
+		Run: tokensShow,
+	}
+	tokenJsonString string
+	token           core.Token
+)
+
+func init() {
+	tokenAddCmd.Flags().StringVarP(&tokenJsonString, "json", "j", "", "Json encoded data for token")
+	tokenAddCmd.Flags().StringVarP(&token.Name, "name", "n", "", "Name of token")
+	tokenAddCmd.Flags().StringVar(&token.Token, "token", "", "Token to use (default generated)")
+	tokenAddCmd.Flags().StringSliceVarP(&token.Scopes, "scopes", "s", nil, "Scopes of token, comma separated (read-only,routes-only,certs-admin,full)")
+
+	tokenRemoveCmd.Flags().StringVarP(&token.Name, "name", "n", "", "Name of token to remove")
+}
+
+func tokenAdd(ccmd *cobra.Command, args []string) {
+	if tokenJsonString != "" {
+		err := json.Unmarshal([]byte(tokenJsonString), &token)
+		if err != nil {
+			fail("Bad JSON syntax")
+		}
+	}
+
+	jsonBytes, err := json.Marshal(token)
+	if err != nil {
+		fail("Bad values for token")
+	}
+	res, err := rest("tokens", "POST", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
+
+func tokenRemove(ccmd *cobra.Command, args []string) {
+	if token.Name == "" {
+		fail("Token name required")
+	}
+
+	res, err := rest(fmt.Sprintf("tokens/%s", token.Name), "DELETE", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
+
+func tokensShow(ccmd *cobra.Command, args []string) {
+	res, err := rest("tokens", "GET", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nanopack/portal/core"
+)
+
+// add-webhook
+// remove-webhook
+// show-webhooks
+
+var (
+	webhookAddCmd = &cobra.Command{
+		Use:   "add-webhook",
+		Short: "Add (or update) webhook",
+		Long:  ``,
+
+		Run: webhookAdd,
+	}
+	webhookRemoveCmd = &cobra.Command{
+		Use:   "remove-webhook",
+		Short: "Remove webhook",
+		Long:  ``,
+
+		Run: webhookRemove,
+	}
+	webhooksShowCmd = &cobra.Command{
+		Use:   "show-webhooks",
+		Short: "Show all webhooks",
+		Long:  ``,
+
+		Run: webhooksShow,
+	}
+	webhookJsonString string
+	hook              core.Webhook
+)
+
+func init() {
+	webhookAddCmd.Flags().StringVarP(&webhookJsonString, "json", "j", "", "Json encoded data for webhook")
+	webhookAddCmd.Flags().StringVarP(&hook.Url, "url", "u", "", "Url to post events to")
+	webhookAddCmd.Flags().StringVarP(&hook.Secret, "secret", "s", "", "Secret to sign payloads with")
+	webhookAddCmd.Flags().StringSliceVarP(&hook.Events, "events", "e", nil, "Events to post, comma separated (default all)")
+
+	webhookRemoveCmd.Flags().StringVarP(&hook.Id, "id", "I", "", "Id of webhook to remove")
+}
+
+func webhookAdd(ccmd *cobra.Command, args []string) {
+	if webhookJsonString != "" {
+		err := json.Unmarshal([]byte(webhookJsonString), &hook)
+		if err != nil {
+			fail("Bad JSON syntax")
+		}
+	}
+
+	jsonBytes, err := json.Marshal(hook)
+	if err != nil {
+		fail("Bad values for webhook")
+	}
+	res, err := rest("webhooks", "POST", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
+
+func webhookRemove(ccmd *cobra.Command, args []string) {
+	if hook.Id == "" {
+		fail("Webhook id required")
+	}
+
+	res, err := rest(fmt.Sprintf("webhooks/%s", hook.Id), "DELETE", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
+
+func webhooksShow(ccmd *cobra.Command, args []string) {
+	res, err := rest("webhooks", "GET", nil)
+	if err != nil {
+		fail("Could not contact portal - %s", err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fail("Could not read portal's response - %s", err)
+	}
+	fmt.Print(string(b))
+}
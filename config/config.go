@@ -18,10 +18,15 @@ var (
 	ApiKey             = ""
 	ApiCert            = ""
 	ApiKeyPassword     = ""
+	ApiClientCa        = ""
+	ClientCert         = ""
+	ClientKey          = ""
 	ConfigFile         = ""
 	DatabaseConnection = "scribble:///var/db/portal"
 	ClusterConnection  = "none://"
 	ClusterToken       = ""
+	ClusterDegraded    = false
+	ClusterCa          = ""
 	Insecure           = false
 	LogLevel           = "INFO"
 	LogFile            = ""
@@ -30,8 +35,19 @@ var (
 	RouteHttp          = "0.0.0.0:80"
 	RouteTls           = "0.0.0.0:443"
 	Balancer           = "lvs"
+	Proxy              = "nanobox"
 	WorkDir            = "/var/db/portal"
 	JustProxy          = false
+	HealthInterval     = 10
+	DrainTimeout       = 60
+	SnapshotInterval   = 0
+	SnapshotKeep       = 24
+	RevisionKeep       = 100
+	AuditKeep          = 0
+	AcmeDirectory      = ""
+	AcmeEmail          = ""
+	AcmeCa             = ""
+	VipPriority        = 0
 	Server             = false
 	Version            = false
 )
@@ -42,20 +58,36 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVarP(&ApiHost, "api-host", "H", ApiHost, "Listen address for the API")
 	cmd.PersistentFlags().StringVarP(&ApiPort, "api-port", "P", ApiPort, "Listen address for the API")
 	cmd.PersistentFlags().StringVarP(&ConfigFile, "conf", "c", ConfigFile, "Configuration file to load")
+	cmd.PersistentFlags().StringVar(&ClientCert, "client-cert", ClientCert, "SSL cert to present to the api (client)")
+	cmd.PersistentFlags().StringVar(&ClientKey, "client-key", ClientKey, "SSL key for the client cert (client)")
 
 	cmd.Flags().StringVarP(&ApiKey, "api-key", "k", ApiKey, "SSL key for the api")
 	cmd.Flags().StringVarP(&ApiCert, "api-cert", "C", ApiCert, "SSL cert for the api")
 	cmd.Flags().StringVarP(&ApiKeyPassword, "api-key-password", "p", ApiKeyPassword, "Password for the SSL key")
+	cmd.Flags().StringVar(&ApiClientCa, "api-client-ca", ApiClientCa, "CA cert to require and verify api client certs with (blank disables)")
 	cmd.Flags().StringVarP(&DatabaseConnection, "db-connection", "d", DatabaseConnection, "Database connection string")
-	cmd.Flags().StringVarP(&ClusterConnection, "cluster-connection", "r", ClusterConnection, "Cluster connection string (redis://127.0.0.1:6379)")
+	cmd.Flags().StringVarP(&ClusterConnection, "cluster-connection", "r", ClusterConnection, "Cluster connection string (redis://127.0.0.1:6379, etcd://127.0.0.1:2379, raft://, or raft://member:8443 to join)")
 	cmd.Flags().StringVarP(&ClusterToken, "cluster-token", "T", ClusterToken, "Cluster security token")
+	cmd.Flags().BoolVar(&ClusterDegraded, "cluster-degraded", ClusterDegraded, "Keep serving the last config while redis or etcd is unreachable, rejecting changes (rather than exiting)")
+	cmd.Flags().StringVar(&ClusterCa, "cluster-ca", ClusterCa, "CA cert to verify raft members' api certs with (blank trusts only a shared api-cert)")
 	cmd.Flags().StringVarP(&LogLevel, "log-level", "l", LogLevel, "Log level to output")
 	cmd.Flags().StringVarP(&LogFile, "log-file", "L", LogFile, "Log file to write to")
 	cmd.Flags().BoolVarP(&ProxyIgnore, "proxy-ignore-upstream", "u", Server, "Ignore upstream's(target's) certs when routing")
 	cmd.Flags().StringVarP(&RouteHttp, "proxy-http", "x", RouteHttp, "Address to listen on for proxying http")
 	cmd.Flags().StringVarP(&RouteTls, "proxy-tls", "X", RouteTls, "Address to listen on for proxying https")
 	cmd.Flags().StringVarP(&Balancer, "balancer", "b", Balancer, "Load balancer to use (nginx|lvs)")
+	cmd.Flags().StringVar(&Proxy, "proxy", Proxy, "Proxy to route with (nanobox|nginx|haproxy)")
 	cmd.Flags().StringVarP(&WorkDir, "work-dir", "w", WorkDir, "Directory for portal to use (balancer config)")
+	cmd.Flags().IntVar(&HealthInterval, "health-interval", HealthInterval, "Seconds between server health checks")
+	cmd.Flags().IntVar(&DrainTimeout, "drain-timeout", DrainTimeout, "Seconds to wait for connections to finish when draining a server")
+	cmd.Flags().IntVar(&SnapshotInterval, "snapshot-interval", SnapshotInterval, "Seconds between config snapshots written to <work-dir>/snapshots (0 disables)")
+	cmd.Flags().IntVar(&SnapshotKeep, "snapshot-keep", SnapshotKeep, "Number of config snapshots to keep")
+	cmd.Flags().IntVar(&RevisionKeep, "revision-keep", RevisionKeep, "Number of config revisions to keep in the database (0 keeps all)")
+	cmd.Flags().IntVar(&AuditKeep, "audit-keep", AuditKeep, "Number of audit records to keep in the database (0 keeps all)")
+	cmd.Flags().StringVar(&AcmeDirectory, "acme-directory", AcmeDirectory, "ACME directory to obtain route certs from (https://acme-v02.api.letsencrypt.org/directory) (blank disables)")
+	cmd.Flags().StringVar(&AcmeEmail, "acme-email", AcmeEmail, "Contact email for the ACME account")
+	cmd.Flags().StringVar(&AcmeCa, "acme-ca", AcmeCa, "CA cert to trust for the ACME directory (for test servers like pebble)")
+	cmd.Flags().IntVar(&VipPriority, "vip-priority", VipPriority, "This member's priority to own vips when clustered with redis, etcd, or raft (higher wins)")
 
 	cmd.Flags().BoolVarP(&Server, "server", "s", Server, "Run in server mode")
 	cmd.Flags().BoolVarP(&Version, "version", "v", Version, "Print version info and exit")
@@ -73,9 +105,14 @@ func LoadConfigFile() error {
 	viper.SetDefault("api-key", ApiKey)
 	viper.SetDefault("api-cert", ApiCert)
 	viper.SetDefault("api-key-password", ApiKeyPassword)
+	viper.SetDefault("api-client-ca", ApiClientCa)
+	viper.SetDefault("client-cert", ClientCert)
+	viper.SetDefault("client-key", ClientKey)
 	viper.SetDefault("db-connection", DatabaseConnection)
 	viper.SetDefault("cluster-connection", ClusterConnection)
 	viper.SetDefault("cluster-token", ClusterToken)
+	viper.SetDefault("cluster-degraded", ClusterDegraded)
+	viper.SetDefault("cluster-ca", ClusterCa)
 	viper.SetDefault("insecure", Insecure)
 	viper.SetDefault("just-proxy", JustProxy)
 	viper.SetDefault("log-level", LogLevel)
@@ -85,7 +122,18 @@ func LoadConfigFile() error {
 	viper.SetDefault("proxy-tls", RouteTls)
 	viper.SetDefault("proxy-ignore-upstream", ProxyIgnore)
 	viper.SetDefault("balancer", Balancer)
+	viper.SetDefault("proxy", Proxy)
 	viper.SetDefault("work-dir", WorkDir)
+	viper.SetDefault("health-interval", HealthInterval)
+	viper.SetDefault("drain-timeout", DrainTimeout)
+	viper.SetDefault("snapshot-interval", SnapshotInterval)
+	viper.SetDefault("snapshot-keep", SnapshotKeep)
+	viper.SetDefault("revision-keep", RevisionKeep)
+	viper.SetDefault("audit-keep", AuditKeep)
+	viper.SetDefault("acme-directory", AcmeDirectory)
+	viper.SetDefault("acme-email", AcmeEmail)
+	viper.SetDefault("acme-ca", AcmeCa)
+	viper.SetDefault("vip-priority", VipPriority)
 
 	filename := filepath.Base(ConfigFile)
 	viper.SetConfigName(filename[:len(filename)-len(filepath.Ext(filename))])
@@ -103,9 +151,14 @@ func LoadConfigFile() error {
 	ApiKey = viper.GetString("api-key")
 	ApiCert = viper.GetString("api-cert")
 	ApiKeyPassword = viper.GetString("api-key-password")
+	ApiClientCa = viper.GetString("api-client-ca")
+	ClientCert = viper.GetString("client-cert")
+	ClientKey = viper.GetString("client-key")
 	DatabaseConnection = viper.GetString("db-connection")
 	ClusterConnection = viper.GetString("cluster-connection")
 	ClusterToken = viper.GetString("cluster-token")
+	ClusterDegraded = viper.GetBool("cluster-degraded")
+	ClusterCa = viper.GetString("cluster-ca")
 	Insecure = viper.GetBool("insecure")
 	JustProxy = viper.GetBool("just-proxy")
 	LogLevel = viper.GetString("log-level")
@@ -115,7 +168,18 @@ func LoadConfigFile() error {
 	RouteTls = viper.GetString("proxy-tls")
 	ProxyIgnore = viper.GetBool("proxy-ignore-upstream")
 	Balancer = viper.GetString("balancer")
+	Proxy = viper.GetString("proxy")
 	WorkDir = viper.GetString("work-dir")
+	HealthInterval = viper.GetInt("health-interval")
+	DrainTimeout = viper.GetInt("drain-timeout")
+	SnapshotInterval = viper.GetInt("snapshot-interval")
+	SnapshotKeep = viper.GetInt("snapshot-keep")
+	RevisionKeep = viper.GetInt("revision-keep")
+	AuditKeep = viper.GetInt("audit-keep")
+	AcmeDirectory = viper.GetString("acme-directory")
+	AcmeEmail = viper.GetString("acme-email")
+	AcmeCa = viper.GetString("acme-ca")
+	VipPriority = viper.GetInt("vip-priority")
 
 	return nil
 }
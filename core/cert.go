@@ -0,0 +1,130 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// Parse returns the metadata of the bundle's leaf (first) certificate
+func (c CertBundle) Parse() (*CertInfo, error) {
+	leaf, err := c.leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &CertInfo{
+		Subject:   leaf.Subject.CommonName,
+		Sans:      append([]string{}, leaf.DNSNames...),
+		Issuer:    leaf.Issuer.CommonName,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		KeyType:   leaf.PublicKeyAlgorithm.String(),
+	}
+	for i := range leaf.IPAddresses {
+		info.Sans = append(info.Sans, leaf.IPAddresses[i].String())
+	}
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType = fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		info.KeyType = fmt.Sprintf("ECDSA-P%d", key.Curve.Params().BitSize)
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	info.Fingerprint = hex.EncodeToString(sum[:])
+
+	return info, nil
+}
+
+// Validate ensures the key matches the cert and the chain's certificates parse
+func (c CertBundle) Validate() error {
+	if _, err := tls.X509KeyPair([]byte(c.Cert), []byte(c.Key)); err != nil {
+		return fmt.Errorf("Bad cert/key pair - %s", err)
+	}
+	_, err := c.chain()
+	return err
+}
+
+// CheckExpiry ensures no certificate in the chain is expired (or not yet
+// valid)
+func (c CertBundle) CheckExpiry() error {
+	chain, err := c.chain()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, cert := range chain {
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("Certificate '%s' expired %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("Certificate '%s' not valid until %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// chain parses the bundle's certificates
+func (c CertBundle) chain() ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(c.Cert)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Bad certificate in chain - %s", err)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// Same reports whether both bundles hold the same leaf certificate. As the leaf
+// pins its public key, they can only differ in pem formatting, the
+// intermediates sent with it, or the key's encoding, so one replaces the other.
+func (c CertBundle) Same(other CertBundle) bool {
+	if c.Cert == other.Cert {
+		return true
+	}
+	a, err := c.leaf()
+	if err != nil {
+		return false
+	}
+	b, err := other.leaf()
+	if err != nil {
+		return false
+	}
+	return a.Equal(b)
+}
+
+// Covers reports whether the bundle's leaf certificate is valid for host
+func (c CertBundle) Covers(host string) bool {
+	leaf, err := c.leaf()
+	return err == nil && leaf.VerifyHostname(host) == nil
+}
+
+func (c CertBundle) leaf() (*x509.Certificate, error) {
+	rest := []byte(c.Cert)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in pem data")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
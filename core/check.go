@@ -0,0 +1,82 @@
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// transports for health checks (not kept alive between checks, nor proxied
+	// like http.DefaultTransport)
+	checkTransport    = &http.Transport{DisableKeepAlives: true}
+	insecureTransport = &http.Transport{DisableKeepAlives: true, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+)
+
+type (
+	// HttpCheck is an http health check, shared by servers and route targets
+	HttpCheck struct {
+		Url            string        // url to request - "http://127.0.0.1:8080/ping"
+		Host           string        // host header to send, if set
+		ExpectedCode   int           // response code expected (default 200)
+		ExpectedHeader string        // "Name: value" header expected, if set
+		ExpectedBody   string        // text expected in the body, if set
+		Timeout        time.Duration // default 3 seconds
+		Insecure       bool          // don't verify https certs
+	}
+)
+
+// Check performs the check once, returning an error if it fails
+func (c HttpCheck) Check() error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	client := http.Client{Timeout: timeout, Transport: checkTransport}
+	if c.Insecure {
+		client.Transport = insecureTransport
+	}
+
+	req, err := http.NewRequest("GET", c.Url, nil)
+	if err != nil {
+		return err
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	expected := c.ExpectedCode
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if res.StatusCode != expected {
+		return fmt.Errorf("Unexpected response code - %d", res.StatusCode)
+	}
+	if c.ExpectedHeader != "" {
+		header := strings.SplitN(c.ExpectedHeader, ":", 2)
+		if len(header) != 2 || res.Header.Get(header[0]) != strings.TrimSpace(header[1]) {
+			return fmt.Errorf("Unexpected header - %s", c.ExpectedHeader)
+		}
+	}
+	if c.ExpectedBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), c.ExpectedBody) {
+			return fmt.Errorf("Unexpected body")
+		}
+	}
+
+	return nil
+}
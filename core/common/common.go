@@ -10,10 +10,16 @@ import (
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/metrics"
 	"github.com/nanopack/portal/proxymgr"
 	"github.com/nanopack/portal/vipmgr"
 )
 
+var (
+	rollbacks = metrics.NewCounter("portal_rollbacks_total",
+		"Actions undone after a failure to save them.", "resource", "result")
+)
+
 func SetServices(services []core.Service) error {
 	// in case of failure
 	oldServices, err := database.GetServices()
@@ -32,11 +38,12 @@ func SetServices(services []core.Service) error {
 		err = database.SetServices(services)
 		if err != nil {
 			// undo balance action
-			if uerr := balance.SetServices(oldServices); uerr != nil {
+			if uerr := rollback("services", balance.SetServices(oldServices)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-services")
 	}
 	return nil
 }
@@ -59,11 +66,12 @@ func SetService(service *core.Service) error {
 		err = database.SetService(service)
 		if err != nil {
 			// undo balancer action
-			if uerr := balance.SetServices(oldServices); uerr != nil {
+			if uerr := rollback("services", balance.SetServices(oldServices)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-service")
 	}
 	return nil
 }
@@ -89,12 +97,13 @@ func DeleteService(svcId string) error {
 		if err != nil {
 			// undo balance action
 			if oldService != nil {
-				if uerr := balance.SetService(oldService); uerr != nil {
+				if uerr := rollback("services", balance.SetService(oldService)); uerr != nil {
 					err = fmt.Errorf("%s - %s", err, uerr)
 				}
 			}
 			return err
 		}
+		revise("delete-service")
 	}
 	return nil
 }
@@ -118,11 +127,12 @@ func SetServers(svcId string, servers []core.Server) error {
 		err = database.SetServers(svcId, servers)
 		if err != nil {
 			// undo balance action
-			if uerr := balance.SetServers(svcId, oldServers); uerr != nil {
+			if uerr := rollback("servers", balance.SetServers(svcId, oldServers)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-servers")
 	}
 	return nil
 }
@@ -144,11 +154,12 @@ func SetServer(svcId string, server *core.Server) error {
 		err = database.SetServer(svcId, server)
 		if err != nil {
 			// undo balance action
-			if uerr := balance.DeleteServer(svcId, server.Id); uerr != nil {
+			if uerr := rollback("servers", balance.DeleteServer(svcId, server.Id)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-server")
 	}
 	return nil
 }
@@ -173,11 +184,12 @@ func DeleteServer(svcId, srvId string) error {
 		// remove from backend
 		if err = database.DeleteServer(svcId, srvId); err != nil && !strings.Contains(err.Error(), "No Server Found") {
 			// undo balance action
-			if uerr := balance.SetServer(svcId, srv); uerr != nil {
+			if uerr := rollback("servers", balance.SetServer(svcId, srv)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("delete-server")
 	}
 	return nil
 }
@@ -210,11 +222,12 @@ func SetRoutes(routes []core.Route) error {
 		err = database.SetRoutes(routes)
 		if err != nil {
 			// undo proxymgr action
-			if uerr := proxymgr.SetRoutes(oldRoutes); uerr != nil {
+			if uerr := rollback("routes", proxymgr.SetRoutes(oldRoutes)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-routes")
 	}
 	return nil
 }
@@ -237,11 +250,12 @@ func SetRoute(route core.Route) error {
 		err = database.SetRoute(route)
 		if err != nil {
 			// undo proxymgr action
-			if uerr := proxymgr.SetRoutes(oldRoutes); uerr != nil {
+			if uerr := rollback("routes", proxymgr.SetRoutes(oldRoutes)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-route")
 	}
 	return nil
 }
@@ -264,11 +278,12 @@ func DeleteRoute(route core.Route) error {
 		err = database.DeleteRoute(route)
 		if err != nil {
 			// undo proxymgr action
-			if uerr := proxymgr.SetRoutes(oldRoutes); uerr != nil {
+			if uerr := rollback("routes", proxymgr.SetRoutes(oldRoutes)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("delete-route")
 	}
 	return nil
 }
@@ -295,11 +310,12 @@ func SetCerts(certs []core.CertBundle) error {
 		err = database.SetCerts(certs)
 		if err != nil {
 			// undo proxymgr action
-			if uerr := proxymgr.SetCerts(oldCerts); uerr != nil {
+			if uerr := rollback("certs", proxymgr.SetCerts(oldCerts)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-certs")
 	}
 	return nil
 }
@@ -323,11 +339,12 @@ func SetCert(cert core.CertBundle) error {
 		if err != nil {
 			config.Log.Error("Failed to save cert to db, undoing")
 			// undo proxymgr action
-			if uerr := proxymgr.SetCerts(oldCerts); uerr != nil {
+			if uerr := rollback("certs", proxymgr.SetCerts(oldCerts)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-cert")
 	}
 	return nil
 }
@@ -350,11 +367,12 @@ func DeleteCert(cert core.CertBundle) error {
 		err = database.DeleteCert(cert)
 		if err != nil {
 			// undo proxymgr action
-			if uerr := proxymgr.SetCerts(oldCerts); uerr != nil {
+			if uerr := rollback("certs", proxymgr.SetCerts(oldCerts)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("delete-cert")
 	}
 	return nil
 }
@@ -380,11 +398,12 @@ func SetVips(vips []core.Vip) error {
 		err = database.SetVips(vips)
 		if err != nil {
 			// undo vipmgr action
-			if uerr := vipmgr.SetVips(oldVips); uerr != nil {
+			if uerr := rollback("vips", vipmgr.SetVips(oldVips)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-vips")
 	}
 	return nil
 }
@@ -407,11 +426,12 @@ func SetVip(vip core.Vip) error {
 		err = database.SetVip(vip)
 		if err != nil {
 			// undo vipmgr action
-			if uerr := vipmgr.SetVips(oldVips); uerr != nil {
+			if uerr := rollback("vips", vipmgr.SetVips(oldVips)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("set-vip")
 	}
 	return nil
 }
@@ -434,11 +454,12 @@ func DeleteVip(vip core.Vip) error {
 		err = database.DeleteVip(vip)
 		if err != nil {
 			// undo vipmgr action
-			if uerr := vipmgr.SetVips(oldVips); uerr != nil {
+			if uerr := rollback("vips", vipmgr.SetVips(oldVips)); uerr != nil {
 				err = fmt.Errorf("%s - %s", err, uerr)
 			}
 			return err
 		}
+		revise("delete-vip")
 	}
 	return nil
 }
@@ -446,3 +467,13 @@ func DeleteVip(vip core.Vip) error {
 func GetVips() ([]core.Vip, error) {
 	return database.GetVips()
 }
+
+// rollback records the result of undoing an action, returning its error
+func rollback(resource string, uerr error) error {
+	if uerr != nil {
+		rollbacks.Inc(resource, "error")
+		return uerr
+	}
+	rollbacks.Inc(resource, "ok")
+	return nil
+}
@@ -0,0 +1,338 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+// GetManifest returns the current state as a manifest
+func GetManifest() (*core.Manifest, error) {
+	services, err := database.GetServices()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := database.GetRoutes()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := database.GetCerts()
+	if err != nil {
+		return nil, err
+	}
+	vips, err := database.GetVips()
+	if err != nil {
+		return nil, err
+	}
+	return &core.Manifest{Services: services, Routes: routes, Certs: certs, Vips: vips}, nil
+}
+
+// Hashes returns a short hash of each section of the manifest, for members to
+// compare their config with
+func Hashes(manifest core.Manifest) map[string]string {
+	// health is reported, not stored
+	services := make([]core.Service, len(manifest.Services))
+	for i, svc := range manifest.Services {
+		svc.Servers = append([]core.Server(nil), svc.Servers...)
+		for j := range svc.Servers {
+			svc.Servers[j].Health = ""
+		}
+		services[i] = svc
+	}
+
+	hashes := map[string]string{}
+	for section, v := range map[string]interface{}{"services": services, "routes": manifest.Routes, "certs": manifest.Certs, "vips": manifest.Vips} {
+		b, _ := json.Marshal(v)
+		// none is none, however it was stored
+		if string(b) == "null" {
+			b = []byte("[]")
+		}
+		hashes[section] = fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+	}
+	return hashes
+}
+
+// Diff returns the changes needed to go from the current state to the
+// manifest's. Sections left out of the manifest (nil) aren't managed by it and
+// are filled in from the current state.
+func Diff(manifest *core.Manifest) ([]core.Change, error) {
+	current, err := GetManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Services == nil {
+		manifest.Services = current.Services
+	}
+	if manifest.Routes == nil {
+		manifest.Routes = current.Routes
+	}
+	if manifest.Certs == nil {
+		manifest.Certs = current.Certs
+	}
+	if manifest.Vips == nil {
+		manifest.Vips = current.Vips
+	}
+
+	return DiffManifests(*current, *manifest), nil
+}
+
+// DiffManifests returns the changes needed to go from one manifest to another
+func DiffManifests(from, to core.Manifest) []core.Change {
+	changes := []core.Change{}
+
+	// services, and their servers
+	oldServices := map[string]core.Service{}
+	for _, svc := range from.Services {
+		oldServices[svc.Id] = svc
+	}
+	for _, svc := range to.Services {
+		old, ok := oldServices[svc.Id]
+		if !ok {
+			changes = append(changes, core.Change{Action: "add", Resource: "service", Id: svc.Id})
+			continue
+		}
+		delete(oldServices, svc.Id)
+		if !same(serviceOnly(old), serviceOnly(svc)) {
+			changes = append(changes, core.Change{Action: "update", Resource: "service", Id: svc.Id})
+		}
+		changes = append(changes, diffServers(svc.Id, old.Servers, svc.Servers)...)
+	}
+	for _, svc := range from.Services {
+		if _, ok := oldServices[svc.Id]; ok {
+			changes = append(changes, core.Change{Action: "delete", Resource: "service", Id: svc.Id})
+		}
+	}
+
+	// routes
+	oldRoutes := map[string]core.Route{}
+	for _, route := range from.Routes {
+		oldRoutes[routeId(route)] = route
+	}
+	for _, route := range to.Routes {
+		id := routeId(route)
+		old, ok := oldRoutes[id]
+		if !ok {
+			changes = append(changes, core.Change{Action: "add", Resource: "route", Id: id})
+			continue
+		}
+		delete(oldRoutes, id)
+		if !same(normalRoute(old), normalRoute(route)) {
+			changes = append(changes, core.Change{Action: "update", Resource: "route", Id: id})
+		}
+	}
+	for _, route := range from.Routes {
+		if _, ok := oldRoutes[routeId(route)]; ok {
+			changes = append(changes, core.Change{Action: "delete", Resource: "route", Id: routeId(route)})
+		}
+	}
+
+	// certs
+	oldCerts := map[string]core.CertBundle{}
+	for _, cert := range from.Certs {
+		oldCerts[cert.Cert] = cert
+	}
+	for _, cert := range to.Certs {
+		old, ok := oldCerts[cert.Cert]
+		if !ok {
+			changes = append(changes, core.Change{Action: "add", Resource: "cert", Id: certId(cert)})
+			continue
+		}
+		delete(oldCerts, cert.Cert)
+		if old.Key != cert.Key {
+			changes = append(changes, core.Change{Action: "update", Resource: "cert", Id: certId(cert)})
+		}
+	}
+	for _, cert := range from.Certs {
+		if _, ok := oldCerts[cert.Cert]; ok {
+			changes = append(changes, core.Change{Action: "delete", Resource: "cert", Id: certId(cert)})
+		}
+	}
+
+	// vips
+	oldVips := map[string]core.Vip{}
+	for _, vip := range from.Vips {
+		oldVips[vip.Ip] = vip
+	}
+	for _, vip := range to.Vips {
+		old, ok := oldVips[vip.Ip]
+		if !ok {
+			changes = append(changes, core.Change{Action: "add", Resource: "vip", Id: vip.Ip})
+			continue
+		}
+		delete(oldVips, vip.Ip)
+		if old != vip {
+			changes = append(changes, core.Change{Action: "update", Resource: "vip", Id: vip.Ip})
+		}
+	}
+	for _, vip := range from.Vips {
+		if _, ok := oldVips[vip.Ip]; ok {
+			changes = append(changes, core.Change{Action: "delete", Resource: "vip", Id: vip.Ip})
+		}
+	}
+
+	return changes
+}
+
+// ChangeOps returns the ops making the changes from one manifest to the other,
+// one per changed resource, so resources that didn't change aren't reapplied
+// (setting every service would flush the balancer's connections to them all)
+func ChangeOps(from, to core.Manifest, changes []core.Change) []core.Op {
+	oldServices, services := map[string]core.Service{}, map[string]core.Service{}
+	servers := map[string]core.Server{}
+	for _, svc := range from.Services {
+		oldServices[svc.Id] = svc
+	}
+	for _, svc := range to.Services {
+		services[svc.Id] = svc
+		for _, srv := range svc.Servers {
+			servers[svc.Id+"/"+srv.Id] = srv
+		}
+	}
+	oldRoutes, routes := map[string]core.Route{}, map[string]core.Route{}
+	for _, route := range from.Routes {
+		oldRoutes[routeId(route)] = route
+	}
+	for _, route := range to.Routes {
+		routes[routeId(route)] = route
+	}
+	oldCerts, certs := map[string]core.CertBundle{}, map[string]core.CertBundle{}
+	for _, cert := range from.Certs {
+		oldCerts[certId(cert)] = cert
+	}
+	for _, cert := range to.Certs {
+		certs[certId(cert)] = cert
+	}
+	oldVips, vips := map[string]core.Vip{}, map[string]core.Vip{}
+	for _, vip := range from.Vips {
+		oldVips[vip.Ip] = vip
+	}
+	for _, vip := range to.Vips {
+		vips[vip.Ip] = vip
+	}
+
+	ops := []core.Op{}
+	for _, change := range changes {
+		id := change.Id
+		deleted := change.Action == "delete"
+		switch change.Resource {
+		case "service":
+			if deleted {
+				ops = append(ops, core.Op{Action: "delete-service", SvcId: id})
+				continue
+			}
+			svc := services[id]
+			ops = append(ops, core.Op{Action: "set-service", Service: &svc})
+		case "server":
+			svcId, srvId := id, ""
+			if i := strings.Index(id, "/"); i != -1 {
+				svcId, srvId = id[:i], id[i+1:]
+			}
+			if deleted {
+				ops = append(ops, core.Op{Action: "delete-server", SvcId: svcId, SrvId: srvId})
+				continue
+			}
+			srv := servers[id]
+			ops = append(ops, core.Op{Action: "set-server", SvcId: svcId, Server: &srv})
+		case "route":
+			if deleted {
+				route := oldRoutes[id]
+				ops = append(ops, core.Op{Action: "delete-route", Route: &route})
+				continue
+			}
+			route := routes[id]
+			ops = append(ops, core.Op{Action: "set-route", Route: &route})
+		case "cert":
+			if deleted {
+				cert := oldCerts[id]
+				ops = append(ops, core.Op{Action: "delete-cert", Cert: &cert})
+				continue
+			}
+			cert := certs[id]
+			ops = append(ops, core.Op{Action: "set-cert", Cert: &cert})
+		case "vip":
+			if deleted {
+				vip := oldVips[id]
+				ops = append(ops, core.Op{Action: "delete-vip", Vip: &vip})
+				continue
+			}
+			vip := vips[id]
+			ops = append(ops, core.Op{Action: "set-vip", Vip: &vip})
+		}
+	}
+	return ops
+}
+
+func diffServers(svcId string, from, to []core.Server) []core.Change {
+	changes := []core.Change{}
+
+	oldServers := map[string]core.Server{}
+	for _, srv := range from {
+		oldServers[srv.Id] = srv
+	}
+	for _, srv := range to {
+		id := svcId + "/" + srv.Id
+		old, ok := oldServers[srv.Id]
+		if !ok {
+			changes = append(changes, core.Change{Action: "add", Resource: "server", Id: id})
+			continue
+		}
+		delete(oldServers, srv.Id)
+		// health is reported, not stored
+		old.Health, srv.Health = "", ""
+		if old != srv {
+			changes = append(changes, core.Change{Action: "update", Resource: "server", Id: id})
+		}
+	}
+	for _, srv := range from {
+		if _, ok := oldServers[srv.Id]; ok {
+			changes = append(changes, core.Change{Action: "delete", Resource: "server", Id: svcId + "/" + srv.Id})
+		}
+	}
+
+	return changes
+}
+
+// serviceOnly strips a service's servers, which are diffed separately
+func serviceOnly(svc core.Service) core.Service {
+	svc.Servers = nil
+	return svc
+}
+
+// normalRoute treats no targets the same as empty targets
+func normalRoute(route core.Route) core.Route {
+	if len(route.Targets) == 0 {
+		route.Targets = nil
+	}
+	return route
+}
+
+// routeId identifies a route - "admin.myapp.com/admin"
+func routeId(route core.Route) string {
+	if route.SubDomain == "" {
+		return route.Domain + route.Path
+	}
+	return fmt.Sprintf("%s.%s%s", route.SubDomain, route.Domain, route.Path)
+}
+
+// certId identifies a cert by its common name, falling back to its fingerprint
+func certId(cert core.CertBundle) string {
+	if block, _ := pem.Decode([]byte(cert.Cert)); block != nil {
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil && c.Subject.CommonName != "" {
+			return c.Subject.CommonName
+		}
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(cert.Cert)))[:16]
+}
+
+func same(a, b interface{}) bool {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	return string(aj) == string(bj)
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"strings"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+// Stored records a revision of the config once a change has been saved to the
+// central database, returning err if it wasn't
+func Stored(action string, err error) error {
+	if err != nil {
+		return err
+	}
+	revise(action)
+	return nil
+}
+
+// revise saves a numbered copy of the config as the action left it, unless
+// it's unchanged since the last (reapplying the database on start or resync),
+// removing the oldest beyond revision-keep. The change is already saved, so
+// failing to record it is logged rather than undoing it. Each member records
+// the changes it saves, so with redis and a per-member database (scribble or
+// bolt) every member numbers its own revisions.
+func revise(action string) {
+	manifest, err := GetManifest()
+	if err != nil {
+		config.Log.Error("Failed to record revision - %s", err)
+		return
+	}
+	// challenge routes only exist while a cert is issued, so issuing one is
+	// recorded as a single revision (of the cert)
+	manifest.Routes = unchallenged(manifest.Routes)
+
+	last, err := database.GetLastRevision()
+	if err != nil && err != database.NoRevisionError {
+		config.Log.Error("Failed to record revision - %s", err)
+		return
+	}
+	if last != nil && last.Manifest != nil && same(Hashes(*last.Manifest), Hashes(*manifest)) {
+		return
+	}
+	number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: action, Manifest: manifest})
+	if err != nil {
+		config.Log.Error("Failed to record revision - %s", err)
+		return
+	}
+	config.Log.Trace("Recorded revision %d (%s)", number, action)
+
+	if config.RevisionKeep > 0 && number > config.RevisionKeep {
+		if err = database.DeleteRevisions(number - config.RevisionKeep + 1); err != nil {
+			config.Log.Error("Failed to remove old revisions - %s", err)
+		}
+	}
+}
+
+// unchallenged returns the routes, leaving out those serving acme challenges
+func unchallenged(routes []core.Route) []core.Route {
+	kept := make([]core.Route, 0, len(routes))
+	for i := range routes {
+		if !strings.HasPrefix(routes[i].Path, core.AcmeChallengePath) {
+			kept = append(kept, routes[i])
+		}
+	}
+	return kept
+}
@@ -0,0 +1,415 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/proxymgr"
+	"github.com/nanopack/portal/vipmgr"
+)
+
+var (
+	BadAction = errors.New("Invalid batch action")
+)
+
+type (
+	// Tx stages changes to balance, proxymgr, vipmgr, and the database,
+	// committing them in order. If a step fails, every step already applied is
+	// undone in reverse, across all subsystems.
+	Tx struct {
+		steps []txStep
+	}
+
+	txStep struct {
+		subsystem string // "balance", "proxymgr", "vipmgr", or "database"
+		resource  string // "services", "servers", "routes", "certs", "vips", "webhooks", or "tokens"
+		action    string
+		apply     func() error
+	}
+
+	txUndo struct {
+		resource string
+		undo     func() error
+	}
+)
+
+// NewTx creates an empty transaction
+func NewTx() *Tx {
+	return &Tx{}
+}
+
+// Batch stages the ops in a transaction and commits it
+func Batch(ops []core.Op) error {
+	tx := NewTx()
+	for i := range ops {
+		if err := tx.Stage(ops[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// StoreBatch saves the ops to the database only (when it is central, the
+// members have already applied them)
+func StoreBatch(ops []core.Op) error {
+	tx := NewTx()
+	for i := range ops {
+		if err := tx.Stage(ops[i]); err != nil {
+			return err
+		}
+	}
+	return tx.commit(func(step txStep) bool { return step.subsystem == "database" })
+}
+
+// Stage stages the op's action
+func (tx *Tx) Stage(op core.Op) error {
+	switch op.Action {
+	case "set-services":
+		tx.SetServices(op.Services)
+	case "set-service":
+		if op.Service == nil {
+			return fmt.Errorf("%s - missing service", op.Action)
+		}
+		tx.SetService(op.Service)
+	case "delete-service":
+		tx.DeleteService(op.SvcId)
+	case "set-servers":
+		tx.SetServers(op.SvcId, op.Servers)
+	case "set-server":
+		if op.Server == nil {
+			return fmt.Errorf("%s - missing server", op.Action)
+		}
+		tx.SetServer(op.SvcId, op.Server)
+	case "delete-server":
+		tx.DeleteServer(op.SvcId, op.SrvId)
+	case "set-routes":
+		tx.SetRoutes(op.Routes)
+	case "set-route", "delete-route":
+		if op.Route == nil {
+			return fmt.Errorf("%s - missing route", op.Action)
+		}
+		if op.Action == "set-route" {
+			tx.SetRoute(*op.Route)
+		} else {
+			tx.DeleteRoute(*op.Route)
+		}
+	case "set-certs":
+		tx.SetCerts(op.Certs)
+	case "set-cert", "delete-cert":
+		if op.Cert == nil {
+			return fmt.Errorf("%s - missing cert", op.Action)
+		}
+		if op.Action == "set-cert" {
+			tx.SetCert(*op.Cert)
+		} else {
+			tx.DeleteCert(*op.Cert)
+		}
+	case "set-vips":
+		tx.SetVips(op.Vips)
+	case "set-vip", "delete-vip":
+		if op.Vip == nil {
+			return fmt.Errorf("%s - missing vip", op.Action)
+		}
+		if op.Action == "set-vip" {
+			tx.SetVip(*op.Vip)
+		} else {
+			tx.DeleteVip(*op.Vip)
+		}
+	case "set-webhooks":
+		tx.SetWebhooks(op.Webhooks)
+	case "set-webhook":
+		if op.Webhook == nil {
+			return fmt.Errorf("%s - missing webhook", op.Action)
+		}
+		tx.SetWebhook(*op.Webhook)
+	case "delete-webhook":
+		tx.DeleteWebhook(op.HookId)
+	case "set-tokens":
+		tx.SetTokens(op.Tokens)
+	case "set-token":
+		if op.Token == nil {
+			return fmt.Errorf("%s - missing token", op.Action)
+		}
+		tx.SetToken(*op.Token)
+	case "delete-token":
+		tx.DeleteToken(op.TokenName)
+	default:
+		return fmt.Errorf("%s - '%s'", BadAction, op.Action)
+	}
+	return nil
+}
+
+// services
+func (tx *Tx) SetServices(services []core.Service) {
+	tx.stage("balance", "services", "set-services", func() error { return balance.SetServices(services) })
+	tx.stage("database", "services", "set-services", func() error { return database.SetServices(services) })
+}
+
+func (tx *Tx) SetService(service *core.Service) {
+	tx.stage("balance", "services", "set-service", func() error { return balance.SetService(service) })
+	tx.stage("database", "services", "set-service", func() error { return database.SetService(service) })
+}
+
+func (tx *Tx) DeleteService(svcId string) {
+	tx.stage("balance", "services", "delete-service", func() error { return balance.DeleteService(svcId) })
+	tx.stage("database", "services", "delete-service", func() error { return database.DeleteService(svcId) })
+}
+
+// servers
+func (tx *Tx) SetServers(svcId string, servers []core.Server) {
+	tx.stage("balance", "servers", "set-servers", func() error { return balance.SetServers(svcId, servers) })
+	tx.stage("database", "servers", "set-servers", func() error { return database.SetServers(svcId, servers) })
+}
+
+func (tx *Tx) SetServer(svcId string, server *core.Server) {
+	tx.stage("balance", "servers", "set-server", func() error { return balance.SetServer(svcId, server) })
+	tx.stage("database", "servers", "set-server", func() error { return database.SetServer(svcId, server) })
+}
+
+func (tx *Tx) DeleteServer(svcId, srvId string) {
+	tx.stage("balance", "servers", "delete-server", func() error { return balance.DeleteServer(svcId, srvId) })
+	tx.stage("database", "servers", "delete-server", func() error { return database.DeleteServer(svcId, srvId) })
+}
+
+// routes
+func (tx *Tx) SetRoutes(routes []core.Route) {
+	tx.stage("proxymgr", "routes", "set-routes", func() error { return proxymgr.SetRoutes(routes) })
+	tx.stage("database", "routes", "set-routes", func() error { return database.SetRoutes(routes) })
+}
+
+func (tx *Tx) SetRoute(route core.Route) {
+	tx.stage("proxymgr", "routes", "set-route", func() error { return proxymgr.SetRoute(route) })
+	tx.stage("database", "routes", "set-route", func() error { return database.SetRoute(route) })
+}
+
+func (tx *Tx) DeleteRoute(route core.Route) {
+	tx.stage("proxymgr", "routes", "delete-route", func() error { return proxymgr.DeleteRoute(route) })
+	tx.stage("database", "routes", "delete-route", func() error { return database.DeleteRoute(route) })
+}
+
+// certs
+func (tx *Tx) SetCerts(certs []core.CertBundle) {
+	tx.stage("proxymgr", "certs", "set-certs", func() error { return proxymgr.SetCerts(certs) })
+	tx.stage("database", "certs", "set-certs", func() error { return database.SetCerts(certs) })
+}
+
+func (tx *Tx) SetCert(cert core.CertBundle) {
+	tx.stage("proxymgr", "certs", "set-cert", func() error { return proxymgr.SetCert(cert) })
+	tx.stage("database", "certs", "set-cert", func() error { return database.SetCert(cert) })
+}
+
+func (tx *Tx) DeleteCert(cert core.CertBundle) {
+	tx.stage("proxymgr", "certs", "delete-cert", func() error { return proxymgr.DeleteCert(cert) })
+	tx.stage("database", "certs", "delete-cert", func() error { return database.DeleteCert(cert) })
+}
+
+// vips
+func (tx *Tx) SetVips(vips []core.Vip) {
+	tx.stage("vipmgr", "vips", "set-vips", func() error { return vipmgr.SetVips(vips) })
+	tx.stage("database", "vips", "set-vips", func() error { return database.SetVips(vips) })
+}
+
+func (tx *Tx) SetVip(vip core.Vip) {
+	tx.stage("vipmgr", "vips", "set-vip", func() error { return vipmgr.SetVip(vip) })
+	tx.stage("database", "vips", "set-vip", func() error { return database.SetVip(vip) })
+}
+
+func (tx *Tx) DeleteVip(vip core.Vip) {
+	tx.stage("vipmgr", "vips", "delete-vip", func() error { return vipmgr.DeleteVip(vip) })
+	tx.stage("database", "vips", "delete-vip", func() error { return database.DeleteVip(vip) })
+}
+
+// webhooks (only stored)
+func (tx *Tx) SetWebhooks(hooks []core.Webhook) {
+	tx.stage("database", "webhooks", "set-webhooks", func() error { return setWebhooks(hooks) })
+}
+
+func (tx *Tx) SetWebhook(hook core.Webhook) {
+	tx.stage("database", "webhooks", "set-webhook", func() error { return database.SetWebhook(hook) })
+}
+
+func (tx *Tx) DeleteWebhook(id string) {
+	tx.stage("database", "webhooks", "delete-webhook", func() error {
+		// members may not have it (added before they joined)
+		if err := database.DeleteWebhook(id); err != nil && err != database.NoWebhookError {
+			return err
+		}
+		return nil
+	})
+}
+
+// tokens (only stored)
+func (tx *Tx) SetTokens(tokens []core.Token) {
+	tx.stage("database", "tokens", "set-tokens", func() error { return setTokens(tokens) })
+}
+
+func (tx *Tx) SetToken(token core.Token) {
+	tx.stage("database", "tokens", "set-token", func() error { return database.SetToken(token) })
+}
+
+func (tx *Tx) DeleteToken(name string) {
+	tx.stage("database", "tokens", "delete-token", func() error {
+		// members may not have it (added before they joined)
+		if err := database.DeleteToken(name); err != nil && err != database.NoTokenError {
+			return err
+		}
+		return nil
+	})
+}
+
+// Commit applies the staged steps in order, undoing the applied ones in
+// reverse if one fails
+func (tx *Tx) Commit() error {
+	return tx.commit(func(step txStep) bool {
+		// members don't save to a central database
+		return step.subsystem != "database" || !database.CentralStore
+	})
+}
+
+func (tx *Tx) stage(subsystem, resource, action string, apply func() error) {
+	tx.steps = append(tx.steps, txStep{subsystem: subsystem, resource: resource, action: action, apply: apply})
+}
+
+func (tx *Tx) commit(include func(txStep) bool) error {
+	undos := []txUndo{}
+	stored := []string{}
+	for _, step := range tx.steps {
+		if !include(step) {
+			continue
+		}
+		if step.subsystem == "database" {
+			stored = append(stored, step.action)
+		}
+
+		// in case of failure
+		undo, err := snapshot(step.subsystem, step.resource)
+		if err == nil {
+			err = step.apply()
+		}
+		if err != nil {
+			err = fmt.Errorf("Failed to %s (%s) - %s", step.action, step.subsystem, err)
+			// undo applied steps
+			for i := len(undos) - 1; i >= 0; i-- {
+				if uerr := rollback(undos[i].resource, undos[i].undo()); uerr != nil {
+					err = fmt.Errorf("%s - %s", err, uerr)
+				}
+			}
+			return err
+		}
+
+		undos = append(undos, txUndo{resource: step.resource, undo: undo})
+	}
+
+	// one revision for the whole transaction
+	if len(stored) == 1 {
+		revise(stored[0])
+	} else if len(stored) > 1 {
+		revise("batch")
+	}
+	return nil
+}
+
+// snapshot returns a func restoring the subsystem's resources to their current
+// (stored) state
+func snapshot(subsystem, resource string) (func() error, error) {
+	switch resource {
+	case "services", "servers":
+		old, err := database.GetServices()
+		if err != nil {
+			return nil, err
+		}
+		if subsystem == "database" {
+			return func() error { return database.SetServices(old) }, nil
+		}
+		return func() error { return balance.SetServices(old) }, nil
+	case "routes":
+		old, err := database.GetRoutes()
+		if err != nil {
+			return nil, err
+		}
+		if subsystem == "database" {
+			return func() error { return database.SetRoutes(old) }, nil
+		}
+		return func() error { return proxymgr.SetRoutes(old) }, nil
+	case "certs":
+		old, err := database.GetCerts()
+		if err != nil {
+			return nil, err
+		}
+		if subsystem == "database" {
+			return func() error { return database.SetCerts(old) }, nil
+		}
+		return func() error { return proxymgr.SetCerts(old) }, nil
+	case "vips":
+		old, err := database.GetVips()
+		if err != nil {
+			return nil, err
+		}
+		if subsystem == "database" {
+			return func() error { return database.SetVips(old) }, nil
+		}
+		return func() error { return vipmgr.SetVips(old) }, nil
+	case "webhooks":
+		old, err := database.GetWebhooks()
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return setWebhooks(old) }, nil
+	case "tokens":
+		old, err := database.GetTokens()
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return setTokens(old) }, nil
+	}
+	return nil, fmt.Errorf("Unknown resource '%s'", resource)
+}
+
+// setWebhooks replaces the stored webhooks
+func setWebhooks(hooks []core.Webhook) error {
+	current, err := database.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for i := range hooks {
+		keep[hooks[i].Id] = true
+		if err = database.SetWebhook(hooks[i]); err != nil {
+			return err
+		}
+	}
+	for i := range current {
+		if !keep[current[i].Id] {
+			if err = database.DeleteWebhook(current[i].Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setTokens replaces the stored tokens
+func setTokens(tokens []core.Token) error {
+	current, err := database.GetTokens()
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for i := range tokens {
+		keep[tokens[i].Name] = true
+		if err = database.SetToken(tokens[i]); err != nil {
+			return err
+		}
+	}
+	for i := range current {
+		if !keep[current[i].Name] {
+			if err = database.DeleteToken(current[i].Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
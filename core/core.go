@@ -2,8 +2,11 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type (
@@ -43,6 +46,36 @@ type (
 		GetVips() ([]Vip, error)
 	}
 
+	Hookable interface {
+		// webhooks
+		GetWebhooks() ([]Webhook, error)
+		SetWebhook(hook Webhook) error
+		DeleteWebhook(id string) error
+	}
+
+	Tokenable interface {
+		// api tokens
+		GetTokens() ([]Token, error)
+		SetToken(token Token) error
+		DeleteToken(name string) error
+	}
+
+	Auditable interface {
+		// audit log (append only)
+		AddAudit(record AuditRecord) error
+		GetAudit(since time.Time, resource string) ([]AuditRecord, error)
+		DeleteAudit(keep int) error // removes all but the newest keep records
+	}
+
+	Revisable interface {
+		// config revisions (numbered in the order added)
+		AddRevision(rev Revision) (int, error)
+		GetRevisions() ([]Revision, error)
+		GetLastRevision() (*Revision, error)
+		GetRevision(number int) (*Revision, error)
+		DeleteRevisions(before int) error
+	}
+
 	Server struct {
 		// todo: change "Id" to "name" (for clarity)
 		Id             string `json:"id,omitempty"`
@@ -52,6 +85,16 @@ type (
 		Weight         int    `json:"weight"`
 		UpperThreshold int    `json:"upper_threshold"`
 		LowerThreshold int    `json:"lower_threshold"`
+		// defines health check
+		Check        string `json:"check,omitempty"`         // type of health check to perform - "tcp", "udp", or "http" (blank disables health checks)
+		Endpoint     string `json:"endpoint,omitempty"`      // url path to check for health (http only) - "/health" (default "/")
+		ExpectedCode int    `json:"expected_code,omitempty"` // expected http response code (http only) (default 200)
+		Timeout      int    `json:"timeout,omitempty"`       // milliseconds before check times out (default 3000 (3s))
+		Attempts     int    `json:"attempts,omitempty"`      // number of failed checks before removing from balancer (default 3)
+		Recover      int    `json:"recover,omitempty"`       // number of successful checks before restoring to balancer (default 2)
+		Health       string `json:"health,omitempty"`        // health as seen by this portal - "unknown", "healthy", or "unhealthy" (read only)
+		// defines removal
+		Draining bool `json:"draining,omitempty"` // server is set to weight 0 and will be removed once its connections finish (read only)
 	}
 	Service struct {
 		Id          string   `json:"id,omitempty"`
@@ -89,35 +132,187 @@ type (
 		Key  string `json:"key"`
 	}
 
+	// CertInfo describes a cert bundle's leaf certificate (see CertBundle.Parse)
+	CertInfo struct {
+		Subject     string    `json:"subject"`     // common name - "myapp.com"
+		Sans        []string  `json:"sans"`        // dns names and ips the cert is valid for - ["myapp.com","admin.myapp.com"]
+		Issuer      string    `json:"issuer"`      // issuer's common name - "R3"
+		NotBefore   time.Time `json:"not_before"`  // start of validity
+		NotAfter    time.Time `json:"not_after"`   // expiry
+		KeyType     string    `json:"key_type"`    // "RSA-2048" or "ECDSA-P256"
+		Fingerprint string    `json:"fingerprint"` // sha256 of the leaf certificate (hex)
+	}
+
 	Vip struct {
 		Ip        string `json:"ip"`        // ip/cidr
 		Interface string `json:"interface"` // interface to bind to
 		Alias     string `json:"alias"`     // label for ip
+		// when clustered, one alive member owns the vip (each member's priority is
+		// its config.VipPriority)
+		Preempt bool `json:"preempt,omitempty"` // take the vip from an owner with a lower priority
 	}
+
+	// Manifest is the desired state of portal
+	Manifest struct {
+		Services []Service    `json:"services"`
+		Routes   []Route      `json:"routes"`
+		Certs    []CertBundle `json:"certs"`
+		Vips     []Vip        `json:"vips"`
+	}
+
+	// Snapshot is all of portal's config at a point in time, to back up and
+	// restore
+	Snapshot struct {
+		Version int       `json:"version"` // format of the snapshot (SnapshotVersion)
+		Time    time.Time `json:"time"`    // when it was taken
+		Manifest
+		Errors map[string]string `json:"errors"` // custom error pages - {"no-routes":"<HTML>...","no-healthy":"<HTML>..."}
+	}
+
+	// Revision is a numbered copy of the config, saved after each change to it
+	Revision struct {
+		Number int       `json:"number"` // counts up from 1
+		Time   time.Time `json:"time"`   // when the change was saved
+		Action string    `json:"action"` // change that made it - "set-services", "batch"
+		*Manifest
+	}
+
+	// Change is a difference between a manifest and the current state
+	Change struct {
+		Action   string `json:"action"`   // "add", "update", or "delete"
+		Resource string `json:"resource"` // "service", "server", "route", "cert", or "vip"
+		Id       string `json:"id"`       // identifies the resource - "tcp-192_168_0_15-80", "tcp-192_168_0_15-80/192_168_0_16-8080", "admin.myapp.com/admin"
+	}
+
+	// Op is a single action in a batch, with the field(s) the action uses
+	Op struct {
+		Action    string       `json:"action"`               // "set-services", "set-service", "delete-service", "set-servers", "set-server", "delete-server", "set-routes", "set-route", "delete-route", "set-certs", "set-cert", "delete-cert", "set-vips", "set-vip", "delete-vip", "set-webhooks", "set-webhook", "delete-webhook", "set-tokens", "set-token", or "delete-token"
+		SvcId     string       `json:"svc_id,omitempty"`     // service to delete, or to set/delete servers on
+		SrvId     string       `json:"srv_id,omitempty"`     // server to delete
+		Service   *Service     `json:"service,omitempty"`    // set-service
+		Services  []Service    `json:"services,omitempty"`   // set-services
+		Server    *Server      `json:"server,omitempty"`     // set-server
+		Servers   []Server     `json:"servers,omitempty"`    // set-servers
+		Route     *Route       `json:"route,omitempty"`      // set-route, delete-route
+		Routes    []Route      `json:"routes,omitempty"`     // set-routes
+		Cert      *CertBundle  `json:"cert,omitempty"`       // set-cert, delete-cert
+		Certs     []CertBundle `json:"certs,omitempty"`      // set-certs
+		Vip       *Vip         `json:"vip,omitempty"`        // set-vip, delete-vip
+		Vips      []Vip        `json:"vips,omitempty"`       // set-vips
+		Webhook   *Webhook     `json:"webhook,omitempty"`    // set-webhook (webhooks are replicated between members, not sent as events)
+		Webhooks  []Webhook    `json:"webhooks,omitempty"`   // set-webhooks
+		HookId    string       `json:"hook_id,omitempty"`    // delete-webhook
+		Token     *Token       `json:"token,omitempty"`      // set-token (tokens are replicated like webhooks, only their hashes)
+		Tokens    []Token      `json:"tokens,omitempty"`     // set-tokens
+		TokenName string       `json:"token_name,omitempty"` // delete-token
+	}
+
+	// Event is a change (an applied op) made through a cluster member, or a
+	// change in health seen by a member ("server-health", "target-health")
+	Event struct {
+		Op
+		Target string    `json:"target,omitempty"` // target-health: the route's target - "http://127.0.0.1:8080"
+		Health string    `json:"health,omitempty"` // server-health, target-health: "healthy" or "unhealthy"
+		Member string    `json:"member"`           // member the change was made through (or seen by) - "portal1:8443"
+		Time   time.Time `json:"time"`             // when the change was applied
+	}
+
+	// Webhook is a url events are posted to
+	Webhook struct {
+		Id     string   `json:"id,omitempty"`     // generated from the url
+		Url    string   `json:"url"`              // url to post events to - "https://hooks.myapp.com/portal"
+		Secret string   `json:"secret,omitempty"` // key to sign payloads with (X-Portal-Signature) (write only)
+		Events []string `json:"events,omitempty"` // event actions to post - ["set-route","server-health"] (default all)
+	}
+
+	// Token is a named api token, limited to its scopes
+	Token struct {
+		Name   string   `json:"name"`            // "ci"
+		Token  string   `json:"token,omitempty"` // the token, only returned when it's added
+		Hash   string   `json:"hash,omitempty"`  // salted hash of the token, stored instead of it
+		Scopes []string `json:"scopes"`          // what it may do - ["read-only","routes-only"]
+	}
+
+	// AuditRecord is a change made through the api
+	AuditRecord struct {
+		Id         string          `json:"id"`               // sorts in the order recorded
+		Time       time.Time       `json:"time"`             // when the change was made
+		RemoteAddr string          `json:"remote_addr"`      // who made it (X-Forwarded-For, if set)
+		Identity   string          `json:"identity"`         // token it was made with
+		Request    string          `json:"request"`          // "DELETE /services/tcp-192_168_0_15-80"
+		Action     string          `json:"action"`           // "set-route", "apply-manifest"
+		Resource   string          `json:"resource"`         // "route", "manifest"
+		Before     json.RawMessage `json:"before,omitempty"` // what was changed (private keys redacted)
+		After      json.RawMessage `json:"after,omitempty"`  // what it was changed to (private keys redacted)
+	}
+)
+
+// SnapshotVersion is the format of the snapshots this portal takes (and the
+// only one it restores)
+const SnapshotVersion = 1
+
+// AcmeChallengePath prefixes the paths of the temporary routes serving acme
+// challenges
+const AcmeChallengePath = "/.well-known/acme-challenge/"
+
+var (
+	// hosts are encoded in ids so ipv4 and ipv6 addresses are url safe and
+	// don't contain the "-" separator
+	hostEncoder = strings.NewReplacer(".", "_", ":", ".")
+	hostDecoder = strings.NewReplacer("_", ".", ".", ":")
 )
 
+// EncodeHost encodes a host for use in an id - "192.168.0.1" -> "192_168_0_1",
+// "fd00::1" -> "fd00..1"
+func EncodeHost(host string) string {
+	return hostEncoder.Replace(host)
+}
+
+// DecodeHost decodes a host encoded with EncodeHost
+func DecodeHost(host string) string {
+	return hostDecoder.Replace(host)
+}
+
 func (s *Service) GenId() {
 	if s.Type == "" { // default to tcp
 		s.Type = "tcp"
 	}
-	s.Id = fmt.Sprintf("%s-%s-%d", s.Type, strings.Replace(s.Host, ".", "_", -1), s.Port)
+	s.Id = fmt.Sprintf("%s-%s-%d", s.Type, EncodeHost(s.Host), s.Port)
+}
+
+func (w *Webhook) GenId() {
+	w.Id = fmt.Sprintf("%x", sha256.Sum256([]byte(w.Url)))[:16]
+}
+
+// Wants reports whether the webhook posts events with the action
+func (w Webhook) Wants(action string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for i := range w.Events {
+		if w.Events[i] == action {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) GenId() {
-	s.Id = fmt.Sprintf("%s-%d", strings.Replace(s.Host, ".", "_", -1), s.Port)
+	s.Id = fmt.Sprintf("%s-%d", EncodeHost(s.Host), s.Port)
 }
 
-// GenHost resets the server's Host it's service's Host if "127.0.0.1" was detected
+// GenHost resets the server's Host it's service's Host if "127.0.0.1" (or
+// "::1") was detected
 func (s *Server) GenHost(svcId string) {
-	if s.Host != "127.0.0.1" {
+	if s.Host != "127.0.0.1" && s.Host != "::1" {
 		return
 	}
 
-	host := strings.Split(strings.Replace(svcId, "_", ".", -1), "-")
+	host := strings.Split(svcId, "-")
 
 	if len(host) != 3 {
 		return
 	}
 
-	s.Host = host[1]
+	s.Host = DecodeHost(host[1])
 }
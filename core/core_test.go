@@ -0,0 +1,49 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/nanopack/portal/core"
+)
+
+func TestEncodeHost(t *testing.T) {
+	hosts := []struct {
+		host, encoded string
+	}{
+		{"192.168.0.1", "192_168_0_1"},
+		{"fd00::1", "fd00..1"},
+		{"::1", "..1"},
+		{"fd00::1.2.3.4", "fd00..1_2_3_4"},
+		{"2001:db8:0:0:8:800:200c:417a", "2001.db8.0.0.8.800.200c.417a"},
+	}
+
+	for _, h := range hosts {
+		if encoded := core.EncodeHost(h.host); encoded != h.encoded {
+			t.Errorf("Failed to encode '%s' - '%s' expected '%s'", h.host, encoded, h.encoded)
+		}
+		if decoded := core.DecodeHost(h.encoded); decoded != h.host {
+			t.Errorf("Failed to decode '%s' - '%s' expected '%s'", h.encoded, decoded, h.host)
+		}
+	}
+}
+
+func TestGenIdIpv6(t *testing.T) {
+	service := core.Service{Host: "fd00::3", Port: 80}
+	service.GenId()
+	if service.Id != "tcp-fd00..3-80" {
+		t.Errorf("Bad service id - '%s'", service.Id)
+	}
+
+	server := core.Server{Host: "fd00::1.2.3.4", Port: 8080}
+	server.GenId()
+	if server.Id != "fd00..1_2_3_4-8080" {
+		t.Errorf("Bad server id - '%s'", server.Id)
+	}
+
+	// local servers take the service's host
+	server = core.Server{Host: "::1", Port: 8080}
+	server.GenHost(service.Id)
+	if server.Host != "fd00::3" {
+		t.Errorf("Bad server host - '%s'", server.Host)
+	}
+}
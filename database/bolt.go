@@ -0,0 +1,752 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nanobox-io/golang-scribble"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+var (
+	// BoltTimeout is how long to wait for the database file to be unlocked (by
+	// another portal using it)
+	BoltTimeout = time.Second
+
+	NotBoltError = errors.New("Only bolt databases can be imported into")
+
+	// a bucket is kept for each
+	boltKinds = []string{"services", "routes", "certs", "vips", "webhooks", "tokens", "audit", "revisions"}
+)
+
+type (
+	// BoltDb stores each service, route, cert, etc. as json under its id, in a
+	// bucket for its kind, in one file ("bolt:///var/db/portal/portal.db"). Each
+	// change is one transaction, so a crash never leaves a change half made.
+	BoltDb struct {
+		db *bolt.DB
+	}
+)
+
+func (b *BoltDb) Init() error {
+	u, err := url.Parse(config.DatabaseConnection)
+	if err != nil {
+		return fmt.Errorf("Failed to parse db connection - %s", err)
+	}
+	if u.Path == "" {
+		return fmt.Errorf("Failed to parse db connection - missing path")
+	}
+	err = os.MkdirAll(filepath.Dir(u.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(u.Path, 0600, &bolt.Options{Timeout: BoltTimeout})
+	if err != nil {
+		return fmt.Errorf("Failed to open bolt database - %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, kind := range boltKinds {
+			if _, err := tx.CreateBucketIfNotExists([]byte(kind)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("Failed to create buckets - %s", err)
+	}
+
+	b.db = db
+	return nil
+}
+
+// Close closes the database file, unlocking it
+func (b *BoltDb) Close() error {
+	return b.db.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SERVICES
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetServices() ([]core.Service, error) {
+	services := make([]core.Service, 0, 0)
+	values, err := b.list("services")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var service core.Service
+		if err = json.Unmarshal(values[i], &service); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (b BoltDb) GetService(id string) (*core.Service, error) {
+	service := core.Service{}
+	found, err := b.get("services", id, &service)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, NoServiceError
+	}
+	return &service, nil
+}
+
+func (b BoltDb) SetServices(services []core.Service) error {
+	ids := make([]string, len(services))
+	values := make([]interface{}, len(services))
+	for i := range services {
+		ids[i], values[i] = services[i].Id, services[i]
+	}
+	return b.replace("services", ids, values)
+}
+
+func (b BoltDb) SetService(service *core.Service) error {
+	return b.put("services", service.Id, *service)
+}
+
+func (b BoltDb) DeleteService(id string) error {
+	_, err := b.del("services", id)
+	return err
+}
+
+func (b BoltDb) SetServer(svcId string, server *core.Server) error {
+	return b.updateService(svcId, func(service *core.Service) {
+		for i := range service.Servers {
+			if service.Servers[i].Id == server.Id {
+				// if server already exists, update it rather than duplicate it
+				service.Servers[i] = *server
+				return
+			}
+		}
+		service.Servers = append(service.Servers, *server)
+	})
+}
+
+func (b BoltDb) SetServers(svcId string, servers []core.Server) error {
+	return b.updateService(svcId, func(service *core.Service) {
+		service.Servers = servers
+	})
+}
+
+func (b BoltDb) DeleteServer(svcId, srvId string) error {
+	err := b.updateService(svcId, func(service *core.Service) {
+		servers := []core.Server{}
+		for _, srv := range service.Servers {
+			if srv.Id != srvId {
+				servers = append(servers, srv)
+			}
+		}
+		service.Servers = servers
+	})
+	if err == NoServiceError {
+		return nil
+	}
+	return err
+}
+
+func (b BoltDb) GetServer(svcId, srvId string) (*core.Server, error) {
+	service, err := b.GetService(svcId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, srv := range service.Servers {
+		if srv.Id == srvId {
+			return &srv, nil
+		}
+	}
+
+	return nil, NoServerError
+}
+
+// updateService changes the stored service, in one transaction
+func (b BoltDb) updateService(svcId string, update func(service *core.Service)) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var service core.Service
+		found, err := boltGet(tx, "services", svcId, &service)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return NoServiceError
+		}
+		update(&service)
+		return boltPut(tx, "services", svcId, service)
+	})
+	if err == NoServiceError {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to update service - %s", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ROUTES
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetRoutes() ([]core.Route, error) {
+	routes := make([]core.Route, 0, 0)
+	values, err := b.list("routes")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var route core.Route
+		if err = json.Unmarshal(values[i], &route); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (b BoltDb) SetRoutes(routes []core.Route) error {
+	ids := make([]string, len(routes))
+	values := make([]interface{}, len(routes))
+	for i := range routes {
+		ids[i], values[i] = routeKey(routes[i]), routes[i]
+	}
+	return b.replace("routes", ids, values)
+}
+
+func (b BoltDb) SetRoute(route core.Route) error {
+	return b.put("routes", routeKey(route), route)
+}
+
+func (b BoltDb) DeleteRoute(route core.Route) error {
+	_, err := b.del("routes", routeKey(route))
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CERTS
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetCerts() ([]core.CertBundle, error) {
+	certs := make([]core.CertBundle, 0, 0)
+	values, err := b.list("certs")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var cert core.CertBundle
+		if err = json.Unmarshal(values[i], &cert); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func (b BoltDb) SetCerts(certs []core.CertBundle) error {
+	ids := make([]string, len(certs))
+	values := make([]interface{}, len(certs))
+	for i := range certs {
+		ids[i], values[i] = certKey(certs[i]), certs[i]
+	}
+	return b.replace("certs", ids, values)
+}
+
+// SetCert adds the cert, or updates its key if the cert is already stored
+func (b BoltDb) SetCert(cert core.CertBundle) error {
+	return b.put("certs", certKey(cert), cert)
+}
+
+func (b BoltDb) DeleteCert(cert core.CertBundle) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		stored := core.CertBundle{}
+		found, err := boltGet(tx, "certs", certKey(cert), &stored)
+		if err != nil || !found || stored.Key != cert.Key {
+			return err
+		}
+		return tx.Bucket([]byte("certs")).Delete([]byte(certKey(cert)))
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete cert - %s", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// VIPS
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetVips() ([]core.Vip, error) {
+	vips := make([]core.Vip, 0, 0)
+	values, err := b.list("vips")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var vip core.Vip
+		if err = json.Unmarshal(values[i], &vip); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		vips = append(vips, vip)
+	}
+	return vips, nil
+}
+
+func (b BoltDb) SetVips(vips []core.Vip) error {
+	ids := make([]string, len(vips))
+	values := make([]interface{}, len(vips))
+	for i := range vips {
+		ids[i], values[i] = vipKey(vips[i]), vips[i]
+	}
+	return b.replace("vips", ids, values)
+}
+
+func (b BoltDb) SetVip(vip core.Vip) error {
+	return b.put("vips", vipKey(vip), vip)
+}
+
+func (b BoltDb) DeleteVip(vip core.Vip) error {
+	_, err := b.del("vips", vipKey(vip))
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// WEBHOOKS
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetWebhooks() ([]core.Webhook, error) {
+	hooks := make([]core.Webhook, 0, 0)
+	values, err := b.list("webhooks")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var hook core.Webhook
+		if err = json.Unmarshal(values[i], &hook); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (b BoltDb) SetWebhook(hook core.Webhook) error {
+	return b.put("webhooks", hook.Id, hook)
+}
+
+func (b BoltDb) DeleteWebhook(id string) error {
+	deleted, err := b.del("webhooks", id)
+	if err == nil && !deleted {
+		return NoWebhookError
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TOKENS
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) GetTokens() ([]core.Token, error) {
+	tokens := make([]core.Token, 0, 0)
+	values, err := b.list("tokens")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var token core.Token
+		if err = json.Unmarshal(values[i], &token); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (b BoltDb) SetToken(token core.Token) error {
+	return b.put("tokens", token.Name, token)
+}
+
+func (b BoltDb) DeleteToken(name string) error {
+	deleted, err := b.del("tokens", name)
+	if err == nil && !deleted {
+		return NoTokenError
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AUDIT
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) AddAudit(record core.AuditRecord) error {
+	return b.put("audit", record.Id, record)
+}
+
+func (b BoltDb) GetAudit(since time.Time, resource string) ([]core.AuditRecord, error) {
+	records := make([]core.AuditRecord, 0, 0)
+	// ids sort in the order recorded, as do their keys
+	values, err := b.list("audit")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var record core.AuditRecord
+		if err = json.Unmarshal(values[i], &record); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		if record.Time.Before(since) || (resource != "" && record.Resource != resource) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (b BoltDb) DeleteAudit(keep int) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("audit"))
+		// oldest first, deleting while iterating skips keys
+		keys := [][]byte{}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for i := 0; i < len(keys)-keep; i++ {
+			if err := bucket.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete from audit - %s", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// REVISIONS
+////////////////////////////////////////////////////////////////////////////////
+
+func (b BoltDb) AddRevision(rev core.Revision) (int, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		// numbered one after the last
+		rev.Number = 1
+		if k, _ := tx.Bucket([]byte("revisions")).Cursor().Last(); k != nil {
+			last, err := strconv.Atoi(string(k))
+			if err != nil {
+				return fmt.Errorf("Bad revision number stored in db")
+			}
+			rev.Number = last + 1
+		}
+		return boltPut(tx, "revisions", revisionKey(rev.Number), rev)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to write revisions - %s", err)
+	}
+	return rev.Number, nil
+}
+
+func (b BoltDb) GetRevisions() ([]core.Revision, error) {
+	revs := make([]core.Revision, 0, 0)
+	// keys sort in the order numbered
+	values, err := b.list("revisions")
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		var rev core.Revision
+		if err = json.Unmarshal(values[i], &rev); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+func (b BoltDb) GetRevision(number int) (*core.Revision, error) {
+	rev := core.Revision{}
+	found, err := b.get("revisions", revisionKey(number), &rev)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, NoRevisionError
+	}
+	return &rev, nil
+}
+
+func (b BoltDb) GetLastRevision() (*core.Revision, error) {
+	rev := core.Revision{}
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// keys sort in the order numbered
+		k, v := tx.Bucket([]byte("revisions")).Cursor().Last()
+		if k == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(v, &rev); err != nil {
+			return fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, NoRevisionError
+	}
+	return &rev, nil
+}
+
+func (b BoltDb) DeleteRevisions(before int) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revisions"))
+		// deleting while iterating skips keys
+		keys := [][]byte{}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < revisionKey(before); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for i := range keys {
+			if err := bucket.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete from revisions - %s", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// IMPORT
+////////////////////////////////////////////////////////////////////////////////
+
+// ImportScribble copies everything stored in the scribble directory into the
+// bolt database (db-connection), in one transaction. The bolt database must be
+// empty, and not open by a running portal.
+func ImportScribble(dir string) error {
+	u, err := url.Parse(config.DatabaseConnection)
+	if err != nil {
+		return fmt.Errorf("Failed to parse db connection - %s", err)
+	}
+	if u.Scheme != "bolt" {
+		return NotBoltError
+	}
+	// scribble creates a missing directory
+	if _, err = os.Stat(dir); err != nil {
+		return fmt.Errorf("Failed to read scribble directory - %s", err)
+	}
+	driver, err := scribble.New(dir, nil)
+	if err != nil {
+		return err
+	}
+
+	b := &BoltDb{}
+	if err = b.Init(); err != nil {
+		return err
+	}
+	defer b.Close()
+	return b.importFrom(&ScribbleDatabase{scribbleDb: driver, dir: dir})
+}
+
+// importFrom copies everything stored in another database into this (empty)
+// one
+func (b BoltDb) importFrom(from Storable) error {
+	services, err := from.GetServices()
+	if err != nil {
+		return fmt.Errorf("Failed to read services - %s", err)
+	}
+	routes, err := from.GetRoutes()
+	if err != nil {
+		return fmt.Errorf("Failed to read routes - %s", err)
+	}
+	certs, err := from.GetCerts()
+	if err != nil {
+		return fmt.Errorf("Failed to read certs - %s", err)
+	}
+	vips, err := from.GetVips()
+	if err != nil {
+		return fmt.Errorf("Failed to read vips - %s", err)
+	}
+	hooks, err := from.GetWebhooks()
+	if err != nil {
+		return fmt.Errorf("Failed to read webhooks - %s", err)
+	}
+	tokens, err := from.GetTokens()
+	if err != nil {
+		return fmt.Errorf("Failed to read tokens - %s", err)
+	}
+	records, err := from.GetAudit(time.Time{}, "")
+	if err != nil {
+		return fmt.Errorf("Failed to read audit - %s", err)
+	}
+	revs, err := from.GetRevisions()
+	if err != nil {
+		return fmt.Errorf("Failed to read revisions - %s", err)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, kind := range boltKinds {
+			if k, _ := tx.Bucket([]byte(kind)).Cursor().First(); k != nil {
+				return fmt.Errorf("Bolt database already has %s", kind)
+			}
+		}
+		for i := range services {
+			if err := boltPut(tx, "services", services[i].Id, services[i]); err != nil {
+				return err
+			}
+		}
+		for i := range routes {
+			if err := boltPut(tx, "routes", routeKey(routes[i]), routes[i]); err != nil {
+				return err
+			}
+		}
+		for i := range certs {
+			if err := boltPut(tx, "certs", certKey(certs[i]), certs[i]); err != nil {
+				return err
+			}
+		}
+		for i := range vips {
+			if err := boltPut(tx, "vips", vipKey(vips[i]), vips[i]); err != nil {
+				return err
+			}
+		}
+		for i := range hooks {
+			if err := boltPut(tx, "webhooks", hooks[i].Id, hooks[i]); err != nil {
+				return err
+			}
+		}
+		for i := range tokens {
+			if err := boltPut(tx, "tokens", tokens[i].Name, tokens[i]); err != nil {
+				return err
+			}
+		}
+		for i := range records {
+			if err := boltPut(tx, "audit", records[i].Id, records[i]); err != nil {
+				return err
+			}
+		}
+		for i := range revs {
+			if err := boltPut(tx, "revisions", revisionKey(revs[i].Number), revs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE
+////////////////////////////////////////////////////////////////////////////////
+
+// list returns the values stored for the kind, sorted by id
+func (b BoltDb) list(kind string) ([][]byte, error) {
+	values := [][]byte{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kind)).ForEach(func(k, v []byte) error {
+			// v is only valid during the transaction
+			values = append(values, append([]byte{}, v...))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s - %s", kind, err)
+	}
+	return values, nil
+}
+
+// get reads the item into v, returning whether it was found
+func (b BoltDb) get(kind, id string, v interface{}) (bool, error) {
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = boltGet(tx, kind, id, v)
+		return err
+	})
+	return found, err
+}
+
+func (b BoltDb) put(kind, id string, v interface{}) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, kind, id, v)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write %s - %s", kind, err)
+	}
+	return nil
+}
+
+// del deletes the item, returning whether it was there
+func (b BoltDb) del(kind, id string) (bool, error) {
+	var deleted bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		deleted = bucket.Get([]byte(id)) != nil
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete from %s - %s", kind, err)
+	}
+	return deleted, nil
+}
+
+// replace stores the values in place of all of the kind, in one transaction
+func (b BoltDb) replace(kind string, ids []string, values []interface{}) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(kind)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(kind)); err != nil {
+			return err
+		}
+		for i := range ids {
+			if err := boltPut(tx, kind, ids[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to replace %s - %s", kind, err)
+	}
+	return nil
+}
+
+// boltGet reads the item into v, returning whether it was found
+func boltGet(tx *bolt.Tx, kind, id string, v interface{}) (bool, error) {
+	value := tx.Bucket([]byte(kind)).Get([]byte(id))
+	if value == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return false, fmt.Errorf("Bad JSON syntax stored in db")
+	}
+	return true, nil
+}
+
+func boltPut(tx *bolt.Tx, kind, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(kind)).Put([]byte(id), b)
+}
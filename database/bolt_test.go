@@ -0,0 +1,267 @@
+package database_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+func TestServicesBolt(t *testing.T) {
+	boltBackend(t)
+
+	if err := database.SetServices([]core.Service{testService1, testService2}); err != nil {
+		t.Fatalf("Failed to SET services - %s", err)
+	}
+	services, err := database.GetServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Id != testService1.Id || services[1].Id != testService2.Id {
+		t.Errorf("Read services differ from written services - %v", services)
+	}
+
+	// replaces, rather than adds to, the services
+	if err = database.SetServices([]core.Service{testService2}); err != nil {
+		t.Fatalf("Failed to SET services - %s", err)
+	}
+	if _, err = database.GetService(testService1.Id); err != database.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+
+	if err = database.DeleteService(testService2.Id); err != nil {
+		t.Errorf("Failed to DELETE service - %s", err)
+	}
+	// idempotent
+	if err = database.DeleteService(testService2.Id); err != nil {
+		t.Errorf("Failed to DELETE missing service - %s", err)
+	}
+	services, err = database.GetServices()
+	if err != nil || len(services) != 0 {
+		t.Errorf("Failed to DELETE service - %v %s", services, err)
+	}
+}
+
+func TestServersBolt(t *testing.T) {
+	boltBackend(t)
+
+	if err := database.SetServer(testService1.Id, &testServer1); err != database.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+
+	if err := database.SetService(&testService1); err != nil {
+		t.Fatalf("Failed to SET service - %s", err)
+	}
+	if err := database.SetServers(testService1.Id, []core.Server{testServer1}); err != nil {
+		t.Errorf("Failed to SET servers - %s", err)
+	}
+	// updates, rather than duplicates, the server
+	server := testServer1
+	server.Weight = 10
+	if err := database.SetServer(testService1.Id, &server); err != nil {
+		t.Errorf("Failed to SET server - %s", err)
+	}
+	srv, err := database.GetServer(testService1.Id, testServer1.Id)
+	if err != nil || srv.Weight != 10 {
+		t.Errorf("Failed to GET server - %v %s", srv, err)
+	}
+
+	if err = database.DeleteServer(testService1.Id, testServer1.Id); err != nil {
+		t.Errorf("Failed to DELETE server - %s", err)
+	}
+	if _, err = database.GetServer(testService1.Id, testServer1.Id); err != database.NoServerError {
+		t.Errorf("Expected NoServerError, got %v", err)
+	}
+	if err = database.DeleteServer("not-a-service", testServer1.Id); err != nil {
+		t.Errorf("Failed to DELETE server of missing service - %s", err)
+	}
+}
+
+func TestRoutesCertsVipsBolt(t *testing.T) {
+	boltBackend(t)
+
+	route := core.Route{Domain: "portal.test", Path: "/admin", Endpoint: "/health", Attempts: 2}
+	if err := database.SetRoutes([]core.Route{testRoute, route}); err != nil {
+		t.Fatalf("Failed to SET routes - %s", err)
+	}
+	if err := database.DeleteRoute(testRoute); err != nil {
+		t.Errorf("Failed to DELETE route - %s", err)
+	}
+	routes, err := database.GetRoutes()
+	if err != nil || len(routes) != 1 || routes[0].Endpoint != "/health" {
+		t.Errorf("Read routes differ from written routes - %v %s", routes, err)
+	}
+
+	if err = database.SetCert(testCert); err != nil {
+		t.Errorf("Failed to SET cert - %s", err)
+	}
+	// a cert with a different key isn't deleted
+	if err = database.DeleteCert(core.CertBundle{Cert: testCert.Cert, Key: "other"}); err != nil {
+		t.Errorf("Failed to DELETE cert - %s", err)
+	}
+	certs, err := database.GetCerts()
+	if err != nil || len(certs) != 1 {
+		t.Errorf("Read certs differ from written certs - %v %s", certs, err)
+	}
+
+	vip := core.Vip{Ip: "192.168.0.100", Interface: "eth0", Alias: "eth0:1", Preempt: true}
+	if err = database.SetVips([]core.Vip{vip}); err != nil {
+		t.Errorf("Failed to SET vips - %s", err)
+	}
+	vips, err := database.GetVips()
+	if err != nil || len(vips) != 1 || vips[0] != vip {
+		t.Errorf("Read vips differ from written vips - %v %s", vips, err)
+	}
+}
+
+func TestWebhooksTokensBolt(t *testing.T) {
+	boltBackend(t)
+
+	hook := core.Webhook{Url: "https://hooks.portal.test", Secret: "shh"}
+	hook.GenId()
+	if err := database.SetWebhook(hook); err != nil {
+		t.Errorf("Failed to SET webhook - %s", err)
+	}
+	if err := database.DeleteWebhook(hook.Id); err != nil {
+		t.Errorf("Failed to DELETE webhook - %s", err)
+	}
+	if err := database.DeleteWebhook(hook.Id); err != database.NoWebhookError {
+		t.Errorf("Expected NoWebhookError, got %v", err)
+	}
+
+	if err := database.SetToken(core.Token{Name: "ci", Hash: "abc", Scopes: []string{"read-only"}}); err != nil {
+		t.Errorf("Failed to SET token - %s", err)
+	}
+	tokens, err := database.GetTokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Hash != "abc" {
+		t.Errorf("Read tokens differ from written tokens - %v %s", tokens, err)
+	}
+	if err = database.DeleteToken("missing"); err != database.NoTokenError {
+		t.Errorf("Expected NoTokenError, got %v", err)
+	}
+}
+
+func TestRevisionsBolt(t *testing.T) {
+	boltBackend(t)
+
+	manifest := &core.Manifest{Routes: []core.Route{{Domain: "portal.test"}}}
+	if _, err := database.GetLastRevision(); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "set-routes", Manifest: manifest})
+		if err != nil || number != i {
+			t.Fatalf("Failed to ADD revision %d - %d %v", i, number, err)
+		}
+	}
+
+	revs, err := database.GetRevisions()
+	if err != nil || len(revs) != 3 || revs[0].Number != 1 || revs[2].Number != 3 {
+		t.Fatalf("Read revisions differ from written revisions - %v %v", revs, err)
+	}
+	rev, err := database.GetRevision(2)
+	if err != nil || rev.Action != "set-routes" || rev.Manifest == nil || len(rev.Routes) != 1 || rev.Routes[0].Domain != "portal.test" {
+		t.Errorf("Read revision differs from written revision - %v %v", rev, err)
+	}
+	if _, err = database.GetRevision(4); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	if last, err := database.GetLastRevision(); err != nil || last.Number != 3 || last.Action != "set-routes" {
+		t.Errorf("Read last revision differs from written revision - %v %v", last, err)
+	}
+
+	// numbering continues after the oldest are removed
+	if err = database.DeleteRevisions(3); err != nil {
+		t.Errorf("Failed to DELETE revisions - %s", err)
+	}
+	revs, err = database.GetRevisions()
+	if err != nil || len(revs) != 1 || revs[0].Number != 3 {
+		t.Errorf("Failed to DELETE revisions - %v %v", revs, err)
+	}
+	if number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "batch", Manifest: manifest}); err != nil || number != 4 {
+		t.Errorf("Failed to ADD revision - %d %v", number, err)
+	}
+}
+
+func TestImportScribble(t *testing.T) {
+	dir := t.TempDir()
+	config.DatabaseConnection = "scribble://" + dir + "/scribble"
+	if err := database.Init(); err != nil {
+		t.Fatal(err)
+	}
+	service := testService1
+	service.Servers = []core.Server{testServer1}
+	if err := database.SetService(&service); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetRoutes([]core.Route{testRoute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetToken(core.Token{Name: "ci", Hash: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	record := core.AuditRecord{Id: "0001", Time: time.Now().UTC(), Action: "set-route", After: json.RawMessage(`{"domain":"portal.test"}`)}
+	if err := database.AddAudit(record); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		config.DatabaseConnection = "scribble:///tmp/scribbleTest"
+		database.Init()
+	})
+
+	if err := database.ImportScribble(dir + "/scribble"); err != database.NotBoltError {
+		t.Errorf("Expected NotBoltError, got %v", err)
+	}
+
+	config.DatabaseConnection = "bolt://" + dir + "/portal.db"
+	if err := database.ImportScribble(dir + "/missing"); err == nil {
+		t.Errorf("Expected a missing scribble directory to fail")
+	}
+	if err := database.ImportScribble(dir + "/scribble"); err != nil {
+		t.Fatalf("Failed to import - %s", err)
+	}
+	// one-shot
+	if err := database.ImportScribble(dir + "/scribble"); err == nil {
+		t.Errorf("Expected import into a non-empty database to fail")
+	}
+
+	if err := database.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Backend.(*database.BoltDb).Close()
+	svc, err := database.GetService(testService1.Id)
+	if err != nil || len(svc.Servers) != 1 || svc.Servers[0].Id != testServer1.Id {
+		t.Errorf("Failed to import service - %v %s", svc, err)
+	}
+	routes, err := database.GetRoutes()
+	if err != nil || len(routes) != 1 || routes[0].Domain != testRoute.Domain {
+		t.Errorf("Failed to import routes - %v %s", routes, err)
+	}
+	tokens, err := database.GetTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Errorf("Failed to import tokens - %v %s", tokens, err)
+	}
+	audit, err := database.GetAudit(time.Time{}, "")
+	if err != nil || len(audit) != 1 || string(audit[0].After) != `{"domain":"portal.test"}` {
+		t.Errorf("Failed to import audit - %v %s", audit, err)
+	}
+}
+
+// boltBackend points the database at a new bolt file
+func boltBackend(t *testing.T) {
+	config.DatabaseConnection = "bolt://" + t.TempDir() + "/portal.db"
+	if err := database.Init(); err != nil {
+		t.Fatalf("Failed to init bolt database - %s", err)
+	}
+	if database.CentralStore {
+		t.Errorf("Expected bolt not to be a central store")
+	}
+	t.Cleanup(func() {
+		database.Backend.(*database.BoltDb).Close()
+		config.DatabaseConnection = "scribble:///tmp/scribbleTest"
+		database.Init()
+	})
+}
@@ -5,23 +5,48 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
 )
 
 var (
-	CentralStore   bool
-	Backend        Storable
-	NoServiceError = errors.New("No Service Found")
-	NoServerError  = errors.New("No Server Found")
+	CentralStore    bool
+	Backend         Storable
+	NoServiceError  = errors.New("No Service Found")
+	NoServerError   = errors.New("No Server Found")
+	NoWebhookError  = errors.New("No Webhook Found")
+	NoTokenError    = errors.New("No Token Found")
+	NoRevisionError = errors.New("No Revision Found")
 )
 
 type Storable interface {
 	core.Backender
 	core.Proxyable
 	core.Vipable
-}
+	core.Hookable
+	core.Tokenable
+	core.Auditable
+	core.Revisable
+}
+
+type (
+	// Notifier is a central store that tells the members sharing it of changes
+	// made by the others
+	Notifier interface {
+		// Listen calls changed with each change made by another member, until the
+		// database is closed. A change with no resource means changes may have
+		// been missed.
+		Listen(changed func(Change)) error
+	}
+
+	// Change is a change made to a central store
+	Change struct {
+		Resource string `json:"resource"`     // "services", "routes", "certs", or "vips"
+		Id       string `json:"id,omitempty"` // service changed, empty when all of them were
+	}
+)
 
 func Init() error {
 	var err error
@@ -40,6 +65,12 @@ func Init() error {
 	case "postgresql":
 		CentralStore = true
 		Backend = &PostgresDb{}
+	case "etcd":
+		CentralStore = true
+		Backend = &EtcdDb{}
+	case "bolt":
+		CentralStore = false
+		Backend = &BoltDb{}
 	default:
 		CentralStore = false
 		Backend = &ScribbleDatabase{}
@@ -134,3 +165,58 @@ func DeleteVip(vip core.Vip) error {
 func GetVips() ([]core.Vip, error) {
 	return Backend.GetVips()
 }
+
+func GetWebhooks() ([]core.Webhook, error) {
+	return Backend.GetWebhooks()
+}
+
+func SetWebhook(hook core.Webhook) error {
+	return Backend.SetWebhook(hook)
+}
+
+func DeleteWebhook(id string) error {
+	return Backend.DeleteWebhook(id)
+}
+
+func GetTokens() ([]core.Token, error) {
+	return Backend.GetTokens()
+}
+
+func SetToken(token core.Token) error {
+	return Backend.SetToken(token)
+}
+
+func DeleteToken(name string) error {
+	return Backend.DeleteToken(name)
+}
+
+func AddAudit(record core.AuditRecord) error {
+	return Backend.AddAudit(record)
+}
+
+func GetAudit(since time.Time, resource string) ([]core.AuditRecord, error) {
+	return Backend.GetAudit(since, resource)
+}
+func DeleteAudit(keep int) error {
+	return Backend.DeleteAudit(keep)
+}
+
+func AddRevision(rev core.Revision) (int, error) {
+	return Backend.AddRevision(rev)
+}
+
+func GetRevisions() ([]core.Revision, error) {
+	return Backend.GetRevisions()
+}
+
+func GetRevision(number int) (*core.Revision, error) {
+	return Backend.GetRevision(number)
+}
+
+func GetLastRevision() (*core.Revision, error) {
+	return Backend.GetLastRevision()
+}
+
+func DeleteRevisions(before int) error {
+	return Backend.DeleteRevisions(before)
+}
@@ -0,0 +1,362 @@
+//go:build etcd
+// +build etcd
+
+// the etcd tests start an embedded etcd - go test -tags etcd ./database/
+
+package database_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+)
+
+func TestServicesEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	if err := database.SetServices([]core.Service{testService1, testService2}); err != nil {
+		t.Fatalf("Failed to SET services - %s", err)
+	}
+	services, err := database.GetServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Id != testService1.Id || services[1].Id != testService2.Id {
+		t.Errorf("Read services differ from written services - %v", services)
+	}
+
+	// replaces, rather than adds to, the services
+	if err = database.SetServices([]core.Service{testService2}); err != nil {
+		t.Fatalf("Failed to SET services - %s", err)
+	}
+	svc, err := database.GetService(testService2.Id)
+	if err != nil || svc.Host != testService2.Host {
+		t.Errorf("Failed to GET service - %v %s", svc, err)
+	}
+	if _, err = database.GetService(testService1.Id); err != database.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+
+	if err = database.DeleteService(testService2.Id); err != nil {
+		t.Errorf("Failed to DELETE service - %s", err)
+	}
+	// idempotent
+	if err = database.DeleteService(testService2.Id); err != nil {
+		t.Errorf("Failed to DELETE missing service - %s", err)
+	}
+	services, err = database.GetServices()
+	if err != nil || len(services) != 0 {
+		t.Errorf("Failed to DELETE service - %v %s", services, err)
+	}
+}
+
+func TestServersEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	if err := database.SetServer(testService1.Id, &testServer1); err != database.NoServiceError {
+		t.Errorf("Expected NoServiceError, got %v", err)
+	}
+
+	if err := database.SetService(&testService1); err != nil {
+		t.Fatalf("Failed to SET service - %s", err)
+	}
+	if err := database.SetServers(testService1.Id, []core.Server{testServer1}); err != nil {
+		t.Errorf("Failed to SET servers - %s", err)
+	}
+	if err := database.SetServer(testService1.Id, &testServer2); err != nil {
+		t.Errorf("Failed to SET server - %s", err)
+	}
+	// updates, rather than duplicates, the server
+	server := testServer2
+	server.Weight = 10
+	if err := database.SetServer(testService1.Id, &server); err != nil {
+		t.Errorf("Failed to SET server - %s", err)
+	}
+
+	svc, err := database.GetService(testService1.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.Servers) != 2 || svc.Servers[1].Weight != 10 {
+		t.Errorf("Read servers differ from written servers - %v", svc.Servers)
+	}
+	srv, err := database.GetServer(testService1.Id, testServer2.Id)
+	if err != nil || srv.Weight != 10 {
+		t.Errorf("Failed to GET server - %v %s", srv, err)
+	}
+
+	if err = database.DeleteServer(testService1.Id, testServer1.Id); err != nil {
+		t.Errorf("Failed to DELETE server - %s", err)
+	}
+	if _, err = database.GetServer(testService1.Id, testServer1.Id); err != database.NoServerError {
+		t.Errorf("Expected NoServerError, got %v", err)
+	}
+	if err = database.DeleteServer("not-a-service", testServer1.Id); err != nil {
+		t.Errorf("Failed to DELETE server of missing service - %s", err)
+	}
+}
+
+func TestRoutesEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	route := core.Route{SubDomain: "admin", Domain: "portal.test", Path: "/admin", Targets: []string{"http://127.0.0.1:8080"}}
+	if err := database.SetRoutes([]core.Route{testRoute, route}); err != nil {
+		t.Fatalf("Failed to SET routes - %s", err)
+	}
+	// updates, rather than duplicates, the route
+	route.Targets = []string{"http://127.0.0.1:8081"}
+	if err := database.SetRoute(route); err != nil {
+		t.Errorf("Failed to SET route - %s", err)
+	}
+
+	routes, err := database.GetRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[1].Targets[0] != "http://127.0.0.1:8081" {
+		t.Errorf("Read routes differ from written routes - %v", routes)
+	}
+
+	if err = database.DeleteRoute(testRoute); err != nil {
+		t.Errorf("Failed to DELETE route - %s", err)
+	}
+	routes, err = database.GetRoutes()
+	if err != nil || len(routes) != 1 || routes[0].SubDomain != "admin" {
+		t.Errorf("Failed to DELETE route - %v %s", routes, err)
+	}
+}
+
+func TestCertsEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	if err := database.SetCerts([]core.CertBundle{testCert}); err != nil {
+		t.Fatalf("Failed to SET certs - %s", err)
+	}
+	// same cert with a new key replaces it
+	if err := database.SetCert(core.CertBundle{Cert: cert, Key: "new-key"}); err != nil {
+		t.Errorf("Failed to SET cert - %s", err)
+	}
+	certs, err := database.GetCerts()
+	if err != nil || len(certs) != 1 || certs[0].Key != "new-key" {
+		t.Errorf("Read certs differ from written certs - %v %s", certs, err)
+	}
+
+	// only with the key it has
+	if err = database.DeleteCert(testCert); err != nil {
+		t.Errorf("Failed to DELETE cert - %s", err)
+	}
+	if certs, _ = database.GetCerts(); len(certs) != 1 {
+		t.Errorf("Deleted cert with a different key")
+	}
+	if err = database.DeleteCert(core.CertBundle{Cert: cert, Key: "new-key"}); err != nil {
+		t.Errorf("Failed to DELETE cert - %s", err)
+	}
+	if certs, _ = database.GetCerts(); len(certs) != 0 {
+		t.Errorf("Failed to DELETE cert - %v", certs)
+	}
+}
+
+func TestVipsEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	vip := core.Vip{Ip: "192.168.0.100/24", Interface: "eth0", Alias: "eth0:0"}
+	if err := database.SetVip(vip); err != nil {
+		t.Errorf("Failed to SET vip - %s", err)
+	}
+	if err := database.SetVip(vip); err != nil {
+		t.Errorf("Failed to SET vip - %s", err)
+	}
+	vips, err := database.GetVips()
+	if err != nil || len(vips) != 1 || vips[0] != vip {
+		t.Errorf("Read vips differ from written vips - %v %s", vips, err)
+	}
+
+	if err = database.DeleteVip(vip); err != nil {
+		t.Errorf("Failed to DELETE vip - %s", err)
+	}
+	if vips, _ = database.GetVips(); len(vips) != 0 {
+		t.Errorf("Failed to DELETE vip - %v", vips)
+	}
+}
+
+func TestWebhooksEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	hook := core.Webhook{Id: "hook1", Url: "https://hooks.portal.test", Secret: "secret", Events: []string{"set-route"}}
+	if err := database.SetWebhook(hook); err != nil {
+		t.Errorf("Failed to SET webhook - %s", err)
+	}
+	hooks, err := database.GetWebhooks()
+	if err != nil || len(hooks) != 1 || hooks[0].Url != hook.Url || hooks[0].Events[0] != "set-route" {
+		t.Errorf("Read webhooks differ from written webhooks - %v %s", hooks, err)
+	}
+
+	if err = database.DeleteWebhook(hook.Id); err != nil {
+		t.Errorf("Failed to DELETE webhook - %s", err)
+	}
+	if err = database.DeleteWebhook(hook.Id); err != database.NoWebhookError {
+		t.Errorf("Expected NoWebhookError, got %v", err)
+	}
+}
+
+func TestTokensEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	token := core.Token{Name: "deploy", Hash: "abc123", Scopes: []string{"routes-only"}}
+	if err := database.SetToken(token); err != nil {
+		t.Errorf("Failed to SET token - %s", err)
+	}
+	tokens, err := database.GetTokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Hash != token.Hash || tokens[0].Scopes[0] != "routes-only" {
+		t.Errorf("Read tokens differ from written tokens - %v %s", tokens, err)
+	}
+
+	if err = database.DeleteToken(token.Name); err != nil {
+		t.Errorf("Failed to DELETE token - %s", err)
+	}
+	if err = database.DeleteToken(token.Name); err != database.NoTokenError {
+		t.Errorf("Expected NoTokenError, got %v", err)
+	}
+}
+
+func TestAuditEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	then := time.Now().UTC().Add(-time.Hour)
+	records := []core.AuditRecord{
+		{Id: "0001", Time: then, Action: "set-route", Resource: "route", After: json.RawMessage(`{"domain":"portal.test"}`)},
+		{Id: "0002", Time: then.Add(time.Minute), Action: "delete-vip", Resource: "vip"},
+		{Id: "0003", Time: then.Add(2 * time.Minute), Action: "delete-route", Resource: "route"},
+	}
+	for i := range records {
+		if err := database.AddAudit(records[i]); err != nil {
+			t.Errorf("Failed to ADD audit record - %s", err)
+		}
+	}
+
+	audit, err := database.GetAudit(time.Time{}, "")
+	if err != nil || len(audit) != 3 || audit[0].Id != "0001" || string(audit[0].After) != `{"domain":"portal.test"}` {
+		t.Fatalf("Read audit differs from written audit - %v %s", audit, err)
+	}
+	audit, err = database.GetAudit(then.Add(30*time.Second), "route")
+	if err != nil || len(audit) != 1 || audit[0].Id != "0003" {
+		t.Errorf("Failed to filter audit - %v %s", audit, err)
+	}
+
+	if err = database.DeleteAudit(2); err != nil {
+		t.Errorf("Failed to DELETE audit records - %s", err)
+	}
+	audit, _ = database.GetAudit(time.Time{}, "")
+	if len(audit) != 2 || audit[0].Id != "0002" {
+		t.Errorf("Failed to trim audit - %v", audit)
+	}
+}
+
+func TestRevisionsEtcd(t *testing.T) {
+	etcdBackend(t)
+
+	manifest := &core.Manifest{Routes: []core.Route{{Domain: "portal.test"}}}
+	if _, err := database.GetLastRevision(); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "set-routes", Manifest: manifest})
+		if err != nil || number != i {
+			t.Fatalf("Failed to ADD revision %d - %d %v", i, number, err)
+		}
+	}
+
+	revs, err := database.GetRevisions()
+	if err != nil || len(revs) != 3 || revs[0].Number != 1 || revs[2].Number != 3 {
+		t.Fatalf("Read revisions differ from written revisions - %v %v", revs, err)
+	}
+	rev, err := database.GetRevision(2)
+	if err != nil || rev.Action != "set-routes" || rev.Manifest == nil || len(rev.Routes) != 1 || rev.Routes[0].Domain != "portal.test" {
+		t.Errorf("Read revision differs from written revision - %v %v", rev, err)
+	}
+	if _, err = database.GetRevision(4); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	if last, err := database.GetLastRevision(); err != nil || last.Number != 3 || last.Action != "set-routes" {
+		t.Errorf("Read last revision differs from written revision - %v %v", last, err)
+	}
+
+	// numbering continues after the oldest are removed
+	if err = database.DeleteRevisions(3); err != nil {
+		t.Errorf("Failed to DELETE revisions - %s", err)
+	}
+	revs, err = database.GetRevisions()
+	if err != nil || len(revs) != 1 || revs[0].Number != 3 {
+		t.Errorf("Failed to DELETE revisions - %v %v", revs, err)
+	}
+	if number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "batch", Manifest: manifest}); err != nil || number != 4 {
+		t.Errorf("Failed to ADD revision - %d %v", number, err)
+	}
+}
+
+// etcdBackend points the database at a new embedded etcd
+func etcdBackend(t *testing.T) {
+	config.DatabaseConnection = fmt.Sprintf("etcd://%s/portalTest", newEtcd(t))
+	if err := database.Init(); err != nil {
+		t.Fatalf("Failed to init etcd database - %s", err)
+	}
+	if !database.CentralStore {
+		t.Errorf("Expected etcd to be a central store")
+	}
+	t.Cleanup(func() {
+		config.DatabaseConnection = "scribble:///tmp/scribbleTest"
+		database.Init()
+	})
+}
+
+// newEtcd starts an embedded etcd for the test, returning its client address
+func newEtcd(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "etcdTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	client, peer := freeUrl(t), freeUrl(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start etcd - %s", err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		os.RemoveAll(dir)
+	})
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Etcd took too long to start")
+	}
+	return client.Host
+}
+
+func freeUrl(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
@@ -0,0 +1,305 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nanopack/portal/config"
+)
+
+var (
+	NotMigratedError = errors.New("Only postgres databases have migrations")
+
+	// pgMigrations update the postgres schema, in order. Each must be idempotent,
+	// databases created before schema_version existed already have some of them.
+	pgMigrations = []pgMigration{
+		{1, "create tables", `
+CREATE TABLE IF NOT EXISTS services (
+	serviceId      SERIAL PRIMARY KEY NOT NULL,
+	id             TEXT NOT NULL UNIQUE,
+	host           TEXT NOT NULL,
+	interface      TEXT,
+	port           INTEGER NOT NULL,
+	type           TEXT,
+	scheduler      TEXT,
+	persistence    INTEGER,
+	netmask        TEXT
+);
+
+CREATE TABLE IF NOT EXISTS servers (
+	serverId       SERIAL PRIMARY KEY NOT NULL,
+	serviceId      TEXT REFERENCES services (id) ON DELETE CASCADE,
+	id             TEXT NOT NULL UNIQUE,
+	host           TEXT NOT NULL,
+	port           INTEGER NOT NULL,
+	forwarder      TEXT,
+	weight         TEXT,
+	upperThreshold TEXT,
+	lowerThreshold TEXT
+);
+
+CREATE TABLE IF NOT EXISTS routes (
+	routeId   SERIAL PRIMARY KEY NOT NULL,
+	subdomain TEXT,
+	domain    TEXT,
+	path      TEXT,
+	targets   TEXT,
+	fwdPath   TEXT,
+	page      TEXT
+);
+
+CREATE TABLE IF NOT EXISTS certs (
+	certId SERIAL PRIMARY KEY NOT NULL,
+	cert   TEXT NOT NULL,
+	key    TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS vips (
+	vipId     SERIAL PRIMARY KEY NOT NULL,
+	ip        TEXT,
+	interface TEXT,
+	alias     TEXT
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	webhookId SERIAL PRIMARY KEY NOT NULL,
+	id        TEXT NOT NULL UNIQUE,
+	url       TEXT NOT NULL,
+	secret    TEXT,
+	events    TEXT
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	tokenId SERIAL PRIMARY KEY NOT NULL,
+	name    TEXT NOT NULL UNIQUE,
+	hash    TEXT NOT NULL,
+	scopes  TEXT
+);
+
+CREATE TABLE IF NOT EXISTS audit (
+	auditId    SERIAL PRIMARY KEY NOT NULL,
+	id         TEXT NOT NULL UNIQUE,
+	time       TIMESTAMP WITH TIME ZONE NOT NULL,
+	remoteAddr TEXT,
+	identity   TEXT,
+	request    TEXT,
+	action     TEXT,
+	resource   TEXT,
+	before     TEXT,
+	after      TEXT
+)`},
+		{2, "add route health checks", `
+ALTER TABLE routes
+	ADD COLUMN IF NOT EXISTS endpoint       TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS expectedCode   INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS expectedBody   TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS expectedHeader TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS host           TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS timeout        INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS attempts       INTEGER NOT NULL DEFAULT 0`},
+		{3, "store server weights and thresholds as integers", `
+ALTER TABLE servers
+	ALTER COLUMN weight         TYPE INTEGER USING COALESCE(NULLIF(weight::TEXT, ''), '0')::INTEGER,
+	ALTER COLUMN upperThreshold TYPE INTEGER USING COALESCE(NULLIF(upperThreshold::TEXT, ''), '0')::INTEGER,
+	ALTER COLUMN lowerThreshold TYPE INTEGER USING COALESCE(NULLIF(lowerThreshold::TEXT, ''), '0')::INTEGER`},
+		{4, "add server health checks and draining", `
+ALTER TABLE servers
+	ADD COLUMN IF NOT EXISTS "check"      TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS endpoint     TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS expectedCode INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS timeout      INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS attempts     INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS recover      INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS draining     BOOLEAN NOT NULL DEFAULT false`},
+		{5, "add vip ownership", `
+ALTER TABLE vips
+	ADD COLUMN IF NOT EXISTS preempt BOOLEAN NOT NULL DEFAULT false`},
+		{6, "add config revisions", `
+CREATE TABLE IF NOT EXISTS revisions (
+	number   SERIAL PRIMARY KEY NOT NULL,
+	time     TIMESTAMP WITH TIME ZONE NOT NULL,
+	action   TEXT,
+	manifest TEXT NOT NULL
+)`},
+		// values were html escaped when written by portal as it was before
+		// parameterized queries (the servers referencing a service are updated in
+		// the same statement). Not idempotent, but every database created before
+		// it has escaped values.
+		{7, "unescape values stored html escaped", fmt.Sprintf(`
+WITH unescaped AS (
+	UPDATE services SET id = %s, host = %s, interface = %s, type = %s, scheduler = %s, netmask = %s RETURNING id
+)
+UPDATE servers SET serviceId = %s, id = %s, host = %s, forwarder = %s;
+UPDATE routes SET subdomain = %s, domain = %s, path = %s, targets = %s, fwdPath = %s, page = %s;
+UPDATE certs SET cert = %s, key = %s;
+UPDATE vips SET ip = %s, interface = %s, alias = %s`,
+			pgUnescape("id"), pgUnescape("host"), pgUnescape("interface"), pgUnescape("type"), pgUnescape("scheduler"), pgUnescape("netmask"),
+			pgUnescape("serviceId"), pgUnescape("id"), pgUnescape("host"), pgUnescape("forwarder"),
+			pgUnescape("subdomain"), pgUnescape("domain"), pgUnescape("path"), pgUnescape("targets"), pgUnescape("fwdPath"), pgUnescape("page"),
+			pgUnescape("cert"), pgUnescape("key"),
+			pgUnescape("ip"), pgUnescape("interface"), pgUnescape("alias"))},
+	}
+)
+
+// pgMigrationLock is the advisory lock held while migrating, so members
+// starting together migrate one at a time
+const pgMigrationLock = 0x706f7274616c // "portal"
+
+type (
+	// Migration is a change to the database's schema
+	Migration struct {
+		Version int        `json:"version"`
+		Name    string     `json:"name"`
+		Applied *time.Time `json:"applied,omitempty"` // when it was applied (nil while pending)
+	}
+
+	pgMigration struct {
+		version int
+		name    string
+		sql     string
+	}
+)
+
+// pgUnescape is the sql undoing template.HTMLEscapeString on a column (its
+// "&amp;" last, so what it escaped stays as it was)
+func pgUnescape(column string) string {
+	return fmt.Sprintf(`replace(replace(replace(replace(replace(%s, '&#34;', '"'), '&#39;', ''''), '&lt;', '<'), '&gt;', '>'), '&amp;', '&')`, column)
+}
+
+// Migrate applies the pending migrations to the database, returning them
+func Migrate() ([]Migration, error) {
+	p, err := openMigrated()
+	if err != nil {
+		return nil, err
+	}
+	defer p.pg.Close()
+	return p.migrate()
+}
+
+// Migrations returns every migration, and when it was applied to the database
+func Migrations() ([]Migration, error) {
+	p, err := openMigrated()
+	if err != nil {
+		return nil, err
+	}
+	defer p.pg.Close()
+	return p.migrations()
+}
+
+// openMigrated connects to the database, without migrating it
+func openMigrated() (*PostgresDb, error) {
+	u, err := url.Parse(config.DatabaseConnection)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse db connection - %s", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, NotMigratedError
+	}
+	p := &PostgresDb{}
+	return p, p.connect()
+}
+
+// migrate applies the pending migrations, in order
+func (p PostgresDb) migrate() ([]Migration, error) {
+	_, err := p.pg.Exec(`
+CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY NOT NULL,
+	name    TEXT NOT NULL,
+	applied TIMESTAMP WITH TIME ZONE NOT NULL
+)`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create schema_version table - %s", err)
+	}
+
+	applied := []Migration{}
+	for _, m := range pgMigrations {
+		migration, err := p.applyMigration(m)
+		if err != nil {
+			return applied, err
+		}
+		if migration != nil {
+			applied = append(applied, *migration)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration applies the migration, unless it already has been (returning
+// nil)
+func (p PostgresDb) applyMigration(m pgMigration) (*Migration, error) {
+	tx, err := p.pg.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", pgMigrationLock)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock schema_version - %s", err)
+	}
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM schema_version WHERE version = $1", m.version).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select from schema_version table - %s", err)
+	}
+	if count != 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(m.sql)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to apply migration %d (%s) - %s", m.version, m.name, err)
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO schema_version(version, name, applied) VALUES($1, $2, $3)", m.version, m.name, now)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to insert into schema_version table - %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit migration %d (%s) - %s", m.version, m.name, err)
+	}
+	return &Migration{Version: m.version, Name: m.name, Applied: &now}, nil
+}
+
+// migrations returns every migration, with when it was applied
+func (p PostgresDb) migrations() ([]Migration, error) {
+	migrations := make([]Migration, 0, len(pgMigrations))
+	for _, m := range pgMigrations {
+		migrations = append(migrations, Migration{Version: m.version, Name: m.name})
+	}
+
+	var exists bool
+	err := p.pg.QueryRow("SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check for schema_version table - %s", err)
+	}
+	if !exists {
+		// never migrated
+		return migrations, nil
+	}
+
+	rows, err := p.pg.Query("SELECT version, applied FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select from schema_version table - %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var applied time.Time
+		if err = rows.Scan(&version, &applied); err != nil {
+			return nil, fmt.Errorf("Failed to save results into migration - %s", err)
+		}
+		for i := range migrations {
+			if migrations[i].Version == version {
+				migrations[i].Applied = &applied
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error with results - %s", err)
+	}
+	return migrations, nil
+}
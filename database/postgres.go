@@ -2,12 +2,13 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"html/template"
-	"strconv"
+	"os"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/nanopack/portal/config"
 	"github.com/nanopack/portal/core"
@@ -15,10 +16,27 @@ import (
 
 type (
 	PostgresDb struct {
-		pg *sql.DB
+		pg     *sql.DB
+		origin string  // identifies my changes to the members sharing the database
+		tx     *sql.Tx // the change being made, set on the copy making it
+	}
+
+	// pgQuerier is the database, or a transaction in it
+	pgQuerier interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+		Query(query string, args ...interface{}) (*sql.Rows, error)
+	}
+
+	// pgChange is a change, as notified on pgChannel
+	pgChange struct {
+		Change
+		Origin string `json:"origin"`
 	}
 )
 
+// pgChannel is the channel changes are notified on
+const pgChannel = "portal"
+
 // todo: prepare statements
 
 func (p *PostgresDb) connect() error {
@@ -33,82 +51,8 @@ func (p *PostgresDb) connect() error {
 	}
 
 	p.pg = db
-	return nil
-}
-
-func (p PostgresDb) createTables() error {
-	// create services table
-	_, err := p.pg.Exec(`
-CREATE TABLE IF NOT EXISTS services (
-	serviceId      SERIAL PRIMARY KEY NOT NULL,
-	id             TEXT NOT NULL UNIQUE,
-	host           TEXT NOT NULL,
-	interface      TEXT,
-	port           INTEGER NOT NULL,
-	type           TEXT,
-	scheduler      TEXT,
-	persistence    INTEGER,
-	netmask        TEXT
-)`)
-	if err != nil {
-		return fmt.Errorf("Failed to create services table - %s", err)
-	}
-
-	// create servers table
-	_, err = p.pg.Exec(`
-CREATE TABLE IF NOT EXISTS servers (
-	serverId       SERIAL PRIMARY KEY NOT NULL,
-	serviceId      TEXT REFERENCES services (id) ON DELETE CASCADE,
-	id             TEXT NOT NULL UNIQUE,
-	host           TEXT NOT NULL,
-	port           INTEGER NOT NULL,
-	forwarder      TEXT,
-	weight         TEXT,
-	upperThreshold TEXT,
-	lowerThreshold TEXT
-)`)
-	if err != nil {
-		return fmt.Errorf("Failed to create servers table - %s", err)
-	}
-
-	// create routes table
-	_, err = p.pg.Exec(`
-CREATE TABLE IF NOT EXISTS routes (
-	routeId   SERIAL PRIMARY KEY NOT NULL,
-	subdomain TEXT,
-	domain    TEXT,
-	path      TEXT,
-	targets   TEXT,
-	fwdPath   TEXT,
-	page      TEXT
-)`)
-	if err != nil {
-		return fmt.Errorf("Failed to create routes table - %s", err)
-	}
-
-	// create certs table
-	_, err = p.pg.Exec(`
-CREATE TABLE IF NOT EXISTS certs (
-	certId SERIAL PRIMARY KEY NOT NULL,
-	cert   TEXT NOT NULL,
-	key    TEXT NOT NULL
-)`)
-	if err != nil {
-		return fmt.Errorf("Failed to create cert table - %s", err)
-	}
-
-	// create vips table
-	_, err = p.pg.Exec(`
-CREATE TABLE IF NOT EXISTS vips (
-	vipId     SERIAL PRIMARY KEY NOT NULL,
-	ip        TEXT,
-	interface TEXT,
-	alias     TEXT
-)`)
-	if err != nil {
-		return fmt.Errorf("Failed to create vips table - %s", err)
-	}
-
+	hostname, _ := os.Hostname()
+	p.origin = fmt.Sprintf("%s-%d", hostname, time.Now().UnixNano())
 	return nil
 }
 
@@ -118,10 +62,10 @@ func (p *PostgresDb) Init() error {
 		return fmt.Errorf("Failed to create new connection - %s", err)
 	}
 
-	// create tables
-	err = p.createTables()
+	// create or update tables
+	_, err = p.migrate()
 	if err != nil {
-		return fmt.Errorf("Failed to create tables - %s", err)
+		return fmt.Errorf("Failed to migrate tables - %s", err)
 	}
 
 	return nil
@@ -129,7 +73,7 @@ func (p *PostgresDb) Init() error {
 
 func (p PostgresDb) GetServices() ([]core.Service, error) {
 	// read from services table
-	rows, err := p.pg.Query("SELECT id, host, interface, port, type, scheduler, persistence, netmask FROM services")
+	rows, err := p.db().Query("SELECT id, host, interface, port, type, scheduler, persistence, netmask FROM services")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from services table - %s", err)
 	}
@@ -145,13 +89,6 @@ func (p PostgresDb) GetServices() ([]core.Service, error) {
 			return nil, fmt.Errorf("Failed to save results into service - %s", err)
 		}
 
-		// get service's servers
-		servers, err := p.GetServers(svc.Id)
-		if err != nil {
-			return nil, err
-		}
-		svc.Servers = servers
-
 		services = append(services, svc)
 	}
 
@@ -159,12 +96,22 @@ func (p PostgresDb) GetServices() ([]core.Service, error) {
 	if err = rows.Err(); err != nil {
 		return services, fmt.Errorf("Error with results - %s", err)
 	}
+	// the rows are read before querying again, a transaction can't do both
+	rows.Close()
+
+	// get services' servers
+	for i := range services {
+		services[i].Servers, err = p.GetServers(services[i].Id)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return services, nil
 }
 
 func (p PostgresDb) GetService(id string) (*core.Service, error) {
 	// read from services table
-	rows, err := p.pg.Query(fmt.Sprintf("SELECT id, host, interface, port, type, scheduler, persistence, netmask FROM services WHERE id = '%s'", template.HTMLEscapeString(id)))
+	rows, err := p.db().Query("SELECT id, host, interface, port, type, scheduler, persistence, netmask FROM services WHERE id = $1", id)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from services table - %s", err)
 	}
@@ -180,13 +127,6 @@ func (p PostgresDb) GetService(id string) (*core.Service, error) {
 			return nil, fmt.Errorf("Failed to save results into service - %s", err)
 		}
 
-		// get service's servers
-		servers, err := p.GetServers(svc.Id)
-		if err != nil {
-			return nil, err
-		}
-		svc.Servers = servers
-
 		services = append(services, svc)
 	}
 
@@ -198,147 +138,155 @@ func (p PostgresDb) GetService(id string) (*core.Service, error) {
 	if len(services) == 0 {
 		return nil, NoServiceError
 	}
+	rows.Close()
 
+	// get service's servers
+	services[0].Servers, err = p.GetServers(services[0].Id)
+	if err != nil {
+		return nil, err
+	}
 	return &services[0], nil
 }
 
 func (p PostgresDb) SetServices(services []core.Service) error {
-	// truncate services table
-	_, err := p.pg.Exec("TRUNCATE services CASCADE")
-	if err != nil {
-		return fmt.Errorf("Failed to truncate services table - %s", err)
-	}
-	for i := range services {
-		err = p.SetService(&services[i]) // prevents duplicates
+	return p.change("services", "", func(p PostgresDb) error {
+		// truncate services table
+		_, err := p.db().Exec("TRUNCATE services CASCADE")
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to truncate services table - %s", err)
 		}
-	}
-	return nil
+		for i := range services {
+			err = p.SetService(&services[i]) // prevents duplicates
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // todo: not pointer
 func (p PostgresDb) SetService(service *core.Service) error {
-	services, err := p.GetServices()
-	if err != nil {
-		return err
-	}
-	// for idempotency
-	for i := range services {
-		// update services table
-		if services[i].Id == service.Id {
-			_, err = p.pg.Exec(fmt.Sprintf(`
-UPDATE services SET host = '%s', interface = '%s', port = '%s', type = '%s', scheduler = '%s', persistence = '%s', netmask = '%s'
-WHERE id = '%s'`,
-				template.HTMLEscapeString(service.Host), template.HTMLEscapeString(service.Interface), template.HTMLEscapeString(strconv.Itoa(service.Port)),
-				template.HTMLEscapeString(service.Type), template.HTMLEscapeString(service.Scheduler), template.HTMLEscapeString(strconv.Itoa(service.Persistence)),
-				template.HTMLEscapeString(service.Netmask), template.HTMLEscapeString(service.Id)))
-			if err != nil {
-				return fmt.Errorf("Failed to update services table - %s", err)
-			}
-
-			// reset servers
-			err = p.SetServers(service.Id, service.Servers)
-			if err != nil {
-				return err
+	return p.change("services", service.Id, func(p PostgresDb) error {
+		services, err := p.GetServices()
+		if err != nil {
+			return err
+		}
+		// for idempotency
+		for i := range services {
+			// update services table
+			if services[i].Id == service.Id {
+				_, err = p.db().Exec(`
+UPDATE services SET host = $1, interface = $2, port = $3, type = $4, scheduler = $5, persistence = $6, netmask = $7
+WHERE id = $8`,
+					service.Host, service.Interface, service.Port, service.Type, service.Scheduler, service.Persistence,
+					service.Netmask, service.Id)
+				if err != nil {
+					return fmt.Errorf("Failed to update services table - %s", err)
+				}
+
+				// reset servers
+				return p.SetServers(service.Id, service.Servers)
 			}
-
-			return nil
 		}
-	}
 
-	// insert into services table
-	_, err = p.pg.Exec(fmt.Sprintf(`
+		// insert into services table
+		_, err = p.db().Exec(`
 INSERT INTO services(id, host, interface, port, type, scheduler, persistence, netmask)
-VALUES('%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s')`,
-		template.HTMLEscapeString(service.Id), template.HTMLEscapeString(service.Host), template.HTMLEscapeString(service.Interface), template.HTMLEscapeString(strconv.Itoa(service.Port)),
-		template.HTMLEscapeString(service.Type), template.HTMLEscapeString(service.Scheduler), template.HTMLEscapeString(strconv.Itoa(service.Persistence)), template.HTMLEscapeString(service.Netmask)))
-	if err != nil {
-		return fmt.Errorf("Failed to insert into services table - %s", err)
-	}
-
-	// reset servers
-	err = p.SetServers(service.Id, service.Servers)
-	if err != nil {
-		return err
-	}
+VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+			service.Id, service.Host, service.Interface, service.Port, service.Type, service.Scheduler, service.Persistence, service.Netmask)
+		if err != nil {
+			return fmt.Errorf("Failed to insert into services table - %s", err)
+		}
 
-	return nil
+		// reset servers
+		return p.SetServers(service.Id, service.Servers)
+	})
 }
 
 func (p PostgresDb) DeleteService(id string) error {
-	// delete from services table
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM services WHERE id = '%s'`, template.HTMLEscapeString(id)))
-	if err != nil {
-		return fmt.Errorf("Failed to delete from services table - %s", err)
-	}
-	return nil
+	return p.change("services", id, func(p PostgresDb) error {
+		// delete from services table
+		_, err := p.db().Exec(`DELETE FROM services WHERE id = $1`, id)
+		if err != nil {
+			return fmt.Errorf("Failed to delete from services table - %s", err)
+		}
+		return nil
+	})
 }
 
 // SetServers resets all servers for the service
 func (p PostgresDb) SetServers(svcId string, servers []core.Server) error {
-	// delete servers from service
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM servers WHERE serviceId = '%s'`, template.HTMLEscapeString(svcId)))
-	if err != nil {
-		return fmt.Errorf("Failed to remove old servers - %s", err)
-	}
-
-	for i := range servers {
-		err = p.SetServer(svcId, &servers[i])
+	return p.change("services", svcId, func(p PostgresDb) error {
+		// delete servers from service
+		_, err := p.db().Exec(`DELETE FROM servers WHERE serviceId = $1`, svcId)
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to remove old servers - %s", err)
 		}
-	}
-	return nil
+
+		for i := range servers {
+			err = p.SetServer(svcId, &servers[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) SetServer(svcId string, server *core.Server) error {
-	service, err := p.GetService(svcId)
-	if err != nil {
-		return err
-	}
+	return p.change("services", svcId, func(p PostgresDb) error {
+		service, err := p.GetService(svcId)
+		if err != nil {
+			return err
+		}
 
-	// for idempotency
-	for i := range service.Servers {
-		// update servers table
-		if service.Servers[i].Id == server.Id {
-			_, err = p.pg.Exec(fmt.Sprintf(`
-UPDATE servers SET host = '%s', port = '%s', forwarder = '%s',
-weight = '%s', upperThreshold = '%s', lowerThreshold = '%s'
-WHERE id = '%s' AND serviceId = '%s'`,
-				template.HTMLEscapeString(server.Host), template.HTMLEscapeString(strconv.Itoa(server.Port)), template.HTMLEscapeString(server.Forwarder), template.HTMLEscapeString(strconv.Itoa(server.Weight)),
-				template.HTMLEscapeString(strconv.Itoa(server.UpperThreshold)), template.HTMLEscapeString(strconv.Itoa(server.LowerThreshold)), template.HTMLEscapeString(server.Id), template.HTMLEscapeString(svcId)))
-			if err != nil {
-				return fmt.Errorf("Failed to update servers table - %s", err)
+		// for idempotency
+		for i := range service.Servers {
+			// update servers table
+			if service.Servers[i].Id == server.Id {
+				_, err = p.db().Exec(`
+UPDATE servers SET host = $1, port = $2, forwarder = $3, weight = $4, upperThreshold = $5, lowerThreshold = $6,
+"check" = $7, endpoint = $8, expectedCode = $9, timeout = $10, attempts = $11, recover = $12, draining = $13
+WHERE id = $14 AND serviceId = $15`,
+					server.Host, server.Port, server.Forwarder, server.Weight, server.UpperThreshold, server.LowerThreshold,
+					server.Check, server.Endpoint, server.ExpectedCode, server.Timeout, server.Attempts, server.Recover, server.Draining,
+					server.Id, svcId)
+				if err != nil {
+					return fmt.Errorf("Failed to update servers table - %s", err)
+				}
+				return nil
 			}
-			return nil
 		}
-	}
 
-	// insert into servers table
-	_, err = p.pg.Exec(fmt.Sprintf(`
-INSERT INTO servers(serviceId, id, host, port, forwarder, weight, upperThreshold, lowerThreshold)
-VALUES('%s', '%s', '%s', '%s', '%s', '%s', '%s', '%s')`,
-		template.HTMLEscapeString(svcId), template.HTMLEscapeString(server.Id), template.HTMLEscapeString(server.Host), template.HTMLEscapeString(strconv.Itoa(server.Port)), template.HTMLEscapeString(server.Forwarder),
-		template.HTMLEscapeString(strconv.Itoa(server.Weight)), template.HTMLEscapeString(strconv.Itoa(server.UpperThreshold)), template.HTMLEscapeString(strconv.Itoa(server.LowerThreshold))))
-	if err != nil {
-		return fmt.Errorf("Failed to insert into servers table - %s", err)
-	}
-	return nil
+		// insert into servers table
+		_, err = p.db().Exec(`
+INSERT INTO servers(serviceId, id, host, port, forwarder, weight, upperThreshold, lowerThreshold,
+"check", endpoint, expectedCode, timeout, attempts, recover, draining)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+			svcId, server.Id, server.Host, server.Port, server.Forwarder, server.Weight, server.UpperThreshold, server.LowerThreshold,
+			server.Check, server.Endpoint, server.ExpectedCode, server.Timeout, server.Attempts, server.Recover, server.Draining)
+		if err != nil {
+			return fmt.Errorf("Failed to insert into servers table - %s", err)
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) DeleteServer(svcId, srvId string) error {
-	// delete from servers table
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM servers WHERE id = '%s' AND serviceId = '%s'`, template.HTMLEscapeString(srvId), template.HTMLEscapeString(svcId)))
-	if err != nil {
-		return fmt.Errorf("Failed to delete from servers table - %s", err)
-	}
-	return nil
+	return p.change("services", svcId, func(p PostgresDb) error {
+		// delete from servers table
+		_, err := p.db().Exec(`DELETE FROM servers WHERE id = $1 AND serviceId = $2`, srvId, svcId)
+		if err != nil {
+			return fmt.Errorf("Failed to delete from servers table - %s", err)
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) GetServer(svcId, srvId string) (*core.Server, error) {
 	// read from servers table
-	rows, err := p.pg.Query(fmt.Sprintf("SELECT id, host, port, forwarder, weight, upperThreshold, lowerThreshold FROM servers WHERE id = '%s' AND serviceId = '%s'", template.HTMLEscapeString(srvId), template.HTMLEscapeString(svcId)))
+	rows, err := p.db().Query("SELECT id, host, port, forwarder, weight, upperThreshold, lowerThreshold, \"check\", endpoint, expectedCode, timeout, attempts, recover, draining FROM servers WHERE id = $1 AND serviceId = $2", srvId, svcId)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from servers table - %s", err)
 	}
@@ -349,7 +297,8 @@ func (p PostgresDb) GetServer(svcId, srvId string) (*core.Server, error) {
 	// get data
 	for rows.Next() {
 		srv := core.Server{}
-		err = rows.Scan(&srv.Id, &srv.Host, &srv.Port, &srv.Forwarder, &srv.Weight, &srv.UpperThreshold, &srv.LowerThreshold)
+		err = rows.Scan(&srv.Id, &srv.Host, &srv.Port, &srv.Forwarder, &srv.Weight, &srv.UpperThreshold, &srv.LowerThreshold,
+			&srv.Check, &srv.Endpoint, &srv.ExpectedCode, &srv.Timeout, &srv.Attempts, &srv.Recover, &srv.Draining)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to save results into server - %s", err)
 		}
@@ -371,7 +320,7 @@ func (p PostgresDb) GetServer(svcId, srvId string) (*core.Server, error) {
 
 func (p PostgresDb) GetServers(svcId string) ([]core.Server, error) {
 	// read from servers table
-	rows, err := p.pg.Query(fmt.Sprintf("SELECT id, host, port, forwarder, weight, upperThreshold, lowerThreshold FROM servers WHERE serviceId = '%s'", template.HTMLEscapeString(svcId)))
+	rows, err := p.db().Query("SELECT id, host, port, forwarder, weight, upperThreshold, lowerThreshold, \"check\", endpoint, expectedCode, timeout, attempts, recover, draining FROM servers WHERE serviceId = $1", svcId)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from servers table - %s", err)
 	}
@@ -382,7 +331,8 @@ func (p PostgresDb) GetServers(svcId string) ([]core.Server, error) {
 	// get data
 	for rows.Next() {
 		srv := core.Server{}
-		err = rows.Scan(&srv.Id, &srv.Host, &srv.Port, &srv.Forwarder, &srv.Weight, &srv.UpperThreshold, &srv.LowerThreshold)
+		err = rows.Scan(&srv.Id, &srv.Host, &srv.Port, &srv.Forwarder, &srv.Weight, &srv.UpperThreshold, &srv.LowerThreshold,
+			&srv.Check, &srv.Endpoint, &srv.ExpectedCode, &srv.Timeout, &srv.Attempts, &srv.Recover, &srv.Draining)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to save results into server - %s", err)
 		}
@@ -404,7 +354,8 @@ func (p PostgresDb) GetServers(svcId string) ([]core.Server, error) {
 
 func (p PostgresDb) GetRoutes() ([]core.Route, error) {
 	// read from routes table
-	rows, err := p.pg.Query("SELECT subdomain, domain, path, targets, fwdPath, page FROM routes")
+	rows, err := p.db().Query(`SELECT subdomain, domain, path, targets, fwdPath, page,
+endpoint, expectedCode, expectedBody, expectedHeader, host, timeout, attempts FROM routes`)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from routes table - %s", err)
 	}
@@ -416,7 +367,8 @@ func (p PostgresDb) GetRoutes() ([]core.Route, error) {
 	for rows.Next() {
 		route := core.Route{}
 		var tmpTargets string
-		err = rows.Scan(&route.SubDomain, &route.Domain, &route.Path, &tmpTargets, &route.FwdPath, &route.Page)
+		err = rows.Scan(&route.SubDomain, &route.Domain, &route.Path, &tmpTargets, &route.FwdPath, &route.Page,
+			&route.Endpoint, &route.ExpectedCode, &route.ExpectedBody, &route.ExpectedHeader, &route.Host, &route.Timeout, &route.Attempts)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to save results into route - %s", err)
 		}
@@ -433,63 +385,70 @@ func (p PostgresDb) GetRoutes() ([]core.Route, error) {
 }
 
 func (p PostgresDb) SetRoutes(routes []core.Route) error {
-	// truncate routes table
-	_, err := p.pg.Exec("TRUNCATE routes")
-	if err != nil {
-		return fmt.Errorf("Failed to truncate routes table - %s", err)
-	}
-	for i := range routes {
-		err = p.SetRoute(routes[i]) // prevents duplicates
+	return p.change("routes", "", func(p PostgresDb) error {
+		// truncate routes table
+		_, err := p.db().Exec("TRUNCATE routes")
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to truncate routes table - %s", err)
 		}
-	}
-	return nil
+		for i := range routes {
+			err = p.SetRoute(routes[i]) // prevents duplicates
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) SetRoute(route core.Route) error {
-	routes, err := p.GetRoutes()
-	if err != nil {
-		return err
-	}
-	// for idempotency
-	for i := range routes {
-		// update routes table
-		if routes[i].SubDomain == route.SubDomain && routes[i].Domain == route.Domain && routes[i].Path == route.Path {
-			_, err = p.pg.Exec(fmt.Sprintf(`
-UPDATE routes SET targets = '%s', fwdPath = '%s', page = '%s'
-WHERE subdomain = '%s' AND domain = '%s' AND path = '%s'`,
-				template.HTMLEscapeString(strings.Join(route.Targets, ",")),
-				template.HTMLEscapeString(route.FwdPath), template.HTMLEscapeString(route.Page), template.HTMLEscapeString(route.SubDomain), template.HTMLEscapeString(route.Domain),
-				template.HTMLEscapeString(route.Path)))
-			if err != nil {
-				return fmt.Errorf("Failed to update routes table - %s", err)
+	return p.change("routes", "", func(p PostgresDb) error {
+		routes, err := p.GetRoutes()
+		if err != nil {
+			return err
+		}
+		// for idempotency
+		for i := range routes {
+			// update routes table
+			if routes[i].SubDomain == route.SubDomain && routes[i].Domain == route.Domain && routes[i].Path == route.Path {
+				_, err = p.db().Exec(`
+UPDATE routes SET targets = $1, fwdPath = $2, page = $3, endpoint = $4, expectedCode = $5,
+expectedBody = $6, expectedHeader = $7, host = $8, timeout = $9, attempts = $10
+WHERE subdomain = $11 AND domain = $12 AND path = $13`,
+					strings.Join(route.Targets, ","), route.FwdPath, route.Page, route.Endpoint, route.ExpectedCode,
+					route.ExpectedBody, route.ExpectedHeader, route.Host, route.Timeout, route.Attempts,
+					route.SubDomain, route.Domain, route.Path)
+				if err != nil {
+					return fmt.Errorf("Failed to update routes table - %s", err)
+				}
+				return nil
 			}
-			return nil
 		}
-	}
 
-	// insert into routes table
-	_, err = p.pg.Exec(fmt.Sprintf(`
-INSERT INTO routes(subdomain, domain, path, targets, fwdPath, page)
-VALUES('%s', '%s', '%s', '%s', '%s', '%s')`,
-		template.HTMLEscapeString(route.SubDomain), template.HTMLEscapeString(route.Domain), template.HTMLEscapeString(route.Path),
-		template.HTMLEscapeString(strings.Join(route.Targets, ",")),
-		template.HTMLEscapeString(route.FwdPath), template.HTMLEscapeString(route.Page)))
-	if err != nil {
-		return fmt.Errorf("Failed to insert into routes table - %s", err)
-	}
-	return nil
+		// insert into routes table
+		_, err = p.db().Exec(`
+INSERT INTO routes(subdomain, domain, path, targets, fwdPath, page,
+endpoint, expectedCode, expectedBody, expectedHeader, host, timeout, attempts)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			route.SubDomain, route.Domain, route.Path, strings.Join(route.Targets, ","), route.FwdPath, route.Page,
+			route.Endpoint, route.ExpectedCode, route.ExpectedBody, route.ExpectedHeader, route.Host, route.Timeout, route.Attempts)
+		if err != nil {
+			return fmt.Errorf("Failed to insert into routes table - %s", err)
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) DeleteRoute(route core.Route) error {
-	// delete from routes table
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM routes WHERE subdomain = '%s' AND domain = '%s' AND path = '%s'`,
-		template.HTMLEscapeString(route.SubDomain), template.HTMLEscapeString(route.Domain), template.HTMLEscapeString(route.Path)))
-	if err != nil {
-		return fmt.Errorf("Failed to delete from routes table - %s", err)
-	}
-	return nil
+	return p.change("routes", "", func(p PostgresDb) error {
+		// delete from routes table
+		_, err := p.db().Exec(`DELETE FROM routes WHERE subdomain = $1 AND domain = $2 AND path = $3`,
+			route.SubDomain, route.Domain, route.Path)
+		if err != nil {
+			return fmt.Errorf("Failed to delete from routes table - %s", err)
+		}
+		return nil
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -498,7 +457,7 @@ func (p PostgresDb) DeleteRoute(route core.Route) error {
 
 func (p PostgresDb) GetCerts() ([]core.CertBundle, error) {
 	// read from certs table
-	rows, err := p.pg.Query("SELECT cert, key FROM certs")
+	rows, err := p.db().Query("SELECT cert, key FROM certs")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from certs table - %s", err)
 	}
@@ -525,58 +484,64 @@ func (p PostgresDb) GetCerts() ([]core.CertBundle, error) {
 }
 
 func (p PostgresDb) SetCerts(certs []core.CertBundle) error {
-	// truncate certs table
-	_, err := p.pg.Exec("TRUNCATE certs")
-	if err != nil {
-		return fmt.Errorf("Failed to truncate certs table - %s", err)
-	}
-	for i := range certs {
-		err = p.SetCert(certs[i])
+	return p.change("certs", "", func(p PostgresDb) error {
+		// truncate certs table
+		_, err := p.db().Exec("TRUNCATE certs")
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to truncate certs table - %s", err)
 		}
-	}
-	return nil
+		for i := range certs {
+			err = p.SetCert(certs[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) SetCert(cert core.CertBundle) error {
-	certs, err := p.GetCerts()
-	if err != nil {
-		return err
-	}
-	// for idempotency
-	for i := 0; i < len(certs); i++ {
-		// todo: can there be multiple keys for same cert?
-		// if certs[i].Cert == cert.Cert && certs[i].Key == cert.Key {
-
-		// update certs table
-		if certs[i].Cert == cert.Cert {
-			_, err = p.pg.Exec(fmt.Sprintf(`UPDATE certs SET key = '%s' WHERE cert = '%s'`, template.HTMLEscapeString(cert.Key), template.HTMLEscapeString(cert.Cert)))
-			if err != nil {
-				return fmt.Errorf("Failed to update certs table - %s", err)
+	return p.change("certs", "", func(p PostgresDb) error {
+		certs, err := p.GetCerts()
+		if err != nil {
+			return err
+		}
+		// for idempotency
+		for i := 0; i < len(certs); i++ {
+			// todo: can there be multiple keys for same cert?
+			// if certs[i].Cert == cert.Cert && certs[i].Key == cert.Key {
+
+			// update certs table
+			if certs[i].Cert == cert.Cert {
+				_, err = p.db().Exec(`UPDATE certs SET key = $1 WHERE cert = $2`, cert.Key, cert.Cert)
+				if err != nil {
+					return fmt.Errorf("Failed to update certs table - %s", err)
+				}
+				return nil
 			}
-			return nil
 		}
-	}
 
-	// insert into certs table
-	_, err = p.pg.Exec(fmt.Sprintf(`INSERT INTO certs(cert, key) VALUES('%s', '%s')`, template.HTMLEscapeString(cert.Cert), template.HTMLEscapeString(cert.Key)))
-	if err != nil {
-		return fmt.Errorf("Failed to insert into certs table - %s", err)
-	}
-	return nil
+		// insert into certs table
+		_, err = p.db().Exec(`INSERT INTO certs(cert, key) VALUES($1, $2)`, cert.Cert, cert.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to insert into certs table - %s", err)
+		}
+		return nil
+	})
 }
 
 func (p PostgresDb) DeleteCert(cert core.CertBundle) error {
-	// todo: can there be multiple keys for same cert?
-	// _, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM certs WHERE cert = '%s' AND key = '%s'`, template.HTMLEscapeString(cert.Cert), template.HTMLEscapeString(cert.Key)))
+	return p.change("certs", "", func(p PostgresDb) error {
+		// todo: can there be multiple keys for same cert?
+		// _, err := p.db().Exec(`DELETE FROM certs WHERE cert = $1 AND key = $2`, cert.Cert, cert.Key)
 
-	// delete from certs table
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM certs WHERE cert = '%s'`, template.HTMLEscapeString(cert.Cert)))
-	if err != nil {
-		return fmt.Errorf("Failed to delete from certs table - %s", err)
-	}
-	return nil
+		// delete from certs table
+		_, err := p.db().Exec(`DELETE FROM certs WHERE cert = $1`, cert.Cert)
+		if err != nil {
+			return fmt.Errorf("Failed to delete from certs table - %s", err)
+		}
+		return nil
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -585,7 +550,7 @@ func (p PostgresDb) DeleteCert(cert core.CertBundle) error {
 
 func (p PostgresDb) GetVips() ([]core.Vip, error) {
 	// read from vips table
-	rows, err := p.pg.Query("SELECT ip, interface, alias FROM vips")
+	rows, err := p.db().Query("SELECT ip, interface, alias, preempt FROM vips")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from vips table - %s", err)
 	}
@@ -596,7 +561,7 @@ func (p PostgresDb) GetVips() ([]core.Vip, error) {
 	// get data
 	for rows.Next() {
 		vip := core.Vip{}
-		err = rows.Scan(&vip.Ip, &vip.Interface, &vip.Alias)
+		err = rows.Scan(&vip.Ip, &vip.Interface, &vip.Alias, &vip.Preempt)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to save results into vip - %s", err)
 		}
@@ -612,50 +577,425 @@ func (p PostgresDb) GetVips() ([]core.Vip, error) {
 }
 
 func (p PostgresDb) SetVips(vips []core.Vip) error {
-	// truncate vips table
-	_, err := p.pg.Exec("TRUNCATE vips")
+	return p.change("vips", "", func(p PostgresDb) error {
+		// truncate vips table
+		_, err := p.db().Exec("TRUNCATE vips")
+		if err != nil {
+			return fmt.Errorf("Failed to truncate vips table - %s", err)
+		}
+		for i := range vips {
+			err = p.SetVip(vips[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p PostgresDb) SetVip(vip core.Vip) error {
+	return p.change("vips", "", func(p PostgresDb) error {
+		vips, err := p.GetVips()
+		if err != nil {
+			return err
+		}
+		// for idempotency
+		for i := 0; i < len(vips); i++ {
+			// update vips table
+			if vips[i].Ip == vip.Ip {
+				_, err = p.db().Exec(`UPDATE vips SET interface = $1, alias = $2, preempt = $3 WHERE ip = $4`,
+					vip.Interface, vip.Alias, vip.Preempt, vip.Ip)
+				if err != nil {
+					return fmt.Errorf("Failed to update vips table - %s", err)
+				}
+				return nil
+			}
+		}
+
+		// insert into vips table
+		_, err = p.db().Exec(`INSERT INTO vips(ip, interface, alias, preempt) VALUES($1, $2, $3, $4)`,
+			vip.Ip, vip.Interface, vip.Alias, vip.Preempt)
+		if err != nil {
+			return fmt.Errorf("Failed to insert into vips table - %s", err)
+		}
+		return nil
+	})
+}
+
+func (p PostgresDb) DeleteVip(vip core.Vip) error {
+	return p.change("vips", "", func(p PostgresDb) error {
+		// delete from vips table
+		_, err := p.db().Exec(`DELETE FROM vips WHERE ip = $1`, vip.Ip)
+		if err != nil {
+			return fmt.Errorf("Failed to delete from vips table - %s", err)
+		}
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// WEBHOOKS
+////////////////////////////////////////////////////////////////////////////////
+
+func (p PostgresDb) GetWebhooks() ([]core.Webhook, error) {
+	// read from webhooks table
+	rows, err := p.pg.Query("SELECT id, url, secret, events FROM webhooks")
 	if err != nil {
-		return fmt.Errorf("Failed to truncate vips table - %s", err)
+		return nil, fmt.Errorf("Failed to select from webhooks table - %s", err)
 	}
-	for i := range vips {
-		err = p.SetVip(vips[i])
+	defer rows.Close()
+
+	hooks := make([]core.Webhook, 0, 0)
+
+	// get data
+	for rows.Next() {
+		hook := core.Webhook{}
+		var events string
+		err = rows.Scan(&hook.Id, &hook.Url, &hook.Secret, &events)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Failed to save results into webhook - %s", err)
 		}
+		if events != "" {
+			hook.Events = strings.Split(events, ",")
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	// check for errors
+	if err = rows.Err(); err != nil {
+		return hooks, fmt.Errorf("Error with results - %s", err)
+	}
+	return hooks, nil
+}
+
+func (p PostgresDb) SetWebhook(hook core.Webhook) error {
+	// insert (or update) webhooks table
+	_, err := p.pg.Exec(`INSERT INTO webhooks(id, url, secret, events) VALUES($1, $2, $3, $4)
+ON CONFLICT (id) DO UPDATE SET url = $2, secret = $3, events = $4`, hook.Id, hook.Url, hook.Secret, strings.Join(hook.Events, ","))
+	if err != nil {
+		return fmt.Errorf("Failed to insert into webhooks table - %s", err)
 	}
 	return nil
 }
 
-func (p PostgresDb) SetVip(vip core.Vip) error {
-	vips, err := p.GetVips()
+func (p PostgresDb) DeleteWebhook(id string) error {
+	// delete from webhooks table
+	res, err := p.pg.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to delete from webhooks table - %s", err)
 	}
-	// for idempotency
-	for i := 0; i < len(vips); i++ {
-		// update vips table
-		if vips[i].Ip == vip.Ip {
-			_, err = p.pg.Exec(fmt.Sprintf(`UPDATE vips SET interface = '%s', alias = '%s' WHERE ip = '%s'`, template.HTMLEscapeString(vip.Interface), template.HTMLEscapeString(vip.Alias), template.HTMLEscapeString(vip.Ip)))
-			if err != nil {
-				return fmt.Errorf("Failed to update vips table - %s", err)
-			}
-			return nil
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NoWebhookError
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TOKENS
+////////////////////////////////////////////////////////////////////////////////
+
+func (p PostgresDb) GetTokens() ([]core.Token, error) {
+	// read from tokens table
+	rows, err := p.pg.Query("SELECT name, hash, scopes FROM tokens")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select from tokens table - %s", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]core.Token, 0, 0)
+
+	// get data
+	for rows.Next() {
+		token := core.Token{}
+		var scopes string
+		err = rows.Scan(&token.Name, &token.Hash, &scopes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save results into token - %s", err)
 		}
+		if scopes != "" {
+			token.Scopes = strings.Split(scopes, ",")
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	// check for errors
+	if err = rows.Err(); err != nil {
+		return tokens, fmt.Errorf("Error with results - %s", err)
 	}
+	return tokens, nil
+}
 
-	// insert into vips table
-	_, err = p.pg.Exec(fmt.Sprintf(`INSERT INTO vips(ip, interface, alias) VALUES('%s', '%s', '%s')`, template.HTMLEscapeString(vip.Ip), template.HTMLEscapeString(vip.Interface), template.HTMLEscapeString(vip.Alias)))
+func (p PostgresDb) SetToken(token core.Token) error {
+	// insert (or update) tokens table
+	_, err := p.pg.Exec(`INSERT INTO tokens(name, hash, scopes) VALUES($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET hash = $2, scopes = $3`, token.Name, token.Hash, strings.Join(token.Scopes, ","))
 	if err != nil {
-		return fmt.Errorf("Failed to insert into vips table - %s", err)
+		return fmt.Errorf("Failed to insert into tokens table - %s", err)
 	}
 	return nil
 }
 
-func (p PostgresDb) DeleteVip(vip core.Vip) error {
-	// delete from vips table
-	_, err := p.pg.Exec(fmt.Sprintf(`DELETE FROM vips WHERE ip = '%s'`, template.HTMLEscapeString(vip.Ip)))
+func (p PostgresDb) DeleteToken(name string) error {
+	// delete from tokens table
+	res, err := p.pg.Exec(`DELETE FROM tokens WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("Failed to delete from tokens table - %s", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NoTokenError
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AUDIT
+////////////////////////////////////////////////////////////////////////////////
+
+func (p PostgresDb) AddAudit(record core.AuditRecord) error {
+	// insert into audit table (never updated)
+	_, err := p.pg.Exec(`INSERT INTO audit(id, time, remoteAddr, identity, request, action, resource, before, after)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`, record.Id, record.Time, record.RemoteAddr, record.Identity,
+		record.Request, record.Action, record.Resource, string(record.Before), string(record.After))
 	if err != nil {
-		return fmt.Errorf("Failed to delete from vips table - %s", err)
+		return fmt.Errorf("Failed to insert into audit table - %s", err)
 	}
 	return nil
 }
+
+func (p PostgresDb) GetAudit(since time.Time, resource string) ([]core.AuditRecord, error) {
+	// read from audit table
+	rows, err := p.pg.Query(`SELECT id, time, remoteAddr, identity, request, action, resource, before, after FROM audit
+WHERE time >= $1 AND ($2 = '' OR resource = $2) ORDER BY auditId`, since, resource)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select from audit table - %s", err)
+	}
+	defer rows.Close()
+
+	records := make([]core.AuditRecord, 0, 0)
+
+	// get data
+	for rows.Next() {
+		record := core.AuditRecord{}
+		var before, after string
+		err = rows.Scan(&record.Id, &record.Time, &record.RemoteAddr, &record.Identity, &record.Request, &record.Action, &record.Resource, &before, &after)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save results into audit record - %s", err)
+		}
+		if before != "" {
+			record.Before = []byte(before)
+		}
+		if after != "" {
+			record.After = []byte(after)
+		}
+		record.Time = record.Time.UTC()
+
+		records = append(records, record)
+	}
+
+	// check for errors
+	if err = rows.Err(); err != nil {
+		return records, fmt.Errorf("Error with results - %s", err)
+	}
+	return records, nil
+}
+
+func (p PostgresDb) DeleteAudit(keep int) error {
+	// delete from audit table, all but the newest keep
+	_, err := p.pg.Exec(`DELETE FROM audit WHERE auditId <= (SELECT auditId FROM audit ORDER BY auditId DESC OFFSET $1 LIMIT 1)`, keep)
+	if err != nil {
+		return fmt.Errorf("Failed to delete from audit table - %s", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// REVISIONS
+////////////////////////////////////////////////////////////////////////////////
+
+func (p PostgresDb) AddRevision(rev core.Revision) (int, error) {
+	manifest, err := json.Marshal(rev.Manifest)
+	if err != nil {
+		return 0, err
+	}
+	// insert into revisions table (numbered by it, never updated)
+	err = p.pg.QueryRow(`INSERT INTO revisions(time, action, manifest) VALUES($1, $2, $3) RETURNING number`,
+		rev.Time, rev.Action, string(manifest)).Scan(&rev.Number)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to insert into revisions table - %s", err)
+	}
+	return rev.Number, nil
+}
+
+func (p PostgresDb) GetRevisions() ([]core.Revision, error) {
+	// read from revisions table
+	rows, err := p.pg.Query(`SELECT number, time, action, manifest FROM revisions ORDER BY number`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select from revisions table - %s", err)
+	}
+	defer rows.Close()
+
+	revs := make([]core.Revision, 0, 0)
+
+	// get data
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, *rev)
+	}
+
+	// check for errors
+	if err = rows.Err(); err != nil {
+		return revs, fmt.Errorf("Error with results - %s", err)
+	}
+	return revs, nil
+}
+
+func (p PostgresDb) GetRevision(number int) (*core.Revision, error) {
+	// read from revisions table
+	rev, err := scanRevision(p.pg.QueryRow(`SELECT number, time, action, manifest FROM revisions WHERE number = $1`, number))
+	if err == sql.ErrNoRows {
+		return nil, NoRevisionError
+	}
+	return rev, err
+}
+
+func (p PostgresDb) GetLastRevision() (*core.Revision, error) {
+	// read from revisions table
+	rev, err := scanRevision(p.pg.QueryRow(`SELECT number, time, action, manifest FROM revisions ORDER BY number DESC LIMIT 1`))
+	if err == sql.ErrNoRows {
+		return nil, NoRevisionError
+	}
+	return rev, err
+}
+
+func (p PostgresDb) DeleteRevisions(before int) error {
+	// delete from revisions table
+	_, err := p.pg.Exec(`DELETE FROM revisions WHERE number < $1`, before)
+	if err != nil {
+		return fmt.Errorf("Failed to delete from revisions table - %s", err)
+	}
+	return nil
+}
+
+// scanRevision reads a revision from a row of the revisions table
+func scanRevision(row interface{ Scan(...interface{}) error }) (*core.Revision, error) {
+	rev := core.Revision{}
+	var manifest string
+	err := row.Scan(&rev.Number, &rev.Time, &rev.Action, &manifest)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save results into revision - %s", err)
+	}
+	if err = json.Unmarshal([]byte(manifest), &rev.Manifest); err != nil {
+		return nil, fmt.Errorf("Bad JSON syntax stored in db")
+	}
+	rev.Time = rev.Time.UTC()
+	return &rev, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// NOTIFY
+////////////////////////////////////////////////////////////////////////////////
+
+// db is what to query - the change being made, or the database
+func (p PostgresDb) db() pgQuerier {
+	if p.tx != nil {
+		return p.tx
+	}
+	return p.pg
+}
+
+// change makes a change to resource in a transaction, notifying the members
+// sharing the database of it once it's committed. Changes made within it are
+// part of it (and aren't notified separately).
+func (p PostgresDb) change(resource, id string, fn func(p PostgresDb) error) error {
+	if p.tx != nil {
+		return fn(p)
+	}
+
+	tx, err := p.pg.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to begin transaction - %s", err)
+	}
+	p.tx = tx
+	if err = fn(p); err != nil {
+		tx.Rollback()
+		return err
+	}
+	p.notify(resource, id)
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit %s change - %s", resource, err)
+	}
+	return nil
+}
+
+// notify tells the members sharing the database of the change, once it's
+// committed. Failing to is only logged, the change is still made (and the
+// members reapply everything when their listener reconnects).
+func (p PostgresDb) notify(resource, id string) {
+	b, err := json.Marshal(pgChange{Change: Change{Resource: resource, Id: id}, Origin: p.origin})
+	if err == nil {
+		// a failed statement aborts the transaction, unless rolled back to before it
+		_, err = p.tx.Exec("SAVEPOINT notify")
+	}
+	if err == nil {
+		_, err = p.tx.Exec("SELECT pg_notify($1, $2)", pgChannel, string(b))
+		if err != nil {
+			p.tx.Exec("ROLLBACK TO SAVEPOINT notify")
+		}
+	}
+	if err != nil {
+		config.Log.Error("[database] - Failed to notify of %s change - %s", resource, err)
+	}
+}
+
+// Listen calls changed with each change notified by the other members. When
+// the listener reconnects, it's called with an empty change, as some may have
+// been missed.
+func (p PostgresDb) Listen(changed func(Change)) error {
+	listener := pq.NewListener(config.DatabaseConnection, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			config.Log.Error("[database] - Postgres listener - %s", err)
+		}
+	})
+	err := listener.Listen(pgChannel)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("Failed to listen to postgres - %s", err)
+	}
+
+	go func() {
+		for {
+			select {
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				if n == nil {
+					// reconnected
+					changed(Change{})
+					continue
+				}
+				var change pgChange
+				err := json.Unmarshal([]byte(n.Extra), &change)
+				if err != nil {
+					config.Log.Error("[database] - Failed to unmarshal change - %s", err)
+					continue
+				}
+				if change.Origin != p.origin {
+					changed(change.Change)
+				}
+			case <-time.After(90 * time.Second):
+				// checks the connection, reconnecting if it's lost
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
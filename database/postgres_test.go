@@ -1,9 +1,11 @@
 package database_test
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 
@@ -388,3 +390,389 @@ func TestDeleteCertPg(t *testing.T) {
 		t.Errorf("Failed to delete cert")
 	}
 }
+
+func TestWebhooksPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	hook := core.Webhook{Url: "https://hooks.portal.test/portal", Secret: "shh", Events: []string{"set-route", "server-health"}}
+	hook.GenId()
+	if err := pgbackend.SetWebhook(hook); err != nil {
+		t.Errorf("Failed to SET webhook - %s", err)
+	}
+	// updates in place
+	if err := pgbackend.SetWebhook(hook); err != nil {
+		t.Errorf("Failed to SET webhook again - %s", err)
+	}
+
+	hooks, err := pgbackend.GetWebhooks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(hooks) != 1 || len(hooks[0].Events) != 2 {
+		t.Errorf("Read webhook differs from written webhook - %v", hooks)
+	}
+
+	if err := pgbackend.DeleteWebhook(hook.Id); err != nil {
+		t.Errorf("Failed to DELETE webhook - %s", err)
+	}
+	if err := pgbackend.DeleteWebhook(hook.Id); err != database.NoWebhookError {
+		t.Errorf("Expected NoWebhookError, got %v", err)
+	}
+}
+
+func TestTokensPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	token := core.Token{Name: "ci", Hash: "abc123", Scopes: []string{"routes-only"}}
+	if err := pgbackend.SetToken(token); err != nil {
+		t.Errorf("Failed to SET token - %s", err)
+	}
+	// updates in place
+	token.Scopes = []string{"read-only", "routes-only"}
+	if err := pgbackend.SetToken(token); err != nil {
+		t.Errorf("Failed to SET token again - %s", err)
+	}
+
+	tokens, err := pgbackend.GetTokens()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(tokens) != 1 || tokens[0].Hash != "abc123" || len(tokens[0].Scopes) != 2 {
+		t.Errorf("Read token differs from written token - %v", tokens)
+	}
+
+	if err := pgbackend.DeleteToken(token.Name); err != nil {
+		t.Errorf("Failed to DELETE token - %s", err)
+	}
+	if err := pgbackend.DeleteToken(token.Name); err != database.NoTokenError {
+		t.Errorf("Expected NoTokenError, got %v", err)
+	}
+}
+
+func TestAuditPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	now := time.Now().UTC()
+	record := core.AuditRecord{Id: fmt.Sprintf("%019d", now.UnixNano()), Time: now, Identity: "token", Action: "set-vip", Resource: "vip", After: []byte(`{"ip":"192.168.0.100"}`)}
+	if err := pgbackend.AddAudit(record); err != nil {
+		t.Errorf("Failed to ADD audit record - %s", err)
+	}
+
+	audit, err := pgbackend.GetAudit(now.Add(-time.Second), "vip")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(audit) != 1 || audit[0].Id != record.Id || string(audit[0].After) != string(record.After) || audit[0].Before != nil {
+		t.Errorf("Read audit differs from written audit - %v", audit)
+	}
+
+	audit, err = pgbackend.GetAudit(now.Add(-time.Second), "route")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(audit) != 0 {
+		t.Errorf("Failed to filter audit - %v", audit)
+	}
+
+	if err = pgbackend.DeleteAudit(1); err != nil {
+		t.Errorf("Failed to DELETE audit records - %s", err)
+	}
+	audit, _ = pgbackend.GetAudit(time.Time{}, "")
+	if len(audit) != 1 || audit[0].Id != record.Id {
+		t.Errorf("Failed to trim audit - %v", audit)
+	}
+}
+
+func TestRevisionsPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	// numbered from wherever earlier runs left off
+	manifest := &core.Manifest{Routes: []core.Route{{Domain: "portal.test"}}}
+	first, err := pgbackend.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "set-routes", Manifest: manifest})
+	if err != nil {
+		t.Fatalf("Failed to ADD revision - %s", err)
+	}
+	second, err := pgbackend.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "batch", Manifest: manifest})
+	if err != nil || second <= first {
+		t.Fatalf("Failed to ADD revision - %d %v", second, err)
+	}
+
+	rev, err := pgbackend.GetRevision(first)
+	if err != nil || rev.Action != "set-routes" || rev.Manifest == nil || len(rev.Routes) != 1 || rev.Routes[0].Domain != "portal.test" {
+		t.Errorf("Read revision differs from written revision - %v %v", rev, err)
+	}
+	if _, err = pgbackend.GetRevision(second + 1); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	if last, err := pgbackend.GetLastRevision(); err != nil || last.Number != second || last.Action != "batch" {
+		t.Errorf("Read last revision differs from written revision - %v %v", last, err)
+	}
+
+	if err = pgbackend.DeleteRevisions(second); err != nil {
+		t.Errorf("Failed to DELETE revisions - %s", err)
+	}
+	revs, err := pgbackend.GetRevisions()
+	if err != nil || len(revs) != 1 || revs[0].Number != second {
+		t.Errorf("Failed to DELETE revisions - %v %v", revs, err)
+	}
+}
+
+func TestNotifyPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	// another member sharing the database
+	other := &database.PostgresDb{}
+	if err := other.Init(); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan database.Change, 10)
+	if err := other.Listen(func(change database.Change) { changes <- change }); err != nil {
+		t.Fatalf("Failed to listen - %s", err)
+	}
+
+	if err := pgbackend.SetService(&testService1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-changes:
+		if change.Resource != "services" || change.Id != testService1.Id {
+			t.Errorf("Unexpected change %+v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected change to be notified")
+	}
+
+	// once per change, however many rows it makes
+	if err := pgbackend.SetServices([]core.Service{testService1, testService2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-changes:
+		if change.Resource != "services" || change.Id != "" {
+			t.Errorf("Unexpected change %+v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected change to be notified")
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Expected one change, also got %+v", change)
+	case <-time.After(time.Second):
+	}
+
+	// not my own
+	mine := make(chan database.Change, 10)
+	if err := pgbackend.(database.Notifier).Listen(func(change database.Change) { mine <- change }); err != nil {
+		t.Fatalf("Failed to listen - %s", err)
+	}
+	if err := pgbackend.DeleteService(testService1.Id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-mine:
+		t.Errorf("Expected my own change not to be notified, got %+v", change)
+	case <-time.After(time.Second):
+	}
+	pgbackend.DeleteService(testService2.Id)
+}
+
+func TestRouteHealthCheckPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	route := core.Route{Domain: "health.test", Targets: []string{"http://127.0.0.1:8080"}, Endpoint: "/health",
+		ExpectedCode: 200, ExpectedBody: "ok", ExpectedHeader: "X-Ok:yes", Host: "health.test", Timeout: 500, Attempts: 2}
+	if err := pgbackend.SetRoutes([]core.Route{route}); err != nil {
+		t.Fatalf("Failed to SET routes - %s", err)
+	}
+
+	routes, err := pgbackend.GetRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Endpoint != route.Endpoint || routes[0].ExpectedCode != route.ExpectedCode ||
+		routes[0].ExpectedBody != route.ExpectedBody || routes[0].ExpectedHeader != route.ExpectedHeader ||
+		routes[0].Host != route.Host || routes[0].Timeout != route.Timeout || routes[0].Attempts != route.Attempts {
+		t.Errorf("Health check not stored - %+v", routes)
+	}
+	pgbackend.DeleteRoute(route)
+}
+
+func TestServerHealthCheckPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	server := core.Server{Id: "127_0_0_13-8080", Host: "127.0.0.13", Port: 8080, Forwarder: "m", Weight: 5,
+		Check: "http", Endpoint: "/health", ExpectedCode: 204, Timeout: 500, Attempts: 4, Recover: 3, Draining: true}
+	pgbackend.SetService(&testService1)
+	if err := pgbackend.SetServer(testService1.Id, &server); err != nil {
+		t.Fatalf("Failed to SET server - %s", err)
+	}
+
+	srv, err := pgbackend.GetServer(testService1.Id, server.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Check != server.Check || srv.Endpoint != server.Endpoint || srv.ExpectedCode != server.ExpectedCode ||
+		srv.Timeout != server.Timeout || srv.Attempts != server.Attempts || srv.Recover != server.Recover || !srv.Draining {
+		t.Errorf("Health check or draining not stored - %+v", srv)
+	}
+	pgbackend.DeleteServer(testService1.Id, server.Id)
+}
+
+func TestMigrationsPg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	// already migrated by Init
+	applied, err := database.Migrate()
+	if err != nil {
+		t.Fatalf("Failed to migrate - %s", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Expected no pending migrations, applied %+v", applied)
+	}
+
+	migrations, err := database.Migrations()
+	if err != nil {
+		t.Fatalf("Failed to get migrations - %s", err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Applied == nil {
+			t.Errorf("Expected migration %d to be applied, got %+v", i+1, m)
+		}
+	}
+}
+
+// a database created by portal before schema_version existed, as it wrote it
+const pgBaseline = `
+CREATE TABLE services (
+	serviceId      SERIAL PRIMARY KEY NOT NULL,
+	id             TEXT NOT NULL UNIQUE,
+	host           TEXT NOT NULL,
+	interface      TEXT,
+	port           INTEGER NOT NULL,
+	type           TEXT,
+	scheduler      TEXT,
+	persistence    INTEGER,
+	netmask        TEXT
+);
+CREATE TABLE servers (
+	serverId       SERIAL PRIMARY KEY NOT NULL,
+	serviceId      TEXT REFERENCES services (id) ON DELETE CASCADE,
+	id             TEXT NOT NULL UNIQUE,
+	host           TEXT NOT NULL,
+	port           INTEGER NOT NULL,
+	forwarder      TEXT,
+	weight         TEXT,
+	upperThreshold TEXT,
+	lowerThreshold TEXT
+);
+CREATE TABLE routes (
+	routeId   SERIAL PRIMARY KEY NOT NULL,
+	subdomain TEXT,
+	domain    TEXT,
+	path      TEXT,
+	targets   TEXT,
+	fwdPath   TEXT,
+	page      TEXT
+);
+CREATE TABLE certs (
+	certId SERIAL PRIMARY KEY NOT NULL,
+	cert   TEXT NOT NULL,
+	key    TEXT NOT NULL
+);
+CREATE TABLE vips (
+	vipId     SERIAL PRIMARY KEY NOT NULL,
+	ip        TEXT,
+	interface TEXT,
+	alias     TEXT
+);
+INSERT INTO services(id, host, interface, port, type, scheduler, persistence, netmask)
+VALUES('tcp-192_168_0_15-80', '192.168.0.15', '', '80', 'tcp', 'wrr', '300', '');
+INSERT INTO servers(serviceId, id, host, port, forwarder, weight, upperThreshold, lowerThreshold)
+VALUES('tcp-192_168_0_15-80', '127.0.0.11-8080', '127.0.0.11', '8080', 'm', '5', '', '0');
+INSERT INTO routes(subdomain, domain, path, targets, fwdPath, page)
+VALUES('admin', 'test.com', '/a&amp;b', 'http://127.0.0.1:8080', '', '&lt;h1&gt;&#34;down&#34; &amp;amp; &#39;out&#39;&lt;/h1&gt;');
+INSERT INTO certs(cert, key) VALUES('-----BEGIN CERT&amp;', '-----BEGIN KEY&amp;');
+INSERT INTO vips(ip, interface, alias) VALUES('192.168.0.100', 'eth0', 'eth0:1')`
+
+func TestMigrateBaselinePg(t *testing.T) {
+	if pgskip {
+		t.SkipNow()
+	}
+
+	db, err := sql.Open("postgres", config.DatabaseConnection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("DROP SCHEMA IF EXISTS portal_baseline CASCADE; CREATE SCHEMA portal_baseline")
+	if err != nil {
+		t.Fatalf("Failed to create schema - %s", err)
+	}
+	defer db.Exec("DROP SCHEMA IF EXISTS portal_baseline CASCADE")
+	_, err = db.Exec("SET search_path TO portal_baseline;" + pgBaseline)
+	if err != nil {
+		t.Fatalf("Failed to create baseline tables - %s", err)
+	}
+
+	connection := config.DatabaseConnection
+	config.DatabaseConnection += "&search_path=portal_baseline"
+	defer func() { config.DatabaseConnection = connection }()
+
+	baseline := &database.PostgresDb{}
+	if err = baseline.Init(); err != nil {
+		t.Fatalf("Failed to migrate baseline - %s", err)
+	}
+
+	service, err := baseline.GetService("tcp-192_168_0_15-80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Port != 80 || service.Persistence != 300 || len(service.Servers) != 1 {
+		t.Fatalf("Service not migrated - %+v", service)
+	}
+	server := service.Servers[0]
+	if server.Weight != 5 || server.UpperThreshold != 0 || server.LowerThreshold != 0 || server.Draining {
+		t.Errorf("Server not migrated - %+v", server)
+	}
+
+	routes, err := baseline.GetRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Path != "/a&b" || routes[0].Page != `<h1>"down" &amp; 'out'</h1>` ||
+		routes[0].Endpoint != "" || routes[0].ExpectedCode != 0 {
+		t.Errorf("Routes not migrated - %+v", routes)
+	}
+
+	certs, err := baseline.GetCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Cert != "-----BEGIN CERT&" || certs[0].Key != "-----BEGIN KEY&" {
+		t.Errorf("Certs not migrated - %+v", certs)
+	}
+
+	vips, err := baseline.GetVips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vips) != 1 || vips[0].Ip != "192.168.0.100" || vips[0].Alias != "eth0:1" || vips[0].Preempt {
+		t.Errorf("Vips not migrated - %+v", vips)
+	}
+}
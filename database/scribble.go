@@ -3,8 +3,15 @@ package database
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nanobox-io/golang-scribble"
 	"github.com/twinj/uuid"
@@ -13,9 +20,18 @@ import (
 	"github.com/nanopack/portal/core"
 )
 
+var (
+	// revisionLock keeps revisions from being given the same number
+	revisionLock sync.Mutex
+	// lastRevision is the number of the last revision added, read from the
+	// database the first time one is (0 until then)
+	lastRevision int
+)
+
 type (
 	ScribbleDatabase struct {
 		scribbleDb *scribble.Driver
+		dir        string
 	}
 )
 
@@ -31,6 +47,11 @@ func (s *ScribbleDatabase) Init() error {
 	}
 
 	s.scribbleDb = db
+	s.dir = dir
+
+	revisionLock.Lock()
+	lastRevision = 0
+	revisionLock.Unlock()
 	return nil
 }
 
@@ -97,13 +118,18 @@ func (s ScribbleDatabase) SetServer(svcId string, server *core.Server) error {
 	if err != nil {
 		return err
 	}
-	for _, srv := range service.Servers {
-		if srv.Id == server.Id {
-			// if server already exists, don't duplicate it
-			return nil
+	updated := false
+	for i := range service.Servers {
+		if service.Servers[i].Id == server.Id {
+			// if server already exists, update it rather than duplicate it
+			service.Servers[i] = *server
+			updated = true
+			break
 		}
 	}
-	service.Servers = append(service.Servers, *server)
+	if !updated {
+		service.Servers = append(service.Servers, *server)
+	}
 
 	return s.scribbleDb.Write("services", service.Id, service)
 }
@@ -325,7 +351,7 @@ func (s ScribbleDatabase) SetVips(vips []core.Vip) error {
 	s.scribbleDb.Delete("vips", "")
 	for i := range vips {
 		// unique (as much as what we keep) key to store vip by
-		ukey := fmt.Sprintf("%s-%s", strings.Replace(vips[i].Ip, ".", "_", -1), vips[i].Interface)
+		ukey := fmt.Sprintf("%s-%s", core.EncodeHost(vips[i].Ip), vips[i].Interface)
 		err := s.scribbleDb.Write("vips", ukey, vips[i])
 		if err != nil {
 			return err
@@ -363,3 +389,231 @@ func (s ScribbleDatabase) DeleteVip(vip core.Vip) error {
 	}
 	return s.SetVips(vips)
 }
+
+////////////////////////////////////////////////////////////////////////////////
+// WEBHOOKS
+////////////////////////////////////////////////////////////////////////////////
+
+func (s ScribbleDatabase) GetWebhooks() ([]core.Webhook, error) {
+	hooks := make([]core.Webhook, 0, 0)
+	values, err := s.scribbleDb.ReadAll("webhooks")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			// if error is about a missing db, return empty array
+			return hooks, nil
+		}
+		return nil, err
+	}
+	for i := range values {
+		var hook core.Webhook
+		if err = json.Unmarshal([]byte(values[i]), &hook); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (s ScribbleDatabase) SetWebhook(hook core.Webhook) error {
+	return s.scribbleDb.Write("webhooks", hook.Id, hook)
+}
+
+func (s ScribbleDatabase) DeleteWebhook(id string) error {
+	err := s.scribbleDb.Delete("webhooks", id)
+	if err != nil && strings.Contains(err.Error(), "Unable to find") {
+		return NoWebhookError
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TOKENS
+////////////////////////////////////////////////////////////////////////////////
+
+func (s ScribbleDatabase) GetTokens() ([]core.Token, error) {
+	tokens := make([]core.Token, 0, 0)
+	values, err := s.scribbleDb.ReadAll("tokens")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			// if error is about a missing db, return empty array
+			return tokens, nil
+		}
+		return nil, err
+	}
+	for i := range values {
+		var token core.Token
+		if err = json.Unmarshal([]byte(values[i]), &token); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (s ScribbleDatabase) SetToken(token core.Token) error {
+	return s.scribbleDb.Write("tokens", token.Name, token)
+}
+
+func (s ScribbleDatabase) DeleteToken(name string) error {
+	err := s.scribbleDb.Delete("tokens", name)
+	if err != nil && strings.Contains(err.Error(), "Unable to find") {
+		return NoTokenError
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AUDIT
+////////////////////////////////////////////////////////////////////////////////
+
+func (s ScribbleDatabase) AddAudit(record core.AuditRecord) error {
+	return s.scribbleDb.Write("audit", record.Id, record)
+}
+
+func (s ScribbleDatabase) GetAudit(since time.Time, resource string) ([]core.AuditRecord, error) {
+	records := make([]core.AuditRecord, 0, 0)
+	values, err := s.scribbleDb.ReadAll("audit")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			// if error is about a missing db, return empty array
+			return records, nil
+		}
+		return nil, err
+	}
+	for i := range values {
+		var record core.AuditRecord
+		if err = json.Unmarshal([]byte(values[i]), &record); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		if record.Time.Before(since) || (resource != "" && record.Resource != resource) {
+			continue
+		}
+		records = append(records, record)
+	}
+	// ids sort in the order recorded
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	return records, nil
+}
+
+func (s ScribbleDatabase) DeleteAudit(keep int) error {
+	records, err := s.GetAudit(time.Time{}, "")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records)-keep; i++ {
+		err = s.scribbleDb.Delete("audit", records[i].Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// REVISIONS
+////////////////////////////////////////////////////////////////////////////////
+
+func (s ScribbleDatabase) AddRevision(rev core.Revision) (int, error) {
+	// numbered one after the last
+	revisionLock.Lock()
+	defer revisionLock.Unlock()
+	if lastRevision == 0 {
+		numbers, err := s.revisionNumbers()
+		if err != nil {
+			return 0, err
+		}
+		if len(numbers) != 0 {
+			lastRevision = numbers[len(numbers)-1]
+		}
+	}
+	rev.Number = lastRevision + 1
+	if err := s.scribbleDb.Write("revisions", revisionKey(rev.Number), rev); err != nil {
+		return 0, err
+	}
+	lastRevision = rev.Number
+	return rev.Number, nil
+}
+
+func (s ScribbleDatabase) GetRevisions() ([]core.Revision, error) {
+	revs := make([]core.Revision, 0, 0)
+	values, err := s.scribbleDb.ReadAll("revisions")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			// if error is about a missing db, return empty array
+			return revs, nil
+		}
+		return nil, err
+	}
+	for i := range values {
+		var rev core.Revision
+		if err = json.Unmarshal([]byte(values[i]), &rev); err != nil {
+			return nil, fmt.Errorf("Bad JSON syntax stored in db")
+		}
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Number < revs[j].Number })
+	return revs, nil
+}
+
+func (s ScribbleDatabase) GetRevision(number int) (*core.Revision, error) {
+	rev := core.Revision{}
+	err := s.scribbleDb.Read("revisions", revisionKey(number), &rev)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			err = NoRevisionError
+		}
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (s ScribbleDatabase) GetLastRevision() (*core.Revision, error) {
+	numbers, err := s.revisionNumbers()
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) == 0 {
+		return nil, NoRevisionError
+	}
+	return s.GetRevision(numbers[len(numbers)-1])
+}
+
+func (s ScribbleDatabase) DeleteRevisions(before int) error {
+	numbers, err := s.revisionNumbers()
+	if err != nil {
+		return err
+	}
+	for i := range numbers {
+		if numbers[i] >= before {
+			break
+		}
+		err = s.scribbleDb.Delete("revisions", revisionKey(numbers[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revisionNumbers lists the numbers of the stored revisions, in order, from
+// their file names rather than reading each
+func (s ScribbleDatabase) revisionNumbers() ([]int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, "revisions"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, err
+	}
+	// names are padded, so sort in order - "0000000042.json"
+	numbers := make([]int, 0, len(files))
+	for i := range files {
+		number, err := strconv.Atoi(strings.TrimSuffix(files[i].Name(), ".json"))
+		if err != nil {
+			// not a revision (eg. one being written)
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
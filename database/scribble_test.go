@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 
@@ -314,6 +315,150 @@ func TestDeleteCert(t *testing.T) {
 	}
 }
 
+func TestWebhooks(t *testing.T) {
+	hook := core.Webhook{Url: "https://hooks.portal.test/portal", Secret: "shh", Events: []string{"set-route"}}
+	hook.GenId()
+	if err := database.SetWebhook(hook); err != nil {
+		t.Errorf("Failed to SET webhook - %s", err)
+	}
+
+	hooks, err := database.GetWebhooks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(hooks) != 1 || hooks[0].Secret != "shh" || !hooks[0].Wants("set-route") || hooks[0].Wants("delete-route") {
+		t.Errorf("Read webhook differs from written webhook - %v", hooks)
+	}
+
+	if err := database.DeleteWebhook(hook.Id); err != nil {
+		t.Errorf("Failed to DELETE webhook - %s", err)
+	}
+	if err := database.DeleteWebhook(hook.Id); err != database.NoWebhookError {
+		t.Errorf("Expected NoWebhookError, got %v", err)
+	}
+
+	hooks, err = database.GetWebhooks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("Failed to delete webhook")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TOKENS
+////////////////////////////////////////////////////////////////////////////////
+func TestTokens(t *testing.T) {
+	token := core.Token{Name: "ci", Hash: "abc123", Scopes: []string{"read-only", "routes-only"}}
+	if err := database.SetToken(token); err != nil {
+		t.Errorf("Failed to SET token - %s", err)
+	}
+
+	tokens, err := database.GetTokens()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(tokens) != 1 || tokens[0].Hash != "abc123" || len(tokens[0].Scopes) != 2 {
+		t.Errorf("Read token differs from written token - %v", tokens)
+	}
+
+	if err := database.DeleteToken(token.Name); err != nil {
+		t.Errorf("Failed to DELETE token - %s", err)
+	}
+	if err := database.DeleteToken(token.Name); err != database.NoTokenError {
+		t.Errorf("Expected NoTokenError, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// AUDIT
+////////////////////////////////////////////////////////////////////////////////
+func TestAudit(t *testing.T) {
+	then := time.Now().UTC().Add(-time.Hour)
+	records := []core.AuditRecord{
+		{Id: "0001", Time: then, Action: "set-route", Resource: "route", After: json.RawMessage(`{"domain":"portal.test"}`)},
+		{Id: "0002", Time: then.Add(time.Minute), Action: "delete-vip", Resource: "vip", Before: json.RawMessage(`{"ip":"192.168.0.100"}`)},
+		{Id: "0003", Time: then.Add(2 * time.Minute), Action: "delete-route", Resource: "route"},
+	}
+	for i := range records {
+		if err := database.AddAudit(records[i]); err != nil {
+			t.Errorf("Failed to ADD audit record - %s", err)
+		}
+	}
+
+	audit, err := database.GetAudit(time.Time{}, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(audit) != 3 || audit[0].Id != "0001" || audit[0].Before != nil {
+		t.Fatalf("Read audit differs from written audit - %v", audit)
+	}
+	var route core.Route
+	if err = json.Unmarshal(audit[0].After, &route); err != nil || route.Domain != "portal.test" {
+		t.Errorf("Read audit differs from written audit - %q", audit[0].After)
+	}
+
+	audit, err = database.GetAudit(then.Add(30*time.Second), "route")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(audit) != 1 || audit[0].Id != "0003" {
+		t.Errorf("Failed to filter audit - %v", audit)
+	}
+
+	if err = database.DeleteAudit(2); err != nil {
+		t.Errorf("Failed to DELETE audit records - %s", err)
+	}
+	audit, _ = database.GetAudit(time.Time{}, "")
+	if len(audit) != 2 || audit[0].Id != "0002" {
+		t.Errorf("Failed to trim audit - %v", audit)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// REVISIONS
+////////////////////////////////////////////////////////////////////////////////
+func TestRevisions(t *testing.T) {
+	manifest := &core.Manifest{Routes: []core.Route{{Domain: "portal.test"}}}
+	if _, err := database.GetLastRevision(); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "set-routes", Manifest: manifest})
+		if err != nil || number != i {
+			t.Fatalf("Failed to ADD revision %d - %d %v", i, number, err)
+		}
+	}
+
+	revs, err := database.GetRevisions()
+	if err != nil || len(revs) != 3 || revs[0].Number != 1 || revs[2].Number != 3 {
+		t.Fatalf("Read revisions differ from written revisions - %v %v", revs, err)
+	}
+	rev, err := database.GetRevision(2)
+	if err != nil || rev.Action != "set-routes" || rev.Manifest == nil || len(rev.Routes) != 1 || rev.Routes[0].Domain != "portal.test" {
+		t.Errorf("Read revision differs from written revision - %v %v", rev, err)
+	}
+	if _, err = database.GetRevision(4); err != database.NoRevisionError {
+		t.Errorf("Expected NoRevisionError, got %v", err)
+	}
+	if last, err := database.GetLastRevision(); err != nil || last.Number != 3 || last.Action != "set-routes" {
+		t.Errorf("Read last revision differs from written revision - %v %v", last, err)
+	}
+
+	// numbering continues after the oldest are removed
+	if err = database.DeleteRevisions(3); err != nil {
+		t.Errorf("Failed to DELETE revisions - %s", err)
+	}
+	revs, err = database.GetRevisions()
+	if err != nil || len(revs) != 1 || revs[0].Number != 3 {
+		t.Errorf("Failed to DELETE revisions - %v %v", revs, err)
+	}
+	if number, err := database.AddRevision(core.Revision{Time: time.Now().UTC(), Action: "batch", Manifest: manifest}); err != nil || number != 4 {
+		t.Errorf("Failed to ADD revision - %d %v", number, err)
+	}
+}
+
 func toJson(v interface{}) ([]byte, error) {
 	jsonified, err := json.MarshalIndent(v, "", "\t")
 	if err != nil {
@@ -33,6 +33,7 @@
 //    set-service    Set service
 //    add-server     Add server to a service
 //    remove-server  Remove server from a service
+//    drain-server   Drain and remove server from a service
 //    show-server    Show server on a service
 //    show-servers   Show all servers on a service
 //    set-servers    Set server list on a service
@@ -44,27 +45,54 @@
 //    set-certs      Set cert list
 //    show-certs     Show all certs
 //    remove-cert    Remove cert
+//    apply          Apply a manifest (yaml or json) of services, routes, certs, and vips
+//    backup         Save a snapshot of the services, routes, certs, vips, and error pages
+//    restore        Restore a snapshot saved with backup
+//    add-webhook    Add (or update) webhook
+//    show-webhooks  Show all webhooks
+//    remove-webhook Remove webhook
+//    add-token      Add (or replace) named api token
+//    show-tokens    Show all named api tokens
+//    remove-token   Remove named api token
+//    cluster-status Show cluster members, marking those whose config has drifted
+//    db             Manage portal's database (migrate, status, import)
 //
 //  Flags:
+//        --acme-ca="": CA cert to trust for the ACME directory (for test servers like pebble)
+//        --acme-directory="": ACME directory to obtain route certs from (https://acme-v02.api.letsencrypt.org/directory) (blank disables)
+//        --acme-email="": Contact email for the ACME account
 //    -C, --api-cert="": SSL cert for the api
+//        --api-client-ca="": CA cert to require and verify api client certs with (blank disables)
 //    -H, --api-host="127.0.0.1": Listen address for the API
 //    -k, --api-key="": SSL key for the api
 //    -p, --api-key-password="": Password for the SSL key
 //    -P, --api-port="8443": Listen address for the API
 //    -t, --api-token="": Token for API Access
+//        --audit-keep=0: Number of audit records to keep in the database (0 keeps all)
 //    -b, --balancer="lvs": Load balancer to use (nginx|lvs)
-//    -r, --cluster-connection="none://": Cluster connection string (redis://127.0.0.1:6379)
+//        --client-cert="": SSL cert to present to the api (client)
+//        --client-key="": SSL key for the client cert (client)
+//        --cluster-ca="": CA cert to verify raft members' api certs with (blank trusts only a shared api-cert)
+//    -r, --cluster-connection="none://": Cluster connection string (redis://127.0.0.1:6379, etcd://127.0.0.1:2379, raft://, or raft://member:8443 to join)
+//        --cluster-degraded[=false]: Keep serving the last config while redis or etcd is unreachable, rejecting changes (rather than exiting)
 //    -T, --cluster-token="": Cluster security token
 //    -c, --conf="": Configuration file to load
 //    -d, --db-connection="scribble:///var/db/portal": Database connection string
+//        --drain-timeout=60: Seconds to wait for connections to finish when draining a server
+//        --health-interval=10: Seconds between server health checks
 //    -i, --insecure[=false]: Disable tls key checking (client) and listen on http (server)
 //    -j, --just-proxy[=false]: Proxy only (no tcp/udp load balancing)
 //    -L, --log-file="": Log file to write to
 //    -l, --log-level="INFO": Log level to output
+//        --proxy="nanobox": Proxy to route with (nanobox|nginx|haproxy)
 //    -x, --proxy-http="0.0.0.0:80": Address to listen on for proxying http
 //    -X, --proxy-tls="0.0.0.0:443": Address to listen on for proxying https
+//        --revision-keep=100: Number of config revisions to keep in the database (0 keeps all)
 //    -s, --server[=false]: Run in server mode
+//        --snapshot-interval=0: Seconds between config snapshots written to <work-dir>/snapshots (0 disables)
+//        --snapshot-keep=24: Number of config snapshots to keep
 //    -v, --version[=false]: Print version info and exit
+//        --vip-priority=0: This member's priority to own vips when clustered with redis, etcd, or raft (higher wins)
 //    -w, --work-dir="/var/db/portal": Directory for portal to use (balancer config)
 //
 //  Use "portal [command] --help" for more information about a command.
@@ -0,0 +1,236 @@
+// metrics collects portal's internal counters and latencies, along with
+// statistics gathered from the balancer and proxy, and exposes them in the
+// prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefBuckets are the default latency buckets (in seconds)
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	registry     = []metric{}
+	registryLock = &sync.Mutex{}
+)
+
+type (
+	metric interface {
+		write(w io.Writer)
+	}
+
+	// Sample is a collected value and its label values
+	Sample struct {
+		Labels []string
+		Value  float64
+	}
+
+	// Counter is a value that only goes up, partitioned by label values
+	Counter struct {
+		name   string
+		help   string
+		labels []string
+		values map[string]*Sample
+		lock   sync.Mutex
+	}
+
+	// Histogram counts observations (latencies) in buckets, partitioned by
+	// label values
+	Histogram struct {
+		name    string
+		help    string
+		labels  []string
+		buckets []float64
+		values  map[string]*observations
+		lock    sync.Mutex
+	}
+
+	observations struct {
+		labels []string
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+
+	// counterFunc is a counter whose values are collected when written
+	counterFunc struct {
+		name    string
+		help    string
+		labels  []string
+		collect func() []Sample
+	}
+
+	// gaugeFunc is a gauge whose values are collected when written
+	gaugeFunc struct {
+		counterFunc
+	}
+)
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]*Sample)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the label values by 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the label values by v
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &Sample{Labels: labelValues}
+		c.values[key] = s
+	}
+	s.Value += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.lock.Unlock()
+
+	writeSamples(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// NewHistogram creates and registers a histogram
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*observations)}
+	register(h)
+	return h
+}
+
+// Observe records v for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	o, ok := h.values[key]
+	if !ok {
+		o = &observations{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = o
+	}
+	for i := range h.buckets {
+		if v <= h.buckets[i] {
+			o.counts[i]++
+		}
+	}
+	o.count++
+	o.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		o := h.values[k]
+		for i := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, append(append([]string{}, o.labels...), formatFloat(h.buckets[i]))), o.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, append(append([]string{}, o.labels...), "+Inf")), o.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, o.labels), formatFloat(o.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, o.labels), o.count)
+	}
+}
+
+// NewCounterFunc registers a counter whose values are collected by calling
+// collect each time metrics are written (eg. kernel counters)
+func NewCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	register(&counterFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (c *counterFunc) write(w io.Writer) {
+	writeSamples(w, c.name, c.help, "counter", c.labels, c.collect())
+}
+
+// NewGaugeFunc registers a gauge whose values are collected by calling collect
+// each time metrics are written (eg. cert expiry)
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	register(&gaugeFunc{counterFunc{name: name, help: help, labels: labels, collect: collect}})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeSamples(w, g.name, g.help, "gauge", g.labels, g.collect())
+}
+
+// Write writes all registered metrics to w in the prometheus text format
+func Write(w io.Writer) error {
+	registryLock.Lock()
+	metrics := append([]metric{}, registry...)
+	registryLock.Unlock()
+
+	var b bytes.Buffer
+	for i := range metrics {
+		metrics[i].write(&b)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func register(m metric) {
+	registryLock.Lock()
+	registry = append(registry, m)
+	registryLock.Unlock()
+}
+
+func writeSamples(w io.Writer, name, help, kind string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for i := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(labels, samples[i].Labels), formatFloat(samples[i].Value))
+	}
+}
+
+// labelString formats labels as `{name="value",...}`
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nanopack/portal/metrics"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// METRICS
+////////////////////////////////////////////////////////////////////////////////
+func TestCounter(t *testing.T) {
+	c := metrics.NewCounter("test_requests_total", "Test requests.", "method", "code")
+	c.Inc("GET", "200")
+	c.Inc("GET", "200")
+	c.Add(3, "POST", "500")
+
+	out := write(t)
+	expect(t, out, "# HELP test_requests_total Test requests.")
+	expect(t, out, "# TYPE test_requests_total counter")
+	expect(t, out, `test_requests_total{method="GET",code="200"} 2`)
+	expect(t, out, `test_requests_total{method="POST",code="500"} 3`)
+}
+
+func TestHistogram(t *testing.T) {
+	h := metrics.NewHistogram("test_duration_seconds", "Test durations.", []float64{.1, 1}, "route")
+	h.Observe(.05, "a.com")
+	h.Observe(.5, "a.com")
+	h.Observe(5, "a.com")
+
+	out := write(t)
+	expect(t, out, "# TYPE test_duration_seconds histogram")
+	expect(t, out, `test_duration_seconds_bucket{route="a.com",le="0.1"} 1`)
+	expect(t, out, `test_duration_seconds_bucket{route="a.com",le="1"} 2`)
+	expect(t, out, `test_duration_seconds_bucket{route="a.com",le="+Inf"} 3`)
+	expect(t, out, `test_duration_seconds_sum{route="a.com"} 5.55`)
+	expect(t, out, `test_duration_seconds_count{route="a.com"} 3`)
+}
+
+func TestCounterFunc(t *testing.T) {
+	metrics.NewCounterFunc("test_bytes_total", "Test bytes.", []string{"service"}, func() []metrics.Sample {
+		return []metrics.Sample{
+			{Labels: []string{"tcp-192_168_0_1-80"}, Value: 1200},
+			{Labels: []string{`quote"d`}, Value: 1},
+		}
+	})
+
+	out := write(t)
+	expect(t, out, `test_bytes_total{service="tcp-192_168_0_1-80"} 1200`)
+	expect(t, out, `test_bytes_total{service="quote\"d"} 1`)
+}
+
+func TestGaugeFunc(t *testing.T) {
+	metrics.NewGaugeFunc("test_expiry_timestamp_seconds", "Test expiry.", []string{"subject"}, func() []metrics.Sample {
+		return []metrics.Sample{{Labels: []string{"myapp.com"}, Value: 1500000001}}
+	})
+
+	out := write(t)
+	expect(t, out, "# TYPE test_expiry_timestamp_seconds gauge")
+	expect(t, out, `test_expiry_timestamp_seconds{subject="myapp.com"} 1.500000001e+09`)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+func write(t *testing.T) string {
+	var b bytes.Buffer
+	if err := metrics.Write(&b); err != nil {
+		t.Fatalf("Failed to write metrics - %s", err)
+	}
+	return b.String()
+}
+
+func expect(t *testing.T, out, line string) {
+	if !strings.Contains(out, line+"\n") {
+		t.Errorf("Missing line '%s' in:\n%s", line, out)
+	}
+}
@@ -0,0 +1,74 @@
+package proxymgr
+
+import (
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/metrics"
+)
+
+var (
+	// ExpiryWarning is how long before a cert expires to start logging warnings
+	ExpiryWarning = 30 * 24 * time.Hour
+	// ExpiryInterval is the time between checks for expiring certs
+	ExpiryInterval = 12 * time.Hour
+)
+
+func init() {
+	metrics.NewGaugeFunc("portal_cert_expiry_timestamp_seconds",
+		"Time (unix) a cert expires.", []string{"subject", "fingerprint"}, collectExpiry)
+}
+
+// watchExpiry logs a warning for each cert expiring within ExpiryWarning,
+// shortly after starting and every ExpiryInterval
+func watchExpiry() {
+	// give the cluster a chance to load the stored certs
+	time.Sleep(time.Minute)
+	for {
+		checkExpiry()
+		time.Sleep(ExpiryInterval)
+	}
+}
+
+func checkExpiry() {
+	certs, err := GetCerts()
+	if err != nil {
+		config.Log.Error("Failed to check cert expiry - %s", err)
+		return
+	}
+	for i := range certs {
+		info, err := certs[i].Parse()
+		if err != nil {
+			config.Log.Warn("Failed to parse cert - %s", err)
+			continue
+		}
+		left := time.Until(info.NotAfter)
+		if left <= 0 {
+			config.Log.Warn("Cert '%s' (%v) expired %s", info.Subject, info.Sans, info.NotAfter.Format(time.RFC3339))
+		} else if left < ExpiryWarning {
+			config.Log.Warn("Cert '%s' (%v) expires in %d days", info.Subject, info.Sans, int(left.Hours()/24))
+		}
+	}
+}
+
+func collectExpiry() []metrics.Sample {
+	samples := []metrics.Sample{}
+	if Proxy == nil {
+		return samples
+	}
+	certs, err := GetCerts()
+	if err != nil {
+		return samples
+	}
+	for i := range certs {
+		info, err := certs[i].Parse()
+		if err != nil {
+			continue
+		}
+		samples = append(samples, metrics.Sample{
+			Labels: []string{info.Subject, info.Fingerprint},
+			Value:  float64(info.NotAfter.Unix()),
+		})
+	}
+	return samples
+}
@@ -0,0 +1,317 @@
+package proxymgr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nanopack/portal/core"
+)
+
+type (
+	// generator keeps the routes and certs of a proxy configured by generating
+	// its config file, regenerating it whenever they change. Changes are only
+	// kept if the config is regenerated (and reloaded) successfully.
+	generator struct {
+		routes []core.Route
+		certs  []core.CertBundle
+		lock   sync.Mutex
+		regen  func(routes []core.Route, certs []core.CertBundle) error
+	}
+
+	// host is a domain's routes (most specific path first) and cert, for
+	// generating configs
+	host struct {
+		Name   string // "admin.myapp.com" ("" matches any host)
+		Routes []core.Route
+		Cert   *core.CertBundle
+	}
+
+	// upstream is where a route's requests are proxied to
+	upstream struct {
+		Scheme  string   // "http" or "https"
+		Servers []string // "127.0.0.1:8080"
+		Path    string   // path replacing the route's path ("" forwards the path unchanged)
+	}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// ROUTES
+////////////////////////////////////////////////////////////////////////////////
+
+func (g *generator) SetRoute(route core.Route) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	routes := append([]core.Route{}, g.routes...)
+	updated := false
+	for i := range routes {
+		if sameRoute(routes[i], route) {
+			routes[i] = route
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		routes = append(routes, route)
+	}
+	return g.apply(routes, g.certs)
+}
+
+func (g *generator) SetRoutes(routes []core.Route) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.apply(append([]core.Route{}, routes...), g.certs)
+}
+
+func (g *generator) DeleteRoute(route core.Route) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	routes := []core.Route{}
+	for i := range g.routes {
+		if !sameRoute(g.routes[i], route) {
+			routes = append(routes, g.routes[i])
+		}
+	}
+	return g.apply(routes, g.certs)
+}
+
+func (g *generator) GetRoutes() ([]core.Route, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return append([]core.Route{}, g.routes...), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CERTS
+////////////////////////////////////////////////////////////////////////////////
+
+func (g *generator) SetCert(cert core.CertBundle) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	certs := append([]core.CertBundle{}, g.certs...)
+	updated := false
+	for i := range certs {
+		if certs[i].Same(cert) {
+			if certs[i].Key == cert.Key {
+				return nil
+			}
+			certs[i] = cert
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		certs = append(certs, cert)
+	}
+	return g.apply(g.routes, certs)
+}
+
+func (g *generator) SetCerts(certs []core.CertBundle) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.apply(g.routes, append([]core.CertBundle{}, certs...))
+}
+
+func (g *generator) DeleteCert(cert core.CertBundle) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	certs := []core.CertBundle{}
+	for i := range g.certs {
+		if g.certs[i].Cert != cert.Cert || g.certs[i].Key != cert.Key {
+			certs = append(certs, g.certs[i])
+		}
+	}
+	return g.apply(g.routes, certs)
+}
+
+func (g *generator) GetCerts() ([]core.CertBundle, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return append([]core.CertBundle{}, g.certs...), nil
+}
+
+// apply regenerates the config, keeping the routes and certs if successful
+func (g *generator) apply(routes []core.Route, certs []core.CertBundle) error {
+	if err := g.regen(routes, certs); err != nil {
+		return err
+	}
+	g.routes, g.certs = routes, certs
+	return nil
+}
+
+func sameRoute(a, b core.Route) bool {
+	return a.SubDomain == b.SubDomain && a.Domain == b.Domain && a.Path == b.Path
+}
+
+// hostsFor groups the routes by host, most specific host and path first.
+// Routes without a domain match any host, so they're added to every host
+// (unless it has a route for the same path) and to a catch-all host ("").
+func hostsFor(routes []core.Route, certs []core.CertBundle) []host {
+	byName := map[string]*host{}
+	anyHost := []core.Route{}
+	for i := range routes {
+		name := strings.ToLower(routeHost(routes[i]))
+		if routes[i].Domain == "" {
+			anyHost = append(anyHost, routes[i])
+			continue
+		}
+		if byName[name] == nil {
+			byName[name] = &host{Name: name}
+		}
+		byName[name].Routes = append(byName[name].Routes, routes[i])
+	}
+	if len(anyHost) != 0 {
+		byName[""] = &host{}
+	}
+
+	hosts := []host{}
+	for _, h := range byName {
+		for i := range anyHost {
+			if !hasPath(h.Routes, anyHost[i].Path) {
+				h.Routes = append(h.Routes, anyHost[i])
+			}
+		}
+		sort.SliceStable(h.Routes, func(i, j int) bool { return len(h.Routes[i].Path) > len(h.Routes[j].Path) })
+
+		for i := range certs {
+			if h.Name != "" && certs[i].Covers(h.Name) {
+				h.Cert = &certs[i]
+				break
+			}
+		}
+		hosts = append(hosts, *h)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		// catch-all last
+		if hosts[i].Name == "" || hosts[j].Name == "" {
+			return hosts[j].Name == ""
+		}
+		return hosts[i].Name < hosts[j].Name
+	})
+	return hosts
+}
+
+// upstreamFor parses the route's targets, returning nil if it has none
+func upstreamFor(route core.Route) (*upstream, error) {
+	if len(route.Targets) == 0 {
+		return nil, nil
+	}
+
+	up := &upstream{}
+	for i := range route.Targets {
+		target, err := url.Parse(route.Targets[i])
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("Bad target '%s'", route.Targets[i])
+		}
+		if i == 0 {
+			up.Scheme = target.Scheme
+			up.Path = strings.TrimSuffix(target.Path, "/") + route.FwdPath
+		}
+		addr := target.Host
+		if target.Port() == "" {
+			port := "80"
+			if target.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(target.Hostname(), port)
+		}
+		up.Servers = append(up.Servers, addr)
+	}
+	if up.Scheme != "https" {
+		up.Scheme = "http"
+	}
+	// keep the separator the route's path ends with
+	if up.Path != "" && strings.HasSuffix(routePath(route), "/") && !strings.HasSuffix(up.Path, "/") {
+		up.Path += "/"
+	}
+	return up, nil
+}
+
+// routePath is the path the route matches, defaulting to "/"
+func routePath(route core.Route) string {
+	if route.Path == "" {
+		return "/"
+	}
+	return route.Path
+}
+
+func hasPath(routes []core.Route, path string) bool {
+	for i := range routes {
+		if routes[i].Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFiles writes the files (pages, certs) a config references to dir
+func writeFiles(dir string, files map[string][]byte, perm os.FileMode) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFiles removes the files in dir no longer referenced (once the new
+// config is loaded)
+func pruneFiles(dir string, files map[string][]byte) {
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for i := range existing {
+		if _, ok := files[existing[i].Name()]; !ok {
+			os.Remove(filepath.Join(dir, existing[i].Name()))
+		}
+	}
+}
+
+// writeChecked writes the config, running check (if any) and restoring the old
+// config if it fails
+func writeChecked(file string, cfg []byte, check ...string) error {
+	old, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read config file - %s", err)
+	}
+
+	err = ioutil.WriteFile(file, cfg, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write config file - %s", err)
+	}
+	if len(check) == 0 {
+		return nil
+	}
+
+	out, err := exec.Command(check[0], check[1:]...).CombinedOutput()
+	if err != nil {
+		if old != nil {
+			ioutil.WriteFile(file, old, 0644)
+		} else {
+			os.Remove(file)
+		}
+		return fmt.Errorf("Bad config generated - %s", out)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// haproxy.go contains logic to generate an haproxy config for routes
+
+package proxymgr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+type (
+	// Haproxy generates an haproxy config (portal-haproxy.cfg) from a primer
+	// (global/defaults sections) and the routes, (re)starting haproxy with it
+	Haproxy struct {
+		generator
+		configFile string
+		pidFile    string
+		pageDir    string
+		certDir    string
+		primer     string
+	}
+
+	haproxyRule struct {
+		Host    string // "" matches any host
+		Path    string // "" matches any path
+		Backend string
+	}
+
+	haproxyBackend struct {
+		Name     string
+		Page     string // page file to serve
+		Rewrite  string // "^/admin(.*) /goadmin\1"
+		Check    *core.Route
+		Servers  []string
+		Tls      bool
+		Insecure bool
+	}
+)
+
+// haproxyPrimer is used when no primer (portal-haproxy-primer.cfg) exists
+var haproxyPrimer = `global
+	maxconn 4096
+
+defaults
+	mode http
+	timeout connect 5s
+	timeout client 60s
+	timeout server 60s
+`
+
+var haproxyConfig = template.Must(template.New("haproxyConfig").Parse(`{{ .Primer }}
+# CONFIG GENERATED BY PORTAL
+frontend portal_http
+	mode http
+	bind {{ .Http }}
+{{- template "rules" .Rules }}
+{{- if .Tls }}
+
+frontend portal_tls
+	mode http
+	bind {{ .Tls }} ssl crt {{ .CertDir }}
+{{- template "rules" .Rules }}
+{{- end }}
+{{- range .Backends }}
+
+backend {{ .Name }}
+	mode http
+{{- if .Page }}
+	http-request return status 200 content-type text/html file {{ .Page }}
+{{- else }}
+{{- with .Check }}
+	option httpchk
+	http-check send meth GET uri {{ .Endpoint }}{{ if .Host }} hdr Host {{ .Host }}{{ end }}
+	http-check expect status {{ if .ExpectedCode }}{{ .ExpectedCode }}{{ else }}200{{ end }}
+{{- end }}
+{{- if .Rewrite }}
+	http-request replace-path {{ .Rewrite }}
+{{- end }}
+{{- $backend := . }}
+{{- range $i, $server := .Servers }}
+	server s{{ $i }} {{ $server }}{{ if $backend.Tls }} ssl{{ if $backend.Insecure }} verify none{{ else }} ca-file @system-ca{{ end }}{{ end }}{{ if $backend.Check }} check{{ end }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{ define "rules" }}
+{{- range . }}
+	use_backend {{ .Backend }}{{ if or .Host .Path }} if{{ end }}{{ if .Host }} { hdr(host),field(1,:) -i {{ .Host }} }{{ end }}{{ if .Path }} { path_beg {{ .Path }} }{{ end }}
+{{- end }}
+{{- end }}`))
+
+func (self *Haproxy) Init() error {
+	// ensure config location exists
+	err := os.MkdirAll(config.WorkDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create working directory - %s", err)
+	}
+	self.configFile = path.Join(config.WorkDir, "portal-haproxy.cfg")
+	self.pidFile = path.Join(config.WorkDir, "portal-haproxy.pid")
+	self.pageDir = path.Join(config.WorkDir, "haproxy-pages")
+	self.certDir = path.Join(config.WorkDir, "haproxy-certs")
+	self.regen = self.regenerload
+
+	// read primer config file (if any)
+	self.primer = haproxyPrimer
+	primer, err := ioutil.ReadFile(path.Join(config.WorkDir, "portal-haproxy-primer.cfg"))
+	if err == nil {
+		self.primer = string(primer)
+	}
+
+	err = self.regenerload(nil, nil)
+	if err != nil {
+		return err
+	}
+	config.Log.Info("Proxy (haproxy) listening at http://%s...", config.RouteHttp)
+
+	return nil
+}
+
+// regenerload regenerates the haproxy config, checks it, and starts a new
+// haproxy with it, gracefully finishing the old one's connections
+func (self *Haproxy) regenerload(routes []core.Route, certs []core.CertBundle) error {
+	data := struct {
+		Primer, Http, Tls, CertDir string
+		Rules                      []haproxyRule
+		Backends                   []haproxyBackend
+	}{Primer: self.primer, Http: config.RouteHttp, CertDir: self.certDir}
+	pages := map[string][]byte{}
+	keys := map[string][]byte{}
+
+	// haproxy picks the cert by sni from all in the directory
+	for i := range certs {
+		name := fmt.Sprintf("%x.pem", sha256.Sum256([]byte(certs[i].Cert)))
+		keys[name] = []byte(strings.TrimSpace(certs[i].Cert) + "\n" + strings.TrimSpace(certs[i].Key) + "\n")
+	}
+	if len(keys) != 0 {
+		data.Tls = config.RouteTls
+	}
+
+	for _, h := range hostsFor(routes, certs) {
+		for _, route := range h.Routes {
+			backend := haproxyBackend{Name: fmt.Sprintf("portal_%d", len(data.Backends)), Insecure: config.ProxyIgnore}
+			rule := haproxyRule{Host: h.Name, Backend: backend.Name}
+			if route.Path != "" && route.Path != "/" {
+				rule.Path = route.Path
+			}
+
+			up, err := upstreamFor(route)
+			if err != nil {
+				return err
+			}
+			switch {
+			case route.Page != "":
+				name := fmt.Sprintf("%x.html", sha256.Sum256([]byte(route.Page)))
+				pages[name] = []byte(route.Page)
+				backend.Page = path.Join(self.pageDir, name)
+			case up != nil:
+				backend.Servers = up.Servers
+				backend.Tls = up.Scheme == "https"
+				if up.Path != "" {
+					backend.Rewrite = fmt.Sprintf("^%s(.*) %s\\1", regexp.QuoteMeta(routePath(route)), up.Path)
+				}
+				if route.Endpoint != "" {
+					check := route
+					backend.Check = &check
+				}
+			}
+			// without targets or a page, there are no servers to route to (503)
+
+			data.Rules = append(data.Rules, rule)
+			data.Backends = append(data.Backends, backend)
+		}
+	}
+
+	if err := writeFiles(self.pageDir, pages, 0644); err != nil {
+		return fmt.Errorf("Failed to write pages - %s", err)
+	}
+	if err := writeFiles(self.certDir, keys, 0600); err != nil {
+		return fmt.Errorf("Failed to write certs - %s", err)
+	}
+
+	var cfg bytes.Buffer
+	if err := haproxyConfig.Execute(&cfg, data); err != nil {
+		return fmt.Errorf("Failed to generate config file - %s", err)
+	}
+	config.Log.Trace("Regenerating haproxy config - %d routes, %d certs", len(routes), len(certs))
+
+	if err := writeChecked(self.configFile, cfg.Bytes(), "haproxy", "-c", "-q", "-f", self.configFile); err != nil {
+		return err
+	}
+
+	// start a new haproxy, telling the old one (if any) to finish and exit
+	args := []string{"-D", "-f", self.configFile, "-p", self.pidFile}
+	if pids, err := ioutil.ReadFile(self.pidFile); err == nil && len(strings.Fields(string(pids))) != 0 {
+		args = append(append(args, "-sf"), strings.Fields(string(pids))...)
+	}
+	out, err := exec.Command("haproxy", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to reload haproxy - %s", out)
+	}
+
+	pruneFiles(self.pageDir, pages)
+	pruneFiles(self.certDir, keys)
+	return nil
+}
@@ -0,0 +1,46 @@
+package proxymgr_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/proxymgr"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// HAPROXY
+////////////////////////////////////////////////////////////////////////////////
+func TestHaproxy(t *testing.T) {
+	dir := fakeBins(t, "haproxy")
+	defer os.RemoveAll(dir)
+
+	haproxy := &proxymgr.Haproxy{}
+	if err := haproxy.Init(); err != nil {
+		t.Fatalf("Failed to init haproxy - %s", err)
+	}
+	cfg := read(t, filepath.Join(dir, "portal-haproxy.cfg"))
+	expect(t, cfg, "defaults\n\tmode http")
+	if strings.Contains(cfg, "frontend portal_tls") {
+		t.Errorf("Unexpected tls frontend without certs in:\n%s", cfg)
+	}
+
+	if err := haproxy.SetRoutes(genRoutes); err != nil {
+		t.Fatalf("Failed to SET routes - %s", err)
+	}
+	if err := haproxy.SetCert(core.CertBundle{Cert: sanCert, Key: sanKey}); err != nil {
+		t.Fatalf("Failed to SET cert - %s", err)
+	}
+
+	cfg = read(t, filepath.Join(dir, "portal-haproxy.cfg"))
+	expect(t, cfg, "use_backend portal_1 if { hdr(host),field(1,:) -i admin.portal.test } { path_beg /admin }")
+	expect(t, cfg, "use_backend portal_4 if { path_beg /health }")
+	expect(t, cfg, "bind 0.0.0.0:9446 ssl crt "+filepath.Join(dir, "haproxy-certs"))
+	expect(t, cfg, "backend portal_1\n\tmode http\n\thttp-request replace-path ^/admin(.*) /app/go\\1\n\tserver s0 127.0.0.1:8080\n")
+	expect(t, cfg, "http-request return status 200 content-type text/html file "+filepath.Join(dir, "haproxy-pages"))
+	expect(t, cfg, "http-check send meth GET uri /ping")
+	expect(t, cfg, "server s0 10.0.0.1:443 ssl ca-file @system-ca check")
+	expect(t, read(t, filepath.Join(dir, "haproxy.log")), "-c -q -f "+filepath.Join(dir, "portal-haproxy.cfg"))
+}
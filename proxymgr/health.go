@@ -0,0 +1,150 @@
+// health.go checks the targets of routes with an endpoint, reporting when they
+// become unhealthy or recover
+
+package proxymgr
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+var (
+	// TargetHealthChanged, if set (before Init), is called when a route's
+	// target becomes unhealthy or recovers (with its new health). Targets are
+	// only checked by portal when it's set.
+	TargetHealthChanged func(route core.Route, target, health string)
+	// TargetHealthWanted, if set, is asked before each round of checks. The
+	// round is skipped when it returns false (nothing wants the changes).
+	TargetHealthWanted func() bool
+	// TargetInterval is how often route targets are checked
+	TargetInterval = 20 * time.Second
+
+	// target health, keyed by route and target
+	targetChecks = map[string]*targetCheck{}
+	targetLock   sync.Mutex
+	targetWatch  sync.Once
+)
+
+type (
+	targetCheck struct {
+		state string
+		fails int
+	}
+)
+
+// CheckTarget performs the route's health check on the target once,
+// returning an error if the target is not healthy
+func CheckTarget(route core.Route, target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Bad target '%s'", target)
+	}
+
+	return core.HttpCheck{
+		Url:            fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, route.Endpoint),
+		Host:           route.Host,
+		ExpectedCode:   route.ExpectedCode,
+		ExpectedHeader: route.ExpectedHeader,
+		ExpectedBody:   route.ExpectedBody,
+		Timeout:        time.Duration(route.Timeout) * time.Millisecond,
+		Insecure:       config.ProxyIgnore,
+	}.Check()
+}
+
+// watchTargets checks the routes' targets every TargetInterval
+func watchTargets() {
+	for range time.Tick(TargetInterval) {
+		if TargetHealthWanted != nil && !TargetHealthWanted() {
+			// start over once wanted again
+			targetLock.Lock()
+			targetChecks = map[string]*targetCheck{}
+			targetLock.Unlock()
+			continue
+		}
+		routes, err := GetRoutes()
+		if err != nil {
+			config.Log.Error("Failed to get routes to check - %s", err)
+			continue
+		}
+		checkTargets(routes)
+	}
+}
+
+// checkTargets runs all the routes' checks concurrently and records the results
+func checkTargets(routes []core.Route) {
+	type result struct {
+		key    string
+		route  core.Route
+		target string
+		err    error
+	}
+
+	pending := []result{}
+	for i := range routes {
+		if routes[i].Endpoint == "" {
+			continue
+		}
+		for _, target := range routes[i].Targets {
+			key := fmt.Sprintf("%s.%s%s %s", routes[i].SubDomain, routes[i].Domain, routes[i].Path, target)
+			pending = append(pending, result{key: key, route: routes[i], target: target})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range pending {
+		wg.Add(1)
+		go func(r *result) {
+			defer wg.Done()
+			r.err = CheckTarget(r.route, r.target)
+		}(&pending[i])
+	}
+	wg.Wait()
+
+	targetLock.Lock()
+	old := targetChecks
+	targetChecks = map[string]*targetCheck{}
+	changed := []result{}
+	for _, r := range pending {
+		c := old[r.key]
+		if c == nil {
+			c = &targetCheck{}
+		}
+		targetChecks[r.key] = c
+
+		attempts := r.route.Attempts
+		if attempts == 0 {
+			attempts = 3
+		}
+		prev := c.state
+		if r.err != nil {
+			config.Log.Trace("Health check failed for '%s' - %s", r.key, r.err)
+			c.fails++
+			if c.fails >= attempts {
+				c.state = "unhealthy"
+			}
+		} else {
+			c.fails = 0
+			c.state = "healthy"
+		}
+		// only report targets that were or become unhealthy
+		if c.state != prev && (c.state == "unhealthy" || prev == "unhealthy") {
+			changed = append(changed, r)
+		}
+	}
+	targetLock.Unlock()
+
+	for _, r := range changed {
+		if r.err != nil {
+			config.Log.Warn("Target '%s' is unhealthy - %s", r.key, r.err)
+			TargetHealthChanged(r.route, r.target, "unhealthy")
+		} else {
+			config.Log.Info("Target '%s' recovered", r.key)
+			TargetHealthChanged(r.route, r.target, "healthy")
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package proxymgr_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/proxymgr"
+)
+
+func TestCheckTarget(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ping" || req.Host != "portal.test" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("X-Health", "ok")
+		fmt.Fprint(rw, "pong")
+	}))
+	defer ts.Close()
+
+	route := core.Route{Host: "portal.test", Endpoint: "/ping", ExpectedHeader: "X-Health: ok", ExpectedBody: "pong"}
+	if err := proxymgr.CheckTarget(route, ts.URL+"/app"); err != nil {
+		t.Errorf("Failed healthy check - %s", err)
+	}
+
+	bad := []core.Route{
+		{Host: "portal.test", Endpoint: "/nope"},
+		{Host: "portal.test", Endpoint: "/nope", ExpectedCode: 200},
+		{Host: "portal.test", Endpoint: "/ping", ExpectedHeader: "X-Health: bad"},
+		{Host: "portal.test", Endpoint: "/ping", ExpectedBody: "ping"},
+		{Host: "other.test", Endpoint: "/ping"},
+	}
+	for i := range bad {
+		if err := proxymgr.CheckTarget(bad[i], ts.URL); err == nil {
+			t.Errorf("Expected check %d to fail", i)
+		}
+	}
+
+	if err := proxymgr.CheckTarget(core.Route{Endpoint: "/ping", ExpectedCode: 404}, ts.URL); err != nil {
+		t.Errorf("Failed expected code check - %s", err)
+	}
+}
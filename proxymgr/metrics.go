@@ -0,0 +1,140 @@
+package proxymgr
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/metrics"
+)
+
+var (
+	proxyRequests = metrics.NewCounter("portal_proxy_requests_total",
+		"Requests proxied to a route's targets.", "route", "code")
+	proxyDuration = metrics.NewHistogram("portal_proxy_request_duration_seconds",
+		"Time taken for a route's targets to respond.", metrics.DefBuckets, "route")
+
+	// the routes proxying to each target (host:port), updated as routes change
+	routeIndex     = map[string][]indexedRoute{}
+	routeIndexLock = &sync.RWMutex{}
+)
+
+type (
+	// proxyTransport records metrics for requests made to route targets
+	proxyTransport struct {
+		next http.RoundTripper
+	}
+
+	indexedRoute struct {
+		host string // "subdomain.domain"
+		name string // "subdomain.domain/path"
+	}
+)
+
+// instrumentProxy wraps http.DefaultTransport (nanobox-router proxies with it,
+// having no transport of its own) so requests to route targets are counted and
+// timed. Only requests the router received are recorded, the rest (api
+// clients, health checks, webhooks) pass straight through.
+func instrumentProxy() {
+	if _, ok := http.DefaultTransport.(*proxyTransport); ok {
+		return
+	}
+	http.DefaultTransport = &proxyTransport{next: http.DefaultTransport}
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !proxied(req) {
+		return t.next.RoundTrip(req)
+	}
+	route := routeFor(req)
+	if route == "" {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	proxyDuration.Observe(time.Since(start).Seconds(), route)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	proxyRequests.Inc(route, code)
+
+	return res, err
+}
+
+// proxied reports whether the request is being proxied by the router, ie. it
+// was made while serving a request received on the proxy's http or tls address
+// (the proxied request keeps the received one's context)
+func proxied(req *http.Request) bool {
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	_, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	for _, addr := range []string{config.RouteHttp, config.RouteTls} {
+		if _, p, err := net.SplitHostPort(addr); err == nil && p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// indexRoutes replaces the route index with the routes
+func indexRoutes(routes []core.Route) {
+	index := map[string][]indexedRoute{}
+	for i := range routes {
+		for j := range routes[i].Targets {
+			target, err := url.Parse(routes[i].Targets[j])
+			if err != nil {
+				continue
+			}
+			index[target.Host] = append(index[target.Host], indexedRoute{host: routeHost(routes[i]), name: routeName(routes[i])})
+		}
+	}
+
+	routeIndexLock.Lock()
+	routeIndex = index
+	routeIndexLock.Unlock()
+}
+
+// routeFor returns the name ("subdomain.domain/path") of the route the request
+// targets, or "" if it isn't a proxied request
+func routeFor(req *http.Request) string {
+	routeIndexLock.RLock()
+	routes := routeIndex[req.URL.Host]
+	routeIndexLock.RUnlock()
+	if len(routes) == 0 {
+		return ""
+	}
+
+	// the request's host distinguishes routes sharing targets
+	host := strings.Split(req.Host, ":")[0]
+	for i := range routes {
+		if routes[i].host == host {
+			return routes[i].name
+		}
+	}
+	return routes[len(routes)-1].name
+}
+
+func routeHost(route core.Route) string {
+	if route.SubDomain == "" {
+		return route.Domain
+	}
+	return route.SubDomain + "." + route.Domain
+}
+
+func routeName(route core.Route) string {
+	return routeHost(route) + route.Path
+}
@@ -0,0 +1,51 @@
+package proxymgr_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/metrics"
+	"github.com/nanopack/portal/proxymgr"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// METRICS
+////////////////////////////////////////////////////////////////////////////////
+func TestProxyMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+	defer target.Close()
+
+	route := core.Route{SubDomain: "metrics", Domain: "portal.test", Path: "/", Targets: []string{target.URL}}
+	if err := proxymgr.SetRoutes([]core.Route{route}); err != nil {
+		t.Fatalf("Failed to SET routes - %s", err)
+	}
+	defer proxymgr.SetRoutes([]core.Route{})
+
+	// received by the proxy (listening on 9083)
+	proxied := context.WithValue(context.Background(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4zero, Port: 9083})
+	for _, ctx := range []context.Context{proxied, context.Background()} {
+		req, _ := http.NewRequestWithContext(ctx, "GET", target.URL, nil)
+		req.Host = "metrics.portal.test"
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Failed to request target - %s", err)
+		}
+		res.Body.Close()
+	}
+
+	// only the proxied request is counted
+	var b bytes.Buffer
+	metrics.Write(&b)
+	line := `portal_proxy_requests_total{route="metrics.portal.test/",code="418"} 1` + "\n"
+	if !strings.Contains(b.String(), line) {
+		t.Errorf("Missing line '%s' in:\n%s", line, b.String())
+	}
+}
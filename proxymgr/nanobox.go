@@ -21,6 +21,9 @@ func (self Nanobox) Init() error {
 	// configure upstream cert checks
 	router.IgnoreUpstreamCerts = config.ProxyIgnore
 
+	// record per route request metrics
+	instrumentProxy()
+
 	// start http proxy
 	err := router.StartHTTP(config.RouteHttp)
 	if err != nil {
@@ -77,7 +80,12 @@ func (self Nanobox) DeleteRoute(route core.Route) error {
 }
 
 func (self Nanobox) SetRoutes(routes []core.Route) error {
-	return router.UpdateRoutes(self.rToRoutes(routes))
+	err := router.UpdateRoutes(self.rToRoutes(routes))
+	if err != nil {
+		return err
+	}
+	indexRoutes(routes)
+	return nil
 }
 
 func (self Nanobox) GetRoutes() ([]core.Route, error) {
@@ -96,6 +104,10 @@ func (self Nanobox) SetCert(cert core.CertBundle) error {
 			config.Log.Debug("Cert already added, skipping")
 			return nil
 		}
+		if (core.CertBundle{Cert: certs[i].Cert}).Same(cert) {
+			certs[i] = self.cToKey(cert)
+			return self.SetCerts(self.keysToC(certs))
+		}
 	}
 
 	certs = append(certs, self.cToKey(cert))
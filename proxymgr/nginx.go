@@ -0,0 +1,178 @@
+// nginx.go contains logic to generate an nginx http{} config for routes
+
+package proxymgr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"text/template"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
+
+type (
+	// Nginx generates a config of upstreams and servers (portal-nginx-http.conf)
+	// to be included in nginx's http{} block, reloading nginx when it changes
+	Nginx struct {
+		generator
+		configFile string
+		pageDir    string
+		certDir    string
+	}
+
+	nginxServer struct {
+		Name      string // server_name
+		Cert      string // cert file (tls only)
+		Key       string // key file (tls only)
+		Locations []nginxLocation
+	}
+
+	nginxLocation struct {
+		Path      string
+		Page      string // page file to serve
+		ProxyPass string // "http://portal_0/goadmin"
+	}
+
+	nginxUpstream struct {
+		Name    string
+		Servers []string
+	}
+)
+
+var nginxHttpConfig = template.Must(template.New("nginxHttpConfig").Parse(`# CONFIG GENERATED BY PORTAL
+# include in nginx's http{} block
+{{- range .Upstreams }}
+
+upstream {{ .Name }} {
+{{- range .Servers }}
+	server {{ . }};
+{{- end }}
+}
+{{- end }}
+{{- range .Servers }}
+
+server {
+	listen {{ $.Http }};
+{{- if .Cert }}
+	listen {{ $.Tls }} ssl;
+	ssl_certificate     {{ .Cert }};
+	ssl_certificate_key {{ .Key }};
+{{- end }}
+	server_name {{ .Name }};
+{{- range .Locations }}
+
+	location {{ .Path }} {
+{{- if .Page }}
+		default_type text/html;
+		root {{ $.PageDir }};
+		try_files /{{ .Page }} =404;
+{{- else if .ProxyPass }}
+		proxy_pass {{ .ProxyPass }};
+		proxy_set_header Host $host;
+		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+		proxy_set_header X-Forwarded-Proto $scheme;
+{{- else }}
+		return 502;
+{{- end }}
+	}
+{{- end }}
+}
+{{- end }}
+`))
+
+func (self *Nginx) Init() error {
+	// ensure config location exists
+	err := os.MkdirAll(config.WorkDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create working directory - %s", err)
+	}
+	self.configFile = path.Join(config.WorkDir, "portal-nginx-http.conf")
+	self.pageDir = path.Join(config.WorkDir, "nginx-pages")
+	self.certDir = path.Join(config.WorkDir, "nginx-certs")
+	self.regen = self.regenerload
+
+	// reload nginx - don't return (in the event nginx is not running before portal)
+	if err = self.regenerload(nil, nil); err != nil {
+		config.Log.Error("Failed to load nginx config - %s", err)
+	}
+	config.Log.Info("Proxy config at %s (include in nginx's http{} block)...", self.configFile)
+
+	return nil
+}
+
+// regenerload regenerates the nginx config, checks it, and performs a live
+// reload on nginx to re-read in the config.
+func (self *Nginx) regenerload(routes []core.Route, certs []core.CertBundle) error {
+	data := struct {
+		Http, Tls, PageDir string
+		Upstreams          []nginxUpstream
+		Servers            []nginxServer
+	}{Http: config.RouteHttp, Tls: config.RouteTls, PageDir: self.pageDir}
+	pages := map[string][]byte{}
+	keys := map[string][]byte{}
+
+	for _, h := range hostsFor(routes, certs) {
+		server := nginxServer{Name: h.Name}
+		if server.Name == "" {
+			server.Name = "_"
+		}
+		if h.Cert != nil {
+			name := fmt.Sprintf("%x", sha256.Sum256([]byte(h.Cert.Cert)))
+			keys[name+".crt"] = []byte(h.Cert.Cert)
+			keys[name+".key"] = []byte(h.Cert.Key)
+			server.Cert = path.Join(self.certDir, name+".crt")
+			server.Key = path.Join(self.certDir, name+".key")
+		}
+
+		for _, route := range h.Routes {
+			location := nginxLocation{Path: routePath(route)}
+			up, err := upstreamFor(route)
+			if err != nil {
+				return err
+			}
+			switch {
+			case route.Page != "":
+				location.Page = fmt.Sprintf("%x.html", sha256.Sum256([]byte(route.Page)))
+				pages[location.Page] = []byte(route.Page)
+			case up != nil:
+				name := fmt.Sprintf("portal_%d", len(data.Upstreams))
+				data.Upstreams = append(data.Upstreams, nginxUpstream{Name: name, Servers: up.Servers})
+				location.ProxyPass = fmt.Sprintf("%s://%s%s", up.Scheme, name, up.Path)
+			}
+			server.Locations = append(server.Locations, location)
+		}
+		data.Servers = append(data.Servers, server)
+	}
+
+	if err := writeFiles(self.pageDir, pages, 0644); err != nil {
+		return fmt.Errorf("Failed to write pages - %s", err)
+	}
+	if err := writeFiles(self.certDir, keys, 0600); err != nil {
+		return fmt.Errorf("Failed to write certs - %s", err)
+	}
+
+	var cfg bytes.Buffer
+	if err := nginxHttpConfig.Execute(&cfg, data); err != nil {
+		return fmt.Errorf("Failed to generate config file - %s", err)
+	}
+	config.Log.Trace("Regenerating nginx proxy config - %d routes, %d certs", len(routes), len(certs))
+
+	if err := writeChecked(self.configFile, cfg.Bytes(), "nginx", "-t"); err != nil {
+		return err
+	}
+
+	// reload nginx
+	out, err := exec.Command("nginx", "-s", "reload").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to reload nginx - %s", out)
+	}
+
+	pruneFiles(self.pageDir, pages)
+	pruneFiles(self.certDir, keys)
+	return nil
+}
@@ -1,9 +1,13 @@
 // proxymgr handles the adding of 'routes' (subdomain.domain/path sets)
 // and their 'targets' or 'page', creating a reverse proxy router. It also
-// handles the adding of 'certs' (key/cert sets) for a secure reverse proxy router
+// handles the adding of 'certs' (key/cert sets) for a secure reverse proxy router.
+// The router is nanobox-router, or a generated nginx or haproxy config.
 package proxymgr
 
-import "github.com/nanopack/portal/core"
+import (
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+)
 
 type proxyable interface {
 	Init() error
@@ -15,8 +19,26 @@ var (
 )
 
 func Init() error {
-	Proxy = &Nanobox{}
-	return Proxy.Init()
+	// decide which proxy to use
+	switch config.Proxy {
+	case "nginx":
+		Proxy = &Nginx{}
+	case "haproxy":
+		Proxy = &Haproxy{}
+	default:
+		Proxy = &Nanobox{}
+	}
+
+	err := Proxy.Init()
+	if err != nil {
+		return err
+	}
+
+	go watchExpiry()
+	if TargetHealthChanged != nil {
+		targetWatch.Do(func() { go watchTargets() })
+	}
+	return nil
 }
 
 func SetRoute(route core.Route) error {
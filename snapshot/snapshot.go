@@ -0,0 +1,122 @@
+// snapshot takes point in time copies of portal's config (services and their
+// servers, routes, certs, vips, and error pages). The server writes them to
+// <work-dir>/snapshots every snapshot-interval, keeping the newest
+// snapshot-keep.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nanobox-io/nanobox-router"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/core/common"
+)
+
+// Get returns a snapshot of the current config
+func Get() (*core.Snapshot, error) {
+	manifest, err := common.GetManifest()
+	if err != nil {
+		return nil, err
+	}
+	return &core.Snapshot{
+		Version:  core.SnapshotVersion,
+		Time:     time.Now().UTC(),
+		Manifest: *manifest,
+		Errors:   map[string]string{"no-routes": string(router.ErrNoRoutes), "no-healthy": string(router.ErrNoHealthy)},
+	}, nil
+}
+
+// Dir is where scheduled snapshots are written
+func Dir() string {
+	return filepath.Join(config.WorkDir, "snapshots")
+}
+
+// Start writes a snapshot now and every snapshot-interval, if set
+func Start() error {
+	if config.SnapshotInterval <= 0 {
+		return nil
+	}
+	err := os.MkdirAll(Dir(), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create snapshot directory - %s", err)
+	}
+
+	go func() {
+		for {
+			if _, err := Write(); err != nil {
+				config.Log.Error("[snapshot] - %s", err)
+			}
+			time.Sleep(time.Duration(config.SnapshotInterval) * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+// Write writes a snapshot of the current config to Dir, removing the oldest
+// beyond snapshot-keep, and returns its path
+func Write() (string, error) {
+	snap, err := Get()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get snapshot - %s", err)
+	}
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// written whole, or not at all (certs hold private keys)
+	path := filepath.Join(Dir(), fmt.Sprintf("snapshot-%s.json", snap.Time.Format("20060102T150405Z")))
+	err = ioutil.WriteFile(path+".tmp", b, 0600)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write snapshot - %s", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write snapshot - %s", err)
+	}
+	config.Log.Debug("[snapshot] - Wrote '%s'", path)
+
+	return path, rotate()
+}
+
+// List returns the paths of the snapshots in Dir, oldest first
+func List() ([]string, error) {
+	files, err := ioutil.ReadDir(Dir())
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "snapshot-") && strings.HasSuffix(file.Name(), ".json") {
+			paths = append(paths, filepath.Join(Dir(), file.Name()))
+		}
+	}
+	// names sort in the order taken
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// rotate removes the oldest snapshots beyond snapshot-keep
+func rotate() error {
+	paths, err := List()
+	if err != nil {
+		return fmt.Errorf("Failed to list snapshots - %s", err)
+	}
+	for len(paths) > config.SnapshotKeep && len(paths) > 1 {
+		if err = os.Remove(paths[0]); err != nil {
+			return fmt.Errorf("Failed to remove old snapshot - %s", err)
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
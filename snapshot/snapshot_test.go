@@ -0,0 +1,61 @@
+package snapshot_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/snapshot"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+	config.DatabaseConnection = "scribble://" + filepath.Join(dir, "db")
+	config.WorkDir = dir
+	config.SnapshotKeep = 2
+	if err := database.Init(); err != nil {
+		t.Fatal(err)
+	}
+	route := core.Route{Domain: "snapshot.test", Page: "snapshotted\n"}
+	if err := database.SetRoute(route); err != nil {
+		t.Fatal(err)
+	}
+
+	// older snapshots
+	os.MkdirAll(snapshot.Dir(), 0700)
+	for _, name := range []string{"snapshot-20160101T000000Z.json", "snapshot-20160102T000000Z.json"} {
+		if err := ioutil.WriteFile(filepath.Join(snapshot.Dir(), name), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := snapshot.Write()
+	if err != nil {
+		t.Fatalf("Failed to write snapshot - %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap core.Snapshot
+	if err = json.Unmarshal(b, &snap); err != nil || snap.Version != core.SnapshotVersion || len(snap.Routes) != 1 || snap.Routes[0].Domain != route.Domain {
+		t.Errorf("Written snapshot differs from config - %s %v", b, err)
+	}
+
+	// oldest rotated out
+	paths, err := snapshot.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || filepath.Base(paths[0]) != "snapshot-20160102T000000Z.json" || paths[1] != path {
+		t.Errorf("Expected the newest 2 snapshots to be kept, got %v", paths)
+	}
+}
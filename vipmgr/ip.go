@@ -6,6 +6,7 @@ package vipmgr
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 	"sync"
 
 	"github.com/nanopack/portal/config"
@@ -46,11 +47,15 @@ func (self ip) SetVip(vip core.Vip) error {
 		}
 	}
 
-	// add vip to host
-	out, err := exec.Command("ip", "addr", "add", vip.Ip, "dev", vip.Interface, "label", vip.Alias).CombinedOutput()
+	// add vip to host (labels are ipv4 only)
+	args := []string{vip.Ip, "dev", vip.Interface}
+	if !isIpv6(vip.Ip) {
+		args = append(args, "label", vip.Alias)
+	}
+	out, err := exec.Command("ip", append([]string{"addr", "add"}, args...)...).CombinedOutput()
 	if err != nil {
 		// if portal exited uncleanly and interface is still up, "change" addr
-		out2, err2 := exec.Command("ip", "addr", "change", vip.Ip, "dev", vip.Interface, "label", vip.Alias).CombinedOutput()
+		out2, err2 := exec.Command("ip", append([]string{"addr", "change"}, args...)...).CombinedOutput()
 		if err2 != nil {
 			return fmt.Errorf("Failed to add vip '%s' - %s - %s", vip.Ip, out, out2)
 		}
@@ -64,7 +69,12 @@ func (self ip) SetVip(vip core.Vip) error {
 
 	// arp vip to neighbors, takes time goroutine
 	go func() {
-		out, err = exec.Command("arping", "-A", "-c", "10", "-I", vip.Interface, vip.Ip).CombinedOutput()
+		if isIpv6(vip.Ip) {
+			// ipv6 has no arp, send an unsolicited neighbor advertisement instead
+			out, err = exec.Command("ndsend", hostIp(vip.Ip), vip.Interface).CombinedOutput()
+		} else {
+			out, err = exec.Command("arping", "-A", "-c", "10", "-I", vip.Interface, vip.Ip).CombinedOutput()
+		}
 		if err != nil {
 			// log rather than return
 			config.Log.Error("Failed to arp vip '%s' - %s", vip.Ip, out)
@@ -93,7 +103,7 @@ func (self ip) DeleteVip(vip core.Vip) error {
 
 deleteIt:
 	// remove vip from host
-	err := exec.Command("ip", "addr", "del", vip.Ip+"/32", "dev", vip.Interface).Run()
+	err := exec.Command("ip", "addr", "del", hostCidr(vip.Ip), "dev", vip.Interface).Run()
 	if err != nil {
 		return fmt.Errorf("Failed to remove vip '%s' - %s", vip.Ip, err)
 	}
@@ -151,3 +161,24 @@ func (self ip) SetVips(vips []core.Vip) error {
 func (self ip) GetVips() ([]core.Vip, error) {
 	return virtIps, nil
 }
+
+// isIpv6 reports whether the vip's ip ("ip" or "ip/cidr") is ipv6
+func isIpv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// hostIp strips the cidr from the vip's ip
+func hostIp(ip string) string {
+	return strings.Split(ip, "/")[0]
+}
+
+// hostCidr returns the vip's ip with a host cidr (/32 or /128) if none is set
+func hostCidr(ip string) string {
+	if strings.Contains(ip, "/") {
+		return ip
+	}
+	if isIpv6(ip) {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
@@ -10,6 +10,10 @@ type vipable interface {
 
 var (
 	Vip vipable
+
+	// Owns is whether this member owns the vip, when one member is elected to
+	// own each vip. Only owned vips are added to the host (nil adds all).
+	Owns func(vip core.Vip) bool
 )
 
 func Init() error {
@@ -18,6 +22,9 @@ func Init() error {
 }
 
 func SetVip(vip core.Vip) error {
+	if Owns != nil && !Owns(vip) {
+		return nil
+	}
 	return Vip.SetVip(vip)
 }
 
@@ -26,9 +33,28 @@ func DeleteVip(vip core.Vip) error {
 }
 
 func SetVips(vips []core.Vip) error {
+	if Owns != nil {
+		owned := []core.Vip{}
+		for i := range vips {
+			if Owns(vips[i]) {
+				owned = append(owned, vips[i])
+			}
+		}
+		vips = owned
+	}
 	return Vip.SetVips(vips)
 }
 
 func GetVips() ([]core.Vip, error) {
 	return Vip.GetVips()
 }
+
+// Claim adds the vip to the host, arping it to neighbors (once elected to own it)
+func Claim(vip core.Vip) error {
+	return Vip.SetVip(vip)
+}
+
+// Release removes the vip from the host (once no longer its owner)
+func Release(vip core.Vip) error {
+	return Vip.DeleteVip(vip)
+}
@@ -0,0 +1,411 @@
+// webhook posts signed events to the webhooks stored in the database, which
+// are replicated to every member. Changes are posted by the member they were
+// made through, and health changes by the member that saw them. Events are
+// queued in memory so subscribers and health checks never wait on the disk,
+// then deliveries are queued on disk (under the working directory), a queue
+// per webhook, and retried with backoff until they succeed. Each webhook's
+// queue is delivered in order by its own worker, so a slow or dead webhook
+// only holds up its own deliveries.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/nanopack/portal/balance"
+	"github.com/nanopack/portal/cluster"
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/proxymgr"
+)
+
+var (
+	// MaxAttempts is how many times a delivery is tried before it's dropped
+	MaxAttempts = 10
+	// MaxBackoff caps the wait between attempts (doubling from a second)
+	MaxBackoff = 10 * time.Minute
+	// QueueSize bounds the deliveries queued on disk for each webhook, the
+	// oldest are dropped when it's full
+	QueueSize = 1000
+	// Timeout is how long a webhook has to respond
+	Timeout = 10 * time.Second
+
+	queueDir  string
+	queueLock sync.Mutex
+
+	// wakes each webhook's worker, keyed by webhook id
+	workers     = map[string]chan struct{}{}
+	workersLock sync.Mutex
+
+	// events waiting to be queued for delivery
+	pending     []core.Event
+	pendingLock sync.Mutex
+	ready       = make(chan struct{}, 1)
+)
+
+type (
+	// delivery is an event queued for a webhook
+	delivery struct {
+		Id       string          `json:"id"`   // sent as X-Portal-Delivery
+		Hook     string          `json:"hook"` // id of the webhook
+		Action   string          `json:"action"`
+		Body     json.RawMessage `json:"body"`
+		Attempts int             `json:"attempts"`
+		Next     time.Time       `json:"next"` // when to try next
+	}
+)
+
+// Start posts the changes made through this member, and the health changes it
+// sees, to the webhooks. Must be started before the balancer and proxy are
+// initialized, to see their health changes.
+func Start() error {
+	queueDir = filepath.Join(config.WorkDir, "webhooks")
+	err := os.MkdirAll(queueDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create webhook queue - %s", err)
+	}
+
+	balance.HealthChanged = serverHealth
+	proxymgr.TargetHealthChanged = targetHealth
+	proxymgr.TargetHealthWanted = targetHealthWanted
+
+	events, _ := cluster.Subscribe()
+	go func() {
+		for event := range events {
+			if event.Member == cluster.Member() {
+				push(event)
+			}
+		}
+	}()
+	go sendPending()
+
+	// resume the deliveries queued before a restart
+	dirs, _ := ioutil.ReadDir(queueDir)
+	for i := range dirs {
+		if dirs[i].IsDir() {
+			wake(dirs[i].Name())
+		}
+	}
+
+	return nil
+}
+
+// Send queues the event for the webhooks that want it
+func Send(event core.Event) {
+	hooks, err := database.GetWebhooks()
+	if err != nil {
+		config.Log.Error("[webhook] - Failed to get webhooks - %s", err)
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		config.Log.Error("[webhook] - Failed to marshal '%s' event - %s", event.Action, err)
+		return
+	}
+
+	for i := range hooks {
+		if !hooks[i].Wants(event.Action) {
+			continue
+		}
+		d := delivery{Id: uuid.NewV4().String(), Hook: hooks[i].Id, Action: event.Action, Body: body, Next: time.Now()}
+		if err = enqueue(d); err != nil {
+			config.Log.Error("[webhook] - Failed to queue '%s' event for '%s' - %s", event.Action, hooks[i].Url, err)
+			continue
+		}
+		wake(hooks[i].Id)
+	}
+
+	// so workers of removed webhooks drop their deliveries
+	workersLock.Lock()
+	removed := []string{}
+	for id := range workers {
+		found := false
+		for i := range hooks {
+			found = found || hooks[i].Id == id
+		}
+		if !found {
+			removed = append(removed, id)
+		}
+	}
+	workersLock.Unlock()
+	for i := range removed {
+		wake(removed[i])
+	}
+}
+
+// Sign returns the signature of the body, sent as X-Portal-Signature
+// ("sha256=<hex hmac>")
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func serverHealth(svcId string, server core.Server, health string) {
+	push(core.Event{Op: core.Op{Action: "server-health", SvcId: svcId, Server: &server}, Health: health, Member: cluster.Member(), Time: time.Now().UTC()})
+}
+
+func targetHealth(route core.Route, target, health string) {
+	push(core.Event{Op: core.Op{Action: "target-health", Route: &route}, Target: target, Health: health, Member: cluster.Member(), Time: time.Now().UTC()})
+}
+
+// targetHealthWanted reports whether any webhook wants target health changes,
+// so route targets are only checked when one does
+func targetHealthWanted() bool {
+	hooks, err := database.GetWebhooks()
+	if err != nil {
+		config.Log.Error("[webhook] - Failed to get webhooks - %s", err)
+		return false
+	}
+	for i := range hooks {
+		if hooks[i].Wants("target-health") {
+			return true
+		}
+	}
+	return false
+}
+
+// push adds the event to those waiting to be queued, without blocking. The
+// oldest are dropped if QueueSize are already waiting.
+func push(event core.Event) {
+	pendingLock.Lock()
+	for len(pending) >= QueueSize && len(pending) != 0 {
+		config.Log.Warn("[webhook] - Too many events waiting, dropping '%s' event", pending[0].Action)
+		pending = pending[1:]
+	}
+	pending = append(pending, event)
+	pendingLock.Unlock()
+
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+// sendPending queues the waiting events for delivery
+func sendPending() {
+	for range ready {
+		pendingLock.Lock()
+		events := pending
+		pending = nil
+		pendingLock.Unlock()
+
+		for i := range events {
+			Send(events[i])
+		}
+	}
+}
+
+// enqueue writes the delivery to its webhook's queue, dropping the oldest
+// deliveries if it's full
+func enqueue(d delivery) error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	dir := filepath.Join(queueDir, d.Hook)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	queued := queue(dir)
+	for len(queued) >= QueueSize && len(queued) != 0 {
+		config.Log.Warn("[webhook] - Queue full, dropping delivery %s", queued[0])
+		os.Remove(filepath.Join(dir, queued[0]))
+		queued = queued[1:]
+	}
+
+	// named to sort in the order queued
+	return write(dir, fmt.Sprintf("%019d-%s.json", time.Now().UnixNano(), d.Id), d)
+}
+
+// queue lists the deliveries queued in dir, oldest first
+func queue(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for i := range files {
+		if strings.HasSuffix(files[i].Name(), ".json") {
+			names = append(names, files[i].Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func write(dir, name string, d delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	// write then rename, so a partial delivery is never read
+	tmp := filepath.Join(dir, name+".tmp")
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// wake wakes the webhook's worker, starting it if it isn't running
+func wake(hookId string) {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+
+	ch, ok := workers[hookId]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		workers[hookId] = ch
+		go deliver(hookId, ch)
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deliver tries the webhook's queued deliveries as they come due, until its
+// queue is empty
+func deliver(hookId string, ch chan struct{}) {
+	for {
+		wait, empty := attempt(hookId)
+		if empty {
+			workersLock.Lock()
+			// unless one was queued meanwhile
+			select {
+			case <-ch:
+				workersLock.Unlock()
+				continue
+			default:
+			}
+			delete(workers, hookId)
+			workersLock.Unlock()
+			return
+		}
+		select {
+		case <-ch:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt tries the webhook's due deliveries in order, stopping at the first
+// that fails or isn't due. It returns the time until the next one is due, or
+// whether the queue is empty.
+func attempt(hookId string) (time.Duration, bool) {
+	dir := filepath.Join(queueDir, hookId)
+	queued := queue(dir)
+	if len(queued) == 0 {
+		return 0, true
+	}
+
+	hooks, err := database.GetWebhooks()
+	if err != nil {
+		config.Log.Error("[webhook] - Failed to get webhooks - %s", err)
+		return time.Second, false
+	}
+	var hook *core.Webhook
+	for i := range hooks {
+		if hooks[i].Id == hookId {
+			hook = &hooks[i]
+		}
+	}
+	if hook == nil {
+		// webhook was removed
+		queueLock.Lock()
+		os.RemoveAll(dir)
+		queueLock.Unlock()
+		return 0, true
+	}
+
+	for _, name := range queued {
+		file := filepath.Join(dir, name)
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var d delivery
+		if err = json.Unmarshal(b, &d); err != nil {
+			config.Log.Error("[webhook] - Dropping bad delivery %s - %s", name, err)
+			os.Remove(file)
+			continue
+		}
+		if until := time.Until(d.Next); until > 0 {
+			return until, false
+		}
+
+		err = post(*hook, d)
+		if err == nil {
+			os.Remove(file)
+			continue
+		}
+
+		d.Attempts++
+		if d.Attempts >= MaxAttempts {
+			config.Log.Error("[webhook] - Dropping '%s' event for '%s' after %d attempts - %s", d.Action, hook.Url, d.Attempts, err)
+			os.Remove(file)
+			continue
+		}
+		backoff := time.Second << uint(d.Attempts-1)
+		if backoff > MaxBackoff || backoff <= 0 {
+			backoff = MaxBackoff
+		}
+		config.Log.Debug("[webhook] - Failed to post '%s' event to '%s', retrying in %s - %s", d.Action, hook.Url, backoff, err)
+		d.Next = time.Now().Add(backoff)
+
+		queueLock.Lock()
+		if _, err := os.Stat(file); err == nil {
+			err = write(dir, name, d)
+			if err != nil {
+				config.Log.Error("[webhook] - Failed to requeue delivery %s - %s", name, err)
+			}
+		}
+		queueLock.Unlock()
+		return backoff, false
+	}
+
+	return 0, true
+}
+
+// post sends the delivery to the webhook, failing unless it responds 2xx
+func post(hook core.Webhook, d delivery) error {
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "portal")
+	req.Header.Set("X-Portal-Event", d.Action)
+	req.Header.Set("X-Portal-Delivery", d.Id)
+	if hook.Secret != "" {
+		req.Header.Set("X-Portal-Signature", Sign(hook.Secret, d.Body))
+	}
+
+	client := http.Client{Timeout: Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response code - %d", res.StatusCode)
+	}
+	return nil
+}
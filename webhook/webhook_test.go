@@ -0,0 +1,213 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/portal/config"
+	"github.com/nanopack/portal/core"
+	"github.com/nanopack/portal/database"
+	"github.com/nanopack/portal/webhook"
+)
+
+type (
+	// receiver records the webhook posts it gets, failing the first `fail`
+	receiver struct {
+		sync.Mutex
+		fail int
+		reqs []*http.Request
+		body [][]byte
+	}
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "portal-webhook")
+	if err != nil {
+		panic(err)
+	}
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+	config.WorkDir = dir
+	config.DatabaseConnection = "scribble://" + filepath.Join(dir, "db")
+
+	if err = database.Init(); err != nil {
+		panic(err)
+	}
+	if err = webhook.Start(); err != nil {
+		panic(err)
+	}
+
+	rtn := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(rtn)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// DELIVERY
+////////////////////////////////////////////////////////////////////////////////
+func TestSend(t *testing.T) {
+	rec := &receiver{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	hook := addHook(t, core.Webhook{Url: ts.URL + "/portal", Secret: "shh", Events: []string{"set-route"}})
+	defer database.DeleteWebhook(hook.Id)
+
+	webhook.Send(core.Event{Op: core.Op{Action: "delete-route", Route: &core.Route{Domain: "portal.test"}}, Member: "test"})
+	webhook.Send(core.Event{Op: core.Op{Action: "set-route", Route: &core.Route{Domain: "portal.test"}}, Member: "test"})
+
+	reqs, bodies := rec.wait(t, 1)
+	// give unwanted events time to (not) show up
+	time.Sleep(100 * time.Millisecond)
+	if reqs, _ = rec.wait(t, 1); len(reqs) != 1 {
+		t.Fatalf("Expected 1 post, got %d", len(reqs))
+	}
+
+	req := reqs[0]
+	if req.URL.Path != "/portal" || req.Header.Get("X-Portal-Event") != "set-route" || req.Header.Get("X-Portal-Delivery") == "" {
+		t.Errorf("Unexpected request %s %v", req.URL, req.Header)
+	}
+	if req.Header.Get("X-Portal-Signature") != webhook.Sign("shh", bodies[0]) {
+		t.Errorf("Bad signature '%s'", req.Header.Get("X-Portal-Signature"))
+	}
+
+	var event core.Event
+	if err := json.Unmarshal(bodies[0], &event); err != nil {
+		t.Fatalf("Failed to unmarshal payload - %s", err)
+	}
+	if event.Action != "set-route" || event.Route == nil || event.Route.Domain != "portal.test" || event.Member != "test" {
+		t.Errorf("Unexpected payload %q", bodies[0])
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rec := &receiver{fail: 1}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	hook := addHook(t, core.Webhook{Url: ts.URL})
+	defer database.DeleteWebhook(hook.Id)
+
+	webhook.Send(core.Event{Op: core.Op{Action: "delete-vip", Vip: &core.Vip{Ip: "192.168.0.100"}}, Member: "test"})
+
+	// retried after a second
+	reqs, _ := rec.wait(t, 2)
+	if reqs[0].Header.Get("X-Portal-Delivery") != reqs[1].Header.Get("X-Portal-Delivery") {
+		t.Errorf("Expected the same delivery to be retried")
+	}
+	if reqs[0].Header.Get("X-Portal-Signature") != "" {
+		t.Errorf("Unexpected signature without a secret")
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	size := webhook.QueueSize
+	webhook.QueueSize = 2
+	defer func() { webhook.QueueSize = size }()
+
+	// nothing listening
+	ts := httptest.NewServer(&receiver{})
+	ts.Close()
+
+	hook := addHook(t, core.Webhook{Url: ts.URL})
+	for i := 0; i < 5; i++ {
+		webhook.Send(core.Event{Op: core.Op{Action: "set-vips"}, Member: "test"})
+	}
+
+	files, _ := filepath.Glob(filepath.Join(config.WorkDir, "webhooks", hook.Id, "*.json"))
+	if len(files) != 2 {
+		t.Errorf("Expected 2 queued deliveries, got %d", len(files))
+	}
+
+	// deliveries for removed webhooks are dropped
+	database.DeleteWebhook(hook.Id)
+	webhook.Send(core.Event{Op: core.Op{Action: "set-vips"}, Member: "test"})
+	for i := 0; i < 30; i++ {
+		files, _ = filepath.Glob(filepath.Join(config.WorkDir, "webhooks", hook.Id, "*.json"))
+		if len(files) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected deliveries for removed webhook to be dropped, %d left", len(files))
+	}
+}
+
+func TestSlowWebhook(t *testing.T) {
+	timeout := webhook.Timeout
+	webhook.Timeout = 2 * time.Second
+	defer func() { webhook.Timeout = timeout }()
+
+	// never responds in time
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	rec := &receiver{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	slowHook := addHook(t, core.Webhook{Url: slow.URL})
+	defer database.DeleteWebhook(slowHook.Id)
+	hook := addHook(t, core.Webhook{Url: ts.URL})
+	defer database.DeleteWebhook(hook.Id)
+
+	// delivered while the slow webhook is still being waited on
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		webhook.Send(core.Event{Op: core.Op{Action: "set-vips"}, Member: "test"})
+	}
+	rec.wait(t, 3)
+	if time.Since(start) > time.Second {
+		t.Errorf("Deliveries held up by a slow webhook for %s", time.Since(start))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+func addHook(t *testing.T, hook core.Webhook) core.Webhook {
+	hook.GenId()
+	if err := database.SetWebhook(hook); err != nil {
+		t.Fatalf("Failed to add webhook - %s", err)
+	}
+	return hook
+}
+
+func (r *receiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.Lock()
+	defer r.Unlock()
+	r.reqs = append(r.reqs, req)
+	r.body = append(r.body, body)
+	if len(r.reqs) <= r.fail {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// wait waits (up to 5s) for n posts
+func (r *receiver) wait(t *testing.T, n int) ([]*http.Request, [][]byte) {
+	for i := 0; i < 50; i++ {
+		r.Lock()
+		if len(r.reqs) >= n {
+			defer r.Unlock()
+			return r.reqs, r.body
+		}
+		r.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d posts, got %d", n, len(r.reqs))
+	return nil, nil
+}